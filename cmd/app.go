@@ -17,7 +17,14 @@ limitations under the License.
 package cmd
 
 import (
+	"time"
+
 	"github.com/peter-wangxu/goock/pkg/client"
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/csi"
+	"github.com/peter-wangxu/goock/pkg/lock"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+	"github.com/peter-wangxu/goock/pkg/server"
 	"github.com/urfave/cli"
 )
 
@@ -54,49 +61,227 @@ func NewApp() *App {
 	app.Usage = Usage
 	// Global switch/flag
 	var enableDebug = false
+	var sessionAuth, discoveryAuth connector.CHAPCredential
+	var loginParallelism, minLoginPaths, loginRetries int
+	var outputFormat string
+	var transport string
+	var daemonSocket string
+	var manifestPath string
+	var lockTimeout time.Duration
+	var timeout time.Duration
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:        "debug, d",
 			Usage:       "enable debug log on the console.",
 			Destination: &enableDebug,
 		},
+		cli.StringFlag{
+			Name:        "output, o",
+			Usage:       "output format, one of text, json and yaml.",
+			EnvVar:      "GOOCK_OUTPUT",
+			Value:       client.TextOutput,
+			Destination: &outputFormat,
+		},
+		cli.StringFlag{
+			Name:        "socket",
+			Usage:       "send the requests to the goock daemon listening on the unix socket.",
+			EnvVar:      "GOOCK_SOCKET",
+			Destination: &daemonSocket,
+		},
+		cli.StringFlag{
+			Name:        "manifest",
+			Usage:       "state file recording the attached volumes for restore.",
+			EnvVar:      "GOOCK_MANIFEST",
+			Value:       manifest.GetPath(),
+			Destination: &manifestPath,
+		},
+		cli.StringFlag{
+			Name:        "chap-username",
+			Usage:       "CHAP username for iSCSI session login.",
+			EnvVar:      "GOOCK_CHAP_USERNAME",
+			Destination: &sessionAuth.Username,
+		},
+		cli.StringFlag{
+			Name:        "chap-secret",
+			Usage:       "CHAP secret for iSCSI session login.",
+			EnvVar:      "GOOCK_CHAP_SECRET",
+			Destination: &sessionAuth.Secret,
+		},
+		cli.StringFlag{
+			Name:        "chap-username-in",
+			Usage:       "mutual CHAP username of the target for iSCSI session login.",
+			EnvVar:      "GOOCK_CHAP_USERNAME_IN",
+			Destination: &sessionAuth.UsernameIn,
+		},
+		cli.StringFlag{
+			Name:        "chap-secret-in",
+			Usage:       "mutual CHAP secret of the target for iSCSI session login.",
+			EnvVar:      "GOOCK_CHAP_SECRET_IN",
+			Destination: &sessionAuth.SecretIn,
+		},
+		cli.StringFlag{
+			Name:        "discovery-chap-username",
+			Usage:       "CHAP username for iSCSI sendtargets discovery.",
+			EnvVar:      "GOOCK_DISCOVERY_CHAP_USERNAME",
+			Destination: &discoveryAuth.Username,
+		},
+		cli.StringFlag{
+			Name:        "discovery-chap-secret",
+			Usage:       "CHAP secret for iSCSI sendtargets discovery.",
+			EnvVar:      "GOOCK_DISCOVERY_CHAP_SECRET",
+			Destination: &discoveryAuth.Secret,
+		},
+		cli.StringFlag{
+			Name:        "discovery-chap-username-in",
+			Usage:       "mutual CHAP username of the target for iSCSI sendtargets discovery.",
+			EnvVar:      "GOOCK_DISCOVERY_CHAP_USERNAME_IN",
+			Destination: &discoveryAuth.UsernameIn,
+		},
+		cli.StringFlag{
+			Name:        "discovery-chap-secret-in",
+			Usage:       "mutual CHAP secret of the target for iSCSI sendtargets discovery.",
+			EnvVar:      "GOOCK_DISCOVERY_CHAP_SECRET_IN",
+			Destination: &discoveryAuth.SecretIn,
+		},
+		cli.IntFlag{
+			Name:        "login-parallelism",
+			Usage:       "number of iSCSI targets to login concurrently.",
+			EnvVar:      "GOOCK_LOGIN_PARALLELISM",
+			Value:       1,
+			Destination: &loginParallelism,
+		},
+		cli.IntFlag{
+			Name:        "min-login-paths",
+			Usage:       "minimum number of iSCSI paths logged in to connect a LUN.",
+			EnvVar:      "GOOCK_MIN_LOGIN_PATHS",
+			Value:       1,
+			Destination: &minLoginPaths,
+		},
+		cli.IntFlag{
+			Name:        "login-retries",
+			Usage:       "retries of a failed iSCSI login, with exponential backoff.",
+			EnvVar:      "GOOCK_LOGIN_RETRIES",
+			Value:       connector.DefaultLoginRetries,
+			Destination: &loginRetries,
+		},
+		cli.StringSliceFlag{
+			Name: "iface",
+			Usage: "iSCSI iface or network interface to bind the sessions to, repeat it for multiple ifaces, " +
+				"the iface is created for the network interface if absent.",
+			EnvVar: "GOOCK_ISCSI_IFACES",
+		},
+		cli.StringFlag{
+			Name:        "transport",
+			Usage:       "transport of the iSCSI ifaces, tcp, iser, bnx2i, be2iscsi, cxgb3i, cxgb4i, qedi or qla4xxx.",
+			EnvVar:      "GOOCK_ISCSI_TRANSPORT",
+			Destination: &transport,
+		},
+		cli.DurationFlag{
+			Name:        "lock-timeout",
+			Usage:       "maximum time to wait for the target, LUN or rescan lock held by other goock processes.",
+			EnvVar:      "GOOCK_LOCK_TIMEOUT",
+			Value:       lock.Timeout,
+			Destination: &lockTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "timeout",
+			Usage:       "maximum time of the whole operation, the running commands are killed once it expires, 0 means no limit.",
+			EnvVar:      "GOOCK_TIMEOUT",
+			Destination: &timeout,
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := client.SetOutputFormat(outputFormat); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if err := connector.ValidateCHAPCredentials(sessionAuth, discoveryAuth); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		client.SetCHAPCredential(sessionAuth, discoveryAuth)
+		client.SetLoginOption(loginParallelism, minLoginPaths, loginRetries)
+		client.SetIfaceOption(c.StringSlice("iface"), transport)
+		client.SetDaemonSocket(daemonSocket)
+		client.SetManifestPath(manifestPath)
+		client.SetLockTimeout(lockTimeout)
+		client.SetTimeout(timeout)
+		return nil
 	}
 
 	app.Commands = []cli.Command{
 		{
 			Name:    "connect",
 			Aliases: []string{"c"},
-			Usage:   "Connect to a iSCSI or FC device.",
+			Usage:   "Connect to a iSCSI, FC or NVMe/TCP device.",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "require-multipath",
+					Usage: "fail if the multipath map is missing or incomplete after healing, instead of falling back to single paths.",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				// Enable debug log from console
 				client.InitLog(enableDebug)
-				return client.HandleConnect(c.Args()...)
+				client.SetRequireMultipath(c.Bool("require-multipath"))
+				return client.ReportError(client.HandleConnect(c.Args()...))
 			},
-			ArgsUsage: `<target ip>|<wwn> <lun id>`,
+			ArgsUsage: `<target portal>|<wwn> [<lun id>]|<nqn> <portal>... <nguid|uuid>`,
 			Description: `# Connect a device via iSCSI IP and LUN ID
    goock disconnect 192.168.1.200 25
    # Connect a device via WWn and LUN ID
    goock disconnect 5006016d09200925 25
+   # Connect a NVMe/TCP namespace via NQN, portals and namespace NGUID
+   goock connect nqn.2014-08.org.example:subsys1 10.0.0.1:4420 10.0.0.2:4420 6e3d1a8a9c3b4d5e8f0011223344aabb
+   # Connect a device via iSCSI IP and LUN ID, fail if the multipath map is not complete
+   goock connect --require-multipath 192.168.1.200 25
+   # Connect the LUNs 0 to 15, 20 and 0x4001 via iSCSI IP
+   goock connect 192.168.1.200 0-15,20,0x4001
+   # Connect all the LUNs of the targets discovered via iSCSI IP
+   goock connect 192.168.1.200
+   # Connect a device via iSCSI IPv6 portal with port, or via DNS name
+   goock connect [fd00:10::20]:3260 25
+   goock connect storage.example.com 25
+   # Connect all the LUNs of the Fibre Channel targets
+   goock connect 5006016d09200925 5006016536e00e5a
 `,
 		},
 		{
 			Name:    "disconnect",
 			Aliases: []string{"d", "clean"},
 			Usage:   "Disconnect(cleanup) a device from host.",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "keep-sessions",
+					Usage: "keep the iSCSI sessions even if no device is attached after disconnect.",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "remove the devices even if they are mounted, held(e.g., by LVM), opened or used as swap.",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				// Enable debug log from console
 				client.InitLog(enableDebug)
-				return client.HandleISCSIDisconnect(c.Args()...)
+				client.SetKeepSessions(c.Bool("keep-sessions"))
+				client.SetForceDisconnect(c.Bool("force"))
+				return client.ReportError(client.HandleDisconnect(c.Args()...))
 			},
-			ArgsUsage: `[<device path|device name>|<target ip|wwn> <lun id>]`,
+			ArgsUsage: `[<device path|device name>|<target ip|wwn> <lun id>|<nqn> <portal>... <nguid|uuid>]`,
 			Description: `# Disconnect a device via local device path
    goock disconnect /dev/sdb
    # Disconnect a device via device alias
    goock disconnect sdb
-   Disconnect a device via iSCSI IP and LUN ID
+   # Disconnect a multipath device and all its paths
+   goock disconnect /dev/mapper/36006016074e03a00e98b07ef80df4e3a
+   # Disconnect a device even if it is still mounted or opened
+   goock disconnect --force /dev/sdb
+   # Disconnect a device via iSCSI IP and LUN ID, the sessions without any device are logged out
    goock disconnect 192.168.1.200 25
+   # Disconnect a device via iSCSI IP and LUN ID, but keep the sessions
+   goock disconnect --keep-sessions 192.168.1.200 25
    # Disconnect a device via WWn and LUN ID
    goock disconnect 5006016d09200925 25
+   # Disconnect a NVMe/TCP namespace via NQN, portal and namespace UUID
+   goock disconnect nqn.2014-08.org.example:subsys1 10.0.0.1 0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d
 `,
 		},
 		{
@@ -106,7 +291,7 @@ func NewApp() *App {
 			Action: func(c *cli.Context) error {
 				// Enable debug log from console
 				client.InitLog(enableDebug)
-				return client.HandleExtend(c.Args()...)
+				return client.ReportError(client.HandleExtend(c.Args()...))
 			},
 			Description: `# Extend a device via local device path
    goock extend /dev/sdb
@@ -116,23 +301,123 @@ func NewApp() *App {
    goock extend 192.168.1.200 25
    # Extend a device via WWn and LUN ID
    goock extend 5006016d09200925 25
+   # Extend a NVMe/TCP namespace via NQN, portal and namespace NGUID
+   goock extend nqn.2014-08.org.example:subsys1 10.0.0.1 6e3d1a8a9c3b4d5e8f0011223344aabb
 `,
 		},
 		{
-			Name:    "info",
-			Aliases: []string{"i"},
-			Usage:   "Query information for host or LUNs",
+			Name:      "info",
+			Aliases:   []string{"i"},
+			Usage:     "Query information for host or LUNs",
+			ArgsUsage: `[lun <target portal>|<wwn>... <lun id>]`,
 			Action: func(c *cli.Context) error {
 				// Enable debug log from console
 				client.InitLog(enableDebug)
-				return client.HandleInfo(c.Args()...)
+				return client.ReportError(client.HandleInfo(c.Args()...))
 			},
 			Description: `# Query host information about iSCSI or FC
    goock info
-   # Query LUN information by iSCSI
+   # Query LUN information by iSCSI, no login or rescan is done
    goock info lun 192.168.1.200 25
+   goock info lun 192.168.1.200:3260 25
    # Query LUN information by FC
    goock info lun 5006016d09200925 25
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"ls"},
+			Usage:   "List the attached volumes with their paths.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "target",
+					Usage: "only the volumes via the target IQN, wwn, NQN or portal.",
+				},
+				cli.StringFlag{
+					Name:  "wwn",
+					Usage: "only the volume of the wwn.",
+				},
+				cli.StringFlag{
+					Name:  "state",
+					Usage: "only the volumes or recorded attachments in the state, one of active, degraded, failed, drifted and missing.",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				// Enable debug log from console
+				client.InitLog(enableDebug)
+				client.SetListFilter(c.String("target"), c.String("wwn"), c.String("state"))
+				return client.ReportError(client.HandleList())
+			},
+			Description: `# List all the attached volumes, and the recorded attachments which are drifted or missing
+   goock list
+   # List the volumes via the iSCSI portal or the FC target
+   goock list --target 192.168.1.200
+   goock list --target 5006016d09200925
+   # List the volumes with failed or offline paths, in json
+   goock -o json list --state degraded
+`,
+		},
+		{
+			Name:  "restore",
+			Usage: "Re-attach the volumes recorded on connect, e.g., after reboot.",
+			Action: func(c *cli.Context) error {
+				// Enable debug log from console
+				client.InitLog(enableDebug)
+				return client.ReportError(client.HandleRestore())
+			},
+			Description: `# Re-attach the recorded volumes which are missing, the wwns are verified
+   goock restore
+   # Re-attach the volumes recorded in another state file, with the CHAP secret of the sessions
+   goock --manifest /etc/goock/attachments.json --chap-username user --chap-secret secret restore
+`,
+		},
+		{
+			Name:  "serve",
+			Usage: "Run the goock daemon which serves the HTTP/JSON API on a unix socket.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "the unix socket to listen on.",
+					Value: server.DefaultSocket,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				// Enable debug log from console
+				client.InitLog(enableDebug)
+				return client.HandleServe(c.String("listen"))
+			},
+			Description: `# Run the daemon on the default socket
+   goock serve
+   # Use the daemon for the following commands
+   goock --socket /run/goock/goock.sock connect 192.168.1.200 25
+`,
+		},
+		{
+			Name:  "csi",
+			Usage: "Run the CSI node plugin which serves the identity and node services over gRPC.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "endpoint",
+					Usage: "the unix:// or tcp:// endpoint to listen on.",
+					Value: csi.DefaultEndpoint,
+				},
+				cli.StringFlag{
+					Name:  "node-id",
+					Usage: "the id of the node reported to the CO, the hostname if empty.",
+				},
+				cli.StringFlag{
+					Name:  "state-dir",
+					Usage: "the directory to record the staged volumes in.",
+					Value: csi.DefaultStateDir,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				// Enable debug log from console
+				client.InitLog(enableDebug)
+				return client.HandleCSI(c.String("endpoint"), c.String("node-id"), c.String("state-dir"))
+			},
+			Description: `# Run the node plugin on the socket of the kubelet plugin registration
+   goock csi --endpoint unix:///var/lib/kubelet/plugins/csi.goock.io/csi.sock --node-id $(NODE_NAME)
 `,
 		},
 	}
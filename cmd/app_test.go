@@ -1,10 +1,17 @@
 package cmd
 
 import (
+	"github.com/peter-wangxu/goock/test"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	test.DisableUevents()
+	os.Exit(m.Run())
+}
+
 func TestNewAppConnect(t *testing.T) {
 	goockApp := NewApp()
 	err := goockApp.Run([]string{"goock", "connect", "192.168.1.8"})
@@ -3,7 +3,11 @@ module github.com/peter-wangxu/goock
 go 1.12
 
 require (
+	github.com/container-storage-interface/spec v1.2.0
+	github.com/golang/protobuf v1.3.2
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.3.0
 	github.com/urfave/cli v1.20.0
+	google.golang.org/grpc v1.24.0
+	gopkg.in/yaml.v2 v2.2.8
 )
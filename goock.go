@@ -24,5 +24,7 @@ import (
 func main() {
 
 	app := cmd.NewApp()
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(1)
+	}
 }
@@ -16,16 +16,23 @@ limitations under the License.
 package client
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"regexp"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/csi"
 	"github.com/peter-wangxu/goock/pkg/exec"
 	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
+	"github.com/peter-wangxu/goock/pkg/manifest"
 	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/server"
+	"github.com/peter-wangxu/goock/pkg/uevent"
 	"github.com/peter-wangxu/goock/pkg/util"
 	"github.com/sirupsen/logrus"
 )
@@ -41,10 +48,21 @@ Multipath ID:    %s
 WWN:             %s
 `
 
+// ExtendFormat defines the `extend` output format
+var ExtendFormat = `Extend Information:
+Multipath:       %s
+Single Paths:
+%s
+WWN:             %s
+Original Size:   %d
+New Size:        %d
+`
+
 // HostInfoFormat defines the `info` command output
 var HostInfoFormat = `
 Host Name(FQDN):                    %s
 iSCSI Qualified Name(IQN):          %s
+NVMe Qualified Name(NQN):           %s
 Host Bus Adapters:
 %s
 Connected Fibre Channel Targets:
@@ -70,32 +88,92 @@ func InitLog(debug bool) error {
 	} else {
 		log = logrus.New()
 	}
+	if IsStructuredOutput() {
+		// Keep the stdout parsable
+		log.Out = os.Stderr
+	}
 
 	// Set logger for all modules
 	//cmd.SetLogger(log)
 	connector.SetLogger(log)
+	csi.SetLogger(log)
 	exec.SetLogger(log)
 	linux.SetLogger(log)
+	lock.SetLogger(log)
 	model.SetLogger(log)
+	server.SetLogger(log)
+	uevent.SetLogger(log)
 	util.SetLogger(log)
 	return nil
 }
 
-// HandleConnect dispatches the cli to iscsi/fc respectively.
+// SetLockTimeout sets the maximum time to wait for the lock of a target, LUN
+// or the host-wide rescan lock held by other goock processes
+func SetLockTimeout(timeout time.Duration) {
+	lock.Timeout = timeout
+}
+
+// Policy when the multipath map can not be built after connect
+var multipathPolicy connector.StringEnum
+
+// SetRequireMultipath sets whether connect fails if the multipath map is
+// still missing or incomplete after healing, otherwise the single paths are
+// returned
+func SetRequireMultipath(require bool) {
+	multipathPolicy = connector.MultipathFallback
+	if require {
+		multipathPolicy = connector.MultipathRequired
+	}
+}
+
+// Remove the devices on disconnect even if they are in use
+var forceDisconnect bool
+
+// SetForceDisconnect sets whether to disconnect the devices which are mounted,
+// held, opened or used as swap
+func SetForceDisconnect(force bool) {
+	forceDisconnect = force
+}
+
+// Deadline of the command, zero if there is no timeout
+var deadline time.Time
+
+// SetTimeout sets the timeout of the command, the operation is given up and
+// the running commands are killed once timeout elapses, zero means no timeout.
+func SetTimeout(timeout time.Duration) {
+	deadline = time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+}
+
+// newContext returns the context of an operation, which is done at the
+// deadline of the command
+func newContext() (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// HandleConnect dispatches the cli to iscsi/fc/nvme respectively.
 func HandleConnect(args ...string) error {
 	var err error
 	if len(args) <= 0 {
 		log.Error("Target IP or wwn is required.")
 		err = fmt.Errorf("target IP or wwn is required")
-	} else if len(args) == 1 {
-		// User only supply the LUN ID, so did a wildcard scan for all connected targets
-		err = fmt.Errorf("currently [lun id] is not supported")
-		log.WithError(err).Errorf("Unsupported parameters. {%s}", args)
 	} else {
 		target := args[0]
+		if IsNqnLike(target) {
+			return HandleNVMeConnect(args...)
+		}
+		if !hasLunID(args[1:]) {
+			// No LUN ID supplied, connect all the LUNs of the targets
+			return HandleTargetConnect(args...)
+		}
 		// Make sure the last param is LUN ID.
 		if _, err = ValidateLunID(args[len(args)-1:]); err == nil {
-			if IsIPLike(target) {
+			if IsPortalLike(target) {
 				return HandleISCSIConnect(args...)
 			}
 			if IsFcLike(target) {
@@ -106,8 +184,83 @@ func HandleConnect(args ...string) error {
 	return err
 }
 
-// HandleDisconnect dispatches the cli to iscsi/fc respectively.
+// HandleTargetConnect connects all the LUNs of the iSCSI portals or the FC
+// target wwns, every LUN found is printed.
+func HandleTargetConnect(targets ...string) error {
+	allIP, allFc := true, true
+	for _, target := range targets {
+		allIP = allIP && IsPortalLike(target)
+		allFc = allFc && IsFcLike(target)
+	}
+	if allIP {
+		return HandleISCSITargetConnect(targets...)
+	}
+	if allFc {
+		return HandleFCTargetConnect(targets...)
+	}
+	err := fmt.Errorf("%s are neither iSCSI portals nor Fibre Channel wwns", targets)
+	log.WithError(err).Error("Unsupported parameters.")
+	return err
+}
+
+// BeautifyVolumes outputs the volumes attached from a target, only the login
+// results are printed if no volume is attached.
+func BeautifyVolumes(volumes []connector.VolumeInfo) {
+	for _, volume := range volumes {
+		if volume.Wwn == "" && len(volume.Paths) == 0 {
+			BeautifyLoginResults(volume.LoginResults)
+			continue
+		}
+		BeautifyVolumeInfo(volume)
+	}
+}
+
+// HandleDisconnect dispatches the cli to iscsi/fc/nvme respectively.
 func HandleDisconnect(args ...string) error {
+	var err error
+	if len(args) <= 0 {
+		err = fmt.Errorf("need device name or Target IP/WWN with LUN ID")
+		log.WithError(err).Error("Unable to proceed.")
+	} else if len(args) == 1 {
+		// User only supplies the local device name
+		err = HandleDeviceDisconnect(args[0])
+	} else if IsNqnLike(args[0]) {
+		err = HandleNVMeDisconnect(args...)
+	} else if IsFcLike(args[0]) {
+		err = HandleFCDisconnect(args...)
+	} else {
+		err = HandleISCSIDisconnect(args...)
+	}
+	if err == nil {
+		BeautifyDisconnectResult(args...)
+	}
+	return err
+}
+
+// BeautifyDisconnectResult prints the disconnected device or target in
+// structured format, nothing is printed for text output.
+func BeautifyDisconnectResult(args ...string) {
+	if IsStructuredOutput() {
+		PrintOutput(KindDisconnectResult, DisconnectResult{Arguments: args, Disconnected: true})
+	}
+}
+
+// HandleDeviceDisconnect removes the local device and its sibling paths,
+// the protocol is detected from the device automatically.
+func HandleDeviceDisconnect(device string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	// The device links are resolved before they are removed
+	keys, keyErr := manifest.DeviceKeys(device)
+	if keyErr != nil {
+		log.WithError(keyErr).Warnf("Unable to find the attachments of %s in the manifest.", device)
+	}
+	err := disconnectDevice(ctx, device, forceDisconnect)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to disconnect device %s.", device)
+		return err
+	}
+	forgetAttachments(keys...)
 	return nil
 }
 
@@ -118,7 +271,13 @@ func HandleExtend(args ...string) error {
 		err = fmt.Errorf("need device name or Target IP with LUN ID")
 	} else if len(args) == 1 {
 		// User only supplies the local device name
-		err = fmt.Errorf("currently device name is not supported")
+		err = HandleDeviceExtend(args[0])
+	} else if IsNqnLike(args[0]) {
+		// User specify NQN with portals and namespace id
+		err = HandleNVMeExtend(args...)
+	} else if IsFcLike(args[0]) {
+		// User specify WWN with LUN ID
+		err = HandleFCExtend(args...)
 	} else {
 		// User specify TargetIP with LUN ID
 		err = HandleISCSIExtend(args...)
@@ -127,9 +286,31 @@ func HandleExtend(args ...string) error {
 
 }
 
-// HandleInfo displays the host information
+// HandleDeviceExtend extends the local device and its sibling paths.
+func HandleDeviceExtend(device string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	info, err := extendDevice(ctx, device)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to extend device %s.", device)
+		return err
+	}
+	BeautifyExtendInfo(info)
+	return nil
+}
+
+// HandleInfo displays the host information, or the LUN information if the
+// args are like lun 192.168.1.200 25
 func HandleInfo(args ...string) error {
-	hostInfo, err := connector.GetHostInfo()
+	if len(args) > 0 {
+		if args[0] == "lun" {
+			return HandleLunInfo(args[1:]...)
+		}
+		err := fmt.Errorf("unsupported information %s, only lun is supported", args[0])
+		log.WithError(err).Error("Unsupported parameters.")
+		return err
+	}
+	hostInfo, err := getHostInfo()
 	if err != nil {
 		log.WithError(err).Warn("Unable to get host information, permission denied or tools not installed?")
 	}
@@ -139,6 +320,10 @@ func HandleInfo(args ...string) error {
 
 // BeautifyHostInfo prints the output to console
 func BeautifyHostInfo(info connector.HostInfo) {
+	if IsStructuredOutput() {
+		PrintOutput(KindHostInfo, info)
+		return
+	}
 	// Local wwns of HBAs
 	sWwns := ""
 	for i, wwnns := range info.Wwnns {
@@ -153,46 +338,137 @@ func BeautifyHostInfo(info connector.HostInfo) {
 	for i, target := range info.TargetPortals {
 		sIscsiTargets += fmt.Sprintf("  %s,%s\n", target, info.TargetIqns[i])
 	}
-	fmt.Printf(HostInfoFormat, info.Hostname, info.Initiator, sWwns, sTargetWwns, sIscsiTargets)
+	fmt.Printf(HostInfoFormat, info.Hostname, info.Initiator, info.HostNqn, sWwns, sTargetWwns, sIscsiTargets)
 }
 
-// ValidateLunID validates the LunIDs as integer
+// BeautifyExtendInfo prints the size change of an extended volume to stdout.
+func BeautifyExtendInfo(info connector.ExtendInfo) {
+	if IsStructuredOutput() {
+		PrintOutput(KindExtendInfo, info)
+		return
+	}
+	beautifiedPaths := ""
+	for _, path := range info.Paths {
+		beautifiedPaths += fmt.Sprintf("  %s\n", path)
+	}
+	fmt.Printf(ExtendFormat, info.Multipath, beautifiedPaths, info.Wwn,
+		info.OriginalSize, info.NewSize)
+}
+
+// MaxLunRange is the maximum number of LUNs in a LUN range like 0-15
+const MaxLunRange = 16384
+
+// ValidateLunID parses the LUN IDs, each of them is a comma separated list of
+// LUN IDs and LUN ranges, like "0-15,20,0x4001". The LUN ID is in any form of
+// connector.ParseLun, the duplicated LUN IDs are removed.
 func ValidateLunID(lunIDs []string) ([]int, error) {
-	var err error
-	re, _ := regexp.Compile("\\d+")
+	ret, err := parseLunIDs(lunIDs)
+	if err == nil && len(ret) <= 0 {
+		log.Warnf("No lun ID specified, correct and retry.")
+	}
+	return ret, err
+}
+
+func parseLunIDs(lunIDs []string) ([]int, error) {
 	var ret []int
-	for _, lun := range lunIDs {
-		if re.MatchString(lun) == false {
-			err = fmt.Errorf("%s does not look like a LUN ID", lun)
-			break
+	seen := map[int]bool{}
+	for _, list := range lunIDs {
+		for _, item := range strings.Split(list, ",") {
+			first, last, err := parseLunRange(item)
+			if err != nil {
+				return nil, err
+			}
+			for lun := first; lun <= last; lun++ {
+				if !seen[lun] {
+					seen[lun] = true
+					ret = append(ret, lun)
+				}
+			}
 		}
-		i, _ := strconv.Atoi(lun)
-		ret = append(ret, i)
 	}
-	if len(ret) <= 0 {
-		log.Warnf("No lun ID specified, correct and retry.")
+	return ret, nil
+}
+
+// Parses the LUN ID or the LUN range like 0-15, the first and last LUN IDs
+// are returned
+func parseLunRange(item string) (int, int, error) {
+	if item == "" {
+		return 0, 0, fmt.Errorf("empty LUN ID in the list")
 	}
-	return ret, err
+	bounds := strings.SplitN(item, "-", 2)
+	if len(bounds) == 1 {
+		lun, err := connector.ParseLun(item)
+		return lun, lun, err
+	}
+	first, err := connector.ParseLun(bounds[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid LUN range %q: %s", item, err)
+	}
+	last, err := connector.ParseLun(bounds[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid LUN range %q: %s", item, err)
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("invalid LUN range %q: %d is greater than %d", item, first, last)
+	}
+	if last-first >= MaxLunRange {
+		return 0, 0, fmt.Errorf("invalid LUN range %q: more than %d LUNs", item, MaxLunRange)
+	}
+	return first, last, nil
 }
 
-// IsLunLike tests if *data* is a lun id.
+// IsLunLike tests if *data* is a list of lun ids, see ValidateLunID.
 func IsLunLike(data string) bool {
+	_, err := parseLunIDs([]string{data})
+	return err == nil
+}
 
-	if _, err := strconv.Atoi(data); err != nil {
-		return false
+// Tests if any of args is a list of lun ids
+func hasLunID(args []string) bool {
+	for _, arg := range args {
+		if IsLunLike(arg) {
+			return true
+		}
 	}
-	return true
+	return false
 }
 
-// IsIPLike tests if *data* is a ipv4 address.
+// IsIPLike tests if *data* is a ipv4 or ipv6 address with optional port, like
+// 192.168.1.29, 192.168.1.29:3260, fe80::1, [fe80::1] or [fe80::1]:3260.
 func IsIPLike(data string) bool {
-	// IPv4 match
-	if m, _ := regexp.MatchString("^[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}$", data); !m {
+	address := strings.Trim(data, "[]")
+	if host, port, err := net.SplitHostPort(data); err == nil {
+		if m, _ := regexp.MatchString("^\\d{1,5}$", port); !m {
+			return false
+		}
+		address = host
+	}
+	if net.ParseIP(address) == nil {
+		return false
+	}
+	// The wwn like 50:06:01:60:36:e0:0e:5a is a valid ipv6 address as well
+	if m, _ := regexp.MatchString("^\\w{2}(:\\w{2}){7,15}$", data); m {
 		return false
 	}
 	return true
 }
 
+// IsPortalLike tests if *data* is a target portal, which is an IP address or
+// a DNS name with optional port, like storage.example.com:3260.
+func IsPortalLike(data string) bool {
+	if IsIPLike(data) {
+		return true
+	}
+	if IsFcLike(data) || IsLunLike(data) || IsNqnLike(data) {
+		return false
+	}
+	// At least one letter is required so that the numbers are not taken
+	m, _ := regexp.MatchString("^(?i)(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\\.)*"+
+		"[a-z0-9](?:[a-z0-9-]*[a-z0-9])?(?::\\d{1,5})?$", data)
+	l, _ := regexp.MatchString("(?i)[a-z]", data)
+	return m && l
+}
+
 // IsFcLike tests if *data* is a fc wwn.
 func IsFcLike(data string) bool {
 	// Replace the colons if presents
@@ -1,16 +1,35 @@
 package client
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/peter-wangxu/goock/connector"
-	"github.com/peter-wangxu/goock/exec"
-	"github.com/peter-wangxu/goock/model"
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/exec"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
 	"github.com/peter-wangxu/goock/test"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
+// Run the tests with the fake sysfs and /dev tree
+func TestMain(m *testing.M) {
+	root := test.NewFakeRoot()
+	sysfs.SetRoot(root.Dir)
+	test.DisableUevents()
+	lock.SetDir(filepath.Join(root.Dir, "run/goock/locks"))
+	SetManifestPath(filepath.Join(root.Dir, "var/lib/goock/attachments.json"))
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
 func TestInitLogFalse(t *testing.T) {
 	err := InitLog(false)
 	assert.Nil(t, err)
@@ -28,10 +47,74 @@ func TestHandleExtendEmpty(t *testing.T) {
 }
 
 func TestHandleExtendLocal(t *testing.T) {
-	err := HandleExtend("/dev/sdm")
+	err := HandleExtend("/dev/sdz")
+	assert.Error(t, err)
+}
+
+func TestHandleDisconnectEmpty(t *testing.T) {
+	err := HandleDisconnect()
+	assert.Error(t, err)
+}
+
+func TestHandleDisconnectDevice(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	err := HandleDisconnect("sdz")
 	assert.Error(t, err)
 }
 
+func TestHandleExtendDevice(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	err := HandleExtend("/dev/mapper/350060160b6e00e5a50060160b6e11317")
+	assert.Nil(t, err)
+}
+
+func TestHandleDeviceDisconnectTimeout(t *testing.T) {
+	SetTimeout(50 * time.Millisecond)
+	defer SetTimeout(0)
+	disconnectDevice = func(ctx context.Context, device string, force bool) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	defer func() {
+		disconnectDevice = connector.DisconnectDeviceContext
+	}()
+	err := HandleDisconnect("/dev/sdb")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestHandleDeviceDisconnectForce(t *testing.T) {
+	SetForceDisconnect(true)
+	defer SetForceDisconnect(false)
+	var forced bool
+	disconnectDevice = func(ctx context.Context, device string, force bool) error {
+		forced = force
+		return nil
+	}
+	defer func() {
+		disconnectDevice = connector.DisconnectDeviceContext
+	}()
+	err := HandleDisconnect("/dev/sdb")
+	assert.Nil(t, err)
+	assert.True(t, forced)
+}
+
+func TestSetTimeout(t *testing.T) {
+	SetTimeout(time.Minute)
+	ctx, cancel := newContext()
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	SetTimeout(0)
+	ctx, cancel = newContext()
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
+
 func TestHandleInfo(t *testing.T) {
 	model.SetExecutor(test.NewMockExecutor())
 	connector.SetExecutor(test.NewMockExecutor())
@@ -39,6 +122,9 @@ func TestHandleInfo(t *testing.T) {
 	assert.Nil(t, err)
 }
 func TestHandleInfoFailed(t *testing.T) {
+	// No initiator name on the host
+	defer sysfs.SetRoot(sysfs.GetRoot())
+	sysfs.SetRoot("/nonexistent")
 	model.SetExecutor(exec.New())
 	connector.SetExecutor(exec.New())
 	err := HandleInfo()
@@ -56,14 +142,43 @@ func TestValidateLunId_False(t *testing.T) {
 	assert.Len(t, lunids, 0)
 }
 
+func TestValidateLunId_Range(t *testing.T) {
+	lunids, err := ValidateLunID([]string{"0-3,20", "2,0x4001", "0x0109000000000000"})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3, 20, 0x4001, 265}, lunids)
+	lunids, err = ValidateLunID([]string{"0x10-0x11"})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{16, 17}, lunids)
+}
+
+func TestValidateLunId_Invalid(t *testing.T) {
+	for input, message := range map[string]string{
+		"1a":                 `invalid LUN ID "1a"`,
+		"-1":                 `invalid LUN range "-1"`,
+		"1,,2":               "empty LUN ID",
+		"5-2":                "5 is greater than 2",
+		"0-20000":            "more than 16384 LUNs",
+		"0x":                 `invalid LUN ID "0x"`,
+		"0x4001000100020000": "more than two levels",
+		"5006016089200925":   `invalid LUN ID "5006016089200925"`,
+	} {
+		lunids, err := ValidateLunID([]string{input})
+		assert.Error(t, err, input)
+		assert.Contains(t, err.Error(), message, input)
+		assert.Empty(t, lunids, input)
+	}
+}
+
 func TestIsLunLike_False(t *testing.T) {
 	r := IsLunLike("192.168.1.30")
 	assert.False(t, r)
+	assert.False(t, IsLunLike("5006016d09200925"))
 }
 
 func TestIsLunLike_True(t *testing.T) {
 	r := IsLunLike("192")
 	assert.True(t, r)
+	assert.True(t, IsLunLike("0-15,20,0x4001"))
 }
 
 func TestIsIpLike_True(t *testing.T) {
@@ -77,6 +192,32 @@ func TestIsIpLike_False(t *testing.T) {
 
 	r = IsIPLike("129")
 	assert.False(t, r)
+
+	r = IsIPLike("50:06:01:60:36:e0:0e:5a")
+	assert.False(t, r)
+
+	r = IsIPLike("storage.example.com")
+	assert.False(t, r)
+}
+
+func TestIsIpLike_Port(t *testing.T) {
+	assert.True(t, IsIPLike("192.168.1.29:3260"))
+	assert.True(t, IsIPLike("fe80::1"))
+	assert.True(t, IsIPLike("[fe80::1]"))
+	assert.True(t, IsIPLike("[fe80::1]:3260"))
+	assert.False(t, IsIPLike("[fe80::1]:port"))
+}
+
+func TestIsPortalLike(t *testing.T) {
+	assert.True(t, IsPortalLike("192.168.1.29"))
+	assert.True(t, IsPortalLike("[fd00:10::20]:3260"))
+	assert.True(t, IsPortalLike("storage.example.com"))
+	assert.True(t, IsPortalLike("Storage-01:3261"))
+	assert.False(t, IsPortalLike("5006016d09200925"))
+	assert.False(t, IsPortalLike("0x1f"))
+	assert.False(t, IsPortalLike("12"))
+	assert.False(t, IsPortalLike("/dev/sdb"))
+	assert.False(t, IsPortalLike("nqn.2014-08.org.nvmexpress:uuid:1b4e28ba-2fa1-11d2-883f-0016d3cca427"))
 }
 
 func TestIsFcLike_Wwpn(t *testing.T) {
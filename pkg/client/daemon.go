@@ -0,0 +1,98 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package client
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/csi"
+	"github.com/peter-wangxu/goock/pkg/server"
+)
+
+// Local operations, they are replaced by the daemon client if the daemon socket is set
+var getHostInfo = connector.GetHostInfo
+var disconnectDevice = connector.DisconnectDeviceContext
+var extendDevice = connector.ExtendDeviceContext
+
+// SetDaemonSocket makes the handlers thin clients of the goock daemon
+// listening on socket, the operations run locally if socket is empty.
+func SetDaemonSocket(socket string) {
+	if socket == "" {
+		return
+	}
+	daemon := server.NewClient(socket, "")
+	getHostInfo = daemon.GetHostInfo
+	disconnectDevice = daemon.DisconnectDeviceContext
+	extendDevice = daemon.ExtendDeviceContext
+	SetISCSIConnector(server.NewISCSIClient(socket))
+	SetFcConnector(server.NewClient(socket, connector.FcProtocol))
+	SetNVMeConnector(server.NewNVMeTCPClient(socket))
+}
+
+// HandleServe runs the goock daemon on socket until SIGINT or SIGTERM is received,
+// the in-flight requests are finished before exit.
+func HandleServe(socket string) error {
+	if socket == "" {
+		socket = server.DefaultSocket
+	}
+	daemon := server.NewServer()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		log.Infof("Received %s, shutting down the goock daemon.", sig)
+		if err := daemon.Shutdown(); err != nil {
+			log.WithError(err).Error("Unable to shut down the goock daemon gracefully.")
+		}
+	}()
+	err := daemon.Serve(socket)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to serve on %s.", socket)
+	}
+	return err
+}
+
+// HandleCSI runs the CSI node plugin on endpoint until SIGINT or SIGTERM is
+// received, the in-flight requests are finished before exit.
+func HandleCSI(endpoint string, nodeId string, stateDir string) error {
+	if endpoint == "" {
+		endpoint = csi.DefaultEndpoint
+	}
+	plugin := csi.NewServer(csi.NewNodeServer(nodeId, stateDir))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		log.Infof("Received %s, shutting down the CSI plugin.", sig)
+		plugin.Stop()
+	}()
+	err := plugin.Serve(endpoint)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to serve on %s.", endpoint)
+	}
+	return err
+}
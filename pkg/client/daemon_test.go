@@ -0,0 +1,32 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDaemonSocket(t *testing.T) {
+	SetDaemonSocket("")
+	_, ok := iscsiConnector.(*server.ISCSIClient)
+	assert.False(t, ok)
+
+	SetDaemonSocket("/tmp/goock-not-existed.sock")
+	defer func() {
+		getHostInfo = connector.GetHostInfo
+		disconnectDevice = connector.DisconnectDeviceContext
+		extendDevice = connector.ExtendDeviceContext
+		SetISCSIConnector(connector.NewISCSIConnector())
+		SetFcConnector(connector.NewFibreChannelConnector())
+		SetNVMeConnector(connector.NewNVMeTCPConnector())
+	}()
+	_, ok = iscsiConnector.(*server.ISCSIClient)
+	assert.True(t, ok)
+	_, ok = nvmeConnector.(*server.NVMeTCPClient)
+	assert.True(t, ok)
+	err := HandleDeviceDisconnect("/dev/sdb")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to reach the goock daemon")
+}
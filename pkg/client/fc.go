@@ -18,6 +18,7 @@ package client
 import (
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/manifest"
 	"strconv"
 )
 
@@ -28,39 +29,116 @@ func SetFcConnector(fc connector.FibreChannelInterface) {
 	fcConnector = fc
 }
 
-// Convert2ConnectionProperty converts wwn and lunid pair into ConnnectionProperty
+// Convert2ConnectionProperty converts wwn and lunid pair into ConnnectionProperty,
+// lunID is in any form of connector.ParseLun
 func Convert2ConnectionProperty(wwns []string, lunID string) connector.ConnectionProperty {
 	var property connector.ConnectionProperty
 	property.TargetWwns = wwns
-	property.TargetLun, _ = strconv.Atoi(lunID)
+	property.TargetLun, _ = connector.ParseLun(lunID)
 	property.StorageProtocol = connector.FcProtocol
+	property.MultipathPolicy = multipathPolicy
+	property.Force = forceDisconnect
 
 	return property
 }
 
 // HandleFCConnect handles the connection of FC target
 func HandleFCConnect(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
 	var err error
 	if len(args) == 1 {
-		// User only supply the LUN ID, so did a wildcard scan for all connected targets
-		err = fmt.Errorf("currently [LUN ID] is not supported")
+		// No LUN ID supplied, connect all the LUNs of the target
+		return HandleTargetConnect(args...)
+	}
+	targets := args[:len(args)-1]
+	var lunIDs []int
+	if lunIDs, err = ValidateLunID(args[len(args)-1:]); err != nil {
 		log.WithError(err).Error("Unsupported parameters.")
-	} else {
-		targets := args[:len(args)-1]
-
-		conn := Convert2ConnectionProperty(targets, args[len(args)-1])
+		return err
+	}
+	for _, lun := range lunIDs {
+		conn := Convert2ConnectionProperty(targets, strconv.Itoa(lun))
+		info, connErr := fcConnector.ConnectVolumeContext(ctx, conn)
+		if connErr != nil {
+			log.WithError(connErr).Errorf("Unable to connect LUN %d.", lun)
+			err = connErr
+			continue
+		}
+		recordAttachment(conn, info)
+		BeautifyVolumeInfo(info)
+	}
 
-		var info connector.VolumeInfo
+	return err
+}
 
-		if info, err = fcConnector.ConnectVolume(conn); err == nil {
-			BeautifyVolumeInfo(info)
+// HandleFCTargetConnect scans the target wwns and connects every LUN found on them.
+func HandleFCTargetConnect(wwns ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	// The LUN IDs are found after scan
+	conn := Convert2ConnectionProperty(wwns, "0")
+	volumes, err := fcConnector.ConnectTargetContext(ctx, conn)
+	for _, volume := range volumes {
+		if len(volume.Luns) > 0 {
+			recordAttachment(Convert2ConnectionProperty(wwns, strconv.Itoa(volume.Luns[0])), volume)
 		}
 	}
+	BeautifyVolumes(volumes)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to connect all the LUNs of %s.", wwns)
+	}
+	return err
+}
 
+// HandleFCDisconnect disconnects the FC devices of the LUN from local host.
+func HandleFCDisconnect(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	var err error
+	if len(args) <= 1 {
+		err = fmt.Errorf("target wwn and LUN ID are required")
+	} else if lunIDs, validErr := ValidateLunID(args[len(args)-1:]); validErr != nil {
+		err = validErr
+	} else {
+		targets := args[:len(args)-1]
+		for _, lun := range lunIDs {
+			conn := Convert2ConnectionProperty(targets, strconv.Itoa(lun))
+			if err = fcConnector.DisconnectVolumeContext(ctx, conn); err != nil {
+				break
+			}
+			forgetAttachments(manifest.Key(conn))
+		}
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to disconnect the Fibre Channel device.")
+	}
 	return err
 }
 
 // HandleFCExtend handle the request to extend the FC devices.
 func HandleFCExtend(args ...string) error {
-	return nil
+	ctx, cancel := newContext()
+	defer cancel()
+	var err error
+	if len(args) <= 1 {
+		err = fmt.Errorf("target wwn and LUN ID are required")
+		log.WithError(err).Error("Unsupported parameters.")
+	} else if lunIDs, validErr := ValidateLunID(args[len(args)-1:]); validErr != nil {
+		err = validErr
+	} else {
+		targets := args[:len(args)-1]
+		for _, lun := range lunIDs {
+			conn := Convert2ConnectionProperty(targets, strconv.Itoa(lun))
+			var info connector.ExtendInfo
+			if info, err = fcConnector.ExtendVolumeContext(ctx, conn); err != nil {
+				break
+			}
+			BeautifyExtendInfo(info)
+		}
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to extend the Fibre Channel device.")
+	}
+	return err
 }
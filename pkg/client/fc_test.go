@@ -29,7 +29,26 @@ func TestHandleFCConnect(t *testing.T) {
 	assert.Nil(t, err)
 }
 
-func TestHandleFCExtend(t *testing.T) {
+func TestHandleFCDisconnectInvalidLun(t *testing.T) {
+	err := HandleFCDisconnect("5006016d09200925", "invalid")
+	assert.Error(t, err)
+}
+
+func TestHandleFCExtendNoParam(t *testing.T) {
 	err := HandleFCExtend()
+	assert.Error(t, err)
+}
+
+func TestHandleFCExtendInvalidLun(t *testing.T) {
+	err := HandleFCExtend("5006016d09200925", "invalid")
+	assert.Error(t, err)
+}
+
+func TestHandleFCExtend(t *testing.T) {
+	connector.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	util.SetExecutor(test.NewMockExecutor())
+	err := HandleFCExtend("5006016d09200925", "5006016136e00e5a", "11")
 	assert.Nil(t, err)
 }
@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/manifest"
 	"github.com/peter-wangxu/goock/pkg/model"
 )
 
@@ -31,9 +32,53 @@ func SetISCSIConnector(iscsi connector.ISCSIInterface) {
 	iscsiConnector = iscsi
 }
 
+// CHAP credentials for session login and sendtargets discovery
+var sessionAuth, discoveryAuth connector.CHAPCredential
+
+// SetCHAPCredential sets the CHAP credentials used by the iSCSI commands
+func SetCHAPCredential(session connector.CHAPCredential, discovery connector.CHAPCredential) {
+	sessionAuth = session
+	discoveryAuth = discovery
+}
+
+// Options of the iSCSI login, see connector.ConnectionProperty
+var loginParallelism, minLoginPaths int
+var loginRetries = connector.DefaultLoginRetries
+
+// SetLoginOption sets the concurrency, minimum logged in paths and retries
+// of the iSCSI login
+func SetLoginOption(parallelism int, minPaths int, retries int) {
+	loginParallelism = parallelism
+	minLoginPaths = minPaths
+	loginRetries = retries
+	if retries == 0 {
+		loginRetries = connector.NoLoginRetry
+	}
+}
+
+// Keep the iSCSI sessions even if no device attached after disconnect
+var keepSessions bool
+
+// SetKeepSessions sets whether to keep the orphaned iSCSI sessions after disconnect
+func SetKeepSessions(keep bool) {
+	keepSessions = keep
+}
+
+// iSCSI ifaces and transport of the sessions, see connector.ConnectionProperty
+var ifaces []string
+var transport connector.StringEnum
+
+// SetIfaceOption sets the iSCSI ifaces or network interfaces which the
+// sessions are bound to, and the transport of the ifaces
+func SetIfaceOption(names []string, transportName string) {
+	ifaces = names
+	transport = connector.StringEnum(transportName)
+}
+
 // Session2ConnectionProperty converts a session to an ConnectionProperty
 func Session2ConnectionProperty(sessions []model.ISCSISession, lun int) connector.ConnectionProperty {
 	conn := connector.ConnectionProperty{}
+	conn.StorageProtocol = connector.IscsiProtocol
 	var portals []string
 	var iqns []string
 	var lunIDs []int
@@ -45,60 +90,100 @@ func Session2ConnectionProperty(sessions []model.ISCSISession, lun int) connecto
 	conn.TargetIqns = iqns
 	conn.TargetPortals = portals
 	conn.TargetLuns = lunIDs
+	conn.SessionAuth = sessionAuth
+	conn.DiscoveryAuth = discoveryAuth
+	conn.LoginParallelism = loginParallelism
+	conn.MinLoginPaths = minLoginPaths
+	conn.LoginRetries = loginRetries
+	conn.KeepSessions = keepSessions
+	conn.Ifaces = ifaces
+	conn.Transport = transport
+	conn.MultipathPolicy = multipathPolicy
+	conn.Force = forceDisconnect
 	return conn
 }
 
 // HandleISCSIConnect connects the iSCSI target via iscsiadm
 func HandleISCSIConnect(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
 	var err error
 	if len(args) == 1 {
-		err = fmt.Errorf("currently Target IP is not supported")
-		log.Error("Target IP and LUN ID(s) is required.")
-		//log.Info("LUN ID is not specified, will query all LUNs on target IP: %s", args[0])
-		//targetIP := args[0]
-		//// TODO Need to login and find all possible LUN IDs
-		//volumeInfo, conErr := FetchVolumeInfo(targetIP, 4)
-		//if conErr != nil {
-		//	err = conErr
-		//} else {
-		//	BeautifyVolumeInfo(volumeInfo)
-		//}
-	} else {
-		log.Debugf("Trying to validate the target IP : %s, LUN ID: %s", args[0], args[1:])
-		var lunIDs []int
-		lunIDs, err = ValidateLunID(args[1:])
-		if err == nil {
-			targetIP := args[0]
-			sessions := iscsiConnector.DiscoverPortal(targetIP)
-			for _, lun := range lunIDs {
-				volumeInfo, _ := FetchVolumeInfo(sessions, lun)
-				BeautifyVolumeInfo(volumeInfo)
+		log.Infof("LUN ID is not specified, connect all the LUNs of %s.", args[0])
+		return HandleTargetConnect(args...)
+	}
+	log.Debugf("Trying to validate the target IP : %s, LUN ID: %s", args[0], args[1:])
+	var lunIDs []int
+	lunIDs, err = ValidateLunID(args[1:])
+	if err == nil {
+		targetIP := args[0]
+		sessions := iscsiConnector.DiscoverPortalWithIfacesContext(ctx, discoveryAuth, ifaces, transport, targetIP)
+		for _, lun := range lunIDs {
+			volumeInfo, connErr := FetchVolumeInfo(sessions, lun)
+			if connErr != nil {
+				log.WithError(connErr).Errorf("Unable to connect LUN %d.", lun)
+				BeautifyLoginResults(volumeInfo.LoginResults)
+				err = connErr
+				continue
 			}
+			recordAttachment(Session2ConnectionProperty(sessions, lun), volumeInfo)
+			BeautifyVolumeInfo(volumeInfo)
 		}
 	}
 
 	return err
 }
 
+// HandleISCSITargetConnect logs in all the targets discovered via the portals
+// and connects every LUN found on them.
+func HandleISCSITargetConnect(portals ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	sessions := iscsiConnector.DiscoverPortalWithIfacesContext(ctx, discoveryAuth, ifaces, transport, portals...)
+	if len(sessions) <= 0 {
+		err := fmt.Errorf("no target discovered via %s", portals)
+		log.WithError(err).Error("Unable to connect the targets.")
+		return err
+	}
+	// The LUN IDs are found after login
+	property := Session2ConnectionProperty(sessions, 0)
+	volumes, err := iscsiConnector.ConnectTargetContext(ctx, property)
+	for _, volume := range volumes {
+		if len(volume.Luns) > 0 {
+			recordAttachment(Session2ConnectionProperty(sessions, volume.Luns[0]), volume)
+		}
+	}
+	BeautifyVolumes(volumes)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to connect all the LUNs of %s.", portals)
+	}
+	return err
+}
+
 // HandleISCSIDisconnect disconnects the volume devices from local host
 // Accessible format likes follows:
 //  /dev/sdb
 //  sdb
 //  <Target IP> <LUN ID>
 func HandleISCSIDisconnect(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
 	var err error
 	if len(args) == 1 {
-		// TODO Support the device name removal
-		err = fmt.Errorf("currently device name is not supported")
+		return HandleDeviceDisconnect(args[0])
 	} else if len(args) >= 2 {
 
 		targetIP := args[0]
-		lunIDs, err := ValidateLunID(args[1:])
+		var lunIDs []int
+		lunIDs, err = ValidateLunID(args[1:])
 		if err == nil {
-			sessions := iscsiConnector.DiscoverPortal(targetIP)
+			sessions := iscsiConnector.DiscoverPortalWithIfacesContext(ctx, discoveryAuth, ifaces, transport, targetIP)
 			for _, lun := range lunIDs {
 				connectionProperty := Session2ConnectionProperty(sessions, lun)
-				err = iscsiConnector.DisconnectVolume(connectionProperty)
+				err = iscsiConnector.DisconnectVolumeContext(ctx, connectionProperty)
+				if err == nil {
+					forgetAttachments(manifest.Key(connectionProperty))
+				}
 			}
 		}
 
@@ -111,14 +196,21 @@ func HandleISCSIDisconnect(args ...string) error {
 
 // HandleISCSIExtend extends the iscsi block device
 func HandleISCSIExtend(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
 	targetIP := args[0]
 	lunIDs, err := ValidateLunID(args[1:])
 
-	sessions := iscsiConnector.DiscoverPortal(targetIP)
+	sessions := iscsiConnector.DiscoverPortalWithIfacesContext(ctx, discoveryAuth, ifaces, transport, targetIP)
 	if err == nil {
 		for _, lun := range lunIDs {
 			property := Session2ConnectionProperty(sessions, lun)
-			iscsiConnector.ExtendVolume(property)
+			var info connector.ExtendInfo
+			if info, err = iscsiConnector.ExtendVolumeContext(ctx, property); err != nil {
+				log.WithError(err).Errorf("Unable to extend LUN %d.", lun)
+				break
+			}
+			BeautifyExtendInfo(info)
 		}
 	}
 	return err
@@ -126,17 +218,39 @@ func HandleISCSIExtend(args ...string) error {
 
 // FetchVolumeInfo fetches the volume information via iscsiConnector.
 func FetchVolumeInfo(sessions []model.ISCSISession, lun int) (connector.VolumeInfo, error) {
+	ctx, cancel := newContext()
+	defer cancel()
 	connectionProperty := Session2ConnectionProperty(sessions, lun)
-	return iscsiConnector.ConnectVolume(connectionProperty)
+	return iscsiConnector.ConnectVolumeContext(ctx, connectionProperty)
 
 }
 
 // BeautifyVolumeInfo output the volume information to stdout.
 func BeautifyVolumeInfo(info connector.VolumeInfo) {
+	if IsStructuredOutput() {
+		PrintOutput(KindVolumeInfo, info)
+		return
+	}
 	beautifiedPaths := ""
 	for _, path := range info.Paths {
 		beautifiedPaths += fmt.Sprintf("  %s\n", path)
 	}
 	fmt.Printf(fmt.Sprintf(VolumeFormat, info.Multipath, beautifiedPaths,
 		info.MultipathId, info.Wwn))
+	BeautifyLoginResults(info.LoginResults)
+}
+
+// BeautifyLoginResults outputs the login result of each iSCSI target portal.
+func BeautifyLoginResults(results []connector.LoginResult) {
+	if len(results) <= 0 {
+		return
+	}
+	if IsStructuredOutput() {
+		PrintOutput(KindLoginResults, results)
+		return
+	}
+	fmt.Println("Login Results:")
+	for _, result := range results {
+		fmt.Printf("  %s\n", result)
+	}
 }
@@ -1,14 +1,20 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/linux"
 	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/util"
+	"github.com/peter-wangxu/goock/test"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 type FakeISCSIConnector struct {
+	// The ifaces which the last discovery is via
+	discoveryIfaces []string
 }
 
 func (fake *FakeISCSIConnector) GetHostInfo() (connector.HostInfo, error) {
@@ -22,17 +28,47 @@ func (fake *FakeISCSIConnector) ConnectVolume(connectionProperty connector.Conne
 	return connector.VolumeInfo{}, nil
 }
 
+func (fake *FakeISCSIConnector) ConnectTarget(connectionProperty connector.ConnectionProperty) ([]connector.VolumeInfo, error) {
+	if len(connectionProperty.TargetPortals) > 0 && connectionProperty.TargetPortals[0] == "10.244.244.244" {
+		return []connector.VolumeInfo{{LoginResults: []connector.LoginResult{}}}, fmt.Errorf("failed to login target")
+	}
+	return []connector.VolumeInfo{
+		{Wwn: "36001405f3c9a1b2c3d4e5f60718293a4", Paths: []string{"/dev/sdq"}},
+		{Wwn: "36001405f3c9a1b2c3d4e5f60718293a5", Paths: []string{"/dev/sdr"}},
+	}, nil
+}
+
+func (fake *FakeISCSIConnector) ConnectTargetContext(ctx context.Context, connectionProperty connector.ConnectionProperty) ([]connector.VolumeInfo, error) {
+	return fake.ConnectTarget(connectionProperty)
+}
+
 func (fake *FakeISCSIConnector) DisconnectVolume(connectionProperty connector.ConnectionProperty) error {
 	return nil
 }
-func (fake *FakeISCSIConnector) ExtendVolume(connectionProperty connector.ConnectionProperty) error {
-	return nil
+func (fake *FakeISCSIConnector) ExtendVolume(connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return connector.ExtendInfo{}, nil
+}
+
+func (fake *FakeISCSIConnector) ConnectVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	return fake.ConnectVolume(connectionProperty)
+}
+
+func (fake *FakeISCSIConnector) DisconnectVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) error {
+	return fake.DisconnectVolume(connectionProperty)
+}
+
+func (fake *FakeISCSIConnector) ExtendVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return fake.ExtendVolume(connectionProperty)
 }
 
 func (fake *FakeISCSIConnector) LoginPortal(targetPortal string, targetIqn string) error {
 	return nil
 }
 
+func (fake *FakeISCSIConnector) LoginPortalWithAuth(auth connector.CHAPCredential, targetPortal string, targetIqn string) error {
+	return nil
+}
+
 func (fake *FakeISCSIConnector) DiscoverPortal(targetPortal ...string) []model.ISCSISession {
 	// TestHandleIscsiNoLunFailed
 	if len(targetPortal) > 0 && targetPortal[0] == "10.244.244.244" {
@@ -49,6 +85,28 @@ func (fake *FakeISCSIConnector) DiscoverPortal(targetPortal ...string) []model.I
 
 	return nil
 }
+func (fake *FakeISCSIConnector) DiscoverPortalWithAuth(auth connector.CHAPCredential, targetPortal ...string) []model.ISCSISession {
+	return fake.DiscoverPortal(targetPortal...)
+}
+
+func (fake *FakeISCSIConnector) DiscoverPortalWithAuthContext(ctx context.Context, auth connector.CHAPCredential, targetPortal ...string) []model.ISCSISession {
+	return fake.DiscoverPortal(targetPortal...)
+}
+
+func (fake *FakeISCSIConnector) DiscoverPortalWithIfacesContext(ctx context.Context, auth connector.CHAPCredential,
+	ifaces []string, transport connector.StringEnum, targetPortal ...string) []model.ISCSISession {
+	fake.discoveryIfaces = ifaces
+	return fake.DiscoverPortal(targetPortal...)
+}
+
+func (fake *FakeISCSIConnector) LoginTargets(targets []model.ISCSISession, connectionProperty connector.ConnectionProperty) []connector.LoginResult {
+	return []connector.LoginResult{}
+}
+
+func (fake *FakeISCSIConnector) LogoutPortal(targetPortal string, targetIqn string) error {
+	return nil
+}
+
 func (fake *FakeISCSIConnector) SetNode2Auto(targetPortal string, targetIqn string) error {
 	return nil
 }
@@ -70,6 +128,15 @@ func TestSession2ConnectionProperty(t *testing.T) {
 	assert.Equal(t, []string{"192.168.0.10:3260"}, conn.TargetPortals)
 }
 
+func TestSession2ConnectionPropertyWithAuth(t *testing.T) {
+	SetCHAPCredential(connector.CHAPCredential{Username: "user", Secret: "secret"},
+		connector.CHAPCredential{Username: "discovery", Secret: "discovery-secret"})
+	defer SetCHAPCredential(connector.CHAPCredential{}, connector.CHAPCredential{})
+	conn := Session2ConnectionProperty([]model.ISCSISession{{TargetPortal: "192.168.0.10:3260"}}, 4)
+	assert.Equal(t, "user", conn.SessionAuth.Username)
+	assert.Equal(t, "discovery-secret", conn.DiscoveryAuth.Secret)
+}
+
 func TestHandleIscsi(t *testing.T) {
 	fake := &FakeISCSIConnector{}
 	SetISCSIConnector(fake)
@@ -77,14 +144,36 @@ func TestHandleIscsi(t *testing.T) {
 	err := HandleISCSIConnect("192.168.1.17", "33")
 	assert.Nil(t, err)
 }
+func TestHandleIscsiIfaces(t *testing.T) {
+	fake := &FakeISCSIConnector{}
+	SetISCSIConnector(fake)
+	SetIfaceOption([]string{"eth1", "eth2"}, "")
+	defer SetIfaceOption(nil, "")
+
+	err := HandleISCSIConnect("192.168.1.17", "33")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"eth1", "eth2"}, fake.discoveryIfaces)
+}
+
 func TestHandleIscsiNoLun(t *testing.T) {
 	fake := &FakeISCSIConnector{}
 	SetISCSIConnector(fake)
 
+	// No target discovered
 	err := HandleISCSIConnect("192.168.1.19")
 	assert.Error(t, err)
 }
 
+func TestHandleConnectTarget(t *testing.T) {
+	fake := &FakeISCSIConnector{}
+	SetISCSIConnector(fake)
+
+	assert.Nil(t, HandleConnect("10.10.10.10"))
+	assert.Nil(t, HandleISCSIConnect("10.10.10.10"))
+	// Neither iSCSI portals nor FC wwns
+	assert.Error(t, HandleConnect("10.10.10.10", "5006016d09200925"))
+}
+
 func TestHandleIscsiNoLunFailed(t *testing.T) {
 	fake := &FakeISCSIConnector{}
 	SetISCSIConnector(fake)
@@ -93,6 +182,48 @@ func TestHandleIscsiNoLunFailed(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestHandleIscsiConnectFailed(t *testing.T) {
+	fake := &FakeISCSIConnector{}
+	SetISCSIConnector(fake)
+
+	err := HandleISCSIConnect("10.244.244.244", "5")
+	assert.Error(t, err)
+}
+
+func TestSession2ConnectionPropertyWithLoginOption(t *testing.T) {
+	SetLoginOption(4, 2, 1)
+	defer SetLoginOption(0, 0, connector.DefaultLoginRetries)
+	conn := Session2ConnectionProperty([]model.ISCSISession{{TargetPortal: "192.168.0.10:3260"}}, 4)
+	assert.Equal(t, 4, conn.LoginParallelism)
+	assert.Equal(t, 2, conn.MinLoginPaths)
+	assert.Equal(t, 1, conn.LoginRetries)
+	SetLoginOption(0, 0, 0)
+	conn = Session2ConnectionProperty([]model.ISCSISession{{TargetPortal: "192.168.0.10:3260"}}, 4)
+	assert.Equal(t, connector.NoLoginRetry, conn.LoginRetries)
+}
+
+func TestSession2ConnectionPropertyIfaces(t *testing.T) {
+	SetIfaceOption([]string{"eth1", "eth2"}, "iser")
+	defer SetIfaceOption(nil, "")
+	conn := Session2ConnectionProperty([]model.ISCSISession{{TargetPortal: "192.168.0.10:3260"}}, 4)
+	assert.Equal(t, []string{"eth1", "eth2"}, conn.Ifaces)
+	assert.Equal(t, connector.TransportISER, conn.Transport)
+}
+
+func TestSession2ConnectionPropertyKeepSessions(t *testing.T) {
+	SetKeepSessions(true)
+	defer SetKeepSessions(false)
+	conn := Session2ConnectionProperty([]model.ISCSISession{{TargetPortal: "192.168.0.10:3260"}}, 4)
+	assert.True(t, conn.KeepSessions)
+}
+
+func TestSession2ConnectionPropertyRequireMultipath(t *testing.T) {
+	SetRequireMultipath(true)
+	defer SetRequireMultipath(false)
+	conn := Session2ConnectionProperty([]model.ISCSISession{{TargetPortal: "192.168.0.10:3260"}}, 4)
+	assert.Equal(t, connector.MultipathRequired, conn.MultipathPolicy)
+}
+
 func TestHandleIscsiInvalidLun(t *testing.T) {
 	fake := &FakeISCSIConnector{}
 	SetISCSIConnector(fake)
@@ -109,10 +240,11 @@ func TestHandleISCSIDisconnect(t *testing.T) {
 }
 
 func TestHandleDisISCSIConnectViaDevice(t *testing.T) {
-	fake := &FakeISCSIConnector{}
-	SetISCSIConnector(fake)
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	util.SetExecutor(test.NewMockExecutor())
 	err := HandleISCSIDisconnect("/dev/sdb")
-	assert.Error(t, err)
+	assert.Nil(t, err)
 }
 
 func TestHandleExtend(t *testing.T) {
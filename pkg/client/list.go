@@ -0,0 +1,165 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+	"github.com/peter-wangxu/goock/pkg/util"
+)
+
+// VolumeListFormat defines the output of each volume of `list`
+var VolumeListFormat = `WWN:             %s
+LUN:             %d
+Multipath:       %s
+Size:            %d
+Access:          %s
+Vendor/Product:  %s/%s
+State:           %s
+Paths:
+%s
+`
+
+var listVolumes = connector.ListVolumes
+
+// Filters of the list command, empty matches all
+var listTarget, listWwn, listState string
+
+// States of the volumes and recorded attachments
+var listStates = []string{connector.VolumeActive, connector.VolumeDegraded, connector.VolumeFailed,
+	string(manifest.StatusDrifted), string(manifest.StatusMissing)}
+
+// SetListFilter sets the target IQN/wwn/NQN/portal, the wwn and the state of
+// the volumes and recorded attachments to list
+func SetListFilter(target string, wwn string, state string) {
+	listTarget = target
+	listWwn = wwn
+	listState = state
+}
+
+// HandleList displays the volumes attached to the host with their paths, and
+// the recorded attachments whose devices are drifted or missing
+func HandleList() error {
+	if listState != "" && !util.Contains(listState, listStates) {
+		err := fmt.Errorf("unsupported state %s, use one of %s", listState, strings.Join(listStates, ", "))
+		log.WithError(err).Error("Unsupported parameters.")
+		return err
+	}
+	list := VolumeList{Volumes: []connector.AttachedVolume{}}
+	for _, volume := range listVolumes() {
+		if matchVolume(volume) {
+			list.Volumes = append(list.Volumes, volume)
+		}
+	}
+	attachments, err := manifest.Load()
+	if err != nil {
+		log.WithError(err).Warn("Unable to load the manifest, the recorded attachments are not checked.")
+	}
+	for _, attachment := range attachments {
+		status, reason := manifest.Verify(attachment)
+		if status == manifest.StatusAttached || !matchAttachment(attachment, status) {
+			continue
+		}
+		list.Attachments = append(list.Attachments, AttachmentStatus{
+			Key:    attachment.Key,
+			Wwn:    attachment.Wwn,
+			Status: string(status),
+			Reason: reason,
+		})
+	}
+	BeautifyVolumeList(list)
+	return nil
+}
+
+// Tests if the volume matches the filters
+func matchVolume(volume connector.AttachedVolume) bool {
+	if listTarget != "" && !volume.HasTarget(listTarget) {
+		return false
+	}
+	if listWwn != "" && !strings.EqualFold(volume.Wwn, listWwn) {
+		return false
+	}
+	return listState == "" || listState == volume.State
+}
+
+// Tests if the recorded attachment matches the filters
+func matchAttachment(attachment manifest.Attachment, status manifest.Status) bool {
+	if listTarget != "" {
+		property := attachment.Property
+		var paths []connector.PathInfo
+		for _, target := range append(append([]string{property.TargetNqn}, property.TargetIqns...), property.TargetWwns...) {
+			paths = append(paths, connector.PathInfo{Transport: property.StorageProtocol, Target: target})
+		}
+		for _, portal := range property.TargetPortals {
+			paths = append(paths, connector.PathInfo{Transport: property.StorageProtocol, Portal: portal})
+		}
+		if !(connector.AttachedVolume{Paths: paths}).HasTarget(listTarget) {
+			return false
+		}
+	}
+	if listWwn != "" && !strings.EqualFold(attachment.Wwn, listWwn) {
+		return false
+	}
+	return listState == "" || listState == string(status)
+}
+
+// BeautifyVolumeList outputs the attached volumes and the drifted attachments.
+func BeautifyVolumeList(list VolumeList) {
+	if IsStructuredOutput() {
+		PrintOutput(KindVolumeList, list)
+		return
+	}
+	if len(list.Volumes) <= 0 {
+		fmt.Println("No volume is attached.")
+	}
+	for _, volume := range list.Volumes {
+		fmt.Printf(VolumeListFormat, volume.Wwn, volume.Lun, volume.Multipath, volume.Size, volumeAccess(volume),
+			volume.Vendor, volume.Product, volume.State, beautifyPaths(volume.Paths))
+	}
+	if len(list.Attachments) > 0 {
+		fmt.Printf("Recorded Attachments(%s):\n", manifest.GetPath())
+		for _, attachment := range list.Attachments {
+			fmt.Printf("  %s: %s, %s\n", attachment.Key, attachment.Status, attachment.Reason)
+		}
+	}
+}
+
+// Returns the access mode of the volume, like rw
+func volumeAccess(volume connector.AttachedVolume) string {
+	if volume.ReadOnly {
+		return string(connector.ReadOnly)
+	}
+	return string(connector.ReadWrite)
+}
+
+// Returns a line for each path with its address, device, transport, target
+// and states
+func beautifyPaths(paths []connector.PathInfo) string {
+	beautified := ""
+	for _, path := range paths {
+		target := path.Target
+		if path.Portal != "" {
+			target = fmt.Sprintf("%s %s", path.Portal, path.Target)
+		}
+		state := strings.Join(strings.Fields(path.State+" "+path.DmStatus+" "+path.PathStatus), " ")
+		beautified += fmt.Sprintf("  %-12s %-14s %-14s %s [%s]\n",
+			path.Hctl, path.Device, path.Transport, target, state)
+	}
+	return beautified
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+var fakeVolumes = []connector.AttachedVolume{
+	{Wwn: "36001405a1b2c3d4e5f60718293a4b5c6", Lun: 3, State: connector.VolumeDegraded, Paths: []connector.PathInfo{
+		{Hctl: "12:0:0:3", Device: "/dev/sdq", Transport: connector.IscsiProtocol,
+			Target: "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59", Portal: "10.64.77.10:3260", State: "running"},
+		{Hctl: "13:0:0:3", Device: "/dev/sds", Transport: connector.IscsiProtocol,
+			Target: "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59", Portal: "10.64.78.10:3260", State: "offline"},
+	}},
+	{Wwn: "36006016074e03a008dfd94ce623d4c0e", Lun: 10, Multipath: "/dev/dm-2", State: connector.VolumeActive,
+		Paths: []connector.PathInfo{
+			{Hctl: "9:0:0:10", Device: "/dev/sdm", Transport: connector.FcProtocol, Target: "5006016d09200925",
+				DmStatus: "active", PathStatus: "ready"},
+		}},
+}
+
+// Lists the fake volumes with the filters, the structured output is returned
+func listWithFilter(t *testing.T, target string, wwn string, state string) VolumeList {
+	listVolumes = func() []connector.AttachedVolume { return fakeVolumes }
+	defer func() {
+		listVolumes = connector.ListVolumes
+	}()
+	SetListFilter(target, wwn, state)
+	defer SetListFilter("", "", "")
+	buf, restore := captureOutput(JSONOutput)
+	defer restore()
+	assert.Nil(t, HandleList())
+	var output struct {
+		Kind string     `json:"kind"`
+		Data VolumeList `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &output))
+	assert.Equal(t, KindVolumeList, output.Kind)
+	return output.Data
+}
+
+func TestHandleList(t *testing.T) {
+	clearManifest()
+	list := listWithFilter(t, "", "", "")
+	assert.Equal(t, fakeVolumes, list.Volumes)
+	assert.Empty(t, list.Attachments)
+}
+
+func TestHandleListText(t *testing.T) {
+	listVolumes = func() []connector.AttachedVolume { return fakeVolumes }
+	defer func() {
+		listVolumes = connector.ListVolumes
+	}()
+	assert.Nil(t, HandleList())
+}
+
+func TestHandleListFilter(t *testing.T) {
+	clearManifest()
+	list := listWithFilter(t, "10.64.78.10", "", "")
+	assert.Len(t, list.Volumes, 1)
+	assert.Equal(t, 3, list.Volumes[0].Lun)
+
+	list = listWithFilter(t, "50:06:01:6d:09:20:09:25", "", "")
+	assert.Len(t, list.Volumes, 1)
+	assert.Equal(t, "/dev/dm-2", list.Volumes[0].Multipath)
+
+	list = listWithFilter(t, "", "36006016074E03A008DFD94CE623D4C0E", "")
+	assert.Len(t, list.Volumes, 1)
+
+	list = listWithFilter(t, "", "", connector.VolumeDegraded)
+	assert.Len(t, list.Volumes, 1)
+	assert.Equal(t, connector.VolumeDegraded, list.Volumes[0].State)
+
+	list = listWithFilter(t, "", "", connector.VolumeFailed)
+	assert.Empty(t, list.Volumes)
+}
+
+func TestHandleListInvalidState(t *testing.T) {
+	SetListFilter("", "", "broken")
+	defer SetListFilter("", "", "")
+	assert.Error(t, HandleList())
+}
+
+func TestHandleListDriftedAttachments(t *testing.T) {
+	clearManifest()
+	defer clearManifest()
+	manifest.Record(nvmeAttachment)
+	manifest.Record(manifest.Attachment{
+		Key: "fc:5006016d09200925:10",
+		Property: connector.ConnectionProperty{StorageProtocol: connector.FcProtocol,
+			TargetWwns: []string{"5006016d09200925"}, TargetLun: 10},
+		Wwn:   "36001405a1b2c3d4e5f60718293a4b5c6",
+		Paths: []string{"/dev/sdq", "/dev/sdz"},
+	})
+	list := listWithFilter(t, "", "", "")
+	assert.Len(t, list.Attachments, 2)
+	assert.Equal(t, string(manifest.StatusMissing), list.Attachments[0].Status)
+	assert.Equal(t, string(manifest.StatusDrifted), list.Attachments[1].Status)
+	assert.Contains(t, list.Attachments[1].Reason, "/dev/sdz")
+
+	list = listWithFilter(t, "5006016d09200925", "", "")
+	assert.Len(t, list.Attachments, 1)
+	assert.Equal(t, "fc:5006016d09200925:10", list.Attachments[0].Key)
+
+	list = listWithFilter(t, "", "", string(manifest.StatusMissing))
+	assert.Empty(t, list.Volumes)
+	assert.Len(t, list.Attachments, 1)
+}
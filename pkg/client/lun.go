@@ -0,0 +1,193 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+)
+
+// LunInfoFormat defines the output of each LUN of `info lun`
+var LunInfoFormat = `WWN:             %s
+LUN:             %d
+Attached:        %s
+Multipath:       %s
+Size:            %d
+Access:          %s
+Vendor/Product:  %s/%s
+Revision:        %s
+Device Type:     %d
+Serial:          %s
+State:           %s
+Paths:
+%s
+`
+
+// HandleLunInfo displays the LUNs visible via the iSCSI portals or the FC
+// target wwns, the last argument is the LUN IDs. Nothing is changed on the
+// host: no login and no rescan, so only the LUNs already discovered are
+// found.
+func HandleLunInfo(args ...string) error {
+	if len(args) < 2 {
+		err := fmt.Errorf("the target portals or wwns and the LUN ID are required")
+		log.WithError(err).Error("Unsupported parameters.")
+		return err
+	}
+	targets := args[:len(args)-1]
+	for _, target := range targets {
+		if !IsPortalLike(target) && !IsFcLike(target) {
+			err := fmt.Errorf("%s is neither an iSCSI portal nor a Fibre Channel wwn", target)
+			log.WithError(err).Error("Unsupported parameters.")
+			return err
+		}
+	}
+	luns, err := ValidateLunID(args[len(args)-1:])
+	if err != nil {
+		log.WithError(err).Error("Unsupported parameters.")
+		return err
+	}
+	attachments, err := manifest.Load()
+	if err != nil {
+		log.WithError(err).Warn("Unable to load the manifest, only the LUNs in use are taken as attached.")
+	}
+	volumes := listVolumes()
+	var infos []LunInfo
+	var missing []int
+	for _, lun := range luns {
+		found := false
+		for _, volume := range volumes {
+			if volume.Lun != lun || !isSCSIVolume(volume) || !hasAnyTarget(volume, targets) {
+				continue
+			}
+			infos = append(infos, getLunInfo(volume, attachments))
+			found = true
+		}
+		if !found {
+			missing = append(missing, lun)
+		}
+	}
+	BeautifyLunInfo(infos)
+	if len(missing) > 0 {
+		err = fmt.Errorf("LUN %v is not visible via %s", missing, strings.Join(targets, ", "))
+		log.WithError(err).Error("Unable to find the LUN, connect it or rescan the targets first.")
+		return err
+	}
+	return nil
+}
+
+// Tests if the volume is a SCSI LUN, the NVMe namespaces are skipped
+func isSCSIVolume(volume connector.AttachedVolume) bool {
+	for _, path := range volume.Paths {
+		if path.Hctl != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Tests if any path of the volume is via any of the targets
+func hasAnyTarget(volume connector.AttachedVolume, targets []string) bool {
+	for _, target := range targets {
+		if volume.HasTarget(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fills the size, read only and inquiry data of the volume from the device,
+// and tests if it is attached: recorded in the manifest or in use on the
+// host. A multipath map alone does not tell, multipathd builds the maps of
+// all the visible LUNs.
+func getLunInfo(volume connector.AttachedVolume, attachments []manifest.Attachment) LunInfo {
+	info := LunInfo{AttachedVolume: volume}
+	device := volume.Multipath
+	if device == "" {
+		device = volume.Paths[0].Device
+	}
+	if size := linux.GetDeviceSize(device); size > 0 {
+		info.Size = int64(size)
+	}
+	info.ReadOnly = !linux.CheckReadWrite(filepath.Base(volume.Paths[0].Device), volume.Wwn)
+	for _, path := range volume.Paths {
+		if path.Hctl == "" {
+			continue
+		}
+		inquiry, err := linux.GetInquiryData(path.Hctl)
+		if err != nil {
+			log.WithError(err).Debugf("Unable to read the inquiry data of %s.", path.Hctl)
+			continue
+		}
+		info.Inquiry = inquiry
+		break
+	}
+	for _, attachment := range attachments {
+		if volume.Wwn != "" && strings.EqualFold(attachment.Wwn, volume.Wwn) {
+			info.Attached = true
+		}
+	}
+	if !info.Attached {
+		info.Attached = isVolumeInUse(volume)
+	}
+	return info
+}
+
+// Tests if the multipath device or any path of the volume is mounted, open
+// or held by other devices than the multipath device
+func isVolumeInUse(volume connector.AttachedVolume) bool {
+	var devices, ignored []string
+	if volume.Multipath != "" {
+		devices = append(devices, volume.Multipath)
+		ignored = append(ignored, linux.GetDeviceName(volume.Multipath))
+	}
+	for _, path := range volume.Paths {
+		devices = append(devices, path.Device)
+	}
+	usages, err := linux.GetDeviceUsages(devices, ignored...)
+	if err != nil {
+		log.WithError(err).Debugf("Unable to check the usage of %s.", devices)
+		return false
+	}
+	for _, usage := range usages {
+		if usage.InUse() {
+			return true
+		}
+	}
+	return false
+}
+
+// BeautifyLunInfo outputs the LUNs with their paths.
+func BeautifyLunInfo(infos []LunInfo) {
+	if IsStructuredOutput() {
+		PrintOutput(KindLunInfo, infos)
+		return
+	}
+	for _, info := range infos {
+		attached := "no, visible only"
+		if info.Attached {
+			attached = "yes"
+		}
+		fmt.Printf(LunInfoFormat, info.Wwn, info.Lun, attached, info.Multipath, info.Size,
+			volumeAccess(info.AttachedVolume), info.Inquiry.Vendor, info.Inquiry.Product,
+			info.Inquiry.Revision, info.Inquiry.DeviceType, info.Inquiry.Serial, info.State,
+			beautifyPaths(info.Paths))
+	}
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Queries the LUN of the fake root, the structured output is returned
+func lunInfo(t *testing.T, args ...string) ([]LunInfo, error) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	buf, restore := captureOutput(JSONOutput)
+	defer restore()
+	err := HandleInfo(append([]string{"lun"}, args...)...)
+	var output struct {
+		Kind string    `json:"kind"`
+		Data []LunInfo `json:"data"`
+	}
+	assert.Nil(t, json.NewDecoder(buf).Decode(&output))
+	assert.Equal(t, KindLunInfo, output.Kind)
+	return output.Data, err
+}
+
+func TestHandleLunInfoISCSI(t *testing.T) {
+	clearManifest()
+	infos, err := lunInfo(t, "10.64.77.10", "3")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 1)
+	info := infos[0]
+	assert.Equal(t, "36001405a1b2c3d4e5f60718293a4b5c6", info.Wwn)
+	assert.False(t, info.Attached)
+	assert.False(t, info.ReadOnly)
+	assert.Equal(t, int64(3221225472), info.Size)
+	assert.Equal(t, linux.InquiryData{Vendor: "LIO-ORG", Product: "block1", Revision: "4.0",
+		Serial: "a1b2c3d4-e5f6-0718-293a-4b5c6a1b2c3d"}, info.Inquiry)
+	// Both the paths of the LUN are reported
+	assert.Len(t, info.Paths, 2)
+	assert.Equal(t, connector.VolumeDegraded, info.State)
+}
+
+func TestHandleLunInfoRecorded(t *testing.T) {
+	clearManifest()
+	defer clearManifest()
+	manifest.Record(manifest.Attachment{Key: "key1", Wwn: "36001405A1B2C3D4E5F60718293A4B5C6"})
+	infos, err := lunInfo(t, "10.64.78.10:3260", "3")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 1)
+	assert.True(t, infos[0].Attached)
+}
+
+func TestHandleLunInfoFC(t *testing.T) {
+	clearManifest()
+	infos, err := lunInfo(t, "50:06:01:6d:09:20:09:25", "10")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 1)
+	// The multipath map alone is not taken as attached
+	assert.Equal(t, "/dev/dm-2", infos[0].Multipath)
+	assert.False(t, infos[0].Attached)
+}
+
+func TestGetLunInfoInUse(t *testing.T) {
+	// sdab is used as swap
+	volume := connector.AttachedVolume{Wwn: "36001405f3c9a1b2c3d4e5f60718293ab",
+		Paths: []connector.PathInfo{{Device: "/dev/sdab"}}}
+	assert.True(t, getLunInfo(volume, nil).Attached)
+	volume.Paths[0].Device = "/dev/sdq"
+	assert.False(t, getLunInfo(volume, nil).Attached)
+}
+
+func TestHandleLunInfoNotVisible(t *testing.T) {
+	infos, err := lunInfo(t, "10.64.77.10", "3,99")
+	assert.Error(t, err)
+	assert.Len(t, infos, 1)
+}
+
+func TestHandleLunInfoInvalid(t *testing.T) {
+	assert.Error(t, HandleLunInfo("25"))
+	assert.Error(t, HandleLunInfo("nqn.2014-08.org.example:subsys1", "25"))
+	assert.Error(t, HandleLunInfo("10.64.77.10", "a-b"))
+	assert.Error(t, HandleInfo("disk"))
+}
+
+func TestHandleLunInfoText(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	assert.Nil(t, HandleInfo("lun", "fd00:10::20", "5"))
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+)
+
+// Results of restoring an attachment
+const (
+	RestoreAttached = "attached"
+	RestoreRestored = "restored"
+	RestoreFailed   = "failed"
+)
+
+// SetManifestPath sets the state file recording the attached volumes, the
+// default one is used if path is empty
+func SetManifestPath(path string) {
+	if path != "" {
+		manifest.SetPath(path)
+	}
+}
+
+// recordAttachment records the volume connected with property, the connect
+// is not failed if the manifest can not be written
+func recordAttachment(property connector.ConnectionProperty, info connector.VolumeInfo) {
+	if info.Wwn == "" && len(info.Paths) == 0 {
+		return
+	}
+	if err := manifest.Record(manifest.NewAttachment(property, info)); err != nil {
+		log.WithError(err).Warnf("Unable to record the attachment in %s.", manifest.GetPath())
+	}
+}
+
+// forgetAttachments removes the attachments of keys from the manifest
+func forgetAttachments(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	if err := manifest.Remove(keys...); err != nil {
+		log.WithError(err).Warnf("Unable to remove the attachments %s from %s.", keys, manifest.GetPath())
+	}
+}
+
+// HandleRestore re-attaches the volumes recorded in the manifest, e.g., after
+// reboot. The volumes still attached are skipped, and a volume is failed if
+// its wwn is not the recorded one.
+func HandleRestore() error {
+	attachments, err := manifest.Load()
+	if err != nil {
+		log.WithError(err).Error("Unable to load the manifest.")
+		return err
+	}
+	ctx, cancel := newContext()
+	defer cancel()
+	var results []RestoreResult
+	var failed []string
+	for _, attachment := range attachments {
+		result := restoreAttachment(ctx, attachment)
+		if result.Status == RestoreFailed {
+			log.WithField("error", result.Error).Errorf("Unable to restore %s.", attachment.Key)
+			failed = append(failed, attachment.Key)
+		}
+		results = append(results, result)
+	}
+	BeautifyRestoreResults(results)
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to restore %s", failed)
+	}
+	return nil
+}
+
+// restoreAttachment connects the recorded volume again, the CHAP credentials
+// of the command are used for iSCSI. The volume is disconnected again if it
+// is not the recorded one, as the LUN may be mapped to another volume since.
+func restoreAttachment(ctx context.Context, attachment manifest.Attachment) RestoreResult {
+	result := RestoreResult{
+		Key:       attachment.Key,
+		Wwn:       attachment.Wwn,
+		Multipath: attachment.Multipath,
+		Paths:     attachment.Paths,
+	}
+	if status, _ := manifest.Verify(attachment); status == manifest.StatusAttached {
+		result.Status = RestoreAttached
+		return result
+	}
+	property := attachment.Property
+	var volumeConnector connector.Interface
+	switch property.StorageProtocol {
+	case connector.IscsiProtocol:
+		property.SessionAuth = sessionAuth
+		property.DiscoveryAuth = discoveryAuth
+		volumeConnector = iscsiConnector
+	case connector.FcProtocol:
+		volumeConnector = fcConnector
+	case connector.NVMeTCPProtocol:
+		volumeConnector = nvmeConnector
+	default:
+		result.Status = RestoreFailed
+		result.Error = fmt.Sprintf("storage protocol %s is not supported", property.StorageProtocol)
+		return result
+	}
+	info, err := volumeConnector.ConnectVolumeContext(ctx, property)
+	if err == nil && attachment.Wwn != "" && !strings.EqualFold(info.Wwn, attachment.Wwn) {
+		err = fmt.Errorf("the volume attached is of wwn %s rather than %s", info.Wwn, attachment.Wwn)
+		if disconnectErr := volumeConnector.DisconnectVolumeContext(ctx, property); disconnectErr != nil {
+			log.WithError(disconnectErr).Errorf("Unable to disconnect the volume of wwn %s.", info.Wwn)
+			err = fmt.Errorf("%s, unable to disconnect it: %s", err, disconnectErr)
+		}
+	}
+	if err != nil {
+		result.Status = RestoreFailed
+		result.Error = err.Error()
+		return result
+	}
+	recordAttachment(attachment.Property, info)
+	result.Status = RestoreRestored
+	result.Multipath = info.Multipath
+	result.Paths = info.Paths
+	return result
+}
+
+// BeautifyRestoreResults outputs the result of each recorded attachment.
+func BeautifyRestoreResults(results []RestoreResult) {
+	if IsStructuredOutput() {
+		PrintOutput(KindRestoreResults, results)
+		return
+	}
+	if len(results) <= 0 {
+		fmt.Printf("No attachment is recorded in %s.\n", manifest.GetPath())
+		return
+	}
+	fmt.Println("Restore Results:")
+	for _, result := range results {
+		device := result.Multipath
+		if device == "" {
+			device = strings.Join(result.Paths, ",")
+		}
+		if result.Status == RestoreFailed {
+			fmt.Printf("  %s: %s, %s\n", result.Key, result.Status, result.Error)
+		} else {
+			fmt.Printf("  %s: %s, %s\n", result.Key, result.Status, device)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts the test with an empty manifest
+func clearManifest() {
+	os.Remove(manifest.GetPath())
+}
+
+var nvmeAttachment = manifest.Attachment{
+	Key: "nvme:nqn.2014-08.org.example:subsys1:0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d",
+	Property: connector.ConnectionProperty{
+		StorageProtocol: connector.NVMeTCPProtocol,
+		TargetNqn:       "nqn.2014-08.org.example:subsys1",
+		TargetPortals:   []string{"10.0.0.1"},
+		VolumeUuid:      "0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d",
+	},
+	Multipath: "/dev/nvme9n1",
+}
+
+func TestHandleConnectNVMeRecorded(t *testing.T) {
+	clearManifest()
+	defer clearManifest()
+	SetNVMeConnector(&FakeNVMeTCPConnector{})
+	assert.Nil(t, HandleConnect("nqn.2014-08.org.example:subsys1", "10.0.0.1", "0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d"))
+	attachments, _ := manifest.Load()
+	assert.Len(t, attachments, 1)
+	assert.Equal(t, nvmeAttachment.Key, attachments[0].Key)
+	assert.Equal(t, "/dev/nvme0n1", attachments[0].Multipath)
+
+	assert.Nil(t, HandleDisconnect("nqn.2014-08.org.example:subsys1", "10.0.0.1", "0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d"))
+	attachments, _ = manifest.Load()
+	assert.Empty(t, attachments)
+}
+
+func TestHandleConnectFailedNotRecorded(t *testing.T) {
+	clearManifest()
+	defer clearManifest()
+	SetISCSIConnector(&FakeISCSIConnector{})
+	HandleISCSIConnect("10.244.244.244", "4")
+	attachments, _ := manifest.Load()
+	assert.Empty(t, attachments)
+}
+
+func TestHandleRestore(t *testing.T) {
+	clearManifest()
+	defer clearManifest()
+	SetNVMeConnector(&FakeNVMeTCPConnector{})
+	manifest.Record(nvmeAttachment)
+	assert.Nil(t, HandleRestore())
+	attachments, _ := manifest.Load()
+	assert.Equal(t, "/dev/nvme0n1", attachments[0].Multipath)
+
+	// nvme0n1 exists, nothing to restore
+	attachment := nvmeAttachment
+	attachment.Multipath = "/dev/nvme0n1"
+	manifest.Record(attachment)
+	buf, restore := captureOutput(JSONOutput)
+	defer restore()
+	assert.Nil(t, HandleRestore())
+	var output struct {
+		Kind string          `json:"kind"`
+		Data []RestoreResult `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &output))
+	assert.Equal(t, KindRestoreResults, output.Kind)
+	assert.Equal(t, RestoreAttached, output.Data[0].Status)
+}
+
+func TestHandleRestoreWwnChanged(t *testing.T) {
+	clearManifest()
+	defer clearManifest()
+	fake := &FakeNVMeTCPConnector{}
+	SetNVMeConnector(fake)
+	attachment := nvmeAttachment
+	attachment.Wwn = "eui.6e3d1a8a9c3b4d5e8f0011223344aabb"
+	manifest.Record(attachment)
+	manifest.Record(manifest.Attachment{Key: "unknown", Paths: []string{"/dev/sdz"}})
+	assert.Error(t, HandleRestore())
+	attachments, _ := manifest.Load()
+	assert.Equal(t, "/dev/nvme9n1", attachments[0].Multipath)
+	// The volume of another wwn is not left attached
+	assert.True(t, fake.disconnected)
+	assert.Equal(t, attachment.Property.VolumeUuid, fake.property.VolumeUuid)
+}
+
+func TestHandleRestoreEmpty(t *testing.T) {
+	clearManifest()
+	assert.Nil(t, HandleRestore())
+}
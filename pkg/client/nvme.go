@@ -0,0 +1,128 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package client
+
+import (
+	"fmt"
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/manifest"
+	"regexp"
+)
+
+var nvmeConnector = connector.NewNVMeTCPConnector()
+
+// SetNVMeConnector sets the connector for NVMe/TCP connection
+func SetNVMeConnector(nvme connector.NVMeTCPInterface) {
+	nvmeConnector = nvme
+}
+
+// Convert2NVMeConnectionProperty converts nqn, portals and namespace id into ConnnectionProperty,
+// the namespace id is either a NGUID or a UUID.
+func Convert2NVMeConnectionProperty(nqn string, portals []string, namespaceID string) (connector.ConnectionProperty, error) {
+	var property connector.ConnectionProperty
+	property.StorageProtocol = connector.NVMeTCPProtocol
+	property.TargetNqn = nqn
+	property.TargetPortals = portals
+	property.Force = forceDisconnect
+	if IsUUIDLike(namespaceID) {
+		property.VolumeUuid = namespaceID
+	} else if IsNguidLike(namespaceID) {
+		property.VolumeNguid = namespaceID
+	} else {
+		return property, fmt.Errorf("%s does not look like a namespace NGUID or UUID", namespaceID)
+	}
+	return property, nil
+}
+
+// parseNVMeArgs parses args in format of <nqn> <portal>... <nguid|uuid>
+func parseNVMeArgs(args ...string) (connector.ConnectionProperty, error) {
+	if len(args) <= 2 {
+		return connector.ConnectionProperty{}, fmt.Errorf("target NQN, portal and namespace NGUID/UUID are required")
+	}
+	return Convert2NVMeConnectionProperty(args[0], args[1:len(args)-1], args[len(args)-1])
+}
+
+// HandleNVMeConnect handles the connection of NVMe/TCP namespace
+func HandleNVMeConnect(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	conn, err := parseNVMeArgs(args...)
+	if err != nil {
+		log.WithError(err).Error("Unsupported parameters.")
+		return err
+	}
+	info, err := nvmeConnector.ConnectVolumeContext(ctx, conn)
+	if err != nil {
+		log.WithError(err).Error("Unable to connect the NVMe namespace.")
+		return err
+	}
+	recordAttachment(conn, info)
+	BeautifyVolumeInfo(info)
+	return nil
+}
+
+// HandleNVMeDisconnect disconnects the NVMe namespace from local host.
+func HandleNVMeDisconnect(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	conn, err := parseNVMeArgs(args...)
+	if err == nil {
+		err = nvmeConnector.DisconnectVolumeContext(ctx, conn)
+	}
+	if err == nil {
+		forgetAttachments(manifest.Key(conn))
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to disconnect the NVMe namespace.")
+	}
+	return err
+}
+
+// HandleNVMeExtend handle the request to extend the NVMe namespace.
+func HandleNVMeExtend(args ...string) error {
+	ctx, cancel := newContext()
+	defer cancel()
+	conn, err := parseNVMeArgs(args...)
+	if err != nil {
+		log.WithError(err).Error("Unsupported parameters.")
+		return err
+	}
+	info, err := nvmeConnector.ExtendVolumeContext(ctx, conn)
+	if err != nil {
+		log.WithError(err).Error("Unable to extend the NVMe namespace.")
+		return err
+	}
+	BeautifyExtendInfo(info)
+	return nil
+}
+
+// IsNqnLike tests if *data* is a NVMe qualified name.
+func IsNqnLike(data string) bool {
+	m, _ := regexp.MatchString("^nqn\\.\\S+$", data)
+	return m
+}
+
+// IsUUIDLike tests if *data* is a namespace UUID.
+func IsUUIDLike(data string) bool {
+	m, _ := regexp.MatchString("^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}$", data)
+	return m
+}
+
+// IsNguidLike tests if *data* is a namespace NGUID.
+func IsNguidLike(data string) bool {
+	m, _ := regexp.MatchString("^[0-9a-fA-F]{32}$", data)
+	return m
+}
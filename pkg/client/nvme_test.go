@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type FakeNVMeTCPConnector struct {
+	property     connector.ConnectionProperty
+	disconnected bool
+}
+
+func (fake *FakeNVMeTCPConnector) GetHostInfo() (connector.HostInfo, error) {
+	return connector.HostInfo{}, nil
+}
+
+func (fake *FakeNVMeTCPConnector) ConnectVolume(connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	fake.property = connectionProperty
+	return connector.VolumeInfo{Multipath: "/dev/nvme0n1", Paths: []string{"/dev/nvme0"}}, nil
+}
+
+func (fake *FakeNVMeTCPConnector) DisconnectVolume(connectionProperty connector.ConnectionProperty) error {
+	fake.property = connectionProperty
+	fake.disconnected = true
+	return nil
+}
+
+func (fake *FakeNVMeTCPConnector) ExtendVolume(connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	fake.property = connectionProperty
+	return connector.ExtendInfo{}, nil
+}
+
+func (fake *FakeNVMeTCPConnector) ConnectVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	return fake.ConnectVolume(connectionProperty)
+}
+
+func (fake *FakeNVMeTCPConnector) DisconnectVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) error {
+	return fake.DisconnectVolume(connectionProperty)
+}
+
+func (fake *FakeNVMeTCPConnector) ExtendVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return fake.ExtendVolume(connectionProperty)
+}
+
+func (fake *FakeNVMeTCPConnector) ConnectPortal(targetPortal string, targetNqn string) error {
+	return nil
+}
+
+func (fake *FakeNVMeTCPConnector) DiscoverPortal(targetPortal ...string) []model.NVMeDiscoveryEntry {
+	return []model.NVMeDiscoveryEntry{}
+}
+
+func TestConvert2NVMeConnectionProperty(t *testing.T) {
+	prop, err := Convert2NVMeConnectionProperty("nqn.2014-08.org.example:subsys1",
+		[]string{"10.0.0.1"}, "6E3D1A8A9C3B4D5E8F0011223344AABB")
+	assert.Nil(t, err)
+	assert.Equal(t, connector.NVMeTCPProtocol, prop.StorageProtocol)
+	assert.Equal(t, "6E3D1A8A9C3B4D5E8F0011223344AABB", prop.VolumeNguid)
+	prop, err = Convert2NVMeConnectionProperty("nqn.2014-08.org.example:subsys1",
+		[]string{"10.0.0.1"}, "0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d")
+	assert.Nil(t, err)
+	assert.Equal(t, "0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", prop.VolumeUuid)
+	_, err = Convert2NVMeConnectionProperty("nqn.2014-08.org.example:subsys1",
+		[]string{"10.0.0.1"}, "11")
+	assert.Error(t, err)
+}
+
+func TestHandleConnectNVMe(t *testing.T) {
+	fake := &FakeNVMeTCPConnector{}
+	SetNVMeConnector(fake)
+	err := HandleConnect("nqn.2014-08.org.example:subsys1", "10.0.0.1:4420", "10.0.0.2",
+		"6e3d1a8a9c3b4d5e8f0011223344aabb")
+	assert.Nil(t, err)
+	assert.Equal(t, "nqn.2014-08.org.example:subsys1", fake.property.TargetNqn)
+	assert.Equal(t, []string{"10.0.0.1:4420", "10.0.0.2"}, fake.property.TargetPortals)
+}
+
+func TestHandleConnectNVMeNoPortal(t *testing.T) {
+	SetNVMeConnector(&FakeNVMeTCPConnector{})
+	err := HandleConnect("nqn.2014-08.org.example:subsys1", "6e3d1a8a9c3b4d5e8f0011223344aabb")
+	assert.Error(t, err)
+}
+
+func TestHandleDisconnectNVMe(t *testing.T) {
+	fake := &FakeNVMeTCPConnector{}
+	SetNVMeConnector(fake)
+	err := HandleDisconnect("nqn.2014-08.org.example:subsys1", "10.0.0.1",
+		"0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d")
+	assert.Nil(t, err)
+	assert.Equal(t, "0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", fake.property.VolumeUuid)
+}
+
+func TestHandleExtendNVMe(t *testing.T) {
+	fake := &FakeNVMeTCPConnector{}
+	SetNVMeConnector(fake)
+	err := HandleExtend("nqn.2014-08.org.example:subsys1", "10.0.0.1", "invalid")
+	assert.Error(t, err)
+	err = HandleExtend("nqn.2014-08.org.example:subsys1", "10.0.0.1",
+		"6e3d1a8a9c3b4d5e8f0011223344aabb")
+	assert.Nil(t, err)
+}
+
+func TestIsNqnLike(t *testing.T) {
+	assert.True(t, IsNqnLike("nqn.2014-08.org.example:subsys1"))
+	assert.False(t, IsNqnLike("iqn.1992-04.com.emc:cx.fnm00150600267.a0"))
+	assert.False(t, IsNqnLike("5006016d09200925"))
+}
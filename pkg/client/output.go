@@ -0,0 +1,183 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TextOutput = "text"
+	JSONOutput = "json"
+	YAMLOutput = "yaml"
+)
+
+// SchemaVersion is the version of the structured output, it is bumped when
+// any field is renamed or removed.
+const SchemaVersion = "v1"
+
+// Kinds of the structured output
+const (
+	KindVolumeInfo       = "VolumeInfo"
+	KindExtendInfo       = "ExtendInfo"
+	KindHostInfo         = "HostInfo"
+	KindDisconnectResult = "DisconnectResult"
+	KindLoginResults     = "LoginResults"
+	KindRestoreResults   = "RestoreResults"
+	KindVolumeList       = "VolumeList"
+	KindLunInfo          = "LunInfo"
+	KindError            = "Error"
+)
+
+// Output is the envelope of the json/yaml output
+type Output struct {
+	SchemaVersion string      `json:"schemaVersion"`
+	Kind          string      `json:"kind"`
+	Data          interface{} `json:"data,omitempty"`
+	Error         *ErrorInfo  `json:"error,omitempty"`
+}
+
+// ErrorInfo describes the failure of the command
+type ErrorInfo struct {
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// DisconnectResult describes the disconnected device or target
+type DisconnectResult struct {
+	Arguments    []string `json:"arguments"`
+	Disconnected bool     `json:"disconnected"`
+}
+
+// RestoreResult describes a recorded attachment after restore
+type RestoreResult struct {
+	Key       string   `json:"key"`
+	Wwn       string   `json:"wwn"`
+	Status    string   `json:"status"`
+	Multipath string   `json:"multipath,omitempty"`
+	Paths     []string `json:"paths"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// VolumeList describes the volumes attached to the host, and the recorded
+// attachments whose devices are drifted or missing
+type VolumeList struct {
+	Volumes     []connector.AttachedVolume `json:"volumes"`
+	Attachments []AttachmentStatus         `json:"attachments,omitempty"`
+}
+
+// AttachmentStatus describes a recorded attachment which is not attached as
+// recorded
+type AttachmentStatus struct {
+	Key    string `json:"key"`
+	Wwn    string `json:"wwn"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// LunInfo describes a LUN found via the targets, it is attached if it is in
+// a multipath map or recorded in the manifest, otherwise merely visible
+type LunInfo struct {
+	connector.AttachedVolume
+	Attached bool              `json:"attached"`
+	Inquiry  linux.InquiryData `json:"inquiry"`
+}
+
+var outputFormat = TextOutput
+
+// Structured output is written to stdout
+var stdout io.Writer = os.Stdout
+
+// SetOutputFormat sets the output format, one of text, json and yaml
+func SetOutputFormat(format string) error {
+	switch format {
+	case "", TextOutput:
+		outputFormat = TextOutput
+	case JSONOutput, YAMLOutput:
+		outputFormat = format
+	default:
+		return fmt.Errorf("unsupported output format %s, use one of text, json and yaml", format)
+	}
+	return nil
+}
+
+// IsStructuredOutput returns true if the output is json or yaml
+func IsStructuredOutput() bool {
+	return outputFormat != TextOutput
+}
+
+// PrintOutput writes data in the structured format, a yaml document or a
+// json object per call
+func PrintOutput(kind string, data interface{}) error {
+	return printOutput(Output{SchemaVersion: SchemaVersion, Kind: kind, Data: data})
+}
+
+// ReportError writes the structured error when the output is json or yaml,
+// err is returned as is.
+func ReportError(err error) error {
+	if err == nil || !IsStructuredOutput() {
+		return err
+	}
+	printOutput(Output{
+		SchemaVersion: SchemaVersion,
+		Kind:          KindError,
+		Error:         &ErrorInfo{Message: err.Error(), ExitCode: 1},
+	})
+	return err
+}
+
+func printOutput(output Output) error {
+	var data []byte
+	var err error
+	if outputFormat == YAMLOutput {
+		data, err = marshalYAML(output)
+	} else {
+		data, err = json.MarshalIndent(output, "", "  ")
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Unable to format the output of %s.", output.Kind)
+		return err
+	}
+	if outputFormat == YAMLOutput {
+		// Multiple yaml documents are separated by "---"
+		_, err = fmt.Fprintf(stdout, "---\n%s", data)
+	} else {
+		_, err = fmt.Fprintf(stdout, "%s\n", data)
+	}
+	return err
+}
+
+// Encodes the output as YAML with the field names and order of encoding/json,
+// so the json tags apply to YAML as well. YAML is a superset of JSON, and
+// yaml.MapSlice keeps the key order of the JSON objects.
+func marshalYAML(output Output) ([]byte, error) {
+	data, err := json.Marshal(output)
+	if err != nil {
+		return nil, err
+	}
+	var document yaml.MapSlice
+	if err = yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(document)
+}
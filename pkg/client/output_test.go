@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+// Capture the structured output with format
+func captureOutput(format string) (*bytes.Buffer, func()) {
+	buf := &bytes.Buffer{}
+	previous := stdout
+	stdout = buf
+	SetOutputFormat(format)
+	return buf, func() {
+		stdout = previous
+		SetOutputFormat(TextOutput)
+	}
+}
+
+func TestSetOutputFormat(t *testing.T) {
+	defer SetOutputFormat(TextOutput)
+	assert.Nil(t, SetOutputFormat("json"))
+	assert.True(t, IsStructuredOutput())
+	assert.Nil(t, SetOutputFormat(""))
+	assert.False(t, IsStructuredOutput())
+	assert.Error(t, SetOutputFormat("xml"))
+}
+
+func TestBeautifyVolumeInfoJSON(t *testing.T) {
+	buf, restore := captureOutput(JSONOutput)
+	defer restore()
+	BeautifyVolumeInfo(connector.VolumeInfo{
+		Wwn:   "350060160b6e00e5a50060160b6e11317",
+		Paths: []string{"/dev/sdb"},
+		LoginResults: []connector.LoginResult{
+			{TargetPortal: "192.168.3.50:3260", Status: connector.LoginFailed, ExitCode: 8,
+				Err: fmt.Errorf("connection timed out")},
+		},
+	})
+	var output map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &output))
+	assert.Equal(t, SchemaVersion, output["schemaVersion"])
+	assert.Equal(t, KindVolumeInfo, output["kind"])
+	data := output["data"].(map[string]interface{})
+	assert.Equal(t, "350060160b6e00e5a50060160b6e11317", data["wwn"])
+	result := data["loginResults"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "failed", result["status"])
+	assert.Equal(t, 8.0, result["exitCode"])
+	assert.Equal(t, "connection timed out", result["error"])
+}
+
+func TestBeautifyExtendInfoYAML(t *testing.T) {
+	buf, restore := captureOutput(YAMLOutput)
+	defer restore()
+	BeautifyExtendInfo(connector.ExtendInfo{Wwn: "wwn1", Paths: []string{"/dev/sdb"},
+		OriginalSize: 1024, NewSize: 2048})
+	assert.Equal(t, `---
+schemaVersion: v1
+kind: ExtendInfo
+data:
+  wwn: wwn1
+  multipath: ""
+  paths:
+  - /dev/sdb
+  originalSize: 1024
+  newSize: 2048
+`, buf.String())
+}
+
+// The strings which look like other scalars are quoted, and the escaped
+// strings are decoded as is
+func TestPrintOutputYAMLQuoted(t *testing.T) {
+	buf, restore := captureOutput(YAMLOutput)
+	defer restore()
+	data := map[string]string{"access": "yes", "lun": "11", "state": "it's \"ok\"\n\ttab: \\"}
+	PrintOutput(KindVolumeInfo, data)
+	assert.Contains(t, buf.String(), "  access: \"yes\"\n  lun: \"11\"\n")
+	var output struct {
+		Data map[string]string `yaml:"data"`
+	}
+	assert.Nil(t, yaml.Unmarshal(buf.Bytes(), &output))
+	assert.Equal(t, data, output.Data)
+}
+
+func TestReportError(t *testing.T) {
+	buf, restore := captureOutput(JSONOutput)
+	defer restore()
+	err := ReportError(fmt.Errorf("target IP or wwn is required"))
+	assert.Error(t, err)
+	var output Output
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &output))
+	assert.Equal(t, KindError, output.Kind)
+	assert.Equal(t, "target IP or wwn is required", output.Error.Message)
+	assert.Equal(t, 1, output.Error.ExitCode)
+	assert.Nil(t, ReportError(nil))
+}
+
+func TestHandleDisconnectJSON(t *testing.T) {
+	buf, restore := captureOutput(JSONOutput)
+	defer restore()
+	SetISCSIConnector(&FakeISCSIConnector{})
+	assert.Nil(t, HandleDisconnect("10.10.10.10", "15"))
+	var output struct {
+		Kind string
+		Data DisconnectResult
+	}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &output))
+	assert.Equal(t, KindDisconnectResult, output.Kind)
+	assert.Equal(t, []string{"10.10.10.10", "15"}, output.Data.Arguments)
+	assert.True(t, output.Data.Disconnected)
+}
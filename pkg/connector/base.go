@@ -17,39 +17,150 @@ limitations under the License.
 package connector
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/peter-wangxu/goock/pkg/exec"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
 	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
 	"github.com/sirupsen/logrus"
 )
 
 type StringEnum string
 
+// Intervals to wait for the multipath map after healing
+var healWait = 3
+
 const (
 	ReadWrite StringEnum = "rw"
 	ReadOnly  StringEnum = "ro"
 )
 
+// Policies when the multipath map is still missing or incomplete after
+// the healing
+const (
+	// Use the single paths, or the incomplete map
+	MultipathFallback StringEnum = "fallback"
+	// Fail the connect
+	MultipathRequired StringEnum = "required"
+)
+
 const (
-	IscsiProtocol StringEnum = "iscsi"
-	FcProtocol    StringEnum = "fibre_channel"
+	IscsiProtocol   StringEnum = "iscsi"
+	FcProtocol      StringEnum = "fibre_channel"
+	NVMeTCPProtocol StringEnum = "nvme_tcp"
 )
 
+// CHAPCredential holds the iSCSI CHAP credential, the *In fields are only
+// for mutual CHAP, which the target uses to authenticate itself to the host.
+type CHAPCredential struct {
+	Username   string `json:"username,omitempty"`
+	Secret     string `json:"secret,omitempty"`
+	UsernameIn string `json:"usernameIn,omitempty"`
+	SecretIn   string `json:"secretIn,omitempty"`
+}
+
+// IsEmpty returns true if no CHAP credential is specified
+func (c CHAPCredential) IsEmpty() bool {
+	return c.Username == "" && c.Secret == ""
+}
+
+// IsMutual returns true if the mutual CHAP credential is specified
+func (c CHAPCredential) IsMutual() bool {
+	return c.UsernameIn != "" && c.SecretIn != ""
+}
+
+// Validate returns an error if the credential is half filled: a username
+// without the secret or vice versa, or the mutual credential without the
+// credential of the host.
+func (c CHAPCredential) Validate() error {
+	if (c.Username == "") != (c.Secret == "") {
+		return fmt.Errorf("the CHAP username and secret must be given together")
+	}
+	if (c.UsernameIn == "") != (c.SecretIn == "") {
+		return fmt.Errorf("the mutual CHAP username and secret must be given together")
+	}
+	if c.IsMutual() && c.IsEmpty() {
+		return fmt.Errorf("the mutual CHAP requires the CHAP username and secret as well")
+	}
+	return nil
+}
+
+// ValidateCHAPCredentials validates the session and discovery credentials,
+// see CHAPCredential.Validate
+func ValidateCHAPCredentials(session CHAPCredential, discovery CHAPCredential) error {
+	if err := session.Validate(); err != nil {
+		return fmt.Errorf("invalid session credential: %s", err)
+	}
+	if err := discovery.Validate(); err != nil {
+		return fmt.Errorf("invalid discovery credential: %s", err)
+	}
+	return nil
+}
+
+// String masks the secrets, so the credential is safe to be logged
+func (c CHAPCredential) String() string {
+	mask := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "***"
+	}
+	return fmt.Sprintf("{Username:%s Secret:%s UsernameIn:%s SecretIn:%s}",
+		c.Username, mask(c.Secret), c.UsernameIn, mask(c.SecretIn))
+}
+
 type ConnectionProperty struct {
 	// Only for iscsi
-	TargetIqns    []string
-	TargetPortals []string
-	TargetLuns    []int
+	TargetIqns    []string `json:"targetIqns,omitempty"`
+	TargetPortals []string `json:"targetPortals,omitempty"`
+	TargetLuns    []int    `json:"targetLuns,omitempty"`
+	// CHAP credential used for login to target sessions
+	SessionAuth CHAPCredential `json:"sessionAuth"`
+	// CHAP credential used for sendtargets discovery
+	DiscoveryAuth CHAPCredential `json:"discoveryAuth"`
+	// Number of targets to login concurrently, 1(serial login) if not set
+	LoginParallelism int `json:"loginParallelism,omitempty"`
+	// Minimum number of logged in paths required by ConnectVolume, 1 if not set
+	MinLoginPaths int `json:"minLoginPaths,omitempty"`
+	// Retries of a failed login, DefaultLoginRetries if not set, NoLoginRetry
+	// to disable the retry
+	LoginRetries int `json:"loginRetries,omitempty"`
+	// Interval before the first retry, doubled after each retry,
+	// DefaultLoginRetryInterval if not set
+	LoginRetryInterval time.Duration `json:"loginRetryInterval,omitempty"`
+	// Keep the target sessions after DisconnectVolume even if no device left
+	KeepSessions bool `json:"keepSessions,omitempty"`
+	// iSCSI ifaces or network interfaces to bind the sessions to, like iface0
+	// or eth1, the sessions are not bound to any iface if not set
+	Ifaces []string `json:"ifaces,omitempty"`
+	// Transport of the ifaces, like TransportISER, TransportTCP if not set
+	Transport StringEnum `json:"transport,omitempty"`
 	// Only for fibre channel
-	TargetWwns []string
-	TargetLun  int
+	TargetWwns []string `json:"targetWwns,omitempty"`
+	TargetLun  int      `json:"targetLun,omitempty"`
+	// Only for NVMe over TCP, the namespace is located by either NGUID or UUID
+	TargetNqn   string `json:"targetNqn,omitempty"`
+	VolumeNguid string `json:"volumeNguid,omitempty"`
+	VolumeUuid  string `json:"volumeUuid,omitempty"`
 	// Shared by fibre change and iscsi
-	StorageProtocol StringEnum
-	AccessMode      StringEnum
+	StorageProtocol StringEnum `json:"storageProtocol"`
+	AccessMode      StringEnum `json:"accessMode,omitempty"`
+	// MultipathFallback if not set
+	MultipathPolicy StringEnum `json:"multipathPolicy,omitempty"`
+	// Remove the devices in DisconnectVolume even if they are mounted, held,
+	// opened or used as swap
+	Force bool `json:"force,omitempty"`
 }
 
 var executor = exec.New()
@@ -65,8 +176,14 @@ func (prop ConnectionProperty) IsEmpty() error {
 			return fmt.Errorf("An empty ConnectionProperty is specified, forget target IPs or LUN id?")
 		}
 	} else if prop.StorageProtocol == FcProtocol {
-		if len(prop.TargetWwns) == 0 || len(prop.TargetLuns) == 0 {
-			return fmt.Errorf("An empty ConnectionProperty is specified, forget target wwns or LUN id?")
+		// FC uses TargetLun, which is valid to be 0
+		if len(prop.TargetWwns) == 0 {
+			return fmt.Errorf("An empty ConnectionProperty is specified, forget target wwns?")
+		}
+	} else if prop.StorageProtocol == NVMeTCPProtocol {
+		if len(prop.TargetPortals) == 0 || prop.TargetNqn == "" ||
+			(prop.VolumeNguid == "" && prop.VolumeUuid == "") {
+			return fmt.Errorf("An empty ConnectionProperty is specified, forget target portals, NQN or namespace NGUID/UUID?")
 		}
 	} else {
 		return fmt.Errorf("Unknown storage protocol specified.")
@@ -76,28 +193,43 @@ func (prop ConnectionProperty) IsEmpty() error {
 }
 
 type HostInfo struct {
-	Initiator string
+	Initiator string `json:"initiator"`
+	// HostNqn: the NVMe qualified name of the host
+	HostNqn string `json:"hostNqn"`
 	// Wwnns: the node name of the host HBA
-	Wwnns []string
+	Wwnns []string `json:"wwnns"`
 	// Wwpns: the port name of the HOST HBA
-	Wwpns []string
+	Wwpns []string `json:"wwpns"`
 	// TargetWwnns: the node name of connected targets
-	TargetWwnns []string
+	TargetWwnns []string `json:"targetWwnns"`
 	// TargetWwpns: the port name of connected targets
-	TargetWwpns []string
+	TargetWwpns []string `json:"targetWwpns"`
 	// Connected target portals
-	TargetPortals []string
-	TargetIqns    []string
-	Ip            string
-	Hostname      string
-	OSType        string
+	TargetPortals []string `json:"targetPortals"`
+	TargetIqns    []string `json:"targetIqns"`
+	Ip            string   `json:"ip"`
+	Hostname      string   `json:"hostname"`
+	OSType        string   `json:"osType"`
 }
 
 type VolumeInfo struct {
-	MultipathId string
-	Paths       []string
-	Wwn         string
-	Multipath   string
+	MultipathId string   `json:"multipathId"`
+	Paths       []string `json:"paths"`
+	Wwn         string   `json:"wwn"`
+	Multipath   string   `json:"multipath"`
+	// Only for iscsi, the login result of each discovered target portal
+	LoginResults []LoginResult `json:"loginResults,omitempty"`
+	// Only for ConnectTarget, the LUN IDs of the volume on the targets
+	Luns []int `json:"luns,omitempty"`
+}
+
+// ExtendInfo describes the size change of an extended volume, sizes are in bytes.
+type ExtendInfo struct {
+	Wwn          string   `json:"wwn"`
+	Multipath    string   `json:"multipath"`
+	Paths        []string `json:"paths"`
+	OriginalSize int      `json:"originalSize"`
+	NewSize      int      `json:"newSize"`
 }
 
 // Defining these interfaces is mainly for unit testing
@@ -107,24 +239,57 @@ type Interface interface {
 	GetHostInfo() (HostInfo, error)
 	ConnectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error)
 	DisconnectVolume(connectionProperty ConnectionProperty) error
-	ExtendVolume(connectionProperty ConnectionProperty) error
+	ExtendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error)
+	ConnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (VolumeInfo, error)
+	DisconnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) error
+	ExtendVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (ExtendInfo, error)
 }
 
 type ISCSIInterface interface {
 	GetHostInfo() (HostInfo, error)
 	ConnectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error)
 	DisconnectVolume(connectionProperty ConnectionProperty) error
-	ExtendVolume(connectionProperty ConnectionProperty) error
+	ExtendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error)
+	ConnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (VolumeInfo, error)
+	DisconnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) error
+	ExtendVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (ExtendInfo, error)
+	ConnectTarget(connectionProperty ConnectionProperty) ([]VolumeInfo, error)
+	ConnectTargetContext(ctx context.Context, connectionProperty ConnectionProperty) ([]VolumeInfo, error)
 	LoginPortal(targetPortal string, targetIqn string) error
+	LoginPortalWithAuth(auth CHAPCredential, targetPortal string, targetIqn string) error
+	LoginTargets(targets []model.ISCSISession, connectionProperty ConnectionProperty) []LoginResult
+	LogoutPortal(targetPortal string, targetIqn string) error
 	SetNode2Auto(targetPortal string, targetIqn string) error
 	DiscoverPortal(targetPortal ...string) []model.ISCSISession
+	DiscoverPortalWithAuth(auth CHAPCredential, targetPortal ...string) []model.ISCSISession
+	DiscoverPortalWithAuthContext(ctx context.Context, auth CHAPCredential,
+		targetPortal ...string) []model.ISCSISession
+	DiscoverPortalWithIfacesContext(ctx context.Context, auth CHAPCredential, ifaces []string,
+		transport StringEnum, targetPortal ...string) []model.ISCSISession
+}
+
+type NVMeTCPInterface interface {
+	GetHostInfo() (HostInfo, error)
+	ConnectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error)
+	DisconnectVolume(connectionProperty ConnectionProperty) error
+	ExtendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error)
+	ConnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (VolumeInfo, error)
+	DisconnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) error
+	ExtendVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (ExtendInfo, error)
+	ConnectPortal(targetPortal string, targetNqn string) error
+	DiscoverPortal(targetPortal ...string) []model.NVMeDiscoveryEntry
 }
 
 type FibreChannelInterface interface {
 	GetHostInfo() (HostInfo, error)
 	ConnectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error)
 	DisconnectVolume(connectionProperty ConnectionProperty) error
-	ExtendVolume(connectionProperty ConnectionProperty) error
+	ExtendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error)
+	ConnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (VolumeInfo, error)
+	DisconnectVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) error
+	ExtendVolumeContext(ctx context.Context, connectionProperty ConnectionProperty) (ExtendInfo, error)
+	ConnectTarget(connectionProperty ConnectionProperty) ([]VolumeInfo, error)
+	ConnectTargetContext(ctx context.Context, connectionProperty ConnectionProperty) ([]VolumeInfo, error)
 }
 
 var log *logrus.Logger = logrus.New()
@@ -135,6 +300,151 @@ func SetLogger(l *logrus.Logger) {
 
 // Common functions
 
+// lockVolume takes the shared locks of the targets and the exclusive locks of
+// the LUNs, so that different LUNs of a target are handled concurrently while
+// the target itself is not logged out or disconnected in between.
+func lockVolume(ctx context.Context, targets []string, luns []string) (*lock.Set, error) {
+	var shared []string
+	for _, target := range targets {
+		shared = append(shared, lock.TargetKey(target))
+	}
+	locks, err := lock.AcquireContext(ctx, shared, luns)
+	if err != nil {
+		log.WithError(err).Error("Unable to lock the volume.")
+	}
+	return locks, err
+}
+
+// lockDevices takes the exclusive locks of the local devices
+func lockDevices(ctx context.Context, devices []string) (*lock.Set, error) {
+	var keys []string
+	for _, device := range devices {
+		keys = append(keys, lock.DeviceKey(device))
+	}
+	locks, err := lock.AcquireContext(ctx, nil, keys)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to lock the devices %s.", devices)
+	}
+	return locks, err
+}
+
+// rescanWithLock runs the bus rescan holding the host-wide rescan lock,
+// the rescan is skipped if the lock is not acquired.
+func rescanWithLock(ctx context.Context, rescan func()) {
+	locks, err := lock.AcquireContext(ctx, nil, []string{lock.HostRescanKey})
+	if err != nil {
+		log.WithError(err).Warn("Unable to lock the host for rescan, skip the rescan.")
+		return
+	}
+	defer locks.Release()
+	rescan()
+}
+
+// Wait for the multipath device of wwn, the map is healed if it is missing or
+// some of the paths are not in it. The map is returned even if incomplete
+// unless the policy is MultipathRequired.
+func findMultipath(ctx context.Context, wwn string, paths []string, policy StringEnum) (string, error) {
+	mPath := linux.FindMpathByWwnContext(ctx, wwn)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	missing := linux.FindMissingMpathPaths(wwn, paths)
+	if mPath != "" && len(missing) == 0 {
+		return mPath, nil
+	}
+	log.WithFields(logrus.Fields{"wwn": wwn, "multipath": mPath, "missing": missing}).Warn(
+		"Multipath map is missing or incomplete, try to heal it.")
+	if err := linux.HealMultipathContext(ctx, wwn, missing); err != nil {
+		log.WithError(err).Warn("Unable to heal the multipath map.")
+	}
+	mPath = linux.WaitForMpath(ctx, wwn, healWait)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	missing = linux.FindMissingMpathPaths(wwn, paths)
+	if mPath != "" && len(missing) == 0 {
+		log.Infof("Multipath map %s is healed.", mPath)
+		return mPath, nil
+	}
+	var err error
+	if mPath == "" {
+		err = fmt.Errorf("multipath map of %s is not created", wwn)
+	} else {
+		err = fmt.Errorf("paths %s are not added to multipath map of %s", missing, wwn)
+	}
+	if policy == MultipathRequired {
+		return "", err
+	}
+	if mPath == "" {
+		log.WithError(err).Warn("Fall back to the single paths.")
+	} else {
+		log.WithError(err).Warnf("Fall back to the incomplete multipath %s.", mPath)
+	}
+	return mPath, nil
+}
+
+// groupVolumesByWwn merges the volumes of the same wwn, which are the same
+// LUN mapped with different IDs on the target ports.
+func groupVolumesByWwn(volumes []VolumeInfo) []VolumeInfo {
+	var grouped []VolumeInfo
+	index := map[string]int{}
+	for _, volume := range volumes {
+		i, ok := index[volume.Wwn]
+		if !ok || volume.Wwn == "" {
+			index[volume.Wwn] = len(grouped)
+			grouped = append(grouped, volume)
+			continue
+		}
+		for _, path := range volume.Paths {
+			if !goockutil.Contains(path, grouped[i].Paths) {
+				grouped[i].Paths = append(grouped[i].Paths, path)
+			}
+		}
+		for _, lun := range volume.Luns {
+			if !goockutil.ContainsInt(lun, grouped[i].Luns) {
+				grouped[i].Luns = append(grouped[i].Luns, lun)
+			}
+		}
+		if grouped[i].Multipath == "" {
+			grouped[i].Multipath = volume.Multipath
+			grouped[i].MultipathId = volume.MultipathId
+		}
+	}
+	return grouped
+}
+
+// checkDevicesUnused refuses to remove the multipath map or the single devices
+// which are mounted, held, opened or used as swap, unless force is set
+func checkDevicesUnused(multipath model.Multipath, devices []string, force bool) error {
+	var err error
+	if multipath.Wwn != "" {
+		err = linux.CheckMultipathUnused(multipath)
+	} else {
+		err = linux.CheckDevicesUnused(devices)
+	}
+	if err != nil && force {
+		log.WithError(err).Warn("Force to remove the devices.")
+		return nil
+	}
+	return err
+}
+
+// flushMultipath flushes the multipath map of wwn, the failure is ignored if
+// force is set, otherwise its paths must not be removed since the map may be
+// still in use.
+func flushMultipath(ctx context.Context, wwn string, force bool) error {
+	err := linux.ForceFlushPathContext(ctx, wwn)
+	if err == nil {
+		return nil
+	}
+	if force {
+		log.WithError(err).Warnf("Unable to flush multipath %s, force to remove its paths.", wwn)
+		return nil
+	}
+	log.WithError(err).Errorf("Unable to flush multipath %s.", wwn)
+	return fmt.Errorf("unable to flush multipath %s: %s", wwn, err)
+}
+
 // Specific handling for LUN ID.
 // For lun id < 256, the return should be as original
 // For lun id >= 256, return "0x" prefixed string
@@ -152,17 +462,45 @@ func FormatLuns(luns ...int) []string {
 	return formated
 }
 
+// ParseLun parses the LUN ID in decimal like 10, in hexadecimal like 0x4001,
+// or the SAM 8-byte LUN address like 0x4001000000000000, which is the form of
+// FormatLuns. Only the first two levels of the LUN address are supported.
+func ParseLun(lun string) (int, error) {
+	if strings.HasPrefix(lun, "0x") || strings.HasPrefix(lun, "0X") {
+		digits := lun[2:]
+		if len(digits) == 16 {
+			address, err := strconv.ParseUint(digits, 16, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid LUN address %q", lun)
+			}
+			if address&0xffffffff != 0 {
+				return 0, fmt.Errorf("LUN address %q has more than two levels, which is not supported", lun)
+			}
+			return int(address>>48&0xffff | address>>32&0xffff<<16), nil
+		}
+		value, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid LUN ID %q, expect at most 8 hexadecimal digits or an 8-byte LUN address", lun)
+		}
+		return int(value), nil
+	}
+	value, err := strconv.ParseUint(lun, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LUN ID %q, expect a decimal or hexadecimal(0x) number", lun)
+	}
+	return int(value), nil
+}
+
 // GetHostInfo returns host iscsi and fc related information
 func GetHostInfo() (HostInfo, error) {
 	var info HostInfo
 
 	filePath := "/etc/iscsi/initiatorname.iscsi"
-	cmd := executor.Command("cat", filePath)
-	out, err := cmd.Output()
+	out, err := sysfs.ReadAttr(filePath)
 	if err == nil {
 		// Log warning
-		pattern, _ := regexp.Compile("InitiatorName=(?P<name>.*)\n$")
-		matches := pattern.FindStringSubmatch(string(out))
+		pattern, _ := regexp.Compile("(?m)^InitiatorName=(?P<name>.*)$")
+		matches := pattern.FindStringSubmatch(out)
 		if len(matches) >= 2 {
 			info.Initiator = matches[1]
 		}
@@ -171,6 +509,7 @@ func GetHostInfo() (HostInfo, error) {
 	}
 	info.OSType = runtime.GOOS
 	info.Hostname, _ = os.Hostname()
+	info.HostNqn = linux.GetNVMeHostNqn()
 	hbas := model.NewHBA()
 	for _, hba := range hbas {
 		info.Wwnns = append(info.Wwnns, hba.NodeName)
@@ -190,3 +529,191 @@ func GetHostInfo() (HostInfo, error) {
 
 	return info, err
 }
+
+// extendPaths rescans every single path of a volume and then resizes the
+// multipath descriptor, the size of the multipath(or the first path when
+// multipath is absent) is recorded before and after the rescan.
+// wwn is looked up from the first path if it is empty.
+func extendPaths(ctx context.Context, wwn string, paths []string) (ExtendInfo, error) {
+	var info ExtendInfo
+	if len(paths) <= 0 {
+		return info, fmt.Errorf("Unable to find any path to extend.")
+	}
+	info.Paths = paths
+	info.Wwn = wwn
+	if info.Wwn == "" {
+		info.Wwn = linux.GetWWNContext(ctx, paths[0])
+	}
+	multipathEnabled := linux.IsMultipathEnabledContext(ctx)
+	device := paths[0]
+	if multipathEnabled {
+		multipath := linux.FindMultipathByWwn(info.Wwn)
+		if multipath.Wwn != "" {
+			info.Multipath = fmt.Sprintf("/dev/disk/by-id/dm-uuid-mpath-%s", multipath.Wwn)
+			device = info.Multipath
+		}
+	}
+	info.OriginalSize = linux.GetDeviceSizeContext(ctx, device)
+	// Flush size of each single path
+	pathSizes := make(map[string]int)
+	var rescanned []string
+	for _, path := range paths {
+		newSize, err := linux.ExtendDeviceContext(ctx, path)
+		if err != nil {
+			log.WithError(err).Warnf("Unable to rescan the size of path %s.", path)
+			continue
+		}
+		pathSizes[path] = newSize
+		rescanned = append(rescanned, path)
+	}
+	if len(rescanned) == 0 {
+		return info, fmt.Errorf("Unable to rescan any path of %s.", paths)
+	}
+	var err error
+	// All paths should agree on the new size, or the multipath is not
+	// able to be resized properly, so it is left as is.
+	for _, path := range rescanned {
+		if pathSizes[path] != pathSizes[rescanned[0]] {
+			log.WithField("sizes", pathSizes).Warn("Paths report different sizes after rescan.")
+			err = fmt.Errorf("Path %s reports size %d which differs from path %s.",
+				path, pathSizes[path], rescanned[0])
+			break
+		}
+	}
+	if err == nil && multipathEnabled {
+		// Flush size for multipath descriptor
+		err = linux.ResizeMpathContext(ctx, info.Wwn)
+	}
+	info.NewSize = linux.GetDeviceSizeContext(ctx, device)
+	log.WithFields(logrus.Fields{
+		"wwn":      info.Wwn,
+		"original": info.OriginalSize,
+		"new":      info.NewSize,
+	}).Debug("Extend volume finished.")
+	return info, err
+}
+
+// FormatDevicePath completes the device name to a full device path
+// sdb -> /dev/sdb, dm-3 -> /dev/dm-3, <wwn> -> /dev/mapper/<wwn>
+func FormatDevicePath(device string) string {
+	if strings.Contains(device, "/") {
+		return device
+	}
+	if m, _ := regexp.MatchString("^(sd[a-z]+|dm-\\d+)$", device); m {
+		return fmt.Sprintf("/dev/%s", device)
+	}
+	return fmt.Sprintf("/dev/mapper/%s", device)
+}
+
+// GetDeviceProtocol returns the storage protocol of a single path device,
+// empty string is returned for neither iSCSI nor FC device.
+func GetDeviceProtocol(device string) StringEnum {
+	if linux.IsISCSIDevice(device) {
+		return IscsiProtocol
+	}
+	if linux.IsFCDevice(device) {
+		return FcProtocol
+	}
+	return ""
+}
+
+// DisconnectDevice removes a local device along with all its sibling paths.
+// device could be "/dev/sdb", "sdb", "/dev/mapper/<wwn>" or "dm-3"
+// 1. Find all sibling paths via multipath
+// 2. Check that none of them is in use
+// 3. Flush the multipath descriptor
+// 4. Remove every single path from scsi bus
+func DisconnectDevice(device string) error {
+	return DisconnectDeviceContext(context.Background(), device, false)
+}
+
+// DisconnectDeviceContext is DisconnectDevice which gives up once ctx is done,
+// the devices in use are removed as well if force is set.
+func DisconnectDeviceContext(ctx context.Context, device string, force bool) error {
+	device = FormatDevicePath(device)
+	var devNodes []string
+	var multipath model.Multipath
+	if multipaths := model.FindMultipath(device); len(multipaths) > 0 {
+		multipath = multipaths[0]
+		for _, single := range multipath.Paths {
+			devNodes = append(devNodes, single.DevNode)
+		}
+	} else if strings.HasPrefix(device, "/dev/mapper/") || strings.HasPrefix(device, "/dev/dm-") {
+		return fmt.Errorf("Unable to find multipath for device %s.", device)
+	} else {
+		devNodes = append(devNodes, filepath.Base(device))
+	}
+
+	if len(devNodes) > 0 {
+		protocol := GetDeviceProtocol(devNodes[0])
+		if protocol == "" {
+			return fmt.Errorf("Device %s is neither an iSCSI nor a Fibre Channel device.", device)
+		}
+		log.WithFields(logrus.Fields{
+			"device":   device,
+			"protocol": protocol,
+			"paths":    devNodes,
+		}).Info("Disconnecting the device.")
+	}
+	locks, err := lockDevices(ctx, devNodes)
+	if err != nil {
+		return err
+	}
+	defer locks.Release()
+
+	if err := checkDevicesUnused(multipath, devNodes, force); err != nil {
+		return err
+	}
+	if multipath.Wwn != "" {
+		// First, remove the multipath descriptor
+		if err := flushMultipath(ctx, multipath.Wwn, force); err != nil {
+			return err
+		}
+	}
+	// Secondary, remove every single path from scsi bus
+	var devPaths []string
+	for _, devNode := range devNodes {
+		linux.ForceRemoveSCSIDeviceContext(ctx, devNode)
+		devPaths = append(devPaths, fmt.Sprintf("/dev/%s", devNode))
+	}
+	left := goockutil.WaitForPathRemovalContext(ctx, devPaths, 10)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(left) > 0 {
+		log.Warnf("Paths still exist on system: %s.", left)
+		return fmt.Errorf("Paths %s are not removed from system.", left)
+	}
+	return nil
+}
+
+// ExtendDevice updates the size of a local device along with all its sibling paths.
+// device could be "/dev/sdb", "sdb", "/dev/mapper/<wwn>" or "dm-3"
+func ExtendDevice(device string) (ExtendInfo, error) {
+	return ExtendDeviceContext(context.Background(), device)
+}
+
+// ExtendDeviceContext is ExtendDevice which gives up once ctx is done
+func ExtendDeviceContext(ctx context.Context, device string) (ExtendInfo, error) {
+	device = FormatDevicePath(device)
+	var wwn string
+	var paths []string
+	if multipaths := model.FindMultipath(device); len(multipaths) > 0 {
+		wwn = multipaths[0].Wwn
+		for _, single := range multipaths[0].Paths {
+			paths = append(paths, fmt.Sprintf("/dev/%s", single.DevNode))
+		}
+	} else if strings.HasPrefix(device, "/dev/mapper/") || strings.HasPrefix(device, "/dev/dm-") {
+		return ExtendInfo{}, fmt.Errorf("Unable to find multipath for device %s.", device)
+	} else if len(model.NewDeviceInfo(device)) > 0 {
+		paths = append(paths, device)
+	} else {
+		return ExtendInfo{}, fmt.Errorf("Device %s is not a SCSI device.", device)
+	}
+	locks, err := lockDevices(ctx, paths)
+	if err != nil {
+		return ExtendInfo{}, err
+	}
+	defer locks.Release()
+	return extendPaths(ctx, wwn, paths)
+}
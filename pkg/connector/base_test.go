@@ -17,12 +17,31 @@ limitations under the License.
 package connector
 
 import (
+	"context"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
 	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
 	"github.com/peter-wangxu/goock/test"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
+// Run the tests with the fake sysfs and /dev tree
+func TestMain(m *testing.M) {
+	root := test.NewFakeRoot()
+	sysfs.SetRoot(root.Dir)
+	test.DisableUevents()
+	lock.SetDir(filepath.Join(root.Dir, "run/goock/locks"))
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
 func TestConnectionProperty_IsEmpty(t *testing.T) {
 	prop := ConnectionProperty{}
 	assert.Error(t, prop.IsEmpty())
@@ -50,13 +69,47 @@ func TestFormatLuns(t *testing.T) {
 	assert.Equal(t, "0x0109000000000000", formated[1])
 }
 
+func TestParseLun(t *testing.T) {
+	for _, lun := range []int{0, 10, 255, 265, 0x4001, 0x10004} {
+		parsed, err := ParseLun(FormatLuns(lun)[0])
+		assert.Nil(t, err)
+		assert.Equal(t, lun, parsed)
+	}
+	lun, err := ParseLun("0x4001")
+	assert.Nil(t, err)
+	assert.Equal(t, 16385, lun)
+	lun, err = ParseLun("0X4001000000000000")
+	assert.Nil(t, err)
+	assert.Equal(t, 16385, lun)
+	for _, invalid := range []string{"", "-1", "+1", "1.0", "0x", "0xg", "0x123456789", "4294967296",
+		"0x4001000000000001"} {
+		_, err = ParseLun(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestGroupVolumesByWwn(t *testing.T) {
+	volumes := groupVolumesByWwn([]VolumeInfo{
+		{Wwn: "wwn1", Paths: []string{"/dev/sdb"}, Luns: []int{1}},
+		{Wwn: "wwn2", Paths: []string{"/dev/sdc"}, Multipath: "/dev/dm-2", MultipathId: "wwn2"},
+		{Wwn: "wwn1", Paths: []string{"/dev/sdb", "/dev/sdd"}, Multipath: "/dev/dm-1", MultipathId: "wwn1", Luns: []int{1}},
+	})
+	assert.Len(t, volumes, 2)
+	assert.Equal(t, []string{"/dev/sdb", "/dev/sdd"}, volumes[0].Paths)
+	assert.Equal(t, "/dev/dm-1", volumes[0].Multipath)
+	assert.Equal(t, []int{1}, volumes[0].Luns)
+	assert.Equal(t, "wwn2", volumes[1].Wwn)
+}
+
 func TestGetHostInfo(t *testing.T) {
 	SetExecutor(test.NewMockExecutor())
 	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
 	info, _ := GetHostInfo()
 	assert.NotEmpty(t, info.Hostname)
 	assert.NotEmpty(t, info.OSType)
 	assert.Equal(t, "iqn.1993-08.org.debian:01:b974ee37fea", info.Initiator)
+	assert.Equal(t, "nqn.2014-08.org.nvmexpress:uuid:2d1a3c3e-5c4b-4f6e-9a6d-3b2f1e0d9c8b", info.HostNqn)
 	assert.Equal(t, []string{"20000090fa534cd0", "20000090fa534cd1"}, info.Wwnns)
 	assert.Equal(t, []string{"10000090fa534cd0", "10000090fa534cd1"}, info.Wwpns)
 	assert.Equal(t, []string{"5006016089200925", "50060160b6e00e5a",
@@ -64,3 +117,114 @@ func TestGetHostInfo(t *testing.T) {
 	assert.Equal(t, []string{"5006016d09200925", "5006016036e00e5a",
 		"5006016509200925", "5006016136e00e5a"}, info.TargetWwpns)
 }
+
+func TestFormatDevicePath(t *testing.T) {
+	assert.Equal(t, "/dev/sdb", FormatDevicePath("sdb"))
+	assert.Equal(t, "/dev/sdb", FormatDevicePath("/dev/sdb"))
+	assert.Equal(t, "/dev/dm-3", FormatDevicePath("dm-3"))
+	assert.Equal(t, "/dev/mapper/mpatha", FormatDevicePath("mpatha"))
+}
+
+func TestGetDeviceProtocol(t *testing.T) {
+	linux.SetExecutor(test.NewMockExecutor())
+	assert.Equal(t, FcProtocol, GetDeviceProtocol("sdb"))
+	assert.Equal(t, IscsiProtocol, GetDeviceProtocol("/dev/sdq"))
+	assert.Equal(t, StringEnum(""), GetDeviceProtocol("sdz"))
+}
+
+func TestDisconnectDevice(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	err := DisconnectDevice("/dev/mapper/350060160b6e00e5a50060160b6e11317")
+	assert.Nil(t, err)
+}
+
+// The LVM volume on the multipath is mounted
+func TestDisconnectDeviceInUse(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	err := DisconnectDevice("/dev/dm-20")
+	assert.True(t, linux.IsDeviceBusy(err))
+	assert.Contains(t, err.Error(), "dm-20 is mounted on /var/lib/mysql")
+}
+
+func TestDisconnectDeviceForce(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	err := DisconnectDeviceContext(context.Background(), "/dev/dm-20", true)
+	assert.Nil(t, err)
+}
+
+func TestDisconnectDeviceNoMultipath(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	err := DisconnectDevice("dm-99")
+	assert.Error(t, err)
+}
+
+func TestDisconnectDeviceUnknownProtocol(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	err := DisconnectDevice("sdz")
+	assert.Error(t, err)
+}
+
+func TestExtendDevice(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	info, err := ExtendDevice("/dev/mapper/350060160b6e00e5a50060160b6e11318")
+	assert.Nil(t, err)
+	assert.Equal(t, "350060160b6e00e5a50060160b6e11318", info.Wwn)
+	assert.Equal(t, []string{"/dev/sdb", "/dev/sdy"}, info.Paths)
+	assert.Equal(t, 3221225472, info.NewSize)
+}
+
+func TestExtendDeviceSizeMismatch(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	linux.SetExecutor(mockExec)
+	defer linux.SetExecutor(test.NewMockExecutor())
+	_, err := ExtendDevice("dm-2")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "/dev/sdap")
+	// The multipath is not resized to the size of either path
+	for _, command := range mockExec.commands {
+		assert.NotContains(t, command, "multipathd resize map")
+	}
+}
+
+func TestExtendPathsNoneRescanned(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	_, err := extendPaths(context.Background(), "", []string{"/dev/sdzz"})
+	assert.EqualError(t, err, "Unable to rescan any path of [/dev/sdzz].")
+}
+
+func TestExtendDeviceNotSCSI(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	_, err := ExtendDevice("sdz")
+	assert.Error(t, err)
+}
+
+func TestExtendDeviceLocked(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	defer setLockTimeout(100 * time.Millisecond)()
+	held, _ := lock.Exclusive(lock.DeviceKey("/dev/sdy"))
+	defer held.Release()
+	_, err := ExtendDevice("/dev/mapper/350060160b6e00e5a50060160b6e11318")
+	assert.IsType(t, &lock.TimeoutError{}, err)
+}
+
+// setLockTimeout changes the lock timeout and returns the func to restore it
+func setLockTimeout(timeout time.Duration) func() {
+	origin := lock.Timeout
+	lock.Timeout = timeout
+	return func() {
+		lock.Timeout = origin
+	}
+}
@@ -1,12 +1,18 @@
 package connector
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/exec"
 	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
 	"github.com/peter-wangxu/goock/pkg/model"
 	goockutil "github.com/peter-wangxu/goock/pkg/util"
 	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -15,14 +21,24 @@ const (
 	FibreChannelPathPattern = "/dev/disk/by-path/pci-%s-fc-%s-lun-%s"
 )
 
+// PCI address like 0000:05:00.1
+var pciPattern = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
 // Connector for Fibre Channel
 type FibreChannelConnector struct {
 	exec exec.Interface
+	// Context of the operation, the commands are killed once it is done
+	ctx context.Context
 }
 
 // Constructor for FibreChannelConnector
 func NewFibreChannelConnector() FibreChannelInterface {
-	return &FibreChannelConnector{exec: executor}
+	return &FibreChannelConnector{exec: executor, ctx: context.Background()}
+}
+
+// Returns a copy of the connector whose commands, waits and locks are bound to ctx
+func (fc *FibreChannelConnector) withContext(ctx context.Context) *FibreChannelConnector {
+	return &FibreChannelConnector{exec: exec.WithContext(ctx, fc.exec), ctx: ctx}
 }
 
 // Get Fibre Channel host information
@@ -32,6 +48,22 @@ func (fc *FibreChannelConnector) GetHostInfo() (HostInfo, error) {
 
 // Connect/Discover a FC device
 func (fc *FibreChannelConnector) ConnectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	return fc.ConnectVolumeContext(fc.ctx, connectionProperty)
+}
+
+// ConnectVolumeContext is ConnectVolume which gives up once ctx is done
+func (fc *FibreChannelConnector) ConnectVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	return fc.withContext(ctx).connectVolume(connectionProperty)
+}
+
+func (fc *FibreChannelConnector) connectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	targets, luns := fc.getLockKeys(connectionProperty)
+	locks, err := lockVolume(fc.ctx, targets, luns)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	defer locks.Release()
 
 	var volumeInfo VolumeInfo
 	hostPaths := fc.getVolumePaths(connectionProperty)
@@ -39,36 +71,214 @@ func (fc *FibreChannelConnector) ConnectVolume(connectionProperty ConnectionProp
 	if len(hostPaths) <= 0 {
 		return volumeInfo, fmt.Errorf("unable to locate any Fibre Channel devices")
 	}
+	return fc.attachVolume(connectionProperty)
+}
 
-	existedPath, err := goockutil.WaitForAnyPath(
-		hostPaths, fc.wrapperRescanHosts(
-			connectionProperty.TargetWwns, connectionProperty.TargetLun))
+// Wait for the paths of the LUN on the target ports, then find its wwn and
+// multipath device
+func (fc *FibreChannelConnector) attachVolume(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	var volumeInfo VolumeInfo
+	existedPath, err := goockutil.WaitForDeviceContext(fc.ctx, func() []string {
+		return fc.findVolumePaths(connectionProperty)
+	}, fc.wrapperRescanHosts(connectionProperty.TargetWwns, connectionProperty.TargetLun))
 
 	if err != nil {
 		log.WithError(err).Error("Unable to find any Fibre Channel devices.")
 		return volumeInfo, err
 	}
-	lunWwn := linux.GetWWN(existedPath)
+	lunWwn := linux.GetWWNContext(fc.ctx, existedPath)
 	log.Debugf("Found wwn [%s] for path %s.", lunWwn, existedPath)
-	mPath := linux.FindMpathByWwn(lunWwn)
-
 	volumeInfo.Wwn = lunWwn
-	volumeInfo.MultipathId = lunWwn
-	volumeInfo.Multipath = mPath
-	volumeInfo.Paths, _ = goockutil.FilterPath(hostPaths)
-	log.Debugf("ConnectVolume returning %s", volumeInfo)
+	volumeInfo.Paths = fc.findVolumePaths(connectionProperty)
+	if linux.IsMultipathEnabledContext(fc.ctx) {
+		mPath, err := findMultipath(fc.ctx, lunWwn, volumeInfo.Paths, connectionProperty.MultipathPolicy)
+		if err != nil {
+			log.WithError(err).Error("Unable to build the multipath map.")
+			return volumeInfo, err
+		}
+		if mPath != "" {
+			volumeInfo.MultipathId = lunWwn
+			volumeInfo.Multipath = mPath
+		}
+	}
+	log.Debugf("ConnectVolume returning %+v", volumeInfo)
 
 	return volumeInfo, nil
 }
 
+// ConnectTarget scans the target ports of connectionProperty for all the LUNs
+// and attaches every LUN found, TargetLun is ignored. The volumes are grouped
+// by wwn, the volumes attached are returned along with the error if some of
+// the LUNs fail.
+func (fc *FibreChannelConnector) ConnectTarget(connectionProperty ConnectionProperty) ([]VolumeInfo, error) {
+	return fc.ConnectTargetContext(fc.ctx, connectionProperty)
+}
+
+// ConnectTargetContext is ConnectTarget which gives up once ctx is done
+func (fc *FibreChannelConnector) ConnectTargetContext(ctx context.Context,
+	connectionProperty ConnectionProperty) ([]VolumeInfo, error) {
+	return fc.withContext(ctx).connectTarget(connectionProperty)
+}
+
+func (fc *FibreChannelConnector) connectTarget(connectionProperty ConnectionProperty) ([]VolumeInfo, error) {
+	locks, err := lockVolume(fc.ctx, connectionProperty.TargetWwns, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer locks.Release()
+	// Scan before looking up the LUNs, the LUNs may be added after the last scan
+	rescan := fc.wrapperRescanHosts(connectionProperty.TargetWwns, linux.Wildcard)
+	rescan()
+	var lunIDs []int
+	err = goockutil.WaitForContext(fc.ctx, func() bool {
+		lunIDs = fc.findTargetLuns(connectionProperty)
+		return len(lunIDs) > 0
+	}, rescan)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to find any LUN on targets %s.", connectionProperty.TargetWwns)
+		return nil, fmt.Errorf("no LUN found on targets %s: %s", connectionProperty.TargetWwns, err)
+	}
+	log.Infof("Found LUN(s) %v on targets %s.", lunIDs, connectionProperty.TargetWwns)
+	var volumes []VolumeInfo
+	var failed []int
+	for _, lun := range lunIDs {
+		lunProperty := connectionProperty
+		lunProperty.TargetLun = lun
+		info, err := fc.attachLun(lunProperty)
+		if err != nil {
+			log.WithError(err).Errorf("Unable to attach LUN %d.", lun)
+			failed = append(failed, lun)
+			continue
+		}
+		info.Luns = []int{lun}
+		volumes = append(volumes, info)
+	}
+	volumes = groupVolumesByWwn(volumes)
+	if len(failed) > 0 {
+		return volumes, fmt.Errorf("unable to attach LUN(s) %v of targets %s", failed, connectionProperty.TargetWwns)
+	}
+	return volumes, nil
+}
+
+// Attach a single LUN of the targets with the LUN locked
+func (fc *FibreChannelConnector) attachLun(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	_, luns := fc.getLockKeys(connectionProperty)
+	locks, err := lockVolume(fc.ctx, nil, luns)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	defer locks.Release()
+	return fc.attachVolume(connectionProperty)
+}
+
+// Get the LUN IDs found on all the target ports
+func (fc *FibreChannelConnector) findTargetLuns(connectionProperty ConnectionProperty) []int {
+	var lunIDs []int
+	for _, wwn := range connectionProperty.TargetWwns {
+		for _, lun := range linux.FindFCLuns(wwn) {
+			if !goockutil.ContainsInt(lun, lunIDs) {
+				lunIDs = append(lunIDs, lun)
+			}
+		}
+	}
+	sort.Ints(lunIDs)
+	return lunIDs
+}
+
 // DisconnectVolume disconnect/remove an already-connected FC device
+// 1. Flush the multipath descriptor if multipath is enabled
+// 2. Remove every single path from scsi bus
+// 3. Wait for the paths to disappear from the host
 func (fc *FibreChannelConnector) DisconnectVolume(connectionProperty ConnectionProperty) error {
+	return fc.DisconnectVolumeContext(fc.ctx, connectionProperty)
+}
+
+// DisconnectVolumeContext is DisconnectVolume which gives up once ctx is done
+func (fc *FibreChannelConnector) DisconnectVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) error {
+	return fc.withContext(ctx).disconnectVolume(connectionProperty)
+}
+
+func (fc *FibreChannelConnector) disconnectVolume(connectionProperty ConnectionProperty) error {
+	targets, luns := fc.getLockKeys(connectionProperty)
+	locks, err := lockVolume(fc.ctx, targets, luns)
+	if err != nil {
+		return err
+	}
+	defer locks.Release()
+	existedPaths := fc.findVolumePaths(connectionProperty)
+	if len(existedPaths) <= 0 {
+		log.Info("No Fibre Channel path found for targets.")
+		return nil
+	}
+	var multipath model.Multipath
+	if linux.IsMultipathEnabledContext(fc.ctx) {
+		log.Info("Multipath discovery for Fibre Channel enabled.")
+		lunWwn := linux.GetWWNContext(fc.ctx, existedPaths[0])
+		multipath = linux.FindMultipathByWwn(lunWwn)
+	}
+	if multipath.Wwn != "" {
+		if err := checkDevicesUnused(multipath, nil, connectionProperty.Force); err != nil {
+			return err
+		}
+		// First, remove the multipath descriptor
+		if err := flushMultipath(fc.ctx, multipath.Wwn, connectionProperty.Force); err != nil {
+			return err
+		}
+		// Secondary, remove every single path from scsi bus
+		for _, single := range multipath.Paths {
+			linux.ForceRemoveSCSIDeviceContext(fc.ctx, single.DevNode)
+		}
+	} else {
+		log.Info("No multipath found for targets, removing single paths.")
+		var devices []string
+		for _, path := range existedPaths {
+			realPath, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				log.WithError(err).Warnf("Unable to resolve the device of %s, skip the removal.", path)
+				continue
+			}
+			devices = append(devices, realPath)
+		}
+		if err := checkDevicesUnused(multipath, devices, connectionProperty.Force); err != nil {
+			return err
+		}
+		for _, device := range devices {
+			linux.ForceRemoveSCSIDeviceContext(fc.ctx, device)
+		}
+	}
+	left := goockutil.WaitForPathRemovalContext(fc.ctx, existedPaths, 10)
+	if err := fc.ctx.Err(); err != nil {
+		return err
+	}
+	if len(left) > 0 {
+		log.Warnf("Paths still exist on system: %s.", left)
+		return errors.New(fmt.Sprintf("Paths %s are not removed from system.", left))
+	}
 	return nil
 }
 
 // Extend the volume attributes when changes are made on storage side
-func (fc *FibreChannelConnector) ExtendVolume(connectionProperty ConnectionProperty) error {
-	return nil
+// Every FC path is rescanned, then the multipath map is resized.
+func (fc *FibreChannelConnector) ExtendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	return fc.ExtendVolumeContext(fc.ctx, connectionProperty)
+}
+
+// ExtendVolumeContext is ExtendVolume which gives up once ctx is done
+func (fc *FibreChannelConnector) ExtendVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	return fc.withContext(ctx).extendVolume(connectionProperty)
+}
+
+func (fc *FibreChannelConnector) extendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	targets, luns := fc.getLockKeys(connectionProperty)
+	locks, err := lockVolume(fc.ctx, targets, luns)
+	if err != nil {
+		return ExtendInfo{}, err
+	}
+	defer locks.Release()
+	existedPaths := fc.findVolumePaths(connectionProperty)
+	return extendPaths(fc.ctx, "", existedPaths)
 }
 
 // Get all possible fc devices from connection property
@@ -87,6 +297,41 @@ func (fc *FibreChannelConnector) getVolumePaths(connectionProperty ConnectionPro
 	return possiblePaths
 }
 
+// Get the existing paths of the volume, the devices are looked up via sysfs
+// for the target WWNs without any link under /dev/disk/by-path, as the link
+// names vary with udev versions, or udev has not created the links yet.
+func (fc *FibreChannelConnector) findVolumePaths(connectionProperty ConnectionProperty) []string {
+	paths, _ := goockutil.FilterPath(fc.getVolumePaths(connectionProperty))
+	for _, wwn := range connectionProperty.TargetWwns {
+		linked := false
+		for _, path := range paths {
+			if strings.Contains(strings.ToLower(path), fmt.Sprintf("-fc-0x%s-", strings.ToLower(wwn))) {
+				linked = true
+				break
+			}
+		}
+		if linked {
+			continue
+		}
+		for _, device := range linux.FindFCDevices(wwn, connectionProperty.TargetLun) {
+			if goockutil.IsPathExists(device) == nil && !goockutil.Contains(device, paths) {
+				log.Debugf("Found device %s of target %s via sysfs.", device, wwn)
+				paths = append(paths, device)
+			}
+		}
+	}
+	return paths
+}
+
+// Get the target WWNs and LUNs to lock
+func (fc *FibreChannelConnector) getLockKeys(connectionProperty ConnectionProperty) ([]string, []string) {
+	var luns []string
+	for _, wwn := range connectionProperty.TargetWwns {
+		luns = append(luns, lock.LunKey(wwn, connectionProperty.TargetLun))
+	}
+	return connectionProperty.TargetWwns, luns
+}
+
 // Try to get HBA channel and SCSI target to use as filters
 // This could largely avoid unintended presence of the same target
 func (fc *FibreChannelConnector) wrapperRescanHosts(wwpns []string, lunID int) func() {
@@ -103,17 +348,30 @@ func (fc *FibreChannelConnector) wrapperRescanHosts(wwpns []string, lunID int) f
 	}
 	log.WithFields(logrus.Fields{"Targets": connectedTargets, "lun": lunID}).Debug("Found connected targets.")
 	return func() {
-		linux.RescanHosts(connectedTargets, lunID)
+		rescanWithLock(fc.ctx, func() {
+			linux.RescanHostsContext(fc.ctx, connectedTargets, lunID)
+		})
 	}
 }
 
-// Extract pci number from device path: /sys/devices/pci0000:00/0000:00:03.0/0000:05:00.1/host9/fc_host/host9
-// 0000:05:00.1 is the correct pci number
+// Extract pci number from device path: /sys/devices/pci0000:00/0000:00:03.0/0000:05:00.1/host9
+// 0000:05:00.1 is the correct pci number, it is the last PCI device before the
+// host since the depth of PCI bridges varies.
 func (fc *FibreChannelConnector) getPciNums() []string {
 	var pciNums []string
 	hbas := model.NewHBA()
 	for _, hba := range hbas {
-		pciNums = append(pciNums, strings.Split(hba.DevicePath, "/")[5])
+		pciNum := ""
+		for _, name := range strings.Split(hba.DevicePath, "/") {
+			if pciPattern.MatchString(name) {
+				pciNum = name
+			}
+		}
+		if pciNum == "" {
+			log.Debugf("Unable to find the PCI device of %s.", hba.Name)
+			continue
+		}
+		pciNums = append(pciNums, pciNum)
 	}
 	return pciNums
 }
@@ -1,12 +1,14 @@
 package connector
 
 import (
+	"context"
 	"github.com/peter-wangxu/goock/pkg/linux"
 	"github.com/peter-wangxu/goock/pkg/model"
 	"github.com/peter-wangxu/goock/test"
 	goockutil "github.com/peter-wangxu/goock/pkg/util"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestFibreChannelConnector_ConnectVolume(t *testing.T) {
@@ -32,3 +34,109 @@ func TestFibreChannelConnector_ConnectVolume(t *testing.T) {
 			"/dev/disk/by-path/pci-0000:05:00.1-fc-0x5006016136e00e5a-lun-11"},
 		info.Paths)
 }
+
+func TestFibreChannelConnector_DisconnectVolume(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	fc := NewFibreChannelConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetWwns = []string{
+		"5006016d09200925",
+		"5006016136e00e5a",
+	}
+	fakeProperty.TargetLun = 11
+	err := fc.DisconnectVolume(fakeProperty)
+	// The mocked paths are always there, so they are reported as left behind.
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "/dev/disk/by-path/pci-0000:05:00.0-fc-0x5006016d09200925-lun-11")
+}
+
+func TestFibreChannelConnector_DisconnectVolumeNoPath(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	fc := NewFibreChannelConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetWwns = []string{"5006016d09201234"}
+	fakeProperty.TargetLun = 11
+	err := fc.DisconnectVolume(fakeProperty)
+	assert.Nil(t, err)
+}
+
+func TestFibreChannelConnector_ExtendVolume(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	fc := NewFibreChannelConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetWwns = []string{
+		"5006016d09200925",
+		"5006016136e00e5a",
+	}
+	fakeProperty.TargetLun = 11
+	info, err := fc.ExtendVolume(fakeProperty)
+	assert.Nil(t, err)
+	assert.Equal(t, "350060160b6e00e5a50060160b6e11317", info.Wwn)
+	assert.Equal(t, "/dev/disk/by-id/dm-uuid-mpath-350060160b6e00e5a50060160b6e11317", info.Multipath)
+	assert.Len(t, info.Paths, 2)
+	assert.Equal(t, 3221225472, info.OriginalSize)
+	assert.Equal(t, 3221225472, info.NewSize)
+}
+
+func TestFibreChannelConnector_ExtendVolumeNoPath(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	fc := NewFibreChannelConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetWwns = []string{"5006016d09201234"}
+	fakeProperty.TargetLun = 11
+	_, err := fc.ExtendVolume(fakeProperty)
+	assert.Error(t, err)
+}
+
+func TestFibreChannelConnector_findVolumePaths(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	fc := &FibreChannelConnector{exec: test.NewMockExecutor(), ctx: context.Background()}
+	fakeProperty := ConnectionProperty{}
+	// No link under /dev/disk/by-path for the second WWN
+	fakeProperty.TargetWwns = []string{"5006016136e00e5a", "5006016036e00e5a"}
+	fakeProperty.TargetLun = 12
+	assert.Equal(t, []string{"/dev/sdw"}, fc.findVolumePaths(fakeProperty))
+
+	fakeProperty.TargetLun = 11
+	assert.Equal(t, []string{"/dev/disk/by-path/pci-0000:05:00.1-fc-0x5006016136e00e5a-lun-11"},
+		fc.findVolumePaths(fakeProperty))
+}
+
+func TestFibreChannelConnector_findTargetLuns(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	fc := &FibreChannelConnector{exec: test.NewMockExecutor(), ctx: context.Background()}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetWwns = []string{"5006016d09200925", "5006016036e00e5a"}
+	assert.Equal(t, []int{10, 11, 12}, fc.findTargetLuns(fakeProperty))
+}
+
+func TestFibreChannelConnector_ConnectTargetNoLun(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	fc := NewFibreChannelConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetWwns = []string{"5006016d09201234"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	volumes, err := fc.ConnectTargetContext(ctx, fakeProperty)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no LUN found")
+	assert.Empty(t, volumes)
+}
+
+func TestFibreChannelConnector_getPciNums(t *testing.T) {
+	fc := &FibreChannelConnector{exec: test.NewMockExecutor(), ctx: context.Background()}
+	assert.Equal(t, []string{"0000:05:00.0", "0000:05:00.1"}, fc.getPciNums())
+}
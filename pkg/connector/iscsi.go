@@ -16,24 +16,45 @@ limitations under the License.
 package connector
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/exec"
 	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
 	"github.com/peter-wangxu/goock/pkg/model"
 	goockutil "github.com/peter-wangxu/goock/pkg/util"
+	"github.com/sirupsen/logrus"
 	"path/filepath"
+	"regexp"
+	"sort"
 )
 
 const (
 	ISCSIPathPattern = "/dev/disk/by-path/ip-%s-iscsi-%s-lun-%s"
 )
 
+// Transports of the iSCSI ifaces, the ifaces of the offload transports are
+// bound to the MAC address of the NIC
+const (
+	TransportTCP      StringEnum = "tcp"
+	TransportISER     StringEnum = "iser"
+	TransportBnx2i    StringEnum = "bnx2i"
+	TransportBe2iscsi StringEnum = "be2iscsi"
+	TransportCxgb3i   StringEnum = "cxgb3i"
+	TransportCxgb4i   StringEnum = "cxgb4i"
+	TransportQedi     StringEnum = "qedi"
+	TransportQla4xxx  StringEnum = "qla4xxx"
+)
+
+var supportedTransports = []StringEnum{TransportTCP, TransportISER, TransportBnx2i, TransportBe2iscsi,
+	TransportCxgb3i, TransportCxgb4i, TransportQedi, TransportQla4xxx}
+
 type OPERATION_ENUM StringEnum
 
 const (
 	OperationNew           OPERATION_ENUM = "new"
-	OperationDelete        OPERATION_ENUM = "new"
+	OperationDelete        OPERATION_ENUM = "delete"
 	OperationUpdate        OPERATION_ENUM = "update"
 	OperationShow          OPERATION_ENUM = "show"
 	OperationNonPersistent OPERATION_ENUM = "nonpersistent"
@@ -41,10 +62,17 @@ const (
 
 type ISCSIConnector struct {
 	exec exec.Interface
+	// Context of the operation, the commands are killed once it is done
+	ctx context.Context
 }
 
 func NewISCSIConnector() ISCSIInterface {
-	return &ISCSIConnector{exec: executor}
+	return &ISCSIConnector{exec: executor, ctx: context.Background()}
+}
+
+// Returns a copy of the connector whose commands, waits and locks are bound to ctx
+func (iscsi *ISCSIConnector) withContext(ctx context.Context) *ISCSIConnector {
+	return &ISCSIConnector{exec: exec.WithContext(ctx, iscsi.exec), ctx: ctx}
 }
 
 // Returns host information regarding iSCSI and FC
@@ -57,7 +85,10 @@ func (iscsi *ISCSIConnector) getIscsiSessions() []model.ISCSISession {
 	// parse the output from iscsiadm
 	// lines are in the format of
 	// tcp: [1] 192.168.121.250:3260,1 iqn.2010-10.org.openstack:volume-
-	iscsiSession := model.NewISCSISession()
+	iscsiSession := model.NewISCSISessionContext(iscsi.ctx)
+	for i := range iscsiSession {
+		iscsiSession[i].Iface = linux.GetISCSISessionIface(iscsiSession[i].SessionId)
+	}
 	return iscsiSession
 
 }
@@ -69,81 +100,430 @@ func (iscsi *ISCSIConnector) getVolumePaths(connectionProperty ConnectionPropert
 	target_luns := FormatLuns(connectionProperty.TargetLuns...)
 	var potential_paths []string
 	for i, iqn := range target_iqns {
-		path := fmt.Sprintf(ISCSIPathPattern, target_portals[i], iqn, target_luns[i])
+		path := fmt.Sprintf(ISCSIPathPattern, pathPortal(target_portals[i]), iqn, target_luns[i])
 		potential_paths = append(potential_paths, path)
 	}
 	return potential_paths
 
 }
 
-func (iscsi *ISCSIConnector) validateIfaceTransport(transportIface string) string {
-	// TODO need to support multiple transports?
-	return "default"
+// Returns the portal in the by-path link name created by udev, like
+// 10.0.0.1:3260 or fe80::1:3260, the IPv6 address is not bracketed.
+func pathPortal(portal string) string {
+	address, port := model.SplitPortal(portal, model.ISCSIDefaultPort)
+	return model.NormalizeAddress(address) + ":" + port
+}
+
+// Tests if the portals are the same regardless of the format, like
+// [FE80:0::1] and [fe80::1]:3260
+func samePortal(portal string, other string) bool {
+	return model.NormalizePortal(portal, model.ISCSIDefaultPort) ==
+		model.NormalizePortal(other, model.ISCSIDefaultPort)
+}
+
+// Get the existing paths of the volume, the device is looked up via sysfs for
+// the target whose link under /dev/disk/by-path is absent, as the link names
+// vary with udev versions and ifaces, or udev has not created the link yet.
+// The devices are always looked up via sysfs if the sessions are bound to
+// ifaces, the link has no iface in its name, so it only points to the device
+// of one of the sessions to the same portal.
+func (iscsi *ISCSIConnector) findVolumePaths(connectionProperty ConnectionProperty) []string {
+	var paths []string
+	bound := len(boundIfaces(connectionProperty)) > 0
+	for i, path := range iscsi.getVolumePaths(connectionProperty) {
+		if !bound && goockutil.IsPathExists(path) == nil {
+			paths = append(paths, path)
+			continue
+		}
+		devices := linux.FindISCSIDevices(connectionProperty.TargetPortals[i],
+			connectionProperty.TargetIqns[i], connectionProperty.TargetLuns[i])
+		for _, device := range devices {
+			if goockutil.IsPathExists(device) == nil && !goockutil.Contains(device, paths) {
+				log.Debugf("Found device %s of %s via sysfs.", device, path)
+				paths = append(paths, device)
+			}
+		}
+	}
+	return paths
+}
+
+// Get the targets and LUNs to lock, the portal is used if the IQN is unknown
+func (iscsi *ISCSIConnector) getLockKeys(connectionProperty ConnectionProperty) ([]string, []string) {
+	var targets, luns []string
+	for i, portal := range connectionProperty.TargetPortals {
+		target := model.NormalizePortal(portal, model.ISCSIDefaultPort)
+		if i < len(connectionProperty.TargetIqns) && connectionProperty.TargetIqns[i] != "" {
+			target = connectionProperty.TargetIqns[i]
+		}
+		lun := 0
+		if i < len(connectionProperty.TargetLuns) {
+			lun = connectionProperty.TargetLuns[i]
+		}
+		if !goockutil.Contains(target, targets) {
+			targets = append(targets, target)
+		}
+		luns = append(luns, lock.LunKey(target, lun))
+	}
+	return targets, luns
+}
+
+// Every target portal comes with its IQN, they are indexed together
+func checkTargetIqns(connectionProperty ConnectionProperty) error {
+	if len(connectionProperty.TargetIqns) != len(connectionProperty.TargetPortals) {
+		return fmt.Errorf("%d target IQN(s) are given for %d target portal(s)",
+			len(connectionProperty.TargetIqns), len(connectionProperty.TargetPortals))
+	}
+	return nil
+}
+
+// Every target portal comes with its IQN and LUN, they are indexed together
+// to find the volume paths
+func checkTargetLuns(connectionProperty ConnectionProperty) error {
+	if err := checkTargetIqns(connectionProperty); err != nil {
+		return err
+	}
+	if len(connectionProperty.TargetLuns) != len(connectionProperty.TargetPortals) {
+		return fmt.Errorf("%d LUN(s) are given for %d target portal(s)",
+			len(connectionProperty.TargetLuns), len(connectionProperty.TargetPortals))
+	}
+	return nil
+}
+
+// Returns the ifaces which the sessions are bound to, the iser iface is used
+// for the iser transport if no iface is given. nil if not bound to any iface.
+func boundIfaces(connectionProperty ConnectionProperty) []string {
+	if len(connectionProperty.Ifaces) > 0 {
+		return connectionProperty.Ifaces
+	}
+	if connectionProperty.Transport == TransportISER {
+		return []string{string(TransportISER)}
+	}
+	return nil
+}
+
+// Returns the iface of the session, the default iface if unknown
+func sessionIface(session model.ISCSISession) string {
+	if session.Iface == "" {
+		return model.DefaultIface
+	}
+	return session.Iface
+}
+
+// Validates the transport and ifaces of connectionProperty, the ifaces of
+// the network interfaces are created if absent.
+func (iscsi *ISCSIConnector) prepareIfaces(connectionProperty ConnectionProperty) ([]string, error) {
+	transport := connectionProperty.Transport
+	if transport != "" && !containsTransport(transport, supportedTransports) {
+		return nil, fmt.Errorf("iSCSI transport %s is not supported", transport)
+	}
+	ifaces := boundIfaces(connectionProperty)
+	if len(ifaces) == 0 && transport != "" && transport != TransportTCP {
+		return nil, fmt.Errorf("an iface is required for the iSCSI transport %s", transport)
+	}
+	for _, iface := range ifaces {
+		if err := iscsi.validateIfaceTransport(iface, transport); err != nil {
+			return nil, err
+		}
+	}
+	return ifaces, nil
+}
+
+// Checks the transport of the iface if transport is set. The iface of the
+// same name is created if iface is a network interface without iface yet,
+// the iface of tcp or iser is bound to the network interface, while the one
+// of offload transports is bound to its MAC address.
+func (iscsi *ISCSIConnector) validateIfaceTransport(iface string, transport StringEnum) error {
+	output, err := iscsi.exec.Command("iscsiadm", "-m", "iface", "-I", iface).CombinedOutput()
+	if err == nil {
+		current := parseIfaceTransport(string(output))
+		if transport != "" && current != "" && current != transport {
+			return fmt.Errorf("iface %s is of transport %s rather than %s", iface, current, transport)
+		}
+		return nil
+	}
+	address, nicErr := linux.GetNetInterfaceAddress(iface)
+	if nicErr != nil {
+		return fmt.Errorf("%s is neither an iSCSI iface nor a network interface: %s", iface, err)
+	}
+	if transport == "" {
+		transport = TransportTCP
+	}
+	settings := [][2]string{{"iface.transport_name", string(transport)}}
+	if transport == TransportTCP || transport == TransportISER {
+		settings = append(settings, [2]string{"iface.net_ifacename", iface})
+	} else {
+		settings = append(settings, [2]string{"iface.hwaddress", address})
+	}
+	log.Infof("Creating iface %s of transport %s.", iface, transport)
+	if _, err := iscsi.exec.Command("iscsiadm", "-m", "iface", "-I", iface,
+		"--op", string(OperationNew)).CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to create iface %s: %s", iface, err)
+	}
+	for _, setting := range settings {
+		if _, err := iscsi.exec.Command("iscsiadm", "-m", "iface", "-I", iface, "--op", string(OperationUpdate),
+			"-n", setting[0], "-v", setting[1]).CombinedOutput(); err != nil {
+			return fmt.Errorf("unable to update %s of iface %s: %s", setting[0], iface, err)
+		}
+	}
+	return nil
+}
+
+// Parses the transport from the iface record, like iface.transport_name = tcp
+func parseIfaceTransport(record string) StringEnum {
+	m := regexp.MustCompile(`(?m)^iface\.transport_name\s*=\s*(\S+)`).FindStringSubmatch(record)
+	if m == nil || m[1] == "<empty>" {
+		return ""
+	}
+	return StringEnum(m[1])
+}
+
+func containsTransport(transport StringEnum, all []StringEnum) bool {
+	for _, t := range all {
+		if t == transport {
+			return true
+		}
+	}
+	return false
 }
 
 // Discover all target portals
 func (iscsi *ISCSIConnector) DiscoverPortal(targetPortal ...string) []model.ISCSISession {
 	// Parse output like 10.64.76.253:3260,1 iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1
-	iscsiSessions := model.DiscoverISCSISession(targetPortal)
+	iscsiSessions := model.DiscoverISCSISessionContext(iscsi.ctx, targetPortal)
 	return iscsiSessions
 
 }
 
-// Login all target portals if needed
-// TODO(peter) consider using goroutine to login concurrently?
-func (iscsi *ISCSIConnector) LoginPortal(targetPortal string, targetIqn string) error {
-	sessions := iscsi.getIscsiSessions()
-	// If already logged in, skipped
-	var loggedIn = false
-	var err error
-	for _, session := range sessions {
-		if session.TargetIqn == targetIqn && session.TargetPortal == targetPortal {
-			log.Debugf("Target %s, %s is already logged in. skip login.", targetPortal,
-				targetIqn)
-			loggedIn = true
-			err = nil
-			break
+// Discover all target portals with CHAP authentication, the credential is
+// saved to the discovery record of each portal before the discovery.
+func (iscsi *ISCSIConnector) DiscoverPortalWithAuth(auth CHAPCredential, targetPortal ...string) []model.ISCSISession {
+	return iscsi.discoverPortals(auth, nil, targetPortal...)
+}
+
+// Discover the target portals via each of ifaces, the discovered targets are
+// bound to the iface, see model.DiscoverISCSISessionIfaceContext
+func (iscsi *ISCSIConnector) discoverPortals(auth CHAPCredential, ifaces []string,
+	targetPortal ...string) []model.ISCSISession {
+	if auth.IsEmpty() {
+		return model.DiscoverISCSISessionIfaceContext(iscsi.ctx, targetPortal, ifaces)
+	}
+	discoveryIfaces := ifaces
+	if len(discoveryIfaces) == 0 {
+		discoveryIfaces = []string{model.DefaultIface}
+	}
+	for _, portal := range targetPortal {
+		for _, iface := range discoveryIfaces {
+			if err := iscsi.setDiscoveryAuth(portal, iface, auth); err != nil {
+				log.WithError(err).Warnf("Unable to set discovery CHAP for portal %s via iface %s.", portal, iface)
+			}
 		}
 	}
-	if loggedIn != true {
-		_, errLogin := iscsi.exec.Command("iscsiadm", "-m", "node", "-p", targetPortal, "-T", targetIqn, "--login").CombinedOutput()
-		err = errLogin
+	return model.DiscoverISCSISessionDBIfaceContext(iscsi.ctx, targetPortal, ifaces)
+}
+
+// DiscoverPortalWithAuthContext is DiscoverPortalWithAuth which kills the
+// discovery once ctx is done.
+func (iscsi *ISCSIConnector) DiscoverPortalWithAuthContext(ctx context.Context, auth CHAPCredential,
+	targetPortal ...string) []model.ISCSISession {
+	return iscsi.withContext(ctx).DiscoverPortalWithAuth(auth, targetPortal...)
+}
+
+// DiscoverPortalWithIfacesContext is DiscoverPortalWithAuthContext via each
+// of ifaces of transport, the ifaces of network interfaces are created if
+// absent, see ConnectionProperty.Ifaces. Nothing is discovered if the ifaces
+// are invalid.
+func (iscsi *ISCSIConnector) DiscoverPortalWithIfacesContext(ctx context.Context, auth CHAPCredential,
+	ifaces []string, transport StringEnum, targetPortal ...string) []model.ISCSISession {
+	iscsi = iscsi.withContext(ctx)
+	bound, err := iscsi.prepareIfaces(ConnectionProperty{Ifaces: ifaces, Transport: transport})
+	if err != nil {
+		log.WithError(err).Errorf("Unable to discover %s via ifaces %s.", targetPortal, ifaces)
+		return nil
 	}
+	return iscsi.discoverPortals(auth, bound, targetPortal...)
+}
+
+// Save the CHAP credential to the sendtargets discovery record of portal via iface
+func (iscsi *ISCSIConnector) setDiscoveryAuth(targetPortal string, iface string, auth CHAPCredential) error {
+	// The discovery record needs to be created before updating
+	iscsi.exec.Command("iscsiadm", "-m", "discoverydb", "-t", "sendtargets",
+		"-I", iface, "-p", targetPortal, "--op", string(OperationNew)).CombinedOutput()
+	for _, setting := range composeAuthSettings("discovery.sendtargets.auth", auth) {
+		operations := []string{
+			"-m", "discoverydb", "-t", "sendtargets", "-I", iface, "-p", targetPortal,
+			"--op", string(OperationUpdate), "-n", setting[0], "-v", setting[1],
+		}
+		if _, err := iscsi.exec.Command("iscsiadm", operations...).CombinedOutput(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save the CHAP credential to the node record before login
+func (iscsi *ISCSIConnector) setSessionAuth(target model.ISCSISession, auth CHAPCredential) error {
+	for _, setting := range composeAuthSettings("node.session.auth", auth) {
+		if err := iscsi.updateNode(target, setting[0], setting[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the key/value pairs of CHAP settings under prefix, like
+// node.session.auth.authmethod = CHAP
+func composeAuthSettings(prefix string, auth CHAPCredential) [][2]string {
+	settings := [][2]string{
+		{prefix + ".authmethod", "CHAP"},
+		{prefix + ".username", auth.Username},
+		{prefix + ".password", auth.Secret},
+	}
+	if auth.IsMutual() {
+		settings = append(settings,
+			[2]string{prefix + ".username_in", auth.UsernameIn},
+			[2]string{prefix + ".password_in", auth.SecretIn})
+	}
+	return settings
+}
+
+// Login the target portal if not logged in yet, failed login is retried
+// DefaultLoginRetries times.
+func (iscsi *ISCSIConnector) LoginPortal(targetPortal string, targetIqn string) error {
+	return iscsi.LoginPortalWithAuth(CHAPCredential{}, targetPortal, targetIqn)
+}
+
+// Login the target portal with CHAP authentication, the credential is saved
+// to the node record before the login, and the login fails if it can not be
+// saved.
+func (iscsi *ISCSIConnector) LoginPortalWithAuth(auth CHAPCredential, targetPortal string, targetIqn string) error {
+	target := model.ISCSISession{TargetPortal: targetPortal, TargetIqn: targetIqn}
+	return iscsi.loginTarget(iscsi.getIscsiSessions(), target, ConnectionProperty{SessionAuth: auth}).Err
+}
+
+// Logout the target portal and delete the node record, so the session
+// is not restored after reboot
+func (iscsi *ISCSIConnector) LogoutPortal(targetPortal string, targetIqn string) error {
+	return iscsi.logoutTarget(model.ISCSISession{TargetPortal: targetPortal, TargetIqn: targetIqn})
+}
+
+// Logout the target and delete its node record, only the session and record
+// of the iface are affected if the target is bound to an iface
+func (iscsi *ISCSIConnector) logoutTarget(target model.ISCSISession) error {
+	_, err := iscsi.exec.Command("iscsiadm", append(nodeArgs(target), "--logout")...).CombinedOutput()
+	if err != nil {
+		return err
+	}
+	_, err = iscsi.exec.Command("iscsiadm", append(nodeArgs(target),
+		"--op", string(OperationDelete))...).CombinedOutput()
 	return err
 }
 
+// Logout the sessions of the targets which have no SCSI device attached
+func (iscsi *ISCSIConnector) logoutOrphanedSessions(connectionProperty ConnectionProperty) {
+	for _, session := range iscsi.getIscsiSessions() {
+		if !iscsi.isTargetOf(session, connectionProperty) {
+			continue
+		}
+		iscsi.logoutOrphanedSession(session)
+	}
+}
+
+// Logout the session if no device is attached, the target is locked
+// exclusively so that no LUN is being connected in the meantime
+func (iscsi *ISCSIConnector) logoutOrphanedSession(session model.ISCSISession) {
+	locks, err := lock.AcquireContext(iscsi.ctx, nil, []string{lock.TargetKey(session.TargetIqn)})
+	if err != nil {
+		log.WithError(err).Warnf("Unable to lock target %s, skip logout.", session.TargetIqn)
+		return
+	}
+	defer locks.Release()
+	devices, err := linux.GetISCSISessionDevices(session.SessionId)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to get devices of session %s, skip logout.", session.SessionId)
+		return
+	}
+	if len(devices) > 0 {
+		log.Debugf("Devices %s are still attached under session %s, skip logout.", devices,
+			session.SessionId)
+		return
+	}
+	log.Infof("Logging out target %s, %s since no device attached.", session.TargetPortal,
+		session.TargetIqn)
+	if err := iscsi.logoutTarget(session); err != nil {
+		log.WithError(err).Warnf("Unable to logout target %s, %s.", session.TargetPortal,
+			session.TargetIqn)
+	}
+}
+
+// Check if the session belongs to the targets of connectionProperty
+func (iscsi *ISCSIConnector) isTargetOf(session model.ISCSISession, connectionProperty ConnectionProperty) bool {
+	if ifaces := boundIfaces(connectionProperty); len(ifaces) > 0 && !goockutil.Contains(sessionIface(session), ifaces) {
+		return false
+	}
+	for i, portal := range connectionProperty.TargetPortals {
+		if samePortal(portal, session.TargetPortal) && i < len(connectionProperty.TargetIqns) &&
+			connectionProperty.TargetIqns[i] == session.TargetIqn {
+			return true
+		}
+	}
+	return false
+}
+
 // Set the node to 'node.startup = automatic', it will login the portal
 // automatically after reboot
 func (iscsi *ISCSIConnector) SetNode2Auto(targetPortal string, targetIqn string) error {
-	operations := iscsi.composeISCSIOperation(targetPortal, targetIqn, OperationUpdate, "node.startup", "automatic")
+	target := model.ISCSISession{TargetPortal: targetPortal, TargetIqn: targetIqn}
+	return iscsi.updateNode(target, "node.startup", "automatic")
+}
+
+// Update the setting of the node record of target
+func (iscsi *ISCSIConnector) updateNode(target model.ISCSISession, key string, value string) error {
+	operations := iscsi.composeISCSIOperation(target, OperationUpdate, key, value)
 	_, err := iscsi.exec.Command("iscsiadm", operations...).CombinedOutput()
 	return err
 }
 
-func (iscsi *ISCSIConnector) composeISCSIOperation(targetPortal string, targetIqn string,
+func (iscsi *ISCSIConnector) composeISCSIOperation(target model.ISCSISession,
 	operation OPERATION_ENUM, key string, value string) []string {
-	return []string{
-		"-m", "node", "-p", targetPortal, "-T", targetIqn,
-		"--op", string(operation), "-n", key, "-v", value,
+	return append(nodeArgs(target), "--op", string(operation), "-n", key, "-v", value)
+}
+
+// Returns the iscsiadm arguments to select the node record of target, the
+// iface is selected if the target is bound to it, or all the records of the
+// target are selected.
+func nodeArgs(target model.ISCSISession) []string {
+	args := []string{"-m", "node", "-p", target.TargetPortal, "-T", target.TargetIqn}
+	if target.Iface != "" {
+		args = append(args, "-I", target.Iface)
 	}
+	return args
 }
 
 func (iscsi *ISCSIConnector) rescanISCSI() {
-	iscsi.exec.Command("iscsiadm", "-m", "session", "--rescan").CombinedOutput()
+	rescanWithLock(iscsi.ctx, func() {
+		iscsi.exec.Command("iscsiadm", "-m", "session", "--rescan").CombinedOutput()
+	})
 
 }
 
-// Return not logged portals for discovery
+// Return not logged portals for discovery, the portal is not logged in
+// unless there is a session via each of the bound ifaces.
 func (iscsi *ISCSIConnector) filterTargets(sessions []model.ISCSISession, connectionProperty ConnectionProperty) []string {
-	var currPortals []string
-	for _, session := range sessions {
-		currPortals = append(currPortals, session.TargetPortal)
-	}
-
+	ifaces := boundIfaces(connectionProperty)
 	targetPortals := connectionProperty.TargetPortals
 	var notLogged []string
 	for _, portal := range targetPortals {
-		if !goockutil.Contains(portal, currPortals) {
+		var loggedIfaces []string
+		for _, session := range sessions {
+			if samePortal(session.TargetPortal, portal) {
+				loggedIfaces = append(loggedIfaces, sessionIface(session))
+			}
+		}
+		logged := len(loggedIfaces) > 0
+		for _, iface := range ifaces {
+			logged = logged && goockutil.Contains(iface, loggedIfaces)
+		}
+		if !logged {
 			notLogged = append(notLogged, portal)
 		}
 	}
@@ -151,23 +531,28 @@ func (iscsi *ISCSIConnector) filterTargets(sessions []model.ISCSISession, connec
 }
 
 // Update the local kernel's size information
-func (iscsi *ISCSIConnector) ExtendVolume(connectionProperty ConnectionProperty) error {
-	var err error
-	paths := iscsi.getVolumePaths(connectionProperty)
-	paths, _ = goockutil.FilterPath(paths)
-
-	if len(paths) > 0 {
-		// Flush size of each single path
-		for _, path := range paths {
-			linux.ExtendDevice(path)
-		}
-		// Flush size for multipath descriptor
-		mpathId := linux.GetWWN(paths[0])
-		err = linux.ResizeMpath(mpathId)
-	} else {
-		err = fmt.Errorf("Unable to find any path to extend.")
+func (iscsi *ISCSIConnector) ExtendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	return iscsi.ExtendVolumeContext(iscsi.ctx, connectionProperty)
+}
+
+// ExtendVolumeContext is ExtendVolume which gives up once ctx is done
+func (iscsi *ISCSIConnector) ExtendVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	return iscsi.withContext(ctx).extendVolume(connectionProperty)
+}
+
+func (iscsi *ISCSIConnector) extendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	if err := checkTargetLuns(connectionProperty); err != nil {
+		return ExtendInfo{}, err
 	}
-	return err
+	targets, luns := iscsi.getLockKeys(connectionProperty)
+	locks, err := lockVolume(iscsi.ctx, targets, luns)
+	if err != nil {
+		return ExtendInfo{}, err
+	}
+	defer locks.Release()
+	paths := iscsi.findVolumePaths(connectionProperty)
+	return extendPaths(iscsi.ctx, "", paths)
 }
 
 // Attach the volume from the remote to the local
@@ -178,67 +563,253 @@ func (iscsi *ISCSIConnector) ExtendVolume(connectionProperty ConnectionProperty)
 //   MultipathId: <multipath id>
 //   Path: single path device description
 func (iscsi *ISCSIConnector) ConnectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	return iscsi.ConnectVolumeContext(iscsi.ctx, connectionProperty)
+}
+
+// ConnectVolumeContext is ConnectVolume which gives up once ctx is done,
+// the running iscsiadm commands are killed.
+func (iscsi *ISCSIConnector) ConnectVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	return iscsi.withContext(ctx).connectVolume(connectionProperty)
+}
+
+func (iscsi *ISCSIConnector) connectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	if err := checkTargetLuns(connectionProperty); err != nil {
+		return VolumeInfo{}, err
+	}
+	targets, luns := iscsi.getLockKeys(connectionProperty)
+	locks, err := lockVolume(iscsi.ctx, targets, luns)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	defer locks.Release()
+	results, err := iscsi.loginPortals(connectionProperty)
+	if err != nil {
+		return VolumeInfo{LoginResults: results}, err
+	}
+	iscsi.rescanISCSI()
+	return iscsi.attachVolume(connectionProperty, results)
+}
+
+// Log in the target portals which are not logged in yet
+func (iscsi *ISCSIConnector) loginPortals(connectionProperty ConnectionProperty) ([]LoginResult, error) {
+	var results []LoginResult
+	ifaces, err := iscsi.prepareIfaces(connectionProperty)
+	if err != nil {
+		log.WithError(err).Error("Unable to prepare the iSCSI ifaces.")
+		return nil, err
+	}
 	currSessions := iscsi.getIscsiSessions()
 	notLogged := iscsi.filterTargets(currSessions, connectionProperty)
 	if len(notLogged) > 0 {
 		log.Debugf("Discovering the target(s) by iscsiadm...")
-		discovered := iscsi.DiscoverPortal(notLogged...)
-		// login to the session as needed
-		// TODO(peter) can be accelerated by goroutine?
-		// but the os-brick says parallel login can crash open-iscsi
-		for _, newSession := range discovered {
-			iscsi.LoginPortal(newSession.TargetPortal, newSession.TargetIqn)
-			iscsi.SetNode2Auto(newSession.TargetPortal, newSession.TargetIqn)
-
+		discovered := iscsi.discoverPortals(connectionProperty.DiscoveryAuth, ifaces, notLogged...)
+		results = iscsi.LoginTargets(discovered, connectionProperty)
+		if err := checkLoginResults(results,
+			len(connectionProperty.TargetPortals)-len(notLogged), connectionProperty.MinLoginPaths); err != nil {
+			log.WithError(err).Errorf("Unable to login enough target portals within %s.", notLogged)
+			return results, err
 		}
-
 	}
-	iscsi.rescanISCSI()
-	info := VolumeInfo{}
-	possiblePaths := iscsi.getVolumePaths(connectionProperty)
-	accessiblePath, err := goockutil.WaitForAnyPath(possiblePaths, nil)
+	return results, nil
+}
+
+// Wait for the paths of the LUN on the logged in sessions, then find its wwn
+// and multipath device
+func (iscsi *ISCSIConnector) attachVolume(connectionProperty ConnectionProperty,
+	results []LoginResult) (VolumeInfo, error) {
+	info := VolumeInfo{LoginResults: results}
+	accessiblePath, err := goockutil.WaitForDeviceContext(iscsi.ctx, func() []string {
+		return iscsi.findVolumePaths(connectionProperty)
+	}, nil)
 	if err != nil {
-		log.WithError(err).Errorf("Unable to find any existing path within %s", possiblePaths)
+		log.WithError(err).Errorf("Unable to find any existing path within %s",
+			iscsi.getVolumePaths(connectionProperty))
 		return info, err
 	}
-	wwn := linux.GetWWN(accessiblePath)
+	wwn := linux.GetWWNContext(iscsi.ctx, accessiblePath)
 	log.Debugf("Found wwn [%s] for path %s.", wwn, accessiblePath)
-	if linux.IsMultipathEnabled() == true {
+	if linux.IsMultipathEnabledContext(iscsi.ctx) == true {
 		// for multipath, returns the multipath descriptor
 		log.Info("Multipath discovery for iSCSI enabled.")
-		mPath := linux.FindMpathByWwn(wwn)
 		info.Wwn = wwn
-		info.MultipathId = wwn
-		info.Multipath = mPath
-		info.Paths, _ = goockutil.FilterPath(possiblePaths)
+		info.Paths = iscsi.findVolumePaths(connectionProperty)
+		mPath, err := findMultipath(iscsi.ctx, wwn, info.Paths, connectionProperty.MultipathPolicy)
+		if err != nil {
+			log.WithError(err).Error("Unable to build the multipath map.")
+			return info, err
+		}
+		if mPath != "" {
+			info.MultipathId = wwn
+			info.Multipath = mPath
+		}
 		if connectionProperty.AccessMode == ReadWrite {
 			log.Debugf("Checking to see if multipath %s is writable.", mPath)
-			linux.CheckReadWrite(accessiblePath, wwn)
+			linux.CheckReadWriteContext(iscsi.ctx, accessiblePath, wwn)
 		}
 	} else {
 		// for single path, returns any of the found path
 		log.Debug("Multipath discovery for iSCSI disabled.")
-		newPath, _ := goockutil.FilterPath(possiblePaths)
+		newPath := iscsi.findVolumePaths(connectionProperty)
 		info.Wwn = wwn
 		info.Paths = newPath
 		info.Multipath = ""
 		info.MultipathId = ""
 
 	}
-	log.Debugf("ConnectVolume returning %s", info)
+	log.Debugf("ConnectVolume returning %+v", info)
 	return info, nil
 
 }
 
+// ConnectTarget logs in all the target portals of connectionProperty, scans
+// the sessions for all the LUNs and attaches every LUN found, TargetLuns is
+// ignored. The volumes are grouped by wwn, the volumes attached are returned
+// along with the error if some of the LUNs fail.
+func (iscsi *ISCSIConnector) ConnectTarget(connectionProperty ConnectionProperty) ([]VolumeInfo, error) {
+	return iscsi.ConnectTargetContext(iscsi.ctx, connectionProperty)
+}
+
+// ConnectTargetContext is ConnectTarget which gives up once ctx is done
+func (iscsi *ISCSIConnector) ConnectTargetContext(ctx context.Context,
+	connectionProperty ConnectionProperty) ([]VolumeInfo, error) {
+	return iscsi.withContext(ctx).connectTarget(connectionProperty)
+}
+
+func (iscsi *ISCSIConnector) connectTarget(connectionProperty ConnectionProperty) ([]VolumeInfo, error) {
+	if err := checkTargetIqns(connectionProperty); err != nil {
+		return nil, err
+	}
+	connectionProperty.TargetLuns = nil
+	targets, _ := iscsi.getLockKeys(connectionProperty)
+	locks, err := lockVolume(iscsi.ctx, targets, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer locks.Release()
+	results, err := iscsi.loginPortals(connectionProperty)
+	if err != nil {
+		return []VolumeInfo{{LoginResults: results}}, err
+	}
+	// Scan before looking up the LUNs, the sessions may be logged in already
+	rescan := iscsi.rescanTargets(connectionProperty)
+	rescan()
+	var lunIDs []int
+	err = goockutil.WaitForContext(iscsi.ctx, func() bool {
+		lunIDs = iscsi.findTargetLuns(connectionProperty)
+		return len(lunIDs) > 0
+	}, rescan)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to find any LUN on targets %s.", connectionProperty.TargetPortals)
+		return []VolumeInfo{{LoginResults: results}}, fmt.Errorf("no LUN found on targets %s: %s",
+			connectionProperty.TargetPortals, err)
+	}
+	log.Infof("Found LUN(s) %v on targets %s.", lunIDs, connectionProperty.TargetPortals)
+	var volumes []VolumeInfo
+	var failed []int
+	for _, lun := range lunIDs {
+		lunProperty := connectionProperty
+		lunProperty.TargetLuns = nil
+		for range connectionProperty.TargetPortals {
+			lunProperty.TargetLuns = append(lunProperty.TargetLuns, lun)
+		}
+		info, err := iscsi.attachLun(lunProperty)
+		if err != nil {
+			log.WithError(err).Errorf("Unable to attach LUN %d.", lun)
+			failed = append(failed, lun)
+			continue
+		}
+		info.Luns = []int{lun}
+		volumes = append(volumes, info)
+	}
+	volumes = groupVolumesByWwn(volumes)
+	if len(volumes) > 0 {
+		volumes[0].LoginResults = results
+	}
+	if len(failed) > 0 {
+		return volumes, fmt.Errorf("unable to attach LUN(s) %v of targets %s", failed, connectionProperty.TargetPortals)
+	}
+	return volumes, nil
+}
+
+// Attach a single LUN of the target with the LUN locked
+func (iscsi *ISCSIConnector) attachLun(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	_, luns := iscsi.getLockKeys(connectionProperty)
+	locks, err := lockVolume(iscsi.ctx, nil, luns)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	defer locks.Release()
+	return iscsi.attachVolume(connectionProperty, nil)
+}
+
+// Get the LUN IDs found on the sessions of all the target portals
+func (iscsi *ISCSIConnector) findTargetLuns(connectionProperty ConnectionProperty) []int {
+	var lunIDs []int
+	for i, portal := range connectionProperty.TargetPortals {
+		for _, lun := range linux.FindISCSILuns(portal, connectionProperty.TargetIqns[i]) {
+			if !goockutil.ContainsInt(lun, lunIDs) {
+				lunIDs = append(lunIDs, lun)
+			}
+		}
+	}
+	sort.Ints(lunIDs)
+	return lunIDs
+}
+
+// Returns the hook to scan all the LUNs on the hosts of the target sessions
+func (iscsi *ISCSIConnector) rescanTargets(connectionProperty ConnectionProperty) func() {
+	return func() {
+		var hosts [][]int
+		for i, portal := range connectionProperty.TargetPortals {
+			for _, host := range linux.FindISCSIHosts(portal, connectionProperty.TargetIqns[i]) {
+				hosts = append(hosts, []int{host, linux.Wildcard, linux.Wildcard})
+			}
+		}
+		log.WithFields(logrus.Fields{"hosts": hosts}).Debug("Scanning all the LUNs of the targets.")
+		rescanWithLock(iscsi.ctx, func() {
+			linux.RescanHostsContext(iscsi.ctx, hosts, linux.Wildcard)
+		})
+	}
+}
+
+// Detach the volume from the local, the sessions left without any device are
+// logged out unless KeepSessions is set
 func (iscsi *ISCSIConnector) DisconnectVolume(connectProperty ConnectionProperty) error {
+	return iscsi.DisconnectVolumeContext(iscsi.ctx, connectProperty)
+}
+
+// DisconnectVolumeContext is DisconnectVolume which gives up once ctx is done
+func (iscsi *ISCSIConnector) DisconnectVolumeContext(ctx context.Context, connectProperty ConnectionProperty) error {
+	return iscsi.withContext(ctx).disconnectVolume(connectProperty)
+}
 
-	possiblePaths := iscsi.getVolumePaths(connectProperty)
-	possiblePaths, _ = goockutil.FilterPath(possiblePaths)
-	if linux.IsMultipathEnabled() {
+func (iscsi *ISCSIConnector) disconnectVolume(connectProperty ConnectionProperty) error {
+	if err := checkTargetLuns(connectProperty); err != nil {
+		return err
+	}
+	targets, luns := iscsi.getLockKeys(connectProperty)
+	locks, err := lockVolume(iscsi.ctx, targets, luns)
+	if err != nil {
+		return err
+	}
+	err = iscsi.removeVolumePaths(connectProperty)
+	// Release the shared target locks before locking the targets for logout
+	locks.Release()
+	if err == nil && !connectProperty.KeepSessions {
+		iscsi.logoutOrphanedSessions(connectProperty)
+	}
+	return err
+}
+
+// Remove the multipath and the single paths of the volume
+func (iscsi *ISCSIConnector) removeVolumePaths(connectProperty ConnectionProperty) error {
+	possiblePaths := iscsi.findVolumePaths(connectProperty)
+	if linux.IsMultipathEnabledContext(iscsi.ctx) {
 		log.Info("Multipath discovery for iSCSI enabled.")
 		if len(possiblePaths) > 0 {
 			accessiblePath := possiblePaths[0]
-			wwn := linux.GetWWN(accessiblePath)
+			wwn := linux.GetWWNContext(iscsi.ctx, accessiblePath)
 			multipath := linux.FindMultipathByWwn(wwn)
 			if multipath.Wwn == "" {
 				// Sometimes the multipath is not found under specific path,
@@ -246,11 +817,16 @@ func (iscsi *ISCSIConnector) DisconnectVolume(connectProperty ConnectionProperty
 				log.Info("No any multipath path found for targets.")
 				return errors.New("Multipath is not found, skip the deletion.")
 			}
+			if err := checkDevicesUnused(multipath, nil, connectProperty.Force); err != nil {
+				return err
+			}
 			// First, remove the multipath descriptor
-			linux.FlushPath(multipath.Wwn)
+			if err := flushMultipath(iscsi.ctx, multipath.Wwn, connectProperty.Force); err != nil {
+				return err
+			}
 			// Secondary, remove every single path from scsi bus
 			for _, single := range multipath.Paths {
-				linux.RemoveSCSIDevice(single.DevNode)
+				linux.ForceRemoveSCSIDeviceContext(iscsi.ctx, single.DevNode)
 			}
 
 		} else {
@@ -258,17 +834,26 @@ func (iscsi *ISCSIConnector) DisconnectVolume(connectProperty ConnectionProperty
 		}
 	} else {
 		log.Info("Multipath discovery for iSCSI disabled.")
+		var devices []string
 		for _, path := range possiblePaths {
 			path, _ = filepath.EvalSymlinks(path)
-			linux.RemoveSCSIDevice(path)
+			devices = append(devices, path)
+		}
+		if err := checkDevicesUnused(model.Multipath{}, devices, connectProperty.Force); err != nil {
+			return err
+		}
+		for _, device := range devices {
+			linux.ForceRemoveSCSIDeviceContext(iscsi.ctx, device)
 		}
 
 	}
-	left := goockutil.WaitForPathRemoval(possiblePaths, 10)
+	left := goockutil.WaitForPathRemovalContext(iscsi.ctx, possiblePaths, 10)
+	if err := iscsi.ctx.Err(); err != nil {
+		return err
+	}
 	if len(left) > 0 {
 		log.Warnf("Paths still exist on system: %s.", left)
 		return errors.New(fmt.Sprintf("Paths %s are not removed from system.", left))
 	}
-	//TODO(peter) Need to check paths and logout targets that no path exists
 	return nil
 }
@@ -0,0 +1,245 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/peter-wangxu/goock/pkg/exec"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"sync"
+	"time"
+)
+
+type LoginStatus StringEnum
+
+const (
+	LoginSuccess         LoginStatus = "success"
+	LoginAlreadyLoggedIn LoginStatus = "already-logged-in"
+	LoginFailed          LoginStatus = "failed"
+)
+
+// Exit codes of iscsiadm, see include/iscsi_err.h of open-iscsi
+const (
+	iscsiErrSessionExists   = 15
+	iscsiErrNoObjsFound     = 21
+	iscsiErrLoginAuthFailed = 24
+)
+
+// Defaults of ConnectionProperty.LoginRetries and LoginRetryInterval
+const (
+	DefaultLoginRetries       = 2
+	DefaultLoginRetryInterval = time.Second
+	// Set to ConnectionProperty.LoginRetries to disable the retry
+	NoLoginRetry = -1
+)
+
+// LoginResult describes the login outcome of a single target portal
+type LoginResult struct {
+	TargetPortal string      `json:"targetPortal"`
+	TargetIqn    string      `json:"targetIqn"`
+	Status       LoginStatus `json:"status"`
+	// The iface which the target is bound to, empty if not bound
+	Iface string `json:"iface,omitempty"`
+	// Exit code of iscsiadm, only set when the login failed
+	ExitCode int   `json:"exitCode"`
+	Attempts int   `json:"attempts"`
+	Err      error `json:"-"`
+}
+
+// IsLoggedIn returns true if a session to the target portal exists
+func (r LoginResult) IsLoggedIn() bool {
+	return r.Status == LoginSuccess || r.Status == LoginAlreadyLoggedIn
+}
+
+func (r LoginResult) String() string {
+	target := fmt.Sprintf("%s,%s", r.TargetPortal, r.TargetIqn)
+	if r.Iface != "" {
+		target += " via " + r.Iface
+	}
+	if r.Status == LoginFailed {
+		return fmt.Sprintf("%s %s(exit code %d)", target, r.Status, r.ExitCode)
+	}
+	return fmt.Sprintf("%s %s", target, r.Status)
+}
+
+// MarshalJSON includes the error message of the failed login
+func (r LoginResult) MarshalJSON() ([]byte, error) {
+	type result LoginResult
+	var message string
+	if r.Err != nil {
+		message = r.Err.Error()
+	}
+	return json.Marshal(struct {
+		result
+		Error string `json:"error,omitempty"`
+	}{result(r), message})
+}
+
+// Returns the exit code of the failed command
+func getExitCode(err error) int {
+	if ee, ok := err.(exec.ExitError); ok {
+		return ee.ExitStatus()
+	}
+	return exec.Unknown
+}
+
+// LoginTargets logs in the targets with at most connectionProperty.LoginParallelism
+// logins at the same time, the results are in the same order of targets.
+// NOTE: os-brick says parallel login can crash open-iscsi, so the login is
+// serial by default.
+func (iscsi *ISCSIConnector) LoginTargets(targets []model.ISCSISession, connectionProperty ConnectionProperty) []LoginResult {
+	parallelism := connectionProperty.LoginParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	sessions := iscsi.getIscsiSessions()
+	results := make([]LoginResult, len(targets))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = iscsi.loginTarget(sessions, targets[i], connectionProperty)
+				if results[i].Status == LoginSuccess {
+					iscsi.setNode2Auto(targets[i])
+				}
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// Retries of a failed login, DefaultLoginRetries if not set
+func (connectionProperty ConnectionProperty) loginRetries() int {
+	if connectionProperty.LoginRetries < 0 {
+		return 0
+	}
+	if connectionProperty.LoginRetries == 0 {
+		return DefaultLoginRetries
+	}
+	return connectionProperty.LoginRetries
+}
+
+// Interval before the first retry, DefaultLoginRetryInterval if not set
+func (connectionProperty ConnectionProperty) loginRetryInterval() time.Duration {
+	if connectionProperty.LoginRetryInterval <= 0 {
+		return DefaultLoginRetryInterval
+	}
+	return connectionProperty.LoginRetryInterval
+}
+
+// Login a single target with the CHAP credential and retries of the
+// connection property
+func (iscsi *ISCSIConnector) loginTarget(sessions []model.ISCSISession, target model.ISCSISession,
+	connectionProperty ConnectionProperty) LoginResult {
+	auth := connectionProperty.SessionAuth
+	result := LoginResult{TargetPortal: target.TargetPortal, TargetIqn: target.TargetIqn, Iface: target.Iface}
+	for _, session := range sessions {
+		if session.TargetIqn == target.TargetIqn && samePortal(session.TargetPortal, target.TargetPortal) &&
+			(target.Iface == "" || sessionIface(session) == target.Iface) {
+			log.Debugf("Target %s, %s is already logged in via iface %s. skip login.", target.TargetPortal,
+				target.TargetIqn, sessionIface(session))
+			result.Status = LoginAlreadyLoggedIn
+			return result
+		}
+	}
+	if !auth.IsEmpty() {
+		// Login without the CHAP credential is never expected
+		if err := iscsi.setSessionAuth(target, auth); err != nil {
+			result.Status = LoginFailed
+			result.Err = fmt.Errorf("unable to set CHAP for target %s: %s", target.TargetIqn, err)
+			result.ExitCode = getExitCode(err)
+			log.WithError(err).Warnf("Unable to login target %s.", result)
+			return result
+		}
+	}
+	interval := connectionProperty.loginRetryInterval()
+	for {
+		result.Attempts++
+		_, err := iscsi.exec.Command("iscsiadm", append(nodeArgs(target), "--login")...).CombinedOutput()
+		if err == nil {
+			result.Status = LoginSuccess
+			break
+		}
+		result.Err = err
+		result.ExitCode = getExitCode(err)
+		if result.ExitCode == iscsiErrSessionExists {
+			// Logged in by others in the meantime
+			result.Status = LoginAlreadyLoggedIn
+			result.Err = nil
+			result.ExitCode = 0
+			break
+		}
+		result.Status = LoginFailed
+		if result.ExitCode == iscsiErrLoginAuthFailed || result.ExitCode == iscsiErrNoObjsFound ||
+			result.Attempts > connectionProperty.loginRetries() {
+			// Out of retries, or retry does not help
+			break
+		}
+		log.WithError(err).Debugf("Login to %s, %s failed, retry in %s.", target.TargetPortal,
+			target.TargetIqn, interval)
+		select {
+		case <-iscsi.ctx.Done():
+			result.Err = iscsi.ctx.Err()
+		case <-time.After(interval):
+		}
+		if iscsi.ctx.Err() != nil {
+			break
+		}
+		interval *= 2
+	}
+	if result.Status == LoginFailed {
+		log.WithError(result.Err).Warnf("Unable to login target %s.", result)
+	}
+	return result
+}
+
+// Set the newly logged in target to login automatically after reboot
+func (iscsi *ISCSIConnector) setNode2Auto(target model.ISCSISession) {
+	if err := iscsi.updateNode(target, "node.startup", "automatic"); err != nil {
+		log.WithError(err).Warnf("Unable to set node.startup to automatic for target %s, %s.",
+			target.TargetPortal, target.TargetIqn)
+	}
+}
+
+// Returns error if less than minPaths portals are logged in, loggedIn is the
+// number of portals which were logged in before the login.
+func checkLoginResults(results []LoginResult, loggedIn int, minPaths int) error {
+	if minPaths <= 0 {
+		minPaths = 1
+	}
+	var failed []string
+	for _, result := range results {
+		if result.IsLoggedIn() {
+			loggedIn++
+		} else {
+			failed = append(failed, result.String())
+		}
+	}
+	if loggedIn < minPaths {
+		return fmt.Errorf("Only %d path(s) logged in, at least %d required, failed: %s",
+			loggedIn, minPaths, failed)
+	}
+	return nil
+}
@@ -16,13 +16,18 @@ limitations under the License.
 package connector
 
 import (
+	"context"
 	"fmt"
+	"github.com/peter-wangxu/goock/pkg/exec"
 	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
 	"github.com/peter-wangxu/goock/pkg/model"
 	"github.com/peter-wangxu/goock/test"
 	goockutil "github.com/peter-wangxu/goock/pkg/util"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestISCSIConnector_GetHostInfo(t *testing.T) {
@@ -77,8 +82,11 @@ func TestISCSIConnector_ConnectVolume(t *testing.T) {
 func TestISCSIConnector_ConnectVolume_NotAll(t *testing.T) {
 	goockutil.SetExecutor(test.NewMockExecutor())
 	linux.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
 	iscsi := NewISCSIConnector()
 	fakeProperty := ConnectionProperty{}
+	fakeProperty.LoginRetryInterval = time.Millisecond
 	fakeProperty.TargetIqns = []string{
 		"iqn.1992-04.com.emc:cx.apm00152904558.b12",
 		"iqn.1992-04.com.emc:cx.apm00152904558.a12",
@@ -98,6 +106,88 @@ func TestISCSIConnector_ConnectVolume_NotAll(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("/dev/disk/by-id/dm-uuid-mpath-%s", info.Wwn), info.Multipath)
 	//assert.Equal(t, "/dev/disk/by-path/ip-192.168.3.50:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904558.b12-lun-11", info.Paths[0])
 	assert.Equal(t, "/dev/disk/by-path/ip-192.168.3.49:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904558.a12-lun-11", info.Paths[0])
+	assert.Len(t, info.LoginResults, 2)
+	// The discovery is concurrent, so the results are not ordered by portals
+	for _, result := range info.LoginResults {
+		if result.TargetPortal == "192.168.3.50:3260" {
+			assert.Equal(t, LoginFailed, result.Status)
+			assert.Equal(t, 8, result.ExitCode)
+			assert.Equal(t, 3, result.Attempts)
+		} else {
+			assert.Equal(t, LoginSuccess, result.Status)
+		}
+	}
+}
+
+// The map misses the path which is logged in, so the connect fails
+func TestISCSIConnector_ConnectVolume_MultipathRequired(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.LoginRetryInterval = time.Millisecond
+	fakeProperty.TargetIqns = []string{"iqn.1992-04.com.emc:cx.apm00152904558.a12"}
+	fakeProperty.TargetPortals = []string{"192.168.3.49:3260"}
+	fakeProperty.TargetLuns = []int{11}
+	fakeProperty.MultipathPolicy = MultipathRequired
+	info, err := iscsi.ConnectVolume(fakeProperty)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "[sdj]")
+	assert.Empty(t, info.Multipath)
+}
+
+func TestISCSIConnector_ConnectVolume_MinLoginPaths(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.LoginRetryInterval = time.Millisecond
+	fakeProperty.TargetIqns = []string{
+		"iqn.1992-04.com.emc:cx.apm00152904558.b12",
+		"iqn.1992-04.com.emc:cx.apm00152904558.a12",
+	}
+	fakeProperty.TargetPortals = []string{
+		"192.168.3.50:3260",
+		"192.168.3.49:3260",
+	}
+	fakeProperty.TargetLuns = []int{11, 11}
+	fakeProperty.LoginParallelism = 2
+	fakeProperty.MinLoginPaths = 2
+	info, err := iscsi.ConnectVolume(fakeProperty)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "192.168.3.50:3260")
+	assert.Len(t, info.LoginResults, 2)
+}
+
+func TestISCSIConnector_LoginTargets(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	targets := []model.ISCSISession{
+		{TargetPortal: "10.64.76.253:3260", TargetIqn: "iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1"},
+		{TargetPortal: "192.168.3.49:3260", TargetIqn: "iqn.1992-04.com.emc:cx.apm00152904558.a12"},
+		{TargetPortal: "192.168.3.50:3260", TargetIqn: "iqn.1992-04.com.emc:cx.apm00152904558.b12"},
+		{TargetPortal: "192.168.3.51:3260", TargetIqn: "iqn.1992-04.com.emc:cx.apm00152904558.a13"},
+		{TargetPortal: "192.168.3.52:3260", TargetIqn: "iqn.1992-04.com.emc:cx.apm00152904558.b13"},
+	}
+	results := iscsi.LoginTargets(targets, ConnectionProperty{LoginParallelism: 3, LoginRetryInterval: time.Millisecond})
+	assert.Len(t, results, 5)
+	assert.Equal(t, LoginAlreadyLoggedIn, results[0].Status)
+	assert.Equal(t, LoginSuccess, results[1].Status)
+	assert.Equal(t, 1, results[1].Attempts)
+	assert.Equal(t, LoginFailed, results[2].Status)
+	assert.Equal(t, 8, results[2].ExitCode)
+	assert.Equal(t, 3, results[2].Attempts)
+	// No retry for authorization failure
+	assert.Equal(t, LoginFailed, results[3].Status)
+	assert.Equal(t, 24, results[3].ExitCode)
+	assert.Equal(t, 1, results[3].Attempts)
+	assert.Equal(t, LoginAlreadyLoggedIn, results[4].Status)
+	assert.Nil(t, results[4].Err)
 }
 
 func TestISCSIConnector_ConnectVolumeNoMultipath(t *testing.T) {
@@ -147,7 +237,7 @@ func TestISCSIConnector_ExtendVolume(t *testing.T) {
 		19,
 		19,
 	}
-	err := iscsi.ExtendVolume(fakeProperty)
+	_, err := iscsi.ExtendVolume(fakeProperty)
 	assert.Nil(t, err)
 }
 
@@ -165,6 +255,454 @@ func TestISCSIConnector_ExtendVolumeNoAnyPath(t *testing.T) {
 	fakeProperty.TargetLuns = []int{
 		19,
 	}
-	err := iscsi.ExtendVolume(fakeProperty)
+	_, err := iscsi.ExtendVolume(fakeProperty)
+	assert.Error(t, err)
+}
+
+func TestISCSIConnector_ExtendVolumeViaSysfs(t *testing.T) {
+	linux.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	// The sessions have no link under /dev/disk/by-path
+	fakeProperty.TargetIqns = []string{
+		"iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59",
+		"iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59",
+	}
+	fakeProperty.TargetPortals = []string{
+		"10.64.77.10:3260",
+		"10.64.78.10:3260",
+	}
+	fakeProperty.TargetLuns = []int{3, 3}
+	assert.Equal(t, []string{"/dev/sdq", "/dev/sds"}, iscsi.(*ISCSIConnector).findVolumePaths(fakeProperty))
+	info, err := iscsi.ExtendVolume(fakeProperty)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/dev/sdq", "/dev/sds"}, info.Paths)
+}
+
+func TestISCSIConnector_findVolumePathsIfaces(t *testing.T) {
+	iscsi := NewISCSIConnector().(*ISCSIConnector)
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.2003-01.org.linux-iscsi.target7:sn.b2"}
+	fakeProperty.TargetPortals = []string{"10.64.79.10:3260"}
+	fakeProperty.TargetLuns = []int{2}
+	// The link under /dev/disk/by-path only points to the device of eth1
+	assert.Equal(t, []string{
+		"/dev/disk/by-path/ip-10.64.79.10:3260-iscsi-iqn.2003-01.org.linux-iscsi.target7:sn.b2-lun-2",
+	}, iscsi.findVolumePaths(fakeProperty))
+	fakeProperty.Ifaces = []string{"eth1", "eth2"}
+	assert.Equal(t, []string{"/dev/sdae", "/dev/sdaf"}, iscsi.findVolumePaths(fakeProperty))
+}
+
+// The paths are looked up by the portal, IQN and LUN of the same index
+func TestISCSIConnector_VolumeMismatch(t *testing.T) {
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.a", "iqn.a"}
+	fakeProperty.TargetPortals = []string{"10.0.0.1:3260", "10.0.0.2:3260"}
+	fakeProperty.TargetLuns = []int{1}
+	_, err := iscsi.ConnectVolume(fakeProperty)
+	assert.EqualError(t, err, "1 LUN(s) are given for 2 target portal(s)")
+	_, err = iscsi.ExtendVolume(fakeProperty)
+	assert.Error(t, err)
+	fakeProperty.TargetLuns = []int{1, 1}
+	fakeProperty.TargetIqns = []string{"iqn.a"}
+	assert.EqualError(t, iscsi.DisconnectVolume(fakeProperty), "1 target IQN(s) are given for 2 target portal(s)")
+}
+
+func TestCHAPCredential_String(t *testing.T) {
+	auth := CHAPCredential{Username: "user", Secret: "secret", UsernameIn: "target", SecretIn: "target-secret"}
+	assert.NotContains(t, fmt.Sprintf("%v", auth), "secret")
+	assert.NotContains(t, fmt.Sprintf("%+v", ConnectionProperty{SessionAuth: auth}), "secret")
+	assert.Contains(t, auth.String(), "user")
+	assert.True(t, auth.IsMutual())
+	assert.False(t, auth.IsEmpty())
+	assert.True(t, CHAPCredential{}.IsEmpty())
+}
+
+func TestCHAPCredential_Validate(t *testing.T) {
+	assert.Nil(t, CHAPCredential{}.Validate())
+	assert.Nil(t, CHAPCredential{Username: "user", Secret: "secret"}.Validate())
+	assert.Nil(t, CHAPCredential{Username: "user", Secret: "secret", UsernameIn: "target", SecretIn: "target-secret"}.Validate())
+	assert.EqualError(t, CHAPCredential{Username: "user"}.Validate(),
+		"the CHAP username and secret must be given together")
+	assert.EqualError(t, CHAPCredential{Username: "user", Secret: "secret", SecretIn: "target-secret"}.Validate(),
+		"the mutual CHAP username and secret must be given together")
+	assert.EqualError(t, CHAPCredential{UsernameIn: "target", SecretIn: "target-secret"}.Validate(),
+		"the mutual CHAP requires the CHAP username and secret as well")
+	assert.EqualError(t, ValidateCHAPCredentials(CHAPCredential{}, CHAPCredential{Secret: "secret"}),
+		"invalid discovery credential: the CHAP username and secret must be given together")
+}
+
+func TestISCSIConnector_DiscoverPortalWithAuth(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	sessions := iscsi.DiscoverPortalWithAuth(CHAPCredential{Username: "user", Secret: "secret"},
+		"10.244.213.177")
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "iqn.1992-04.com.emc:cx.fnm00150600267.a0", sessions[0].TargetIqn)
+}
+
+func TestISCSIConnector_DiscoverPortalWithIfacesContext(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	model.SetExecutor(mockExec)
+	defer model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	sessions := iscsi.DiscoverPortalWithIfacesContext(context.Background(), CHAPCredential{},
+		[]string{"iface0"}, TransportTCP, "10.244.213.177")
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "iface0", sessions[0].Iface)
+	assert.Equal(t, []string{"iscsiadm -m discovery -t sendtargets -I iface0 -p 10.244.213.177 --op new"},
+		mockExec.commands)
+
+	// Nothing is discovered via the bogus iface
+	sessions = iscsi.DiscoverPortalWithIfacesContext(context.Background(), CHAPCredential{},
+		[]string{"bogus"}, "", "10.244.213.177")
+	assert.Len(t, sessions, 0)
+}
+
+func TestISCSIConnector_SetSessionAuth(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	iscsi := &ISCSIConnector{exec: executor, ctx: context.Background()}
+	target := model.ISCSISession{TargetPortal: "110.244.213.177:3260",
+		TargetIqn: "iqn.1992-04.com.emc:cx.fnm00150600267.a0"}
+	err := iscsi.setSessionAuth(target,
+		CHAPCredential{Username: "user", Secret: "secret", UsernameIn: "target", SecretIn: "target-secret"})
+	assert.Nil(t, err)
+	err = iscsi.setSessionAuth(target, CHAPCredential{Username: "user", Secret: "wrong"})
+	assert.Error(t, err)
+}
+
+func TestISCSIConnector_LoginPortalWithAuth(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	err := iscsi.LoginPortalWithAuth(CHAPCredential{Username: "user", Secret: "secret"},
+		"110.244.213.177:3260", "iqn.1992-04.com.emc:cx.fnm00150600267.a0")
+	assert.Nil(t, err)
+}
+
+// The login is not tried if the CHAP credential can not be saved
+func TestISCSIConnector_loginTargetAuthFailed(t *testing.T) {
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	iscsi := &ISCSIConnector{exec: mockExec, ctx: context.Background()}
+	target := model.ISCSISession{TargetPortal: "110.244.213.177:3260",
+		TargetIqn: "iqn.1992-04.com.emc:cx.fnm00150600267.a0"}
+	result := iscsi.loginTarget(nil, target, ConnectionProperty{SessionAuth: CHAPCredential{Username: "user", Secret: "wrong"}})
+	assert.Equal(t, LoginFailed, result.Status)
+	assert.Error(t, result.Err)
+	for _, command := range mockExec.commands {
+		assert.NotContains(t, command, "--login")
+	}
+}
+
+func TestISCSIConnector_LogoutPortal(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	err := iscsi.LogoutPortal("11.64.76.253:3260", "iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2")
+	assert.Nil(t, err)
+	err = iscsi.LogoutPortal("10.64.76.253:3260", "iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1")
+	assert.Error(t, err)
+}
+
+func TestISCSIConnector_DisconnectVolumeLogout(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	SetExecutor(mockExec)
+	defer SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{
+		"iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1",
+		"iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2",
+	}
+	fakeProperty.TargetPortals = []string{
+		"10.64.76.253:3260",
+		"11.64.76.253:3260",
+	}
+	fakeProperty.TargetLuns = []int{12, 12}
+	err := iscsi.DisconnectVolume(fakeProperty)
+	assert.Nil(t, err)
+	// Only session 2 has no device attached
+	assert.Contains(t, mockExec.commands,
+		"iscsiadm -m node -p 11.64.76.253:3260 -T iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2 --logout")
+	assert.NotContains(t, mockExec.commands,
+		"iscsiadm -m node -p 10.64.76.253:3260 -T iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1 --logout")
+
+	mockExec.commands = nil
+	fakeProperty.KeepSessions = true
+	err = iscsi.DisconnectVolume(fakeProperty)
+	assert.Nil(t, err)
+	assert.NotContains(t, mockExec.commands,
+		"iscsiadm -m node -p 11.64.76.253:3260 -T iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2 --logout")
+}
+
+func TestISCSIConnector_DisconnectVolumeLocked(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	defer setLockTimeout(100 * time.Millisecond)()
+	held, _ := lock.Exclusive(lock.LunKey("iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1", 12))
+	defer held.Release()
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1"}
+	fakeProperty.TargetPortals = []string{"10.64.76.253:3260"}
+	fakeProperty.TargetLuns = []int{12}
+	err := iscsi.DisconnectVolume(fakeProperty)
+	assert.IsType(t, &lock.TimeoutError{}, err)
+	assert.Contains(t, err.Error(), "lun-iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1-12")
+}
+
+func TestISCSIConnector_DisconnectVolumeTargetInUse(t *testing.T) {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	SetExecutor(mockExec)
+	defer SetExecutor(test.NewMockExecutor())
+	defer setLockTimeout(100 * time.Millisecond)()
+	// Another LUN of the target is being connected
+	held, _ := lock.Acquire([]string{lock.TargetKey("iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2")}, nil)
+	defer held.Release()
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2"}
+	fakeProperty.TargetPortals = []string{"11.64.76.253:3260"}
+	fakeProperty.TargetLuns = []int{12}
+	err := iscsi.DisconnectVolume(fakeProperty)
+	assert.Nil(t, err)
+	assert.NotContains(t, mockExec.commands,
+		"iscsiadm -m node -p 11.64.76.253:3260 -T iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2 --logout")
+}
+
+func TestISCSIConnector_findTargetLuns(t *testing.T) {
+	iscsi := &ISCSIConnector{}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{
+		"iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59",
+		"iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59",
+	}
+	fakeProperty.TargetPortals = []string{"10.64.78.10:3260", "10.64.77.10:3260"}
+	assert.Equal(t, []int{3, 4}, iscsi.findTargetLuns(fakeProperty))
+}
+
+// All the LUNs are scanned on the hosts of the sessions
+func TestISCSIConnector_rescanTargets(t *testing.T) {
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	linux.SetExecutor(mockExec)
+	defer linux.SetExecutor(test.NewMockExecutor())
+	iscsi := &ISCSIConnector{exec: test.NewMockExecutor(), ctx: context.Background()}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{
+		"iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59",
+		"iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59",
+	}
+	fakeProperty.TargetPortals = []string{"10.64.77.10:3260", "10.64.78.10:3260"}
+	iscsi.rescanTargets(fakeProperty)()
+	assert.Equal(t, []string{
+		"tee -a /sys/class/scsi_host/host12/scan",
+		"tee -a /sys/class/scsi_host/host13/scan",
+	}, mockExec.commands)
+}
+
+// The login fails, so no LUN is attached
+func TestISCSIConnector_ConnectTargetLoginFailed(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.LoginRetryInterval = time.Millisecond
+	fakeProperty.TargetIqns = []string{"iqn.1992-04.com.emc:cx.apm00152904558.b12"}
+	fakeProperty.TargetPortals = []string{"192.168.3.50:3260"}
+	fakeProperty.TargetLuns = []int{0}
+	volumes, err := iscsi.ConnectTarget(fakeProperty)
+	assert.Error(t, err)
+	assert.Len(t, volumes, 1)
+	assert.Empty(t, volumes[0].Wwn)
+	assert.Len(t, volumes[0].LoginResults, 1)
+	assert.Equal(t, LoginFailed, volumes[0].LoginResults[0].Status)
+}
+
+// The portals and IQNs are indexed together, so their numbers must match
+func TestISCSIConnector_ConnectTargetMismatch(t *testing.T) {
+	iscsi := NewISCSIConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.1992-04.com.emc:cx.apm00152904558.b12"}
+	fakeProperty.TargetPortals = []string{"192.168.3.50:3260", "192.168.3.51:3260"}
+	volumes, err := iscsi.ConnectTarget(fakeProperty)
+	assert.EqualError(t, err, "1 target IQN(s) are given for 2 target portal(s)")
+	assert.Empty(t, volumes)
+}
+
+func TestISCSIConnector_getLockKeys(t *testing.T) {
+	iscsi := &ISCSIConnector{}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.a", "iqn.a", ""}
+	fakeProperty.TargetPortals = []string{"10.0.0.1:3260", "10.0.0.2:3260", "10.0.0.3:3260"}
+	fakeProperty.TargetLuns = []int{1, 1, 1}
+	targets, luns := iscsi.getLockKeys(fakeProperty)
+	assert.Equal(t, []string{"iqn.a", "10.0.0.3:3260"}, targets)
+	assert.Equal(t, []string{"lun-iqn.a-1", "lun-iqn.a-1", "lun-10.0.0.3:3260-1"}, luns)
+}
+
+func TestISCSIConnector_getVolumePathsIPv6(t *testing.T) {
+	iscsi := &ISCSIConnector{}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.a", "iqn.a", "iqn.b"}
+	fakeProperty.TargetPortals = []string{"[FD00:10:0::20]:3260", "fd00:10::21", "10.0.0.1"}
+	fakeProperty.TargetLuns = []int{1, 1, 2}
+	paths := iscsi.getVolumePaths(fakeProperty)
+	assert.Equal(t, []string{
+		"/dev/disk/by-path/ip-fd00:10::20:3260-iscsi-iqn.a-lun-1",
+		"/dev/disk/by-path/ip-fd00:10::21:3260-iscsi-iqn.a-lun-1",
+		"/dev/disk/by-path/ip-10.0.0.1:3260-iscsi-iqn.b-lun-2"}, paths)
+}
+
+func TestISCSIConnector_filterTargetsNormalized(t *testing.T) {
+	iscsi := &ISCSIConnector{}
+	sessions := []model.ISCSISession{
+		{TargetPortal: "[fd00:10::20]:3260", TargetIqn: "iqn.a"},
+		{TargetPortal: "10.0.0.1:3260", TargetIqn: "iqn.b"},
+	}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.a", "iqn.b", "iqn.a"}
+	fakeProperty.TargetPortals = []string{"FD00:10:0::20", "10.0.0.1", "[fd00:10::20]:3261"}
+	assert.Equal(t, []string{"[fd00:10::20]:3261"}, iscsi.filterTargets(sessions, fakeProperty))
+	assert.True(t, iscsi.isTargetOf(sessions[0], fakeProperty))
+}
+
+func TestISCSIConnector_getLockKeysNormalized(t *testing.T) {
+	iscsi := &ISCSIConnector{}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"", ""}
+	fakeProperty.TargetPortals = []string{"[FD00::1]", "fd00:0::1"}
+	fakeProperty.TargetLuns = []int{1, 1}
+	targets, luns := iscsi.getLockKeys(fakeProperty)
+	assert.Equal(t, []string{"[fd00::1]:3260"}, targets)
+	assert.Equal(t, []string{"lun-[fd00::1]:3260-1", "lun-[fd00::1]:3260-1"}, luns)
+}
+
+func TestISCSIConnector_prepareIfaces(t *testing.T) {
+	iscsi := &ISCSIConnector{exec: test.NewMockExecutor(), ctx: context.Background()}
+	ifaces, err := iscsi.prepareIfaces(ConnectionProperty{})
+	assert.Nil(t, err)
+	assert.Nil(t, ifaces)
+	ifaces, err = iscsi.prepareIfaces(ConnectionProperty{Ifaces: []string{"iface0"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"iface0"}, ifaces)
+	// The iser iface is used if no iface given
+	ifaces, err = iscsi.prepareIfaces(ConnectionProperty{Transport: TransportISER})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"iser"}, ifaces)
+
+	_, err = iscsi.prepareIfaces(ConnectionProperty{Transport: "rdma"})
+	assert.Error(t, err)
+	_, err = iscsi.prepareIfaces(ConnectionProperty{Transport: TransportBnx2i})
+	assert.Error(t, err)
+	// iface0 is of transport tcp
+	_, err = iscsi.prepareIfaces(ConnectionProperty{Ifaces: []string{"iface0"}, Transport: TransportCxgb4i})
+	assert.Error(t, err)
+	// Neither an iface nor a NIC
+	_, err = iscsi.prepareIfaces(ConnectionProperty{Ifaces: []string{"bogus"}})
 	assert.Error(t, err)
 }
+
+// The iface is created for the NIC without iface
+func TestISCSIConnector_validateIfaceTransportNIC(t *testing.T) {
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	iscsi := &ISCSIConnector{exec: mockExec, ctx: context.Background()}
+	assert.Nil(t, iscsi.validateIfaceTransport("eth2", ""))
+	assert.Equal(t, []string{
+		"iscsiadm -m iface -I eth2",
+		"iscsiadm -m iface -I eth2 --op new",
+		"iscsiadm -m iface -I eth2 --op update -n iface.transport_name -v tcp",
+		"iscsiadm -m iface -I eth2 --op update -n iface.net_ifacename -v eth2",
+	}, mockExec.commands)
+
+	// The offload iface is bound to the MAC address
+	mockExec.commands = nil
+	assert.Nil(t, iscsi.validateIfaceTransport("eth2", TransportBnx2i))
+	assert.Equal(t, []string{
+		"iscsiadm -m iface -I eth2",
+		"iscsiadm -m iface -I eth2 --op new",
+		"iscsiadm -m iface -I eth2 --op update -n iface.transport_name -v bnx2i",
+		"iscsiadm -m iface -I eth2 --op update -n iface.hwaddress -v 00:0c:29:3e:1a:02",
+	}, mockExec.commands)
+}
+
+func TestISCSIConnector_filterTargetsIfaces(t *testing.T) {
+	iscsi := &ISCSIConnector{}
+	sessions := []model.ISCSISession{
+		{TargetPortal: "10.0.0.1:3260", TargetIqn: "iqn.a", Iface: "eth1"},
+		{TargetPortal: "10.0.0.1:3260", TargetIqn: "iqn.a", Iface: "eth2"},
+		{TargetPortal: "10.0.0.2:3260", TargetIqn: "iqn.a", Iface: "eth1"},
+		{TargetPortal: "10.0.0.3:3260", TargetIqn: "iqn.a"},
+	}
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetIqns = []string{"iqn.a", "iqn.a", "iqn.a"}
+	fakeProperty.TargetPortals = []string{"10.0.0.1:3260", "10.0.0.2:3260", "10.0.0.3:3260"}
+	assert.Empty(t, iscsi.filterTargets(sessions, fakeProperty))
+	fakeProperty.Ifaces = []string{"eth1", "eth2"}
+	assert.Equal(t, []string{"10.0.0.2:3260", "10.0.0.3:3260"}, iscsi.filterTargets(sessions, fakeProperty))
+	// The session of unknown iface is via the default iface
+	fakeProperty.Ifaces = []string{"default"}
+	assert.Equal(t, []string{"10.0.0.1:3260", "10.0.0.2:3260"}, iscsi.filterTargets(sessions, fakeProperty))
+
+	fakeProperty.Ifaces = []string{"eth2"}
+	assert.True(t, iscsi.isTargetOf(sessions[1], fakeProperty))
+	assert.False(t, iscsi.isTargetOf(sessions[2], fakeProperty))
+}
+
+// The target bound to the iface is logged in via the iface, the session via
+// other iface does not count
+func TestISCSIConnector_loginTargetIface(t *testing.T) {
+	mockExec := &recordExecutor{Interface: test.NewMockExecutor()}
+	iscsi := &ISCSIConnector{exec: mockExec, ctx: context.Background()}
+	sessions := []model.ISCSISession{{TargetPortal: "10.0.0.1:3260", TargetIqn: "iqn.a", Iface: "eth1"}}
+	target := model.ISCSISession{TargetPortal: "10.0.0.1:3260", TargetIqn: "iqn.a", Iface: "eth1"}
+	result := iscsi.loginTarget(sessions, target, ConnectionProperty{})
+	assert.Equal(t, LoginAlreadyLoggedIn, result.Status)
+	assert.Empty(t, mockExec.commands)
+
+	target.Iface = "eth2"
+	result = iscsi.loginTarget(sessions, target, ConnectionProperty{})
+	assert.Equal(t, LoginSuccess, result.Status)
+	assert.Equal(t, "eth2", result.Iface)
+	assert.Equal(t, []string{"iscsiadm -m node -p 10.0.0.1:3260 -T iqn.a -I eth2 --login"}, mockExec.commands)
+	assert.Equal(t, "10.0.0.1:3260,iqn.a via eth2 success", result.String())
+}
+
+// recordExecutor records the executed commands
+type recordExecutor struct {
+	exec.Interface
+	commands []string
+}
+
+func (r *recordExecutor) Command(cmd string, args ...string) exec.Cmd {
+	r.commands = append(r.commands, strings.Join(append([]string{cmd}, args...), " "))
+	return r.Interface.Command(cmd, args...)
+}
+
+func (r *recordExecutor) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	r.commands = append(r.commands, strings.Join(append([]string{cmd}, args...), " "))
+	return r.Interface.CommandContext(ctx, cmd, args...)
+}
+
+func TestISCSIConnector_LoginTargetsNoRetry(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	iscsi := NewISCSIConnector()
+	targets := []model.ISCSISession{
+		{TargetPortal: "192.168.3.50:3260", TargetIqn: "iqn.1992-04.com.emc:cx.apm00152904558.b12"},
+	}
+	results := iscsi.LoginTargets(targets, ConnectionProperty{LoginRetries: NoLoginRetry})
+	assert.Len(t, results, 1)
+	assert.Equal(t, LoginFailed, results[0].Status)
+	assert.Equal(t, 1, results[0].Attempts)
+}
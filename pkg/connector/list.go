@@ -0,0 +1,290 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connector
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+)
+
+// States of the attached volume
+const (
+	// All the paths are usable
+	VolumeActive = "active"
+	// Some of the paths are failed or offline
+	VolumeDegraded = "degraded"
+	// None of the paths is usable
+	VolumeFailed = "failed"
+)
+
+// PathInfo describes a path of the attached volume
+type PathInfo struct {
+	// SCSI address like 9:0:0:10, empty for NVMe
+	Hctl string `json:"hctl,omitempty"`
+	// Like /dev/sdb, or the controller like /dev/nvme0 for NVMe
+	Device    string     `json:"device"`
+	Transport StringEnum `json:"transport,omitempty"`
+	// Target IQN, port wwn or NQN
+	Target string `json:"target,omitempty"`
+	// Only for iSCSI and NVMe/TCP
+	Portal string `json:"portal,omitempty"`
+	// SCSI device state like running or offline, controller state like live for NVMe
+	State string `json:"state,omitempty"`
+	// Only for the paths in a multipath map, like active or failed
+	DmStatus string `json:"dmStatus,omitempty"`
+	// Only for the paths in a multipath map, like ready, ghost or faulty
+	PathStatus string `json:"pathStatus,omitempty"`
+}
+
+// IsUsable tests if the IO could be sent via the path
+func (p PathInfo) IsUsable() bool {
+	switch {
+	case p.State != "" && p.State != "running" && p.State != "live":
+		return false
+	case p.DmStatus == "failed":
+		return false
+	case p.PathStatus == "faulty" || p.PathStatus == "shaky":
+		return false
+	}
+	return true
+}
+
+// AttachedVolume describes a LUN or namespace attached to the host, the size
+// is in bytes
+type AttachedVolume struct {
+	Wwn string `json:"wwn"`
+	// LUN ID, or namespace ID for NVMe
+	Lun       int        `json:"lun"`
+	Multipath string     `json:"multipath,omitempty"`
+	Size      int64      `json:"size"`
+	ReadOnly  bool       `json:"readOnly"`
+	Vendor    string     `json:"vendor,omitempty"`
+	Product   string     `json:"product,omitempty"`
+	State     string     `json:"state"`
+	Paths     []PathInfo `json:"paths"`
+}
+
+// HasTarget tests if any path of the volume is via target, which is a
+// target IQN, port wwn, NQN or portal with optional port
+func (v AttachedVolume) HasTarget(target string) bool {
+	wwn := strings.ToLower(strings.Replace(strings.TrimPrefix(target, "0x"), ":", "", -1))
+	address, port := model.SplitPortal(target, "")
+	for _, path := range v.Paths {
+		if strings.EqualFold(path.Target, target) || (path.Transport == FcProtocol && path.Target == wwn) {
+			return true
+		}
+		if path.Portal == "" {
+			continue
+		}
+		pathAddress, pathPort := model.SplitPortal(path.Portal, "")
+		if model.NormalizeAddress(pathAddress) == model.NormalizeAddress(address) && (port == "" || port == pathPort) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListVolumes returns the volumes attached to the host. The iSCSI sessions,
+// FC remote ports and NVMe subsystems are cross-referenced with the
+// multipath maps and sysfs, nothing on the host is changed.
+func ListVolumes() []AttachedVolume {
+	paths := listSCSIPaths()
+	var volumes []AttachedVolume
+	grouped := map[string]bool{}
+	for _, multipath := range model.NewMultipath() {
+		volume := AttachedVolume{Wwn: multipath.Wwn, Vendor: multipath.Vendor, Product: multipath.Product}
+		if multipath.DmDeviceName != "" && multipath.DmDeviceName != "undef" {
+			volume.Multipath = "/dev/" + multipath.DmDeviceName
+		}
+		for _, single := range multipath.Paths {
+			path, ok := paths[single.DevNode]
+			if !ok {
+				// Neither an iSCSI nor a FC path known to sysfs
+				path = PathInfo{
+					Hctl:   fmt.Sprintf("%d:%d:%d:%d", single.Host, single.Channel, single.Id, single.Lun),
+					Device: "/dev/" + single.DevNode,
+					State:  single.OnlineStatus,
+				}
+			}
+			path.DmStatus = single.DmStatus
+			path.PathStatus = single.PathStatus
+			volume.Lun = single.Lun
+			volume.Paths = append(volume.Paths, path)
+			grouped[single.DevNode] = true
+		}
+		volumes = append(volumes, volume)
+	}
+
+	// The single paths which are not in any multipath map, grouped by wwn
+	var names []string
+	for name := range paths {
+		if !grouped[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	singles := map[string]int{}
+	for _, name := range names {
+		path := paths[name]
+		wwn := linux.GetWWN(path.Device)
+		if i, ok := singles[wwn]; ok && wwn != "" {
+			volumes[i].Paths = append(volumes[i].Paths, path)
+			continue
+		}
+		volume := AttachedVolume{Wwn: wwn, Lun: hctlLun(path.Hctl), Paths: []PathInfo{path}}
+		volume.Vendor, _ = sysfs.ReadAttr(filepath.Join(linux.SCSIDevicePath, path.Hctl, "vendor"))
+		volume.Product, _ = sysfs.ReadAttr(filepath.Join(linux.SCSIDevicePath, path.Hctl, "model"))
+		singles[wwn] = len(volumes)
+		volumes = append(volumes, volume)
+	}
+
+	volumes = append(volumes, listNVMeVolumes()...)
+	for i := range volumes {
+		volumes[i].complete()
+	}
+	return volumes
+}
+
+// Fills the size, read only and state of the volume from its paths
+func (v *AttachedVolume) complete() {
+	device := v.Multipath
+	if device == "" && len(v.Paths) > 0 {
+		device = v.Paths[0].Device
+	}
+	name := filepath.Base(device)
+	if sectors, err := sysfs.ReadAttr(filepath.Join(model.BlockPath, name, "size")); err == nil {
+		size, _ := strconv.ParseInt(sectors, 10, 64)
+		// The size is always in 512-byte sectors
+		v.Size = size * 512
+	}
+	ro, _ := sysfs.ReadAttr(filepath.Join(model.BlockPath, name, "ro"))
+	v.ReadOnly = ro == "1"
+	usable := 0
+	for _, path := range v.Paths {
+		if path.IsUsable() {
+			usable++
+		}
+	}
+	switch {
+	case usable == 0:
+		v.State = VolumeFailed
+	case usable < len(v.Paths):
+		v.State = VolumeDegraded
+	default:
+		v.State = VolumeActive
+	}
+}
+
+// Returns the SCSI paths under the iSCSI sessions and FC remote ports by
+// the block device name, like sdb
+func listSCSIPaths() map[string]PathInfo {
+	paths := map[string]PathInfo{}
+	for _, session := range linux.GetISCSISessions() {
+		targets, _ := sysfs.ListDir(session.DevicePath, `^target\d+:\d+:\d+$`)
+		for _, target := range targets {
+			addTargetPaths(paths, filepath.Join(session.DevicePath, target), PathInfo{
+				Transport: IscsiProtocol,
+				Target:    session.TargetIqn,
+				Portal:    net.JoinHostPort(session.Address, session.Port),
+			})
+		}
+	}
+	for _, target := range model.NewFibreChannelTarget() {
+		addTargetPaths(paths, target.DevicePath, PathInfo{Transport: FcProtocol, Target: target.PortName})
+	}
+	return paths
+}
+
+// Adds the block devices of the LUNs under the SCSI target
+func addTargetPaths(paths map[string]PathInfo, targetPath string, template PathInfo) {
+	hctls, _ := sysfs.ListDir(targetPath, `^\d+:\d+:\d+:\d+$`)
+	for _, hctl := range hctls {
+		for _, device := range linux.GetBlockDevices(hctl) {
+			path := template
+			path.Hctl = hctl
+			path.Device = device
+			path.State, _ = sysfs.ReadAttr(filepath.Join(linux.SCSIDevicePath, hctl, "state"))
+			paths[filepath.Base(device)] = path
+		}
+	}
+}
+
+// Returns the LUN of the SCSI address, 10 of 9:0:0:10
+func hctlLun(hctl string) int {
+	var host, channel, target, lun int
+	fmt.Sscanf(hctl, "%d:%d:%d:%d", &host, &channel, &target, &lun)
+	return lun
+}
+
+// Returns the NVMe namespaces, the paths are the controllers of the subsystem
+func listNVMeVolumes() []AttachedVolume {
+	wwns := nvmeNamespaceWwns()
+	var volumes []AttachedVolume
+	for _, subsystem := range model.NewNVMeSubsystem() {
+		var paths []PathInfo
+		for _, controller := range subsystem.Paths {
+			path := PathInfo{
+				Device:    "/dev/" + controller.Name,
+				Transport: NVMeTCPProtocol,
+				Target:    subsystem.Nqn,
+				State:     controller.State,
+			}
+			if address := controller.GetTargetAddress(); address != "" {
+				path.Portal = net.JoinHostPort(address, controller.GetTargetPort())
+			}
+			paths = append(paths, path)
+		}
+		for _, namespace := range linux.GetNVMeNamespaces(subsystem.Name) {
+			var controller, id int
+			fmt.Sscanf(namespace, "nvme%dn%d", &controller, &id)
+			volumes = append(volumes, AttachedVolume{
+				Wwn:       wwns[namespace],
+				Lun:       id,
+				Multipath: "/dev/" + namespace,
+				Paths:     paths,
+			})
+		}
+	}
+	return volumes
+}
+
+// Returns the wwns like eui.<nguid> or uuid.<uuid> of the NVMe namespaces by
+// the device name, from the links under /dev/disk/by-id
+func nvmeNamespaceWwns() map[string]string {
+	wwns := map[string]string{}
+	links, _ := sysfs.ListDir("/dev/disk/by-id", `^nvme-(eui|uuid)\.`)
+	for _, link := range links {
+		device, err := sysfs.RealPath(filepath.Join("/dev/disk/by-id", link))
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(device)
+		// The eui is preferred, like the connect
+		if _, ok := wwns[name]; !ok || strings.HasPrefix(link, "nvme-eui.") {
+			wwns[name] = strings.TrimPrefix(link, "nvme-")
+		}
+	}
+	return wwns
+}
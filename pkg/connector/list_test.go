@@ -0,0 +1,98 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connector
+
+import (
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Returns the listed volume of wwn
+func findVolume(volumes []AttachedVolume, wwn string) (AttachedVolume, bool) {
+	for _, volume := range volumes {
+		if volume.Wwn == wwn {
+			return volume, true
+		}
+	}
+	return AttachedVolume{}, false
+}
+
+func TestListVolumes(t *testing.T) {
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+	volumes := ListVolumes()
+
+	// The iSCSI paths via two portals are grouped by wwn
+	volume, ok := findVolume(volumes, "36001405a1b2c3d4e5f60718293a4b5c6")
+	assert.True(t, ok)
+	assert.Equal(t, 3, volume.Lun)
+	assert.Equal(t, int64(1073741824), volume.Size)
+	assert.Equal(t, "LIO-ORG", volume.Vendor)
+	assert.Equal(t, "block1", volume.Product)
+	assert.Equal(t, VolumeDegraded, volume.State)
+	assert.Len(t, volume.Paths, 2)
+	assert.Equal(t, PathInfo{Hctl: "12:0:0:3", Device: "/dev/sdq", Transport: IscsiProtocol,
+		Target: "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59", Portal: "10.64.77.10:3260",
+		State: "running"}, volume.Paths[0])
+	assert.Equal(t, "offline", volume.Paths[1].State)
+
+	volume, _ = findVolume(volumes, "36001405e9d8c7b6a5f40312a1b2c3d4e")
+	assert.True(t, volume.ReadOnly)
+	assert.Equal(t, "[fd00:10::20]:3260", volume.Paths[0].Portal)
+
+	// The FC paths of the multipath map
+	volume, _ = findVolume(volumes, "36006016074e03a008dfd94ce623d4c0e")
+	assert.Equal(t, "/dev/dm-2", volume.Multipath)
+	assert.Equal(t, VolumeActive, volume.State)
+	assert.Equal(t, FcProtocol, volume.Paths[0].Transport)
+	assert.Equal(t, "5006016d09200925", volume.Paths[0].Target)
+	assert.Equal(t, "ready", volume.Paths[0].PathStatus)
+
+	volume, _ = findVolume(volumes, "3600601601290380036a00936cf13e711")
+	assert.Equal(t, VolumeFailed, volume.State)
+
+	volume, _ = findVolume(volumes, "eui.6e3d1a8a9c3b4d5e8f0011223344aabb")
+	assert.Equal(t, "/dev/nvme0n1", volume.Multipath)
+	assert.Equal(t, 1, volume.Lun)
+	assert.Equal(t, PathInfo{Device: "/dev/nvme0", Transport: NVMeTCPProtocol,
+		Target: "nqn.2014-08.org.example:subsys1", Portal: "10.0.0.1:4420", State: "live"}, volume.Paths[0])
+}
+
+func TestAttachedVolumeHasTarget(t *testing.T) {
+	volume := AttachedVolume{Paths: []PathInfo{
+		{Transport: IscsiProtocol, Target: "iqn.2003-01.org.linux-iscsi.target6:sn.a1", Portal: "[fd00:10::20]:3260"},
+		{Transport: FcProtocol, Target: "5006016d09200925"},
+	}}
+	assert.True(t, volume.HasTarget("iqn.2003-01.org.linux-iscsi.target6:sn.a1"))
+	assert.True(t, volume.HasTarget("fd00:10::20"))
+	assert.True(t, volume.HasTarget("[fd00:10::20]:3260"))
+	assert.False(t, volume.HasTarget("[fd00:10::20]:3261"))
+	assert.True(t, volume.HasTarget("50:06:01:6D:09:20:09:25"))
+	assert.False(t, volume.HasTarget("10.64.77.10"))
+}
+
+func TestPathInfoIsUsable(t *testing.T) {
+	assert.True(t, PathInfo{State: "running", DmStatus: "active", PathStatus: "ghost"}.IsUsable())
+	assert.True(t, PathInfo{State: "live"}.IsUsable())
+	assert.False(t, PathInfo{State: "offline"}.IsUsable())
+	assert.False(t, PathInfo{State: "connecting"}.IsUsable())
+	assert.False(t, PathInfo{DmStatus: "failed"}.IsUsable())
+	assert.False(t, PathInfo{PathStatus: "faulty"}.IsUsable())
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package connector
+
+import (
+	"context"
+	"fmt"
+	"github.com/peter-wangxu/goock/pkg/exec"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
+	"github.com/peter-wangxu/goock/pkg/model"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Patterns to match the NVMe namespace by NGUID or UUID
+	NVMeNguidPathPattern = "/dev/disk/by-id/nvme-eui.%s"
+	NVMeUuidPathPattern  = "/dev/disk/by-id/nvme-uuid.%s"
+	// Default port of the NVMe/TCP I/O controller
+	NVMeDefaultPort = "4420"
+	nvmeTransport   = "tcp"
+)
+
+// Connector for NVMe over TCP
+type NVMeTCPConnector struct {
+	exec exec.Interface
+	// Context of the operation, the commands are killed once it is done
+	ctx context.Context
+}
+
+// Constructor for NVMeTCPConnector
+func NewNVMeTCPConnector() NVMeTCPInterface {
+	return &NVMeTCPConnector{exec: executor, ctx: context.Background()}
+}
+
+// Returns a copy of the connector whose commands, waits and locks are bound to ctx
+func (nvme *NVMeTCPConnector) withContext(ctx context.Context) *NVMeTCPConnector {
+	return &NVMeTCPConnector{exec: exec.WithContext(ctx, nvme.exec), ctx: ctx}
+}
+
+// Returns host information regarding iSCSI, FC and NVMe
+func (nvme *NVMeTCPConnector) GetHostInfo() (HostInfo, error) {
+	return GetHostInfo()
+}
+
+// Find the connected subsystem by NQN
+func (nvme *NVMeTCPConnector) findSubsystem(targetNqn string) (model.NVMeSubsystem, bool) {
+	for _, subsystem := range model.NewNVMeSubsystem() {
+		if subsystem.Nqn == targetNqn {
+			return subsystem, true
+		}
+	}
+	return model.NVMeSubsystem{}, false
+}
+
+// Get all possible namespace paths under /dev/disk/by-id/
+func (nvme *NVMeTCPConnector) getVolumePaths(connectionProperty ConnectionProperty) []string {
+	var potentialPaths []string
+	if connectionProperty.VolumeNguid != "" {
+		nguid := strings.ToLower(strings.Replace(connectionProperty.VolumeNguid, "-", "", -1))
+		potentialPaths = append(potentialPaths, fmt.Sprintf(NVMeNguidPathPattern, nguid))
+	}
+	if connectionProperty.VolumeUuid != "" {
+		uuid := strings.ToLower(connectionProperty.VolumeUuid)
+		potentialPaths = append(potentialPaths, fmt.Sprintf(NVMeUuidPathPattern, uuid))
+	}
+	return potentialPaths
+}
+
+// Get the subsystem NQN and the namespace to lock
+func (nvme *NVMeTCPConnector) getLockKeys(connectionProperty ConnectionProperty) ([]string, []string) {
+	namespace := strings.ToLower(strings.Replace(connectionProperty.VolumeNguid, "-", "", -1))
+	if namespace == "" {
+		namespace = strings.ToLower(connectionProperty.VolumeUuid)
+	}
+	targetNqn := connectionProperty.TargetNqn
+	return []string{targetNqn}, []string{lock.LunKey(targetNqn, namespace)}
+}
+
+// Discover all subsystems provided by the discovery controller of portals
+func (nvme *NVMeTCPConnector) DiscoverPortal(targetPortal ...string) []model.NVMeDiscoveryEntry {
+	return model.DiscoverNVMeSubsystemContext(nvme.ctx, nvmeTransport, targetPortal)
+}
+
+// Returns the portals of the I/O controllers of the subsystem, found by the
+// discovery controllers of targetPortals and the ones they refer to. The
+// portal is connected as is if its discovery controller is unreachable.
+func (nvme *NVMeTCPConnector) discoverPortals(targetPortals []string, targetNqn string) ([]string, error) {
+	var portals []string
+	found := map[string]bool{}
+	discovered := false
+	visited := map[string]bool{}
+	for _, targetPortal := range targetPortals {
+		address, _ := model.SplitPortal(targetPortal, "")
+		queue := []string{net.JoinHostPort(address, model.NVMeDiscoveryPort)}
+		reachable := false
+		for len(queue) > 0 {
+			discoveryPortal := queue[0]
+			queue = queue[1:]
+			if visited[discoveryPortal] {
+				reachable = true
+				continue
+			}
+			visited[discoveryPortal] = true
+			entries := model.DiscoverNVMeLogContext(nvme.ctx, nvmeTransport, discoveryPortal)
+			if len(entries) > 0 {
+				reachable = true
+			}
+			for _, entry := range entries {
+				portal := net.JoinHostPort(entry.Address, entry.Port)
+				switch {
+				case entry.IsReferral():
+					queue = append(queue, portal)
+				case entry.IsSubsystem() && entry.Nqn == targetNqn && !found[portal]:
+					found[portal] = true
+					portals = append(portals, portal)
+				}
+			}
+		}
+		if reachable {
+			discovered = true
+		} else {
+			log.Debugf("Unable to discover %s, connect it directly.", targetPortal)
+			portals = append(portals, targetPortal)
+		}
+	}
+	if discovered && len(found) == 0 {
+		return nil, fmt.Errorf("Subsystem %s is not found by the discovery controllers of %s.",
+			targetNqn, targetPortals)
+	}
+	return portals, nil
+}
+
+// Connect to the subsystem via portal if not connected yet
+func (nvme *NVMeTCPConnector) ConnectPortal(targetPortal string, targetNqn string) error {
+	address, port := model.SplitPortal(targetPortal, NVMeDefaultPort)
+	if subsystem, found := nvme.findSubsystem(targetNqn); found {
+		for _, path := range subsystem.Paths {
+			if path.GetTargetAddress() == address && path.GetTargetPort() == port && path.State == "live" {
+				log.Debugf("Subsystem %s is already connected via %s. skip connect.", targetNqn, targetPortal)
+				return nil
+			}
+		}
+	}
+	_, err := nvme.exec.Command("nvme", "connect", "-t", nvmeTransport, "-a", address,
+		"-s", port, "-n", targetNqn).CombinedOutput()
+	return err
+}
+
+// Rescan the namespaces on every controller of the subsystem
+func (nvme *NVMeTCPConnector) rescanNamespaces(targetNqn string) {
+	subsystem, _ := nvme.findSubsystem(targetNqn)
+	rescanWithLock(nvme.ctx, func() {
+		for _, path := range subsystem.Paths {
+			linux.RescanNVMeNamespacesContext(nvme.ctx, path.Name)
+		}
+	})
+}
+
+// Attach the namespace from the remote subsystem to the local
+// 1. Discover the subsystem via the discovery controller of every portal,
+//    and connect to it via every I/O controller discovered
+// 2. Wait for the namespace to appear under /dev/disk/by-id/
+// 3. If native NVMe multipath is enabled, the namespace device is the multipath
+func (nvme *NVMeTCPConnector) ConnectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	return nvme.ConnectVolumeContext(nvme.ctx, connectionProperty)
+}
+
+// ConnectVolumeContext is ConnectVolume which gives up once ctx is done
+func (nvme *NVMeTCPConnector) ConnectVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	return nvme.withContext(ctx).connectVolume(connectionProperty)
+}
+
+func (nvme *NVMeTCPConnector) connectVolume(connectionProperty ConnectionProperty) (VolumeInfo, error) {
+	targets, namespaces := nvme.getLockKeys(connectionProperty)
+	locks, err := lockVolume(nvme.ctx, targets, namespaces)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	defer locks.Release()
+	info := VolumeInfo{}
+	targetNqn := connectionProperty.TargetNqn
+	portals, err := nvme.discoverPortals(connectionProperty.TargetPortals, targetNqn)
+	if err != nil {
+		return info, err
+	}
+	connected := 0
+	for _, portal := range portals {
+		if err := nvme.ConnectPortal(portal, targetNqn); err != nil {
+			log.WithError(err).Warnf("Unable to connect subsystem %s via portal %s.", targetNqn, portal)
+			continue
+		}
+		connected++
+	}
+	if connected <= 0 {
+		return info, fmt.Errorf("Unable to connect subsystem %s via any portal.", targetNqn)
+	}
+
+	possiblePaths := nvme.getVolumePaths(connectionProperty)
+	accessiblePath, err := goockutil.WaitForAnyPathContext(nvme.ctx, possiblePaths, func() {
+		nvme.rescanNamespaces(targetNqn)
+	})
+	if err != nil {
+		log.WithError(err).Errorf("Unable to find any existing namespace within %s", possiblePaths)
+		return info, err
+	}
+	device := linux.RealPath(accessiblePath)
+	info.Wwn = strings.TrimPrefix(filepath.Base(accessiblePath), "nvme-")
+	if linux.IsNVMeMultipathEnabled() {
+		// for native multipath, the single paths are the controllers
+		log.Info("Native multipath for NVMe enabled.")
+		info.MultipathId = info.Wwn
+		info.Multipath = device
+		subsystem, _ := nvme.findSubsystem(targetNqn)
+		for _, path := range subsystem.Paths {
+			info.Paths = append(info.Paths, fmt.Sprintf("/dev/%s", path.Name))
+		}
+	} else {
+		log.Debug("Native multipath for NVMe disabled.")
+		info.Paths = []string{device}
+	}
+	log.Debugf("ConnectVolume returning %+v", info)
+	return info, nil
+}
+
+// DisconnectVolume flushes the namespace and disconnects the subsystem when
+// none of its namespaces is left on the host, the subsystem is locked
+// exclusively since disconnecting it removes all of its namespaces.
+func (nvme *NVMeTCPConnector) DisconnectVolume(connectionProperty ConnectionProperty) error {
+	return nvme.DisconnectVolumeContext(nvme.ctx, connectionProperty)
+}
+
+// DisconnectVolumeContext is DisconnectVolume which gives up once ctx is done
+func (nvme *NVMeTCPConnector) DisconnectVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) error {
+	return nvme.withContext(ctx).disconnectVolume(connectionProperty)
+}
+
+func (nvme *NVMeTCPConnector) disconnectVolume(connectionProperty ConnectionProperty) error {
+	targets, namespaces := nvme.getLockKeys(connectionProperty)
+	locks, err := lock.AcquireContext(nvme.ctx, nil, append(namespaces, lock.TargetKey(targets[0])))
+	if err != nil {
+		log.WithError(err).Error("Unable to lock the volume.")
+		return err
+	}
+	defer locks.Release()
+	targetNqn := connectionProperty.TargetNqn
+	paths, _ := goockutil.FilterPath(nvme.getVolumePaths(connectionProperty))
+	if len(paths) <= 0 {
+		log.Info("No NVMe namespace found for targets.")
+		return nil
+	}
+	device := linux.RealPath(paths[0])
+	if device != "" {
+		if err := checkDevicesUnused(model.Multipath{}, []string{device}, connectionProperty.Force); err != nil {
+			return err
+		}
+		linux.FlushDeviceIOContext(nvme.ctx, device)
+	}
+	subsystem, found := nvme.findSubsystem(targetNqn)
+	if !found {
+		log.Infof("Subsystem %s is not connected.", targetNqn)
+		return nil
+	}
+	// Disconnecting the subsystem removes all of its namespaces
+	for _, namespace := range linux.GetNVMeNamespaces(subsystem.Name) {
+		if namespace != filepath.Base(device) {
+			log.Infof("Namespace %s of subsystem %s is still in use, keep the subsystem connected.",
+				namespace, targetNqn)
+			return nil
+		}
+	}
+	if _, err := nvme.exec.Command("nvme", "disconnect", "-n", targetNqn).CombinedOutput(); err != nil {
+		log.WithError(err).Errorf("Unable to disconnect subsystem %s.", targetNqn)
+		return err
+	}
+	left := goockutil.WaitForPathRemovalContext(nvme.ctx, paths, 10)
+	if err := nvme.ctx.Err(); err != nil {
+		return err
+	}
+	if len(left) > 0 {
+		log.Warnf("Paths still exist on system: %s.", left)
+		return fmt.Errorf("Paths %s are not removed from system.", left)
+	}
+	return nil
+}
+
+// Update the local kernel's size information by rescanning namespaces
+func (nvme *NVMeTCPConnector) ExtendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	return nvme.ExtendVolumeContext(nvme.ctx, connectionProperty)
+}
+
+// ExtendVolumeContext is ExtendVolume which gives up once ctx is done
+func (nvme *NVMeTCPConnector) ExtendVolumeContext(ctx context.Context,
+	connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	return nvme.withContext(ctx).extendVolume(connectionProperty)
+}
+
+func (nvme *NVMeTCPConnector) extendVolume(connectionProperty ConnectionProperty) (ExtendInfo, error) {
+	targets, namespaces := nvme.getLockKeys(connectionProperty)
+	locks, err := lockVolume(nvme.ctx, targets, namespaces)
+	if err != nil {
+		return ExtendInfo{}, err
+	}
+	defer locks.Release()
+	var info ExtendInfo
+	paths, _ := goockutil.FilterPath(nvme.getVolumePaths(connectionProperty))
+	if len(paths) <= 0 {
+		return info, fmt.Errorf("Unable to find any namespace to extend.")
+	}
+	device := linux.RealPath(paths[0])
+	if device == "" {
+		device = paths[0]
+	}
+	info.Wwn = strings.TrimPrefix(filepath.Base(paths[0]), "nvme-")
+	info.Paths = []string{device}
+	if linux.IsNVMeMultipathEnabled() {
+		info.Multipath = device
+	}
+	info.OriginalSize = linux.GetDeviceSizeContext(nvme.ctx, device)
+	nvme.rescanNamespaces(connectionProperty.TargetNqn)
+	info.NewSize = linux.GetDeviceSizeContext(nvme.ctx, device)
+	return info, nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package connector
+
+import (
+	"context"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/model"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func setNVMeMockExecutor() {
+	goockutil.SetExecutor(test.NewMockExecutor())
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	linux.SetExecutor(test.NewMockExecutor())
+}
+
+func TestNVMeTCPConnector_DiscoverPortal(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	entries := nvme.DiscoverPortal("10.0.0.1")
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "nqn.2014-08.org.example:subsys1", entries[0].Nqn)
+}
+
+func TestNVMeTCPConnector_ConnectPortal(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	// Already connected, no mock data for "nvme connect"
+	assert.Nil(t, nvme.ConnectPortal("10.0.0.1:4420", "nqn.2014-08.org.example:subsys1"))
+	assert.Nil(t, nvme.ConnectPortal("10.0.0.2", "nqn.2014-08.org.example:subsys1"))
+	assert.Error(t, nvme.ConnectPortal("10.0.0.9", "nqn.2014-08.org.example:subsys1"))
+}
+
+func TestNVMeTCPConnector_ConnectVolume(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetPortals = []string{"10.0.0.1:4420", "10.0.0.9"}
+	fakeProperty.TargetNqn = "nqn.2014-08.org.example:subsys1"
+	fakeProperty.VolumeNguid = "6E3D1A8A9C3B4D5E8F0011223344AABB"
+	info, err := nvme.ConnectVolume(fakeProperty)
+	assert.Nil(t, err)
+	assert.Equal(t, "eui.6e3d1a8a9c3b4d5e8f0011223344aabb", info.Wwn)
+	assert.Equal(t, "/dev/nvme0n1", info.Multipath)
+	assert.Equal(t, []string{"/dev/nvme0"}, info.Paths)
+}
+
+func TestNVMeTCPConnector_discoverPortals(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := &NVMeTCPConnector{exec: executor, ctx: context.Background()}
+	// The subsystem is found via the referral of 10.0.0.5, which refers back
+	portals, err := nvme.discoverPortals([]string{"10.0.0.5"}, "nqn.2014-08.org.example:subsys3")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.7:4420"}, portals)
+
+	// The discovery controller of 10.0.0.9 is unreachable
+	portals, err = nvme.discoverPortals([]string{"10.0.0.1:4420", "10.0.0.9"}, "nqn.2014-08.org.example:subsys1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1:4420", "10.0.0.9"}, portals)
+}
+
+func TestNVMeTCPConnector_discoverPortalsUnknownNqn(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := &NVMeTCPConnector{exec: executor, ctx: context.Background()}
+	_, err := nvme.discoverPortals([]string{"10.0.0.1"}, "nqn.2014-08.org.example:subsys9")
+	assert.Error(t, err)
+}
+
+func TestNVMeTCPConnector_ConnectVolumeNoPortal(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetPortals = []string{"10.0.0.9"}
+	fakeProperty.TargetNqn = "nqn.2014-08.org.example:subsys1"
+	fakeProperty.VolumeNguid = "6E3D1A8A9C3B4D5E8F0011223344AABB"
+	_, err := nvme.ConnectVolume(fakeProperty)
+	assert.Error(t, err)
+}
+
+func TestNVMeTCPConnector_DisconnectVolume(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetNqn = "nqn.2014-08.org.example:subsys1"
+	fakeProperty.VolumeNguid = "6E3D1A8A9C3B4D5E8F0011223344AABB"
+	err := nvme.DisconnectVolume(fakeProperty)
+	// The mocked namespace is always there, so it is reported as left behind.
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "/dev/disk/by-id/nvme-eui.6e3d1a8a9c3b4d5e8f0011223344aabb")
+}
+
+func TestNVMeTCPConnector_DisconnectVolumeInUse(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetNqn = "nqn.2014-08.org.example:subsys2"
+	fakeProperty.VolumeUuid = "0B2F3C4D-5E6F-4A7B-8C9D-0E1F2A3B4C5D"
+	// nvme1n2 is still on the subsystem, no disconnect happens
+	assert.Nil(t, nvme.DisconnectVolume(fakeProperty))
+}
+
+func TestNVMeTCPConnector_DisconnectVolumeNoPath(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetNqn = "nqn.2014-08.org.example:subsys2"
+	fakeProperty.VolumeNguid = "00000000000000000000000000000000"
+	assert.Nil(t, nvme.DisconnectVolume(fakeProperty))
+}
+
+func TestNVMeTCPConnector_ExtendVolume(t *testing.T) {
+	setNVMeMockExecutor()
+	nvme := NewNVMeTCPConnector()
+	fakeProperty := ConnectionProperty{}
+	fakeProperty.TargetNqn = "nqn.2014-08.org.example:subsys2"
+	fakeProperty.VolumeUuid = "0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d"
+	info, err := nvme.ExtendVolume(fakeProperty)
+	assert.Nil(t, err)
+	assert.Equal(t, "uuid.0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", info.Wwn)
+	assert.Equal(t, "/dev/nvme1n1", info.Multipath)
+	assert.Equal(t, 10737418240, info.NewSize)
+}
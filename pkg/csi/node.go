@@ -0,0 +1,608 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package csi implements the identity and node services of the Container
+// Storage Interface on top of the connectors, they are served over gRPC by
+// Server. The volumes are attached by a CSI controller of the storage, the
+// node service connects, formats and mounts them.
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var log *logrus.Logger = logrus.New()
+
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+// Keys of the volume context, lists are separated by ","
+const (
+	ContextStorageProtocol = "storageProtocol"
+	ContextPortals         = "portals"
+	ContextIqns            = "iqns"
+	ContextLuns            = "luns"
+	ContextWwns            = "wwns"
+	ContextLun             = "lun"
+	// "fallback" or "required", see connector.MultipathRequired
+	ContextMultipathPolicy = "multipathPolicy"
+	// iSCSI ifaces or network interfaces and their transport, see connector.ConnectionProperty
+	ContextIfaces    = "ifaces"
+	ContextTransport = "transport"
+)
+
+// Keys of the secrets for iSCSI CHAP, they are named after the settings of
+// iscsid.conf
+const (
+	SecretUsername          = "node.session.auth.username"
+	SecretPassword          = "node.session.auth.password"
+	SecretUsernameIn        = "node.session.auth.username_in"
+	SecretPasswordIn        = "node.session.auth.password_in"
+	SecretDiscoveryUsername = "discovery.sendtargets.auth.username"
+	SecretDiscoveryPassword = "discovery.sendtargets.auth.password"
+)
+
+// Keys of the topology segments reported by NodeGetInfo
+const (
+	TopologyIqn   = "topology.goock.io/iqn"
+	TopologyWwpns = "topology.goock.io/wwpns"
+)
+
+// DefaultStateDir keeps the connections of the staged volumes, a record is
+// not kept under the staging path since the volume is mounted there.
+const DefaultStateDir = "/var/lib/goock/csi"
+
+// stagedVolume is recorded in the state directory by NodeStageVolume, the
+// CHAP secrets are not kept as they are not needed for the disconnection.
+type stagedVolume struct {
+	VolumeId          string `json:"volumeId"`
+	StagingTargetPath string `json:"stagingTargetPath"`
+	// The multipath device if any, otherwise the single path
+	Device string `json:"device"`
+	// The filesystem mounted on the staging path, empty for the block volume
+	FsType             string                       `json:"fsType,omitempty"`
+	ReadOnly           bool                         `json:"readOnly,omitempty"`
+	ConnectionProperty connector.ConnectionProperty `json:"connectionProperty"`
+	VolumeInfo         connector.VolumeInfo         `json:"volumeInfo"`
+}
+
+// NodeServer implements csi.NodeServer with the iSCSI and FC connectors, the
+// operations on the same volume are not run concurrently.
+type NodeServer struct {
+	nodeId     string
+	stateDir   string
+	connectors map[connector.StringEnum]connector.Interface
+	hostInfo   func() (connector.HostInfo, error)
+	mutex      sync.Mutex
+	inFlight   map[string]bool
+}
+
+var _ csi.NodeServer = &NodeServer{}
+
+// NewNodeServer creates the node service, nodeId is the hostname and
+// stateDir is DefaultStateDir if empty.
+func NewNodeServer(nodeId string, stateDir string) *NodeServer {
+	if nodeId == "" {
+		nodeId, _ = os.Hostname()
+	}
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+	return &NodeServer{
+		nodeId:   nodeId,
+		stateDir: stateDir,
+		connectors: map[connector.StringEnum]connector.Interface{
+			connector.IscsiProtocol: connector.NewISCSIConnector(),
+			connector.FcProtocol:    connector.NewFibreChannelConnector(),
+		},
+		hostInfo: connector.GetHostInfo,
+		inFlight: map[string]bool{},
+	}
+}
+
+// SetConnector sets the connector of protocol
+func (s *NodeServer) SetConnector(protocol connector.StringEnum, c connector.Interface) {
+	s.connectors[protocol] = c
+}
+
+// NodeStageVolume connects the volume and mounts it on the staging path, the
+// blank volume is formatted first. The block volume is connected only. It is
+// a no-op if the volume is already staged and its device is still there.
+func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	capability := req.GetVolumeCapability()
+	if req.GetVolumeId() == "" || req.GetStagingTargetPath() == "" || capability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume id, staging target path and volume capability are required")
+	}
+	if capability.GetBlock() == nil && capability.GetMount() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability of block or mount access is required")
+	}
+	done, err := s.begin(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	staged, err := s.readStagedVolume(req.GetVolumeId())
+	if err == nil && staged.StagingTargetPath != req.GetStagingTargetPath() {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s is staged at %s",
+			req.GetVolumeId(), staged.StagingTargetPath)
+	}
+	if err == nil && isConnected(ctx, staged) {
+		log.Infof("Volume %s is already connected as %s.", req.GetVolumeId(), staged.Device)
+	} else if err == nil || os.IsNotExist(err) {
+		if err == nil {
+			// The record survives the reboot of the node, while the device does not
+			log.Warnf("Device %s of staged volume %s is gone or replaced, connecting it again.",
+				staged.Device, req.GetVolumeId())
+		}
+		if staged, err = s.connectVolume(ctx, req); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, status.Errorf(codes.Internal, "unable to read staged volume %s: %s", req.GetVolumeId(), err)
+	}
+	if capability.GetMount() != nil {
+		if err := s.mountStagingPath(ctx, staged, capability.GetMount()); err != nil {
+			return nil, err
+		}
+	}
+	log.WithFields(logrus.Fields{"volume": req.GetVolumeId(), "device": staged.Device}).Info("Volume staged.")
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// Connects the volume and records it, the record is kept even though the
+// volume is not mounted yet, so that NodeUnstageVolume disconnects it.
+func (s *NodeServer) connectVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (stagedVolume, error) {
+	staged := stagedVolume{VolumeId: req.GetVolumeId(), StagingTargetPath: req.GetStagingTargetPath()}
+	property, err := ConnectionPropertyFromContext(req.GetVolumeContext(), req.GetSecrets(),
+		req.GetVolumeCapability().GetAccessMode().GetMode())
+	if err != nil {
+		return staged, status.Errorf(codes.InvalidArgument, "invalid volume context of %s: %s", req.GetVolumeId(), err)
+	}
+	c, err := s.getConnector(property)
+	if err != nil {
+		return staged, err
+	}
+	info, err := c.ConnectVolumeContext(ctx, property)
+	if err != nil {
+		return staged, status.Errorf(codes.Internal, "unable to connect volume %s: %s", req.GetVolumeId(), err)
+	}
+	staged.Device = info.Multipath
+	if staged.Device == "" && len(info.Paths) > 0 {
+		staged.Device = info.Paths[0]
+	}
+	staged.ReadOnly = property.AccessMode == connector.ReadOnly
+	if mount := req.GetVolumeCapability().GetMount(); mount != nil {
+		staged.FsType = mount.GetFsType()
+		if staged.FsType == "" {
+			staged.FsType = linux.DefaultFsType
+		}
+	}
+	property.SessionAuth = connector.CHAPCredential{}
+	property.DiscoveryAuth = connector.CHAPCredential{}
+	staged.ConnectionProperty = property
+	staged.VolumeInfo = info
+	if err := s.writeStagedVolume(staged); err != nil {
+		if disconnectErr := c.DisconnectVolumeContext(ctx, property); disconnectErr != nil {
+			log.WithError(disconnectErr).Errorf("Unable to disconnect volume %s.", req.GetVolumeId())
+		}
+		return staged, status.Errorf(codes.Internal, "unable to record volume %s: %s", req.GetVolumeId(), err)
+	}
+	return staged, nil
+}
+
+// Tests if the recorded device of the staged volume exists and is still of
+// the recorded wwn.
+func isConnected(ctx context.Context, staged stagedVolume) bool {
+	if staged.Device == "" || goockutil.IsPathExists(staged.Device) != nil {
+		return false
+	}
+	if staged.VolumeInfo.Wwn == "" {
+		return true
+	}
+	return strings.EqualFold(linux.GetWWNContext(ctx, staged.Device), staged.VolumeInfo.Wwn)
+}
+
+// Mounts the device of the staged volume on the staging path, the device is
+// formatted if it has no filesystem yet.
+func (s *NodeServer) mountStagingPath(ctx context.Context, staged stagedVolume, mount *csi.VolumeCapability_MountVolume) error {
+	mounted, err := linux.IsMountPoint(staged.StagingTargetPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "unable to check the mounts: %s", err)
+	}
+	if mounted {
+		log.Infof("Volume %s is already mounted on %s.", staged.VolumeId, staged.StagingTargetPath)
+		return nil
+	}
+	fsType, err := linux.GetFsTypeContext(ctx, staged.Device)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if fsType == "" {
+		if staged.ReadOnly {
+			return status.Errorf(codes.FailedPrecondition, "read only volume %s has no filesystem", staged.VolumeId)
+		}
+		log.Infof("Formatting %s of volume %s with %s.", staged.Device, staged.VolumeId, staged.FsType)
+		if err := linux.FormatDeviceContext(ctx, staged.Device, staged.FsType); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	} else if fsType != staged.FsType {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is formatted with %s rather than %s",
+			staged.VolumeId, fsType, staged.FsType)
+	}
+	if err := os.MkdirAll(staged.StagingTargetPath, 0750); err != nil {
+		return status.Errorf(codes.Internal, "unable to create staging path %s: %s", staged.StagingTargetPath, err)
+	}
+	options := mount.GetMountFlags()
+	if staged.ReadOnly {
+		options = append(options, "ro")
+	}
+	if err := linux.MountDeviceContext(ctx, staged.Device, staged.StagingTargetPath, staged.FsType, options); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// NodeUnstageVolume unmounts the staging path and disconnects the volume, it
+// is a no-op if the volume is not staged.
+func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if req.GetVolumeId() == "" || req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and staging target path are required")
+	}
+	done, err := s.begin(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	staged, err := s.readStagedVolume(req.GetVolumeId())
+	if os.IsNotExist(err) {
+		log.Infof("Volume %s is not staged at %s.", req.GetVolumeId(), req.GetStagingTargetPath())
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read staged volume %s: %s", req.GetVolumeId(), err)
+	}
+	if err := unmountPath(ctx, req.GetStagingTargetPath()); err != nil {
+		return nil, err
+	}
+	c, err := s.getConnector(staged.ConnectionProperty)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.DisconnectVolumeContext(ctx, staged.ConnectionProperty); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to disconnect volume %s: %s", req.GetVolumeId(), err)
+	}
+	if err := os.Remove(s.stateFile(req.GetVolumeId())); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "unable to remove staged volume %s: %s", req.GetVolumeId(), err)
+	}
+	log.WithField("volume", req.GetVolumeId()).Info("Volume unstaged.")
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind mounts the staging path, or the device of the block
+// volume, on the target path.
+func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" || req.GetStagingTargetPath() == "" || req.GetTargetPath() == "" ||
+		req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"volume id, staging target path, target path and volume capability are required")
+	}
+	done, err := s.begin(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	staged, err := s.readStagedVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not staged", req.GetVolumeId())
+	}
+	target := req.GetTargetPath()
+	mounted, err := linux.IsMountPoint(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to check the mounts: %s", err)
+	}
+	if mounted {
+		log.Infof("Volume %s is already published at %s.", req.GetVolumeId(), target)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	source := staged.StagingTargetPath
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// The device is bind mounted on a file
+		source = staged.Device
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to create target path %s: %s", target, err)
+		}
+		file, err := os.OpenFile(target, os.O_CREATE, 0640)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to create target path %s: %s", target, err)
+		}
+		file.Close()
+	} else if err := os.MkdirAll(target, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to create target path %s: %s", target, err)
+	}
+	options := []string{"bind"}
+	if req.GetReadonly() || staged.ReadOnly {
+		options = append(options, "ro")
+	}
+	if err := linux.MountDeviceContext(ctx, source, target, "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.WithFields(logrus.Fields{"volume": req.GetVolumeId(), "target": target}).Info("Volume published.")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts and removes the target path
+func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" || req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and target path are required")
+	}
+	done, err := s.begin(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := unmountPath(ctx, req.GetTargetPath()); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(req.GetTargetPath()); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "unable to remove target path %s: %s", req.GetTargetPath(), err)
+	}
+	log.WithFields(logrus.Fields{"volume": req.GetVolumeId(), "target": req.GetTargetPath()}).Info("Volume unpublished.")
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeExpandVolume rescans the staged volume for the new size and grows its
+// filesystem.
+func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if req.GetVolumeId() == "" || req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and volume path are required")
+	}
+	done, err := s.begin(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	staged, err := s.readStagedVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not staged", req.GetVolumeId())
+	}
+	c, err := s.getConnector(staged.ConnectionProperty)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.ExtendVolumeContext(ctx, staged.ConnectionProperty)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to expand volume %s: %s", req.GetVolumeId(), err)
+	}
+	if staged.FsType != "" && req.GetVolumeCapability().GetBlock() == nil {
+		if err := linux.ResizeFsContext(ctx, staged.Device, staged.StagingTargetPath, staged.FsType); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: int64(info.NewSize)}, nil
+}
+
+// NodeGetVolumeStats is not supported, the capability is not reported
+func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not supported")
+}
+
+// NodeGetInfo reports the initiator IQN and WWPNs as the topology
+func (s *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	info, err := s.hostInfo()
+	if err != nil {
+		// The host may support either iSCSI or FC only
+		log.WithError(err).Warn("Unable to get all the host information.")
+	}
+	segments := map[string]string{}
+	if info.Initiator != "" {
+		segments[TopologyIqn] = info.Initiator
+	}
+	if len(info.Wwpns) > 0 {
+		segments[TopologyWwpns] = strings.Join(info.Wwpns, ",")
+	}
+	return &csi.NodeGetInfoResponse{NodeId: s.nodeId, AccessibleTopology: &csi.Topology{Segments: segments}}, nil
+}
+
+func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	var capabilities []*csi.NodeServiceCapability
+	for _, rpc := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+	} {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: rpc}},
+		})
+	}
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: capabilities}, nil
+}
+
+func (s *NodeServer) getConnector(property connector.ConnectionProperty) (connector.Interface, error) {
+	c, ok := s.connectors[property.StorageProtocol]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "storage protocol %s is not supported", property.StorageProtocol)
+	}
+	return c, nil
+}
+
+// begin marks the operation on the volume in flight, the returned function
+// ends it. The CO retries later if an operation of the volume is running.
+func (s *NodeServer) begin(volumeId string) (func(), error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.inFlight[volumeId] {
+		return nil, status.Errorf(codes.Aborted, "an operation of volume %s is in progress", volumeId)
+	}
+	s.inFlight[volumeId] = true
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.inFlight, volumeId)
+	}, nil
+}
+
+// Unmounts the path if it is mounted
+func unmountPath(ctx context.Context, path string) error {
+	mounted, err := linux.IsMountPoint(path)
+	if err != nil {
+		return status.Errorf(codes.Internal, "unable to check the mounts: %s", err)
+	}
+	if !mounted {
+		return nil
+	}
+	if err := linux.UnmountContext(ctx, path); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// ConnectionPropertyFromContext maps the CSI volume context and secrets to ConnectionProperty,
+// the protocol is FC if wwns is set, otherwise iSCSI.
+func ConnectionPropertyFromContext(context map[string]string, secrets map[string]string,
+	mode csi.VolumeCapability_AccessMode_Mode) (connector.ConnectionProperty, error) {
+	var property connector.ConnectionProperty
+	property.AccessMode = connector.ReadWrite
+	if mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
+		property.AccessMode = connector.ReadOnly
+	}
+	protocol := connector.StringEnum(context[ContextStorageProtocol])
+	if protocol == "" {
+		protocol = connector.IscsiProtocol
+		if context[ContextWwns] != "" {
+			protocol = connector.FcProtocol
+		}
+	}
+	property.StorageProtocol = protocol
+	property.MultipathPolicy = connector.StringEnum(context[ContextMultipathPolicy])
+	if property.MultipathPolicy != "" && property.MultipathPolicy != connector.MultipathFallback &&
+		property.MultipathPolicy != connector.MultipathRequired {
+		return property, fmt.Errorf("multipath policy %s is not supported", property.MultipathPolicy)
+	}
+	switch protocol {
+	case connector.IscsiProtocol:
+		property.TargetPortals = splitList(context[ContextPortals])
+		property.TargetIqns = splitList(context[ContextIqns])
+		property.Ifaces = splitList(context[ContextIfaces])
+		property.Transport = connector.StringEnum(context[ContextTransport])
+		luns, err := parseLuns(splitList(context[ContextLuns]))
+		if err != nil {
+			return property, err
+		}
+		// A single LUN applies to all the portals
+		if len(luns) == 1 {
+			for len(luns) < len(property.TargetPortals) {
+				luns = append(luns, luns[0])
+			}
+		}
+		property.TargetLuns = luns
+		if len(property.TargetIqns) != len(property.TargetPortals) || len(luns) != len(property.TargetPortals) {
+			return property, fmt.Errorf("the number of portals, iqns and luns mismatch")
+		}
+		property.SessionAuth = connector.CHAPCredential{
+			Username:   secrets[SecretUsername],
+			Secret:     secrets[SecretPassword],
+			UsernameIn: secrets[SecretUsernameIn],
+			SecretIn:   secrets[SecretPasswordIn],
+		}
+		property.DiscoveryAuth = connector.CHAPCredential{
+			Username: secrets[SecretDiscoveryUsername],
+			Secret:   secrets[SecretDiscoveryPassword],
+		}
+		if err := connector.ValidateCHAPCredentials(property.SessionAuth, property.DiscoveryAuth); err != nil {
+			return property, err
+		}
+	case connector.FcProtocol:
+		property.TargetWwns = splitList(context[ContextWwns])
+		luns, err := parseLuns([]string{context[ContextLun]})
+		if err != nil {
+			return property, err
+		}
+		property.TargetLun = luns[0]
+		property.TargetLuns = luns
+	default:
+		return property, fmt.Errorf("storage protocol %s is not supported", protocol)
+	}
+	return property, property.IsEmpty()
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseLuns(values []string) ([]int, error) {
+	var luns []int
+	for _, value := range values {
+		lun, err := connector.ParseLun(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LUN id %q", value)
+		}
+		luns = append(luns, lun)
+	}
+	return luns, nil
+}
+
+// Returns the record of the volume, the volume id is escaped as it may
+// contain "/"
+func (s *NodeServer) stateFile(volumeId string) string {
+	return filepath.Join(s.stateDir, url.PathEscape(volumeId)+".json")
+}
+
+func (s *NodeServer) readStagedVolume(volumeId string) (stagedVolume, error) {
+	var staged stagedVolume
+	data, err := ioutil.ReadFile(s.stateFile(volumeId))
+	if err != nil {
+		return staged, err
+	}
+	err = json.Unmarshal(data, &staged)
+	return staged, err
+}
+
+func (s *NodeServer) writeStagedVolume(staged stagedVolume) error {
+	if err := os.MkdirAll(s.stateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(staged)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.stateFile(staged.VolumeId), data, 0600)
+}
@@ -0,0 +1,474 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package csi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/exec"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type FakeConnector struct {
+	connected    []connector.ConnectionProperty
+	disconnected []connector.ConnectionProperty
+}
+
+func (fake *FakeConnector) GetHostInfo() (connector.HostInfo, error) {
+	return connector.HostInfo{}, nil
+}
+
+func (fake *FakeConnector) ConnectVolume(connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	fake.connected = append(fake.connected, connectionProperty)
+	if connectionProperty.TargetLun == 99 {
+		return connector.VolumeInfo{}, fmt.Errorf("failed to connect volume")
+	}
+	return connector.VolumeInfo{Wwn: "wwn1", Multipath: "/dev/dm-3", Paths: []string{"/dev/sdb", "/dev/sdc"}}, nil
+}
+
+func (fake *FakeConnector) DisconnectVolume(connectionProperty connector.ConnectionProperty) error {
+	fake.disconnected = append(fake.disconnected, connectionProperty)
+	return nil
+}
+
+func (fake *FakeConnector) ExtendVolume(connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return connector.ExtendInfo{Wwn: "wwn1", OriginalSize: 1024, NewSize: 2048}, nil
+}
+
+func (fake *FakeConnector) ConnectVolumeContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	return fake.ConnectVolume(connectionProperty)
+}
+
+func (fake *FakeConnector) DisconnectVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) error {
+	return fake.DisconnectVolume(connectionProperty)
+}
+
+func (fake *FakeConnector) ExtendVolumeContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return fake.ExtendVolume(connectionProperty)
+}
+
+// FakeExecutor records the command lines, the commands succeed with the
+// output of the first matched prefix.
+type FakeExecutor struct {
+	exec.Interface
+	commands []string
+	outputs  map[string]string
+}
+
+type fakeCmd struct {
+	output string
+}
+
+func (cmd *fakeCmd) CombinedOutput() ([]byte, error) { return []byte(cmd.output), nil }
+func (cmd *fakeCmd) Output() ([]byte, error)         { return []byte(cmd.output), nil }
+func (cmd *fakeCmd) SetDir(dir string)               {}
+func (cmd *fakeCmd) SetStdin(in io.Reader)           {}
+func (cmd *fakeCmd) SetStdout(out io.Writer)         {}
+
+func (fake *FakeExecutor) Command(cmd string, args ...string) exec.Cmd {
+	return fake.CommandContext(context.Background(), cmd, args...)
+}
+
+func (fake *FakeExecutor) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	command := strings.Join(append([]string{cmd}, args...), " ")
+	fake.commands = append(fake.commands, command)
+	for prefix, output := range fake.outputs {
+		if strings.HasPrefix(command, prefix) {
+			return &fakeCmd{output: output}
+		}
+	}
+	return &fakeCmd{}
+}
+
+// Run the tests with the fake /dev tree, the fake connector attaches /dev/dm-3
+func TestMain(m *testing.M) {
+	root := test.NewFakeRoot()
+	root.WriteFile("/dev/dm-3", "")
+	sysfs.SetRoot(root.Dir)
+	test.DisableUevents()
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
+func newFakeNodeServer(t *testing.T) (*NodeServer, *FakeConnector, *FakeConnector) {
+	dir, err := ioutil.TempDir("", "goock-csi")
+	assert.Nil(t, err)
+	iscsi, fc := &FakeConnector{}, &FakeConnector{}
+	s := NewNodeServer("node1", filepath.Join(dir, "state"))
+	s.SetConnector(connector.IscsiProtocol, iscsi)
+	s.SetConnector(connector.FcProtocol, fc)
+	s.hostInfo = func() (connector.HostInfo, error) {
+		return connector.HostInfo{Initiator: "iqn.1993-08.org.debian:01:node1",
+			Wwpns: []string{"10000090fa534cd0", "10000090fa534cd1"}}, fmt.Errorf("partial")
+	}
+	return s, iscsi, fc
+}
+
+func newFakeExecutor(outputs map[string]string) *FakeExecutor {
+	fake := &FakeExecutor{outputs: outputs}
+	linux.SetExecutor(fake)
+	return fake
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func assertCode(t *testing.T, code codes.Code, err error) {
+	assert.Error(t, err)
+	assert.Equal(t, code, status.Code(err))
+}
+
+func TestConnectionPropertyFromContextISCSI(t *testing.T) {
+	property, err := ConnectionPropertyFromContext(map[string]string{
+		ContextPortals: "192.168.1.10:3260, 192.168.1.11:3260",
+		ContextIqns:    "iqn.2017-01.com.example:a,iqn.2017-01.com.example:b",
+		ContextLuns:    "5",
+	}, map[string]string{SecretUsername: "user", SecretPassword: "secret",
+		SecretDiscoveryUsername: "discovery", SecretDiscoveryPassword: "discovery-secret"},
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)
+	assert.Nil(t, err)
+	assert.Equal(t, connector.IscsiProtocol, property.StorageProtocol)
+	assert.Equal(t, []string{"192.168.1.10:3260", "192.168.1.11:3260"}, property.TargetPortals)
+	assert.Equal(t, []int{5, 5}, property.TargetLuns)
+	assert.Equal(t, "secret", property.SessionAuth.Secret)
+	assert.Equal(t, "discovery-secret", property.DiscoveryAuth.Secret)
+	assert.Equal(t, connector.ReadOnly, property.AccessMode)
+}
+
+func TestConnectionPropertyFromContextIfaces(t *testing.T) {
+	property, err := ConnectionPropertyFromContext(map[string]string{
+		ContextPortals:   "192.168.1.10:3260",
+		ContextIqns:      "iqn.2017-01.com.example:a",
+		ContextLuns:      "5",
+		ContextIfaces:    "eth1, eth2",
+		ContextTransport: "iser",
+	}, nil, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"eth1", "eth2"}, property.Ifaces)
+	assert.Equal(t, connector.TransportISER, property.Transport)
+}
+
+func TestConnectionPropertyFromContextFC(t *testing.T) {
+	property, err := ConnectionPropertyFromContext(map[string]string{
+		ContextWwns:            "5006016d09200925,5006016136e00e5a",
+		ContextLun:             "0",
+		ContextMultipathPolicy: "required",
+	}, nil, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	assert.Nil(t, err)
+	assert.Equal(t, connector.FcProtocol, property.StorageProtocol)
+	assert.Equal(t, 0, property.TargetLun)
+	assert.Equal(t, connector.MultipathRequired, property.MultipathPolicy)
+	assert.Equal(t, connector.ReadWrite, property.AccessMode)
+
+	// The LUN is in hexadecimal or the 8-byte LUN address
+	property, err = ConnectionPropertyFromContext(map[string]string{
+		ContextWwns: "5006016d09200925", ContextLun: "0x4001000000000000",
+	}, nil, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	assert.Nil(t, err)
+	assert.Equal(t, 0x4001, property.TargetLun)
+}
+
+func TestConnectionPropertyFromContextInvalid(t *testing.T) {
+	mode := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	_, err := ConnectionPropertyFromContext(map[string]string{
+		ContextPortals: "192.168.1.10:3260,192.168.1.11:3260",
+		ContextIqns:    "iqn.2017-01.com.example:a",
+		ContextLuns:    "5",
+	}, nil, mode)
+	assert.Error(t, err)
+	// The CHAP secret is missing
+	_, err = ConnectionPropertyFromContext(map[string]string{
+		ContextPortals: "192.168.1.10:3260",
+		ContextIqns:    "iqn.2017-01.com.example:a",
+		ContextLuns:    "5",
+	}, map[string]string{SecretUsername: "user"}, mode)
+	assert.EqualError(t, err, "invalid session credential: the CHAP username and secret must be given together")
+	_, err = ConnectionPropertyFromContext(map[string]string{ContextWwns: "5006016d09200925", ContextLun: "x"}, nil, mode)
+	assert.Error(t, err)
+	_, err = ConnectionPropertyFromContext(map[string]string{ContextStorageProtocol: "rbd"}, nil, mode)
+	assert.Error(t, err)
+	_, err = ConnectionPropertyFromContext(map[string]string{
+		ContextWwns: "5006016d09200925", ContextLun: "0", ContextMultipathPolicy: "always",
+	}, nil, mode)
+	assert.Error(t, err)
+}
+
+func TestNodeStageUnstageVolume(t *testing.T) {
+	s, _, fc := newFakeNodeServer(t)
+	defer os.RemoveAll(filepath.Dir(s.stateDir))
+	stagingPath := filepath.Join(filepath.Dir(s.stateDir), "staging")
+	executor := newFakeExecutor(nil)
+	ctx := context.Background()
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:     map[string]string{ContextWwns: "5006016d09200925", ContextLun: "11"},
+	}
+	_, err := s.NodeStageVolume(ctx, req)
+	assert.Nil(t, err)
+	// The blank multipath device is formatted and mounted
+	assert.Equal(t, []string{
+		"blkid -p -s TYPE -o value /dev/dm-3",
+		"mkfs.ext4 -F /dev/dm-3",
+		"mount -t ext4 /dev/dm-3 " + stagingPath,
+	}, executor.commands)
+	// Staging again only mounts the volume again as the fake mount is absent
+	executor = newFakeExecutor(map[string]string{"blkid": "ext4\n", "/lib/udev/scsi_id": "wwn1\n"})
+	_, err = s.NodeStageVolume(ctx, req)
+	assert.Nil(t, err)
+	assert.Len(t, fc.connected, 1)
+	assert.Equal(t, 11, fc.connected[0].TargetLun)
+	assert.Equal(t, []string{
+		"/lib/udev/scsi_id --page 0x83 --whitelisted /dev/dm-3",
+		"blkid -p -s TYPE -o value /dev/dm-3",
+		"mount -t ext4 /dev/dm-3 " + stagingPath,
+	}, executor.commands)
+
+	// vol1 is staged at another path
+	req.StagingTargetPath = stagingPath + "2"
+	_, err = s.NodeStageVolume(ctx, req)
+	assertCode(t, codes.AlreadyExists, err)
+
+	expanded, err := s.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{VolumeId: "vol1", VolumePath: "/pods/vol1"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2048), expanded.CapacityBytes)
+	assert.Equal(t, "resize2fs /dev/dm-3", executor.commands[len(executor.commands)-1])
+
+	_, err = s.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "vol1", StagingTargetPath: stagingPath})
+	assert.Nil(t, err)
+	assert.Len(t, fc.disconnected, 1)
+	assert.Equal(t, []string{"5006016d09200925"}, fc.disconnected[0].TargetWwns)
+	// Unstaging again is a no-op
+	_, err = s.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "vol1", StagingTargetPath: stagingPath})
+	assert.Nil(t, err)
+	assert.Len(t, fc.disconnected, 1)
+}
+
+func TestNodeStageVolumeStaleRecord(t *testing.T) {
+	s, _, fc := newFakeNodeServer(t)
+	defer os.RemoveAll(filepath.Dir(s.stateDir))
+	stagingPath := filepath.Join(filepath.Dir(s.stateDir), "staging")
+	ctx := context.Background()
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  blockCapability(),
+		VolumeContext:     map[string]string{ContextWwns: "5006016d09200925", ContextLun: "11"},
+	}
+	// The device recorded before the reboot is gone
+	assert.Nil(t, s.writeStagedVolume(stagedVolume{VolumeId: "vol1", StagingTargetPath: stagingPath,
+		Device: "/dev/dm-4", VolumeInfo: connector.VolumeInfo{Wwn: "wwn1"}}))
+	newFakeExecutor(nil)
+	_, err := s.NodeStageVolume(ctx, req)
+	assert.Nil(t, err)
+	assert.Len(t, fc.connected, 1)
+	staged, err := s.readStagedVolume("vol1")
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/dm-3", staged.Device)
+
+	// The device is of another volume now
+	newFakeExecutor(map[string]string{"/lib/udev/scsi_id": "wwn2\n"})
+	_, err = s.NodeStageVolume(ctx, req)
+	assert.Nil(t, err)
+	assert.Len(t, fc.connected, 2)
+	// The device is still of the volume
+	newFakeExecutor(map[string]string{"/lib/udev/scsi_id": "WWN1\n"})
+	_, err = s.NodeStageVolume(ctx, req)
+	assert.Nil(t, err)
+	assert.Len(t, fc.connected, 2)
+}
+
+func TestNodeStageVolumeSecrets(t *testing.T) {
+	s, iscsi, _ := newFakeNodeServer(t)
+	defer os.RemoveAll(filepath.Dir(s.stateDir))
+	newFakeExecutor(nil)
+	_, err := s.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pool/vol1",
+		StagingTargetPath: filepath.Join(filepath.Dir(s.stateDir), "staging"),
+		VolumeCapability:  blockCapability(),
+		VolumeContext: map[string]string{ContextPortals: "192.168.1.10", ContextIqns: "iqn.2017-01.com.example:a",
+			ContextLuns: "5"},
+		Secrets: map[string]string{SecretUsername: "user", SecretPassword: "session-secret",
+			SecretDiscoveryUsername: "discovery", SecretDiscoveryPassword: "discovery-secret"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "session-secret", iscsi.connected[0].SessionAuth.Secret)
+	// The CHAP secrets are not recorded
+	data, err := ioutil.ReadFile(s.stateFile("pool/vol1"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "session-secret")
+	assert.NotContains(t, string(data), "discovery-secret")
+	assert.Equal(t, "pool%2Fvol1.json", filepath.Base(s.stateFile("pool/vol1")))
+}
+
+func TestNodeStageVolumeFailed(t *testing.T) {
+	s, _, fc := newFakeNodeServer(t)
+	defer os.RemoveAll(filepath.Dir(s.stateDir))
+	stagingPath := filepath.Join(filepath.Dir(s.stateDir), "staging")
+	newFakeExecutor(nil)
+	ctx := context.Background()
+	_, err := s.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: "vol1", StagingTargetPath: stagingPath})
+	assertCode(t, codes.InvalidArgument, err)
+
+	_, err = s.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:     map[string]string{ContextWwns: "5006016d09200925", ContextLun: "99"},
+	})
+	assertCode(t, codes.Internal, err)
+	assert.Len(t, fc.connected, 1)
+	// Nothing is recorded for the failed volume
+	_, err = os.Stat(s.stateFile("vol1"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The read only volume is not formatted
+	_, err = s.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol2",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		VolumeContext:     map[string]string{ContextWwns: "5006016d09200925", ContextLun: "12"},
+	})
+	assertCode(t, codes.FailedPrecondition, err)
+	// The volume of another filesystem is not mounted
+	newFakeExecutor(map[string]string{"blkid": "xfs\n"})
+	_, err = s.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol3",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:     map[string]string{ContextWwns: "5006016d09200925", ContextLun: "13"},
+	})
+	assertCode(t, codes.FailedPrecondition, err)
+}
+
+func TestNodePublishUnpublishVolume(t *testing.T) {
+	s, _, _ := newFakeNodeServer(t)
+	dir := filepath.Dir(s.stateDir)
+	defer os.RemoveAll(dir)
+	executor := newFakeExecutor(map[string]string{"blkid": "ext4\n"})
+	ctx := context.Background()
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "pods", "mount")
+	publish := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol1",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		Readonly:          true,
+	}
+	_, err := s.NodePublishVolume(ctx, publish)
+	assertCode(t, codes.FailedPrecondition, err)
+
+	_, err = s.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  publish.VolumeCapability,
+		VolumeContext:     map[string]string{ContextWwns: "5006016d09200925", ContextLun: "11"},
+	})
+	assert.Nil(t, err)
+	_, err = s.NodePublishVolume(ctx, publish)
+	assert.Nil(t, err)
+	assert.Equal(t, "mount -o bind,ro "+stagingPath+" "+targetPath, executor.commands[len(executor.commands)-1])
+	assert.DirExists(t, targetPath)
+
+	// The device of the block volume is bind mounted on a file
+	blockPath := filepath.Join(dir, "pods", "block")
+	publish.TargetPath = blockPath
+	publish.VolumeCapability = blockCapability()
+	publish.Readonly = false
+	_, err = s.NodePublishVolume(ctx, publish)
+	assert.Nil(t, err)
+	assert.Equal(t, "mount -o bind /dev/dm-3 "+blockPath, executor.commands[len(executor.commands)-1])
+	assert.FileExists(t, blockPath)
+
+	for _, path := range []string{targetPath, blockPath} {
+		_, err = s.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol1", TargetPath: path})
+		assert.Nil(t, err)
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestNodeOperationInFlight(t *testing.T) {
+	s, _, _ := newFakeNodeServer(t)
+	done, err := s.begin("vol1")
+	assert.Nil(t, err)
+	_, err = s.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol1",
+		StagingTargetPath: "/staging"})
+	assertCode(t, codes.Aborted, err)
+	done()
+	_, err = s.begin("vol1")
+	assert.Nil(t, err)
+}
+
+func TestNodeExpandVolumeNotStaged(t *testing.T) {
+	s, _, _ := newFakeNodeServer(t)
+	_, err := s.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{VolumeId: "vol1",
+		VolumePath: "/not/existed"})
+	assertCode(t, codes.NotFound, err)
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	s, _, _ := newFakeNodeServer(t)
+	info, err := s.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "node1", info.NodeId)
+	assert.Equal(t, "iqn.1993-08.org.debian:01:node1", info.AccessibleTopology.Segments[TopologyIqn])
+	assert.Equal(t, "10000090fa534cd0,10000090fa534cd1", info.AccessibleTopology.Segments[TopologyWwpns])
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	s, _, _ := newFakeNodeServer(t)
+	caps, err := s.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	assert.Nil(t, err)
+	var rpcs []csi.NodeServiceCapability_RPC_Type
+	for _, capability := range caps.Capabilities {
+		rpcs = append(rpcs, capability.GetRpc().GetType())
+	}
+	assert.Equal(t, []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+	}, rpcs)
+}
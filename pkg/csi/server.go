@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package csi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// DefaultEndpoint is the unix socket which the CO connects to
+const DefaultEndpoint = "unix:///csi/csi.sock"
+
+// Server serves the identity and node services over gRPC
+type Server struct {
+	grpcServer *grpc.Server
+}
+
+// NewServer registers the identity service and node with the gRPC server
+func NewServer(node *NodeServer) *Server {
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(logRequest))
+	csi.RegisterIdentityServer(grpcServer, &IdentityServer{})
+	csi.RegisterNodeServer(grpcServer, node)
+	return &Server{grpcServer: grpcServer}
+}
+
+// Serve listens on the endpoint, like unix:///csi/csi.sock or
+// tcp://127.0.0.1:10000, and serves the requests until Stop is called.
+func (s *Server) Serve(endpoint string) error {
+	network, address, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.MkdirAll(filepath.Dir(address), 0755); err != nil {
+			return err
+		}
+		// Remove the socket left by the previous plugin
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		defer os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	log.Infof("CSI plugin %s is listening on %s.", DriverName, endpoint)
+	return s.grpcServer.Serve(listener)
+}
+
+// Stop stops accepting new requests and waits for the in-flight ones
+func (s *Server) Stop() {
+	s.grpcServer.GracefulStop()
+}
+
+// ParseEndpoint returns the network and address of the endpoint
+func ParseEndpoint(endpoint string) (string, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		address := u.Path
+		if address == "" {
+			// unix:relative/csi.sock
+			address = u.Opaque
+		}
+		if address != "" {
+			return u.Scheme, address, nil
+		}
+	case "tcp":
+		if u.Host != "" {
+			return u.Scheme, u.Host, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid endpoint %s, unix:// or tcp:// is expected", endpoint)
+}
+
+// Logs the method and the result of the requests, the requests are not
+// logged since they carry the CHAP secrets.
+func logRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	logger := log.WithFields(logrus.Fields{"method": info.FullMethod})
+	logger.Debug("Handling request.")
+	resp, err := handler(ctx, req)
+	if err != nil {
+		logger.WithError(err).Error("Request failed.")
+	}
+	return resp, err
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package csi
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	network, address, err := ParseEndpoint("unix:///csi/csi.sock")
+	assert.Nil(t, err)
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/csi/csi.sock", address)
+	network, address, err = ParseEndpoint("tcp://127.0.0.1:10000")
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:10000", address)
+	_, _, err = ParseEndpoint("/csi/csi.sock")
+	assert.Error(t, err)
+	_, _, err = ParseEndpoint("tcp://")
+	assert.Error(t, err)
+}
+
+func TestServerServe(t *testing.T) {
+	s, _, _ := newFakeNodeServer(t)
+	defer os.RemoveAll(filepath.Dir(s.stateDir))
+	socket := filepath.Join(filepath.Dir(s.stateDir), "csi.sock")
+	server := NewServer(s)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve("unix://" + socket)
+	}()
+
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(5*time.Second),
+		grpc.WithDialer(func(address string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", address, timeout)
+		}))
+	assert.Nil(t, err)
+	defer conn.Close()
+	ctx := context.Background()
+	info, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, DriverName, info.Name)
+	probe, err := csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.True(t, probe.Ready.Value)
+	node, err := csi.NewNodeClient(conn).NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "node1", node.NodeId)
+	_, err = csi.NewNodeClient(conn).NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{})
+	assertCode(t, codes.Unimplemented, err)
+
+	server.Stop()
+	assert.Nil(t, <-served)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
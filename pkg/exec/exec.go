@@ -17,10 +17,12 @@ limitations under the License.
 package exec
 
 import (
+	"context"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
 	osexec "os/exec"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -43,6 +45,10 @@ type Interface interface {
 	// This follows the pattern of package os/exec.
 	Command(cmd string, args ...string) Cmd
 
+	// CommandContext returns a Cmd instance which is killed once ctx is done
+	// before the command completes. This follows the pattern of package os/exec.
+	CommandContext(ctx context.Context, cmd string, args ...string) Cmd
+
 	// LookPath wraps os/exec.LookPath
 	LookPath(file string) (string, error)
 }
@@ -86,7 +92,12 @@ func New() Interface {
 
 // Command is part of the Interface interface.
 func (executor *executor) Command(cmd string, args ...string) Cmd {
-	return (*cmdWrapper)(osexec.Command(cmd, args...))
+	return &cmdWrapper{Cmd: osexec.Command(cmd, args...)}
+}
+
+// CommandContext is part of the Interface interface.
+func (executor *executor) CommandContext(ctx context.Context, cmd string, args ...string) Cmd {
+	return &cmdWrapper{Cmd: osexec.CommandContext(ctx, cmd, args...), ctx: ctx}
 }
 
 // LookPath is part of the Interface interface
@@ -95,7 +106,28 @@ func (executor *executor) LookPath(file string) (string, error) {
 }
 
 // Wraps exec.Cmd so we can capture errors.
-type cmdWrapper osexec.Cmd
+type cmdWrapper struct {
+	*osexec.Cmd
+	// Context of the command, nil if the command is not cancellable
+	ctx context.Context
+}
+
+// Implements Interface by binding the commands to a context
+type contextExecutor struct {
+	Interface
+	ctx context.Context
+}
+
+// WithContext returns an Interface whose Command is bound to ctx, so that
+// the code running commands via Command is cancelled along with ctx.
+func WithContext(ctx context.Context, e Interface) Interface {
+	return &contextExecutor{Interface: e, ctx: ctx}
+}
+
+// Command is part of the Interface interface.
+func (executor *contextExecutor) Command(cmd string, args ...string) Cmd {
+	return executor.Interface.CommandContext(executor.ctx, cmd, args...)
+}
 
 func (cmd *cmdWrapper) SetDir(dir string) {
 	cmd.Dir = dir
@@ -120,17 +152,26 @@ func (cmd *cmdWrapper) Output() ([]byte, error) {
 }
 
 func executeCmd(cmd *cmdWrapper, combined bool) ([]byte, error) {
-	log.Debug("Executing command: ", cmd.Args)
+	args := sanitizeArgs(cmd.Args)
+	log.Debug("Executing command: ", args)
 	start := time.Now()
 	var err error
 	var out []byte
 	if combined {
-		out, err = (*osexec.Cmd)(cmd).CombinedOutput()
+		out, err = cmd.Cmd.CombinedOutput()
 	} else {
-		out, err = (*osexec.Cmd)(cmd).Output()
+		out, err = cmd.Cmd.Output()
 	}
 	end := time.Since(start)
 	var exitCode = 0
+	if err != nil && cmd.ctx != nil && cmd.ctx.Err() != nil {
+		// The command is killed due to the cancellation or deadline
+		log.WithFields(logrus.Fields{
+			"cmd":      args,
+			"duration": fmt.Sprintf("%.4fs", end.Seconds()),
+		}).Warn("Command is killed: ", cmd.ctx.Err())
+		return out, cmd.ctx.Err()
+	}
 	if err != nil {
 		err, exitCode = handleError(err)
 		// When *command not found* error occurred, the out is empty usually,
@@ -151,7 +192,7 @@ func executeCmd(cmd *cmdWrapper, combined bool) ([]byte, error) {
 		}
 	}
 	log.WithFields(logrus.Fields{
-		"cmd":       cmd.Args,
+		"cmd":       args,
 		"output":    string(out),
 		"exit_code": exitCode,
 		"duration":  fmt.Sprintf("%.4fs", end.Seconds()),
@@ -159,6 +200,19 @@ func executeCmd(cmd *cmdWrapper, combined bool) ([]byte, error) {
 	return out, err
 }
 
+// sanitizeArgs masks the value of sensitive settings before logging,
+// such as "-n node.session.auth.password -v <secret>"
+func sanitizeArgs(args []string) []string {
+	sanitized := make([]string, len(args))
+	copy(sanitized, args)
+	for i := 2; i < len(sanitized); i++ {
+		if sanitized[i-1] == "-v" && strings.Contains(sanitized[i-2], "password") {
+			sanitized[i] = "***"
+		}
+	}
+	return sanitized
+}
+
 func handleError(err error) (error, int) {
 	if ee, ok := err.(*osexec.ExitError); ok {
 		// Force a compile fail if ExitErrorWrapper can't convert to ExitError.
@@ -17,9 +17,11 @@ limitations under the License.
 package exec
 
 import (
+	"context"
 	testhelper "github.com/peter-wangxu/goock/test/helper"
 	osexec "os/exec"
 	"testing"
+	"time"
 )
 
 func TestExecutorNoArgs(t *testing.T) {
@@ -105,3 +107,54 @@ func TestExecutableNotFound(t *testing.T) {
 		t.Errorf("Expected error ErrExecutableNotFound but got %v", err)
 	}
 }
+
+func TestSanitizeArgs(t *testing.T) {
+	args := []string{"iscsiadm", "-m", "node", "--op", "update",
+		"-n", "node.session.auth.password", "-v", "secret",
+		"-n", "node.session.auth.username", "-v", "user"}
+	sanitized := sanitizeArgs(args)
+	if sanitized[8] != "***" {
+		t.Errorf("expected the password masked, got %s", sanitized[8])
+	}
+	if sanitized[12] != "user" {
+		t.Errorf("expected the username kept, got %s", sanitized[12])
+	}
+	if args[8] != "secret" {
+		t.Errorf("expected the original args untouched, got %s", args[8])
+	}
+}
+
+func TestCommandContextTimeout(t *testing.T) {
+	testhelper.SkipIfWindows(t)
+	ex := New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ex.CommandContext(ctx, "sleep", "10").CombinedOutput()
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the command to be killed, took %s", elapsed)
+	}
+
+	out, err := ex.CommandContext(context.Background(), "echo", "stdout").Output()
+	if err != nil || string(out) != "stdout\n" {
+		t.Errorf("unexpected output: %q, %v", string(out), err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	testhelper.SkipIfWindows(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	ex := WithContext(ctx, New())
+
+	if _, err := ex.Command("true").CombinedOutput(); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	cancel()
+	if _, err := ex.Command("true").CombinedOutput(); err != context.Canceled {
+		t.Errorf("expected canceled, got %v", err)
+	}
+}
@@ -16,14 +16,16 @@ limitations under the License.
 package linux
 
 import (
+	"context"
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/model"
 	"github.com/peter-wangxu/goock/pkg/util"
+	"strconv"
 	"strings"
 )
 
 func IsFCSupport() bool {
-	err := util.IsPathExists("/sys/class/fc_host")
+	err := util.IsPathExists(model.FCHostClassPath)
 	if nil != err {
 		return false
 	}
@@ -60,14 +62,55 @@ func GetFcWwnn() []string {
 	return wwnns
 }
 
-// Do a more specific scan instead of a wildcard
+// Do a more specific scan instead of a wildcard, the channel, target or
+// lunID of Wildcard is written as "-", e.g. "0 1 -" scans all the LUNs of
+// the target.
 func RescanHosts(allHct [][]int, lunID int) {
+	RescanHostsContext(context.Background(), allHct, lunID)
+}
+
+// RescanHostsContext is RescanHosts which kills the scan once ctx is done
+func RescanHostsContext(ctx context.Context, allHct [][]int, lunID int) {
 	for _, hct := range allHct {
 		path := fmt.Sprintf("/sys/class/scsi_host/host%d/scan", hct[0])
-		ScanSCSIBus(path, fmt.Sprintf("%d %d %d", hct[1], hct[2], lunID))
+		ScanSCSIBusContext(ctx, path, fmt.Sprintf("%s %s %s", scanField(hct[1]), scanField(hct[2]), scanField(lunID)))
 	}
 }
 
+func scanField(n int) string {
+	if n == Wildcard {
+		return "-"
+	}
+	return strconv.Itoa(n)
+}
+
+// IsFCDevice checks whether the device is attached via a Fibre Channel rport
+// device could be "/dev/sdb" or "sdb"
 func IsFCDevice(device string) bool {
-	return false
+	return strings.Contains(GetSysfsDevicePath(device), "/rport-")
+}
+
+// FindFCDevices returns the block devices of lun on the remote ports whose
+// port name is targetWwn, from sysfs:
+// /sys/class/fc_remote_ports/rport-9:0-2/port_name
+// /sys/devices/.../host9/rport-9:0-2/target9:0:0/9:0:0:1/block/sdb
+func FindFCDevices(targetWwn string, lun int) []string {
+	return findTargetDevices(findFCTargets(targetWwn), lun)
+}
+
+// FindFCLuns returns the LUN IDs found on the remote ports whose port name
+// is targetWwn, in ascending order
+func FindFCLuns(targetWwn string) []int {
+	return findTargetLunIDs(findFCTargets(targetWwn))
+}
+
+// Returns the sysfs paths of the SCSI targets of the remote ports of targetWwn
+func findFCTargets(targetWwn string) []string {
+	var targetPaths []string
+	for _, target := range model.NewFibreChannelTarget() {
+		if strings.EqualFold(target.PortName, strings.TrimPrefix(targetWwn, "0x")) {
+			targetPaths = append(targetPaths, target.DevicePath)
+		}
+	}
+	return targetPaths
 }
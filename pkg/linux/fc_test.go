@@ -16,15 +16,33 @@ limitations under the License.
 package linux
 
 import (
-	"github.com/peter-wangxu/goock/model"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
 	"github.com/peter-wangxu/goock/test"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 )
 
+// Run the tests with the fake sysfs and /dev tree
+func TestMain(m *testing.M) {
+	root := test.NewFakeRoot()
+	sysfs.SetRoot(root.Dir)
+	test.DisableUevents()
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
 func TestIsFCSupport(t *testing.T) {
-	r := IsFCSupport()
-	assert.Equal(t, false, r)
+	assert.True(t, IsFCSupport())
+}
+
+func TestIsFCSupportFalse(t *testing.T) {
+	root := sysfs.GetRoot()
+	sysfs.SetRoot(os.TempDir())
+	defer sysfs.SetRoot(root)
+	assert.False(t, IsFCSupport())
 }
 
 func TestGetFCHBA(t *testing.T) {
@@ -51,10 +69,33 @@ func TestRescanHosts(t *testing.T) {
 	RescanHosts([][]int{{9, 0, 1}, {7, 1, 0}}, 10)
 }
 
-func TestIsFCDeviceTrue(t *testing.T) {
+func TestRescanHostsWildcard(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Equal(t, "-", scanField(Wildcard))
+	assert.Equal(t, "0", scanField(0))
+	RescanHosts([][]int{{9, 0, 0}, {12, Wildcard, Wildcard}}, Wildcard)
+}
 
+func TestIsFCDeviceTrue(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.True(t, IsFCDevice("/dev/sdx"))
 }
 
 func TestIsFCDeviceFalse(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.False(t, IsFCDevice("sdq"))
+	assert.False(t, IsFCDevice("sdz"))
+}
+
+func TestFindFCDevices(t *testing.T) {
+	assert.Equal(t, []string{"/dev/sdh"}, FindFCDevices("5006016d09200925", 11))
+	assert.Equal(t, []string{"/dev/sdw"}, FindFCDevices("0x5006016036E00E5A", 12))
+	assert.Empty(t, FindFCDevices("5006016036e00e5a", 11))
+	assert.Empty(t, FindFCDevices("5006016d09201234", 11))
+}
 
+func TestFindFCLuns(t *testing.T) {
+	assert.Equal(t, []int{10, 11}, FindFCLuns("5006016d09200925"))
+	assert.Equal(t, []int{12}, FindFCLuns("0x5006016036E00E5A"))
+	assert.Empty(t, FindFCLuns("5006016d09201234"))
 }
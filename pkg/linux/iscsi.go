@@ -0,0 +1,212 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
+)
+
+// ISCSISessionClassPath lists the iSCSI sessions
+const ISCSISessionClassPath = "/sys/class/iscsi_session"
+
+// NetClassPath lists the network interfaces
+const NetClassPath = "/sys/class/net"
+
+// GetISCSISessionDevices returns the SCSI devices(H:C:T:L) attached under the
+// iSCSI session from sysfs, sessionId is like 1 of /sys/class/iscsi_session/session1
+// sysfs layout:
+// /sys/devices/platform/host3/session1/target3:0:0/3:0:0:1
+func GetISCSISessionDevices(sessionId string) ([]string, error) {
+	sessionPath, err := sysfs.RealPath(filepath.Join(ISCSISessionClassPath, "session"+sessionId, "device"))
+	if err != nil {
+		log.WithError(err).Debugf("Unable to resolve the device of session %s.", sessionId)
+		return nil, fmt.Errorf("Unable to find the sysfs path of session %s.", sessionId)
+	}
+	targetPaths, err := listSessionTargets(sessionPath)
+	if err != nil {
+		return nil, err
+	}
+	devices := []string{}
+	for _, targetPath := range targetPaths {
+		found, err := listSCSIDevices(targetPath)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, found...)
+	}
+	return devices, nil
+}
+
+// GetISCSISessionIface returns the iface which the session is logged in
+// via, sessionId is like 1 of /sys/class/iscsi_session/session1. Empty
+// string is returned if the iface is unknown.
+func GetISCSISessionIface(sessionId string) string {
+	iface, err := sysfs.ReadAttr(filepath.Join(ISCSISessionClassPath, "session"+sessionId, "ifacename"))
+	if err != nil {
+		log.WithError(err).Debugf("Unable to read the iface of session %s.", sessionId)
+		return ""
+	}
+	return iface
+}
+
+// GetNetInterfaceAddress returns the MAC address of the network interface
+// like eth1, error is returned if the network interface does not exist.
+func GetNetInterfaceAddress(name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid network interface %q", name)
+	}
+	return sysfs.ReadAttr(filepath.Join(NetClassPath, name, "address"))
+}
+
+// FindISCSIDevices returns the block devices of lun on the sessions of
+// targetIqn via targetPortal from sysfs, so that the devices are found even
+// if the links under /dev/disk/by-path are absent. sysfs layout:
+// /sys/class/iscsi_session/session1/targetname
+// /sys/class/iscsi_session/session1/device -> ../../../session1
+// /sys/devices/platform/host3/session1/connection1:0/iscsi_connection/connection1:0/persistent_address
+// /sys/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb
+func FindISCSIDevices(targetPortal string, targetIqn string, lun int) []string {
+	return findTargetDevices(findISCSITargets(targetPortal, targetIqn), lun)
+}
+
+// FindISCSILuns returns the LUN IDs found on the sessions of targetIqn via
+// targetPortal, in ascending order
+func FindISCSILuns(targetPortal string, targetIqn string) []int {
+	return findTargetLunIDs(findISCSITargets(targetPortal, targetIqn))
+}
+
+// FindISCSIHosts returns the SCSI host numbers of the sessions of targetIqn
+// via targetPortal, like 3 of /sys/devices/platform/host3/session1
+func FindISCSIHosts(targetPortal string, targetIqn string) []int {
+	var hosts []int
+	for _, sessionPath := range findISCSISessions(targetPortal, targetIqn) {
+		var host int
+		if _, err := fmt.Sscanf(filepath.Base(filepath.Dir(sessionPath)), "host%d", &host); err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Returns the sysfs paths of the SCSI targets of the sessions
+func findISCSITargets(targetPortal string, targetIqn string) []string {
+	var targetPaths []string
+	for _, sessionPath := range findISCSISessions(targetPortal, targetIqn) {
+		found, _ := listSessionTargets(sessionPath)
+		targetPaths = append(targetPaths, found...)
+	}
+	return targetPaths
+}
+
+// Returns the sysfs paths of the SCSI targets under the session, like
+// /sys/devices/platform/host3/session1/target3:0:0
+func listSessionTargets(sessionPath string) ([]string, error) {
+	targets, err := sysfs.ListDir(sessionPath, `^target\d+:\d+:\d+$`)
+	if err != nil {
+		return nil, err
+	}
+	targetPaths := make([]string, len(targets))
+	for i, target := range targets {
+		targetPaths[i] = filepath.Join(sessionPath, target)
+	}
+	return targetPaths, nil
+}
+
+// ISCSISessionInfo is an iSCSI session read from sysfs
+type ISCSISessionInfo struct {
+	// Like 1 of /sys/class/iscsi_session/session1
+	Id        string
+	TargetIqn string
+	Address   string
+	Port      string
+	Iface     string
+	// Like LOGGED_IN, FAILED or FREE
+	State string
+	// Like /sys/devices/platform/host3/session1
+	DevicePath string
+}
+
+// GetISCSISessions returns the iSCSI sessions from sysfs, the address and
+// port are of the first connection of the session
+func GetISCSISessions() []ISCSISessionInfo {
+	sessions, err := sysfs.ListDir(ISCSISessionClassPath, `^session\d+$`)
+	if err != nil {
+		log.WithError(err).Debug("Unable to list the iSCSI sessions.")
+		return nil
+	}
+	var found []ISCSISessionInfo
+	for _, session := range sessions {
+		classPath := filepath.Join(ISCSISessionClassPath, session)
+		sessionPath, err := sysfs.RealPath(filepath.Join(classPath, "device"))
+		if err != nil {
+			log.WithError(err).Debugf("Unable to find the device of %s.", session)
+			continue
+		}
+		info := ISCSISessionInfo{Id: strings.TrimPrefix(session, "session"), DevicePath: sessionPath}
+		info.TargetIqn, _ = sysfs.ReadAttr(filepath.Join(classPath, "targetname"))
+		info.Iface, _ = sysfs.ReadAttr(filepath.Join(classPath, "ifacename"))
+		info.State, _ = sysfs.ReadAttr(filepath.Join(classPath, "state"))
+		connections, _ := sysfs.ListDir(sessionPath, `^connection\d+:\d+$`)
+		if len(connections) > 0 {
+			connectionPath := filepath.Join(sessionPath, connections[0], "iscsi_connection", connections[0])
+			info.Address, _ = sysfs.ReadAttr(filepath.Join(connectionPath, "persistent_address"))
+			info.Port, _ = sysfs.ReadAttr(filepath.Join(connectionPath, "persistent_port"))
+		}
+		found = append(found, info)
+	}
+	return found
+}
+
+// Returns the sysfs device paths of the sessions logged in the target portal
+func findISCSISessions(targetPortal string, targetIqn string) []string {
+	address, port := model.SplitPortal(targetPortal, model.ISCSIDefaultPort)
+	addresses := resolveAddress(address)
+	var found []string
+	for _, session := range GetISCSISessions() {
+		if !strings.EqualFold(session.TargetIqn, targetIqn) {
+			continue
+		}
+		if goockutil.Contains(model.NormalizeAddress(session.Address), addresses) && session.Port == port {
+			found = append(found, session.DevicePath)
+		}
+	}
+	return found
+}
+
+// Returns the normalized IP addresses of the portal address, the DNS name is
+// resolved since sysfs only records the IP address of the connection.
+func resolveAddress(address string) []string {
+	addresses := []string{model.NormalizeAddress(address)}
+	if net.ParseIP(address) != nil {
+		return addresses
+	}
+	ips, err := net.LookupHost(address)
+	if err != nil {
+		log.WithError(err).Debugf("Unable to resolve %s.", address)
+		return addresses
+	}
+	for _, ip := range ips {
+		addresses = append(addresses, model.NormalizeAddress(ip))
+	}
+	return addresses
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGetISCSISessionDevices(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	devices, err := GetISCSISessionDevices("1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3:0:0:0", "3:0:0:11"}, devices)
+	devices, err = GetISCSISessionDevices("2")
+	assert.Nil(t, err)
+	assert.Empty(t, devices)
+	_, err = GetISCSISessionDevices("99")
+	assert.Error(t, err)
+}
+
+func TestFindISCSIDevices(t *testing.T) {
+	iqn := "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59"
+	assert.Equal(t, []string{"/dev/sdq"}, FindISCSIDevices("10.64.77.10:3260", iqn, 3))
+	// The default port is used if absent
+	assert.Equal(t, []string{"/dev/sdr"}, FindISCSIDevices("10.64.77.10", iqn, 4))
+	assert.Equal(t, []string{"/dev/sds"}, FindISCSIDevices("10.64.78.10:3260", iqn, 3))
+	assert.Empty(t, FindISCSIDevices("10.64.78.10:3260", iqn, 4))
+	assert.Empty(t, FindISCSIDevices("10.64.77.10:3261", iqn, 3))
+	assert.Empty(t, FindISCSIDevices("10.64.77.10:3260", "iqn.2003-01.org.linux-iscsi.target2", 3))
+}
+
+func TestFindISCSIDevicesIPv6(t *testing.T) {
+	iqn := "iqn.2003-01.org.linux-iscsi.target6:sn.a1"
+	assert.Equal(t, []string{"/dev/sdt"}, FindISCSIDevices("[fd00:10::20]:3260", iqn, 5))
+	assert.Equal(t, []string{"/dev/sdt"}, FindISCSIDevices("FD00:10:0::20", iqn, 5))
+	assert.Empty(t, FindISCSIDevices("[fd00:10::20]:3261", iqn, 5))
+}
+
+func TestFindISCSILuns(t *testing.T) {
+	iqn := "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59"
+	assert.Equal(t, []int{3, 4}, FindISCSILuns("10.64.77.10:3260", iqn))
+	assert.Equal(t, []int{3}, FindISCSILuns("10.64.78.10", iqn))
+	assert.Empty(t, FindISCSILuns("10.64.77.10:3261", iqn))
+}
+
+func TestFindISCSIHosts(t *testing.T) {
+	iqn := "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59"
+	assert.Equal(t, []int{12}, FindISCSIHosts("10.64.77.10:3260", iqn))
+	assert.Equal(t, []int{13}, FindISCSIHosts("10.64.78.10", iqn))
+	assert.Empty(t, FindISCSIHosts("10.64.77.10", "iqn.2003-01.org.linux-iscsi.target2"))
+}
+
+func TestGetISCSISessions(t *testing.T) {
+	sessions := GetISCSISessions()
+	assert.Len(t, sessions, 7)
+	assert.Equal(t, ISCSISessionInfo{
+		Id:         "7",
+		TargetIqn:  "iqn.2003-01.org.linux-iscsi.target6:sn.a1",
+		Address:    "fd00:10::20",
+		Port:       "3260",
+		Iface:      "eth1",
+		DevicePath: "/sys/devices/platform/host14/session7",
+	}, sessions[4])
+}
+
+func TestGetISCSISessionIface(t *testing.T) {
+	assert.Equal(t, "default", GetISCSISessionIface("5"))
+	assert.Equal(t, "eth1", GetISCSISessionIface("7"))
+	assert.Equal(t, "", GetISCSISessionIface("99"))
+}
+
+func TestGetNetInterfaceAddress(t *testing.T) {
+	address, err := GetNetInterfaceAddress("eth1")
+	assert.Nil(t, err)
+	assert.Equal(t, "00:0c:29:3e:1a:01", address)
+	_, err = GetNetInterfaceAddress("eth9")
+	assert.NotNil(t, err)
+	_, err = GetNetInterfaceAddress("../eth1")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/peter-wangxu/goock/pkg/exec"
+)
+
+// DefaultFsType is the filesystem created on the blank devices
+const DefaultFsType = "ext4"
+
+// blkid exits with 2 if no filesystem is found on the device
+const blkidNotFound = 2
+
+// The octal escapes of the mount points in mountinfo
+var mountPointEscapes = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// GetFsType returns the filesystem type of the device, empty if the device
+// is not formatted:
+// blkid -p -s TYPE -o value <device>
+func GetFsType(device string) (string, error) {
+	return GetFsTypeContext(context.Background(), device)
+}
+
+// GetFsTypeContext is GetFsType which kills blkid once ctx is done
+func GetFsTypeContext(ctx context.Context, device string) (string, error) {
+	output, err := executor.CommandContext(ctx, "blkid", "-p", "-s", "TYPE", "-o", "value", device).Output()
+	if err != nil {
+		if ee, ok := err.(exec.ExitError); ok && ee.ExitStatus() == blkidNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("unable to probe the filesystem of %s: %s", device, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// FormatDevice creates the filesystem of fsType on the device, the ext
+// filesystems are forced in case the device is a whole disk:
+// mkfs.<fsType> [-F] <device>
+func FormatDevice(device string, fsType string) error {
+	return FormatDeviceContext(context.Background(), device, fsType)
+}
+
+// FormatDeviceContext is FormatDevice which kills mkfs once ctx is done
+func FormatDeviceContext(ctx context.Context, device string, fsType string) error {
+	args := []string{device}
+	if strings.HasPrefix(fsType, "ext") {
+		args = append([]string{"-F"}, args...)
+	}
+	output, err := executor.CommandContext(ctx, "mkfs."+fsType, args...).CombinedOutput()
+	if err != nil {
+		log.WithError(err).Debugf("Unable to format %s: %s", device, output)
+		return fmt.Errorf("unable to format %s with %s: %s", device, fsType, err)
+	}
+	return nil
+}
+
+// MountDevice mounts source on target, options are like "ro" or "bind":
+// mount [-t <fsType>] [-o <options>] <source> <target>
+func MountDevice(source string, target string, fsType string, options []string) error {
+	return MountDeviceContext(context.Background(), source, target, fsType, options)
+}
+
+// MountDeviceContext is MountDevice which kills mount once ctx is done
+func MountDeviceContext(ctx context.Context, source string, target string, fsType string, options []string) error {
+	var args []string
+	if fsType != "" {
+		args = append(args, "-t", fsType)
+	}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, source, target)
+	output, err := executor.CommandContext(ctx, "mount", args...).CombinedOutput()
+	if err != nil {
+		log.WithError(err).Debugf("Unable to mount %s on %s: %s", source, target, output)
+		return fmt.Errorf("unable to mount %s on %s: %s", source, target, err)
+	}
+	return nil
+}
+
+// Unmount unmounts the target:
+// umount <target>
+func Unmount(target string) error {
+	return UnmountContext(context.Background(), target)
+}
+
+// UnmountContext is Unmount which kills umount once ctx is done
+func UnmountContext(ctx context.Context, target string) error {
+	output, err := executor.CommandContext(ctx, "umount", target).CombinedOutput()
+	if err != nil {
+		log.WithError(err).Debugf("Unable to unmount %s: %s", target, output)
+		return fmt.Errorf("unable to unmount %s: %s", target, err)
+	}
+	return nil
+}
+
+// ResizeFs grows the filesystem of the device to the device size, ext is
+// resized via the device and xfs via its mount point:
+// resize2fs <device>
+// xfs_growfs <mountPoint>
+func ResizeFs(device string, mountPoint string, fsType string) error {
+	return ResizeFsContext(context.Background(), device, mountPoint, fsType)
+}
+
+// ResizeFsContext is ResizeFs which kills the command once ctx is done
+func ResizeFsContext(ctx context.Context, device string, mountPoint string, fsType string) error {
+	var cmd exec.Cmd
+	switch {
+	case strings.HasPrefix(fsType, "ext"):
+		cmd = executor.CommandContext(ctx, "resize2fs", device)
+	case fsType == "xfs":
+		cmd = executor.CommandContext(ctx, "xfs_growfs", mountPoint)
+	default:
+		return fmt.Errorf("resizing filesystem %s is not supported", fsType)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.WithError(err).Debugf("Unable to resize the filesystem of %s: %s", device, output)
+		return fmt.Errorf("unable to resize the filesystem of %s: %s", device, err)
+	}
+	return nil
+}
+
+// IsMountPoint tests if path is mounted according to mountinfo
+func IsMountPoint(path string) (bool, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return false, err
+	}
+	path = filepath.Clean(path)
+	for _, mount := range mounts {
+		if mountPointEscapes.Replace(mount.point) == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
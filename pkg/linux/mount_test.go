@@ -0,0 +1,66 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"testing"
+
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetFsType(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	fsType, err := GetFsType("/dev/sdq")
+	assert.Nil(t, err)
+	assert.Equal(t, "ext4", fsType)
+	// blkid exits with 2 for the blank device
+	fsType, err = GetFsType("/dev/sdr")
+	assert.Nil(t, err)
+	assert.Empty(t, fsType)
+	_, err = GetFsType("/dev/sdz")
+	assert.Error(t, err)
+}
+
+func TestFormatDevice(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Nil(t, FormatDevice("/dev/sdr", "ext4"))
+	assert.Error(t, FormatDevice("/dev/sdz", "xfs"))
+}
+
+func TestMountDevice(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Nil(t, MountDevice("/dev/sdq", "/mnt/sdq", "ext4", []string{"ro"}))
+	err := MountDevice("/dev/sdr", "/mnt/sdr", "ext4", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "/mnt/sdr")
+	assert.Nil(t, Unmount("/data"))
+}
+
+func TestResizeFs(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Nil(t, ResizeFs("/dev/sdq", "/mnt/sdq", "ext4"))
+	assert.Error(t, ResizeFs("/dev/sdq", "/mnt/sdq", "vfat"))
+}
+
+func TestIsMountPoint(t *testing.T) {
+	mounted, err := IsMountPoint("/var/lib/mysql/")
+	assert.Nil(t, err)
+	assert.True(t, mounted)
+	mounted, err = IsMountPoint("/var/lib")
+	assert.Nil(t, err)
+	assert.False(t, mounted)
+}
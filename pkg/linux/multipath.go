@@ -16,34 +16,75 @@ limitations under the License.
 package linux
 
 import (
+	"context"
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
 	goockutil "github.com/peter-wangxu/goock/pkg/util"
 	"path/filepath"
+	"strings"
 )
 
 func IsMultipathEnabled() bool {
-	_, err := executor.Command("multipathd", "show", "status").CombinedOutput()
+	return IsMultipathEnabledContext(context.Background())
+}
+
+// IsMultipathEnabledContext is IsMultipathEnabled which kills multipathd
+// once ctx is done
+func IsMultipathEnabledContext(ctx context.Context) bool {
+	_, err := executor.CommandContext(ctx, "multipathd", "show", "status").CombinedOutput()
 	if err != nil {
 		return false
 	}
 	return true
 }
 
-// Flush device(s) via multipath -f <device>/-F
+// Flush device(s) via multipath -f <device>/-F, the map is not flushed if
+// it is mounted, held, opened or used as swap. path is the wwn or the
+// device of the map, multipath -F skips the maps in use by itself.
 func FlushPath(path string) error {
+	return FlushPathContext(context.Background(), path)
+}
+
+// FlushPathContext is FlushPath which kills multipath once ctx is done
+func FlushPathContext(ctx context.Context, path string) error {
+	if path != "" {
+		device := path
+		if !strings.Contains(device, "/") {
+			device = "/dev/mapper/" + path
+		}
+		if err := CheckDevicesUnused([]string{device}); err != nil {
+			return err
+		}
+	}
+	return ForceFlushPathContext(ctx, path)
+}
+
+// ForceFlushPath flushes device(s) via multipath -f <device>/-F without
+// checking the usage
+func ForceFlushPath(path string) error {
+	return ForceFlushPathContext(context.Background(), path)
+}
+
+// ForceFlushPathContext is ForceFlushPath which kills multipath once ctx is done
+func ForceFlushPathContext(ctx context.Context, path string) error {
 	var err error
 	if path != "" {
-		_, err = executor.Command("multipath", "-f", path).CombinedOutput()
+		_, err = executor.CommandContext(ctx, "multipath", "-f", path).CombinedOutput()
 	} else {
-		_, err = executor.Command("multipath", "-F").CombinedOutput()
+		_, err = executor.CommandContext(ctx, "multipath", "-F").CombinedOutput()
 	}
 	return err
 }
 
 // Reconfigure multipath
 func Reconfigure() error {
-	output, err := executor.Command("multipathd", "reconfigure").CombinedOutput()
+	return ReconfigureContext(context.Background())
+}
+
+// ReconfigureContext is Reconfigure which kills multipathd once ctx is done
+func ReconfigureContext(ctx context.Context) error {
+	output, err := executor.CommandContext(ctx, "multipathd", "reconfigure").CombinedOutput()
 	if nil != err {
 		log.WithError(err).Info(fmt.Sprintf("Failed to reconfigure the multipathd. %s", output))
 	}
@@ -52,7 +93,12 @@ func Reconfigure() error {
 
 // Force multipath reloads devices via multipath -r
 func Reload() error {
-	output, err := executor.Command("multipath", "-r").Output()
+	return ReloadContext(context.Background())
+}
+
+// ReloadContext is Reload which kills multipath once ctx is done
+func ReloadContext(ctx context.Context) error {
+	output, err := executor.CommandContext(ctx, "multipath", "-r").Output()
 	if nil != err {
 		log.WithError(err).Debug(fmt.Sprintf("Reload multipath failed: %s", output))
 	}
@@ -61,7 +107,12 @@ func Reload() error {
 
 // Check if the path is a multipath device
 func CheckDevice(path string) bool {
-	output, err := executor.Command("multipath", "-c", path).CombinedOutput()
+	return CheckDeviceContext(context.Background(), path)
+}
+
+// CheckDeviceContext is CheckDevice which kills multipath once ctx is done
+func CheckDeviceContext(ctx context.Context, path string) bool {
+	output, err := executor.CommandContext(ctx, "multipath", "-c", path).CombinedOutput()
 	if nil != err {
 		log.WithError(err).Debug(fmt.Sprintf("The specified path doesn't exist: %s", output))
 		return false
@@ -70,7 +121,12 @@ func CheckDevice(path string) bool {
 }
 
 func ResizeMpath(mpathId string) error {
-	output, err := executor.Command("multipathd", "resize", "map", mpathId).CombinedOutput()
+	return ResizeMpathContext(context.Background(), mpathId)
+}
+
+// ResizeMpathContext is ResizeMpath which kills multipathd once ctx is done
+func ResizeMpathContext(ctx context.Context, mpathId string) error {
+	output, err := executor.CommandContext(ctx, "multipathd", "resize", "map", mpathId).CombinedOutput()
 	if nil != err {
 		log.WithError(err).Debug(fmt.Sprintf("Resize %s failed due to [%s]", mpathId, output))
 	}
@@ -90,20 +146,25 @@ func ResizeMpath(mpathId string) error {
 // /dev/disk/by-id/scsi-<WWN>
 // /dev/mapper/<WWN>
 func FindMpathByWwn(wwn string) string {
+	return FindMpathByWwnContext(context.Background(), wwn)
+}
+
+// FindMpathByWwnContext waits for the multipath device of wwn to appear under
+// /dev/disk/by-id or /dev/mapper, it gives up once ctx is done.
+func FindMpathByWwnContext(ctx context.Context, wwn string) string {
 	log.Info("Try to find multipath device for WWN: ", wwn)
-	// Wait for its appearance under /dev/disk/by-id/dm-uuid-mpath
-	potential1 := fmt.Sprintf("/dev/disk/by-id/dm-uuid-mpath-%s", wwn)
-	existed := goockutil.WaitForPath(potential1, 10)
-	if existed {
-		return potential1
-	}
-	// Wait for its appearance under /dev/mapper/
-	potential2 := fmt.Sprintf("/dev/mapper/%s", wwn)
-	existed = goockutil.WaitForPath(potential2, 10)
-	if existed {
-		return potential2
+	return WaitForMpath(ctx, wwn, 10)
+}
+
+// WaitForMpath waits maxWait intervals for the multipath device of wwn,
+// empty string is returned if it does not appear.
+func WaitForMpath(ctx context.Context, wwn string, maxWait int) string {
+	// Either of them appears, the one under /dev/disk/by-id is preferred
+	mPath, err := goockutil.WaitForFirstPathContext(ctx, mpathDevices(wwn), maxWait)
+	if err != nil {
+		return ""
 	}
-	return ""
+	return mPath
 }
 
 // Use multipath -l <path> to discover multipath device
@@ -128,3 +189,85 @@ func FindMultipathByWwn(wwn string) model.Multipath {
 	}
 	return model.Multipath{}
 }
+
+// FindMissingMpathPaths returns the devices like sdb of paths which are not in
+// the multipath map of wwn, all of them are missing if the map does not exist.
+// The paths whose WWN is not wwn are ignored.
+func FindMissingMpathPaths(wwn string, paths []string) []string {
+	multipath := FindMultipathByWwn(wwn)
+	var missing []string
+	for _, path := range paths {
+		if GetWWN(path) != wwn {
+			log.Debugf("Path %s does not belong to %s, skip it.", path, wwn)
+			continue
+		}
+		device := filepath.Base(path)
+		if real, err := sysfs.RealPath(path); err == nil {
+			device = filepath.Base(real)
+		}
+		found := false
+		for _, single := range multipath.Paths {
+			if single.DevNode == device {
+				found = true
+				break
+			}
+		}
+		if !found && !goockutil.Contains(device, missing) {
+			missing = append(missing, device)
+		}
+	}
+	return missing
+}
+
+// Returns the device paths of the multipath map of wwn
+func mpathDevices(wwn string) []string {
+	return []string{
+		fmt.Sprintf("/dev/disk/by-id/dm-uuid-mpath-%s", wwn),
+		fmt.Sprintf("/dev/mapper/%s", wwn),
+	}
+}
+
+// HealMultipath asks multipath to build the map of wwn with the devices:
+// multipath -a <wwid>, only if the map is absent
+// multipathd add path <device>
+// multipathd add map <wwid>, only if the map is still absent
+// multipathd reconfigure, only if adding the map does not help, it is the
+// last resort since all the maps on the host are reloaded
+func HealMultipath(wwn string, devices []string) error {
+	return HealMultipathContext(context.Background(), wwn, devices)
+}
+
+// HealMultipathContext is HealMultipath which kills the commands once ctx
+// is done
+func HealMultipathContext(ctx context.Context, wwn string, devices []string) error {
+	var errs []string
+	// Whitelist the wwid in case find_multipaths is set, it is kept in the
+	// wwids file for good, so it is skipped if only some paths are missing
+	if existing, _ := goockutil.FilterPath(mpathDevices(wwn)); len(existing) == 0 {
+		if output, err := executor.CommandContext(ctx, "multipath", "-a", wwn).CombinedOutput(); err != nil {
+			log.WithError(err).Debugf("Unable to add wwid %s: %s", wwn, output)
+			errs = append(errs, fmt.Sprintf("multipath -a %s: %s", wwn, err))
+		}
+	}
+	for _, device := range devices {
+		if output, err := executor.CommandContext(ctx, "multipathd", "add", "path", device).CombinedOutput(); err != nil {
+			log.WithError(err).Debugf("Unable to add path %s: %s", device, output)
+			errs = append(errs, fmt.Sprintf("multipathd add path %s: %s", device, err))
+		}
+	}
+	if FindMultipathByWwn(wwn).Wwn == "" {
+		if output, err := executor.CommandContext(ctx, "multipathd", "add", "map", wwn).CombinedOutput(); err != nil {
+			log.WithError(err).Debugf("Unable to add map %s: %s", wwn, output)
+		}
+		if FindMultipathByWwn(wwn).Wwn == "" {
+			log.Infof("Multipath map %s is still missing, reconfigure multipathd.", wwn)
+			if err := ReconfigureContext(ctx); err != nil {
+				errs = append(errs, fmt.Sprintf("multipathd reconfigure: %s", err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to heal multipath %s: %s", wwn, strings.Join(errs, "; "))
+	}
+	return nil
+}
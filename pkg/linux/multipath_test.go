@@ -16,6 +16,8 @@ limitations under the License.
 package linux
 
 import (
+	"context"
+	"github.com/peter-wangxu/goock/pkg/model"
 	"github.com/peter-wangxu/goock/test"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -34,6 +36,13 @@ func TestFlushPath(t *testing.T) {
 
 }
 
+func TestFlushPathInUse(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	err := FlushPath("/dev/dm-20")
+	assert.True(t, IsDeviceBusy(err))
+	assert.Contains(t, err.Error(), "mounted on /var/lib/mysql")
+}
+
 func TestFlushPathAll(t *testing.T) {
 
 	SetExecutor(test.NewMockExecutor())
@@ -86,3 +95,75 @@ func TestFindMpathByPath(t *testing.T) {
 	//TODO how to mock "path, err := filepath.EvalSymlinks(path)"
 	//assert.NotEmpty(t, ret)
 }
+
+func TestFindMissingMpathPaths(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	missing := FindMissingMpathPaths("350060160b6e00e5a50060160b6e11317", []string{
+		"/dev/disk/by-path/pci-0000:05:00.0-fc-0x5006016d09200925-lun-11",
+		"/dev/disk/by-path/ip-192.168.3.50:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904558.b12-lun-11",
+	})
+	// The iSCSI path belongs to another LUN
+	assert.Equal(t, []string{"sdi"}, missing)
+}
+
+func TestHealMultipath(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	err := HealMultipath("350060160b6e00e5a50060160b6e11317", []string{"sdi"})
+	assert.Nil(t, err)
+}
+
+func TestHealMultipathFailed(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	err := HealMultipath("350060160b6e00e5a50060160b6e11317", []string{"sdi", "sdz"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "multipathd add path sdz")
+}
+
+func TestHealMultipathContext(t *testing.T) {
+	mockExec := &contextExecutor{Interface: test.NewMockExecutor()}
+	SetExecutor(mockExec)
+	defer SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := HealMultipathContext(ctx, "350060160b6e00e5a50060160b6e11317", []string{"sdi"})
+	assert.Nil(t, err)
+	// The map exists, so the wwid is not added to the wwids file, nor is
+	// multipathd reconfigured
+	assert.Equal(t, []string{"multipathd add path sdi"}, mockExec.commands)
+	for _, commandCtx := range mockExec.contexts {
+		assert.True(t, commandCtx == ctx)
+	}
+}
+
+func TestHealMultipathNoMap(t *testing.T) {
+	mockExec := &contextExecutor{Interface: test.NewMockExecutor()}
+	SetExecutor(mockExec)
+	defer SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	err := HealMultipathContext(context.Background(), "36006016015301d00a5bd6b8fb4c84c2a", []string{"sdi"})
+	assert.Nil(t, err)
+	// multipathd is reconfigured as the map is still missing after adding it
+	assert.Equal(t, []string{
+		"multipath -a 36006016015301d00a5bd6b8fb4c84c2a",
+		"multipathd add path sdi",
+		"multipathd add map 36006016015301d00a5bd6b8fb4c84c2a",
+		"multipathd reconfigure",
+	}, mockExec.commands)
+}
+
+func TestHealMultipathMapAdded(t *testing.T) {
+	mockExec := &contextExecutor{Interface: test.NewMockExecutor()}
+	SetExecutor(mockExec)
+	defer SetExecutor(test.NewMockExecutor())
+	model.SetExecutor(test.NewMockExecutor())
+	// The map is built once the path is added
+	err := HealMultipathContext(context.Background(), "351160160b6e00e5a50060160b6e00e5a", []string{"sdi"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"multipath -a 351160160b6e00e5a50060160b6e00e5a",
+		"multipathd add path sdi",
+	}, mockExec.commands)
+}
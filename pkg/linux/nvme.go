@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+)
+
+// IsNVMeMultipathEnabled checks whether the native NVMe multipath is enabled,
+// when enabled, a single /dev/nvmeXnY is presented for all paths of a namespace.
+func IsNVMeMultipathEnabled() bool {
+	enabled, err := sysfs.ReadAttr("/sys/module/nvme_core/parameters/multipath")
+	if err != nil {
+		return false
+	}
+	return enabled == "Y"
+}
+
+// GetNVMeHostNqn returns the NQN of the host from /etc/nvme/hostnqn
+func GetNVMeHostNqn() string {
+	nqn, err := sysfs.ReadAttr("/etc/nvme/hostnqn")
+	if err != nil {
+		log.WithError(err).Debug("Unable to fetch the NVMe host NQN, nvme-cli is not installed?")
+		return ""
+	}
+	return nqn
+}
+
+// RescanNVMeNamespaces rescans the namespaces of controller, such as nvme0
+func RescanNVMeNamespaces(controller string) error {
+	return RescanNVMeNamespacesContext(context.Background(), controller)
+}
+
+// RescanNVMeNamespacesContext is RescanNVMeNamespaces which kills nvme once
+// ctx is done
+func RescanNVMeNamespacesContext(ctx context.Context, controller string) error {
+	output, err := executor.CommandContext(ctx, "nvme", "ns-rescan", fmt.Sprintf("/dev/%s", controller)).CombinedOutput()
+	if err != nil {
+		log.WithError(err).Debugf("Rescan namespaces of %s failed: %s", controller, output)
+	}
+	return err
+}
+
+// GetNVMeNamespaces returns the namespace devices of subsystem, such as
+// nvme0n1, subsystem is like nvme-subsys0
+func GetNVMeNamespaces(subsystem string) []string {
+	namespaces, err := sysfs.ListDir(filepath.Join("/sys/class/nvme-subsystem", subsystem), `^nvme\d+n\d+$`)
+	if err != nil {
+		log.WithError(err).Debugf("Unable to list namespaces of %s.", subsystem)
+		return []string{}
+	}
+	return namespaces
+}
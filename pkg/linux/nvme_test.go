@@ -0,0 +1,44 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIsNVMeMultipathEnabled(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.True(t, IsNVMeMultipathEnabled())
+}
+
+func TestGetNVMeHostNqn(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Equal(t, "nqn.2014-08.org.nvmexpress:uuid:2d1a3c3e-5c4b-4f6e-9a6d-3b2f1e0d9c8b",
+		GetNVMeHostNqn())
+}
+
+func TestRescanNVMeNamespaces(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Nil(t, RescanNVMeNamespaces("nvme1"))
+}
+
+func TestGetNVMeNamespaces(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Equal(t, []string{"nvme1n1", "nvme1n2"}, GetNVMeNamespaces("nvme-subsys1"))
+	assert.Empty(t, GetNVMeNamespaces("nvme-subsys9"))
+}
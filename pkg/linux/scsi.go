@@ -16,17 +16,33 @@ limitations under the License.
 package linux
 
 import (
+	"context"
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// SCSIDevicePath lists the SCSI devices by H:C:T:L
+const SCSIDevicePath = "/sys/bus/scsi/devices"
+
+// Wildcard scans all the channels, targets or LUNs, see RescanHosts
+const Wildcard = -1
+
 func GetWWN(path string) string {
-	output, _ := executor.Command("/lib/udev/scsi_id", "--page", "0x83",
+	return GetWWNContext(context.Background(), path)
+}
+
+// GetWWNContext is GetWWN which kills scsi_id once ctx is done
+func GetWWNContext(ctx context.Context, path string) string {
+	output, _ := executor.CommandContext(ctx, "/lib/udev/scsi_id", "--page", "0x83",
 		"--whitelisted", path).CombinedOutput()
 	return strings.Trim(string(output), "\n")
 }
@@ -48,7 +64,12 @@ func GetWWN(path string) string {
 // vda                                  0
 // └─vda1                               0
 func CheckReadWrite(path string, wwn string) bool {
-	output, _ := executor.Command("lsblk", "-o", "NAME,RO", "-l", "-n").CombinedOutput()
+	return CheckReadWriteContext(context.Background(), path, wwn)
+}
+
+// CheckReadWriteContext is CheckReadWrite which kills lsblk once ctx is done
+func CheckReadWriteContext(ctx context.Context, path string, wwn string) bool {
+	output, _ := executor.CommandContext(ctx, "lsblk", "-o", "NAME,RO", "-l", "-n").CombinedOutput()
 	pattern, _ := regexp.Compile("(\\w+)\\s+([01])\\s?")
 	results := pattern.FindAllStringSubmatch(string(output), -1)
 	readWrite := false
@@ -67,7 +88,12 @@ func CheckReadWrite(path string, wwn string) bool {
 
 // Get block device size
 func GetDeviceSize(path string) int {
-	output, err := executor.Command("blockdev", "--getsize64", path).CombinedOutput()
+	return GetDeviceSizeContext(context.Background(), path)
+}
+
+// GetDeviceSizeContext is GetDeviceSize which kills blockdev once ctx is done
+func GetDeviceSizeContext(ctx context.Context, path string) int {
+	output, err := executor.CommandContext(ctx, "blockdev", "--getsize64", path).CombinedOutput()
 	if nil != err {
 		log.WithError(err).Warnf("Unable to get size of device %s", path)
 	}
@@ -81,7 +107,12 @@ func GetDeviceSize(path string) int {
 
 // use echo "c t l" > to /sys/class/scsi_host/%s/scan
 func ScanSCSIBus(path string, content string) error {
-	cmd := executor.Command("tee", "-a", path)
+	return ScanSCSIBusContext(context.Background(), path, content)
+}
+
+// ScanSCSIBusContext is ScanSCSIBus which kills tee once ctx is done
+func ScanSCSIBusContext(ctx context.Context, path string, content string) error {
+	cmd := executor.CommandContext(ctx, "tee", "-a", path)
 	cmd.SetStdin(strings.NewReader(content))
 	_, err := cmd.CombinedOutput()
 	if err != nil {
@@ -91,27 +122,73 @@ func ScanSCSIBus(path string, content string) error {
 
 }
 
+// GetSysfsDevicePath returns the real sysfs path of the SCSI device, like
+// /sys/devices/platform/host3/session1/target3:0:0/3:0:0:1
+// device could be "/dev/sdb" or "sdb"
+func GetSysfsDevicePath(device string) string {
+	_, name := filepath.Split(device)
+	return RealPath(fmt.Sprintf("/sys/block/%s/device", name))
+}
+
+// RealPath resolves all symbolic links of path, empty string is returned
+// if the path does not exist.
+func RealPath(path string) string {
+	real, err := sysfs.RealPath(path)
+	if err != nil {
+		log.WithError(err).Debugf("Unable to resolve the real path of %s.", path)
+		return ""
+	}
+	return real
+}
+
+// IsISCSIDevice checks whether the device is attached via an iSCSI session
+// device could be "/dev/sdb" or "sdb"
+func IsISCSIDevice(device string) bool {
+	return strings.Contains(GetSysfsDevicePath(device), "/session")
+}
+
+// path = "/dev/sdb" or "sdb"
+// The device is not removed if it is mounted, held, opened or used as swap
+func RemoveSCSIDevice(path string) error {
+	if err := CheckDevicesUnused([]string{path}); err != nil {
+		return err
+	}
+	ForceRemoveSCSIDevice(path)
+	return nil
+}
+
 // path = "/dev/sdb" or "sdb"
 // Use echo 1 > /sys/block/%s/device/delete to force delete the device
-func RemoveSCSIDevice(path string) {
+func ForceRemoveSCSIDevice(path string) {
+	ForceRemoveSCSIDeviceContext(context.Background(), path)
+}
+
+// ForceRemoveSCSIDeviceContext is ForceRemoveSCSIDevice which kills the
+// commands once ctx is done
+func ForceRemoveSCSIDeviceContext(ctx context.Context, path string) {
 	if strings.Contains(path, string(filepath.Separator)) {
 		// Before remove the device from host, flush buffers to disk
-		FlushDeviceIO(path)
+		FlushDeviceIOContext(ctx, path)
 		// Get the file name from the full path, ex : /dev/sdb -> sdb
 		_, path = filepath.Split(path)
 	} else {
-		FlushDeviceIO(fmt.Sprintf("/dev/%s", path))
+		FlushDeviceIOContext(ctx, fmt.Sprintf("/dev/%s", path))
 	}
 
 	path = fmt.Sprintf("/sys/block/%s/device/delete", path)
-	ScanSCSIBus(path, "1")
+	ScanSCSIBusContext(ctx, path, "1")
 	log.Debugf("Removed device [%s].", path)
 }
 
 // path = "/dev/sdb" or "
 // "/dev/disk/by-path/ip-10.244.213.177:3260-iscsi-iqn.1992-04.com.emc:cx.fnm00150600267.a0-lun-10"
 func FlushDeviceIO(path string) error {
-	cmd := executor.Command("blockdev", "-v", "--flushbufs", path)
+	return FlushDeviceIOContext(context.Background(), path)
+}
+
+// FlushDeviceIOContext is FlushDeviceIO which kills blockdev once ctx is done
+func FlushDeviceIOContext(ctx context.Context, path string) error {
+	cmd := executor.CommandContext(ctx, "blockdev", "-v", "--flushbufs", path)
 	_, err := cmd.CombinedOutput()
 	return err
 }
@@ -119,22 +196,26 @@ func FlushDeviceIO(path string) error {
 // Commands example:
 // echo 1 > /sys/bus/scsi/drivers/sd/9:0:0:6/rescan
 func ExtendDevice(path string) (int, error) {
+	return ExtendDeviceContext(context.Background(), path)
+}
 
+// ExtendDeviceContext is ExtendDevice which kills the commands once ctx is done
+func ExtendDeviceContext(ctx context.Context, path string) (int, error) {
 	info, err := GetDeviceInfo(path)
 	if err != nil {
 		return 0, fmt.Errorf("Unable to extend device %s, device info not found", path)
 	}
 	deviceId := info.GetDeviceIdentifier()
 	rescanPath := fmt.Sprintf("/sys/bus/scsi/drivers/sd/%s/rescan", deviceId)
-	deviceSize := GetDeviceSize(path)
+	deviceSize := GetDeviceSizeContext(ctx, path)
 	log.WithFields(logrus.Fields{
 		"path":     path,
 		"device":   deviceId,
 		"original": deviceSize,
 	}).Debug("Begin to extend the device.")
 
-	ScanSCSIBus(rescanPath, "1")
-	newSize := GetDeviceSize(path)
+	ScanSCSIBusContext(ctx, rescanPath, "1")
+	newSize := GetDeviceSizeContext(ctx, path)
 	log.WithFields(logrus.Fields{
 		"path":    path,
 		"newSize": newSize,
@@ -142,9 +223,8 @@ func ExtendDevice(path string) (int, error) {
 	return newSize, err
 }
 
-// output:
-// sudo sg_scan /dev/disk/by-path/pci-0000:05:00.1-fc-0x5006016d09200925-lun-0
-// /dev/disk/by-path/pci-0000:05:00.1-fc-0x5006016d09200925-lun-0: scsi9 channel=0 id=0 lun=0 [em]
+// GetDeviceInfo returns the SCSI address of the device from sysfs, path is like
+// /dev/disk/by-path/pci-0000:05:00.1-fc-0x5006016d09200925-lun-0 -> scsi9 channel=0 id=0 lun=0
 func GetDeviceInfo(path string) (model.DeviceInfo, error) {
 	devices := model.NewDeviceInfo(path)
 	if len(devices) <= 0 {
@@ -153,3 +233,107 @@ func GetDeviceInfo(path string) (model.DeviceInfo, error) {
 	}
 	return devices[0], nil
 }
+
+// FindTargetLuns returns the H:C:T:L of lun under the SCSI target, targetPath
+// is the sysfs directory of the target, like:
+// /sys/devices/platform/host3/session1/target3:0:0/3:0:0:1
+func FindTargetLuns(targetPath string, lun int) []string {
+	devices, err := listSCSIDevices(targetPath)
+	if err != nil {
+		log.WithError(err).Debugf("Unable to list the SCSI devices of %s.", targetPath)
+		return nil
+	}
+	var hctls []string
+	for _, device := range devices {
+		var host, channel, target, found int
+		if _, err := fmt.Sscanf(device, "%d:%d:%d:%d", &host, &channel, &target, &found); err == nil && found == lun {
+			hctls = append(hctls, device)
+		}
+	}
+	return hctls
+}
+
+// GetBlockDevices returns the block devices like /dev/sdb of the SCSI device
+// H:C:T:L, layout:
+// /sys/bus/scsi/devices/3:0:0:1/block/sdb
+func GetBlockDevices(hctl string) []string {
+	names, err := sysfs.ListDir(filepath.Join(SCSIDevicePath, hctl, "block"), `^[^.]`)
+	if err != nil {
+		// The block device is not created yet
+		log.WithError(err).Debugf("Unable to find the block device of %s.", hctl)
+		return nil
+	}
+	devices := make([]string, len(names))
+	for i, name := range names {
+		devices[i] = "/dev/" + name
+	}
+	return devices
+}
+
+// InquiryData is the standard inquiry data of a SCSI device
+type InquiryData struct {
+	Vendor   string `json:"vendor"`
+	Product  string `json:"product"`
+	Revision string `json:"revision"`
+	// Peripheral device type, 0 for disk
+	DeviceType int `json:"deviceType"`
+	// Unit serial number from the VPD page 0x80, empty if not supported
+	Serial string `json:"serial,omitempty"`
+}
+
+// GetInquiryData returns the inquiry data of the SCSI device H:C:T:L which
+// is cached by the kernel, the device is not queried again. layout:
+// /sys/bus/scsi/devices/3:0:0:1/vendor
+// /sys/bus/scsi/devices/3:0:0:1/vpd_pg80
+func GetInquiryData(hctl string) (InquiryData, error) {
+	devicePath := filepath.Join(SCSIDevicePath, hctl)
+	var inquiry InquiryData
+	var err error
+	if inquiry.Vendor, err = sysfs.ReadAttr(filepath.Join(devicePath, "vendor")); err != nil {
+		return inquiry, err
+	}
+	inquiry.Product, _ = sysfs.ReadAttr(filepath.Join(devicePath, "model"))
+	inquiry.Revision, _ = sysfs.ReadAttr(filepath.Join(devicePath, "rev"))
+	deviceType, _ := sysfs.ReadAttr(filepath.Join(devicePath, "type"))
+	inquiry.DeviceType, _ = strconv.Atoi(deviceType)
+	// The page is binary, the serial number follows the 4-byte header
+	if page, err := ioutil.ReadFile(sysfs.HostPath(filepath.Join(devicePath, "vpd_pg80"))); err == nil && len(page) > 4 {
+		inquiry.Serial = strings.TrimSpace(strings.Trim(string(page[4:]), "\x00"))
+	}
+	return inquiry, nil
+}
+
+// Returns the SCSI devices(H:C:T:L) under the SCSI target
+func listSCSIDevices(targetPath string) ([]string, error) {
+	return sysfs.ListDir(targetPath, `^\d+:\d+:\d+:\d+$`)
+}
+
+// Returns the LUN IDs of all the SCSI devices under the SCSI targets
+func findTargetLunIDs(targetPaths []string) []int {
+	var luns []int
+	for _, targetPath := range targetPaths {
+		devices, _ := listSCSIDevices(targetPath)
+		for _, device := range devices {
+			var host, channel, target, lun int
+			if _, err := fmt.Sscanf(device, "%d:%d:%d:%d", &host, &channel, &target, &lun); err != nil {
+				continue
+			}
+			if !goockutil.ContainsInt(lun, luns) {
+				luns = append(luns, lun)
+			}
+		}
+	}
+	sort.Ints(luns)
+	return luns
+}
+
+// Returns the block devices of lun under the SCSI targets
+func findTargetDevices(targetPaths []string, lun int) []string {
+	var devices []string
+	for _, targetPath := range targetPaths {
+		for _, hctl := range FindTargetLuns(targetPath, lun) {
+			devices = append(devices, GetBlockDevices(hctl)...)
+		}
+	}
+	return devices
+}
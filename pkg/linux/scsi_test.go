@@ -16,10 +16,13 @@ limitations under the License.
 package linux
 
 import (
+	"context"
+	"github.com/peter-wangxu/goock/pkg/exec"
 	"github.com/peter-wangxu/goock/pkg/model"
 	"github.com/peter-wangxu/goock/test"
 	testhelper "github.com/peter-wangxu/goock/test/helper"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -49,13 +52,48 @@ func TestCheckReadWriteNonexistent(t *testing.T) {
 
 func TestRemoveSCSIDevice(t *testing.T) {
 	SetExecutor(test.NewMockExecutor())
-	RemoveSCSIDevice("sdb")
+	// sdb is a path of multipath dm-5
+	err := RemoveSCSIDevice("sdb")
+	assert.True(t, IsDeviceBusy(err))
 }
 
 func TestRemoveSCSIDeviceWithPath(t *testing.T) {
 	testhelper.SkipIfWindows(t)
 	SetExecutor(test.NewMockExecutor())
-	RemoveSCSIDevice("/dev/sdx")
+	err := RemoveSCSIDevice("/dev/sdx")
+	assert.Nil(t, err)
+}
+
+func TestForceRemoveSCSIDevice(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	ForceRemoveSCSIDevice("sdb")
+}
+
+// contextExecutor records the contexts and the command lines of the commands
+type contextExecutor struct {
+	exec.Interface
+	contexts []context.Context
+	commands []string
+}
+
+func (c *contextExecutor) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	c.contexts = append(c.contexts, ctx)
+	c.commands = append(c.commands, strings.Join(append([]string{cmd}, args...), " "))
+	return c.Interface.CommandContext(ctx, cmd, args...)
+}
+
+func TestForceRemoveSCSIDeviceContext(t *testing.T) {
+	mockExec := &contextExecutor{Interface: test.NewMockExecutor()}
+	SetExecutor(mockExec)
+	defer SetExecutor(test.NewMockExecutor())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ForceRemoveSCSIDeviceContext(ctx, "sdb")
+	// Both the flush and the delete are killed along with ctx
+	assert.Len(t, mockExec.contexts, 2)
+	for _, commandCtx := range mockExec.contexts {
+		assert.True(t, commandCtx == ctx)
+	}
 }
 
 func TestFlushDeviceIO(t *testing.T) {
@@ -92,7 +130,45 @@ func TestGetDeviceInfo(t *testing.T) {
 }
 func TestGetDeviceInfoNotFound(t *testing.T) {
 	model.SetExecutor(test.NewMockExecutor())
-	info, err := GetDeviceInfo("/dev/sdx")
+	info, err := GetDeviceInfo("/dev/sdz")
 	assert.Error(t, err)
 	assert.Equal(t, "", info.Device)
 }
+
+func TestGetSysfsDevicePath(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.Equal(t, "/sys/devices/platform/host12/session5/target12:0:0/12:0:0:3",
+		GetSysfsDevicePath("/dev/sdq"))
+	assert.Empty(t, GetSysfsDevicePath("sdz"))
+}
+
+func TestIsISCSIDevice(t *testing.T) {
+	SetExecutor(test.NewMockExecutor())
+	assert.True(t, IsISCSIDevice("sdq"))
+	assert.False(t, IsISCSIDevice("sdx"))
+}
+
+func TestFindTargetLuns(t *testing.T) {
+	target := "/sys/devices/platform/host12/session5/target12:0:0"
+	assert.Equal(t, []string{"12:0:0:4"}, FindTargetLuns(target, 4))
+	assert.Empty(t, FindTargetLuns(target, 5))
+	assert.Empty(t, FindTargetLuns("/sys/devices/platform/host12/session5/target12:0:1", 4))
+}
+
+func TestGetBlockDevices(t *testing.T) {
+	assert.Equal(t, []string{"/dev/sdq"}, GetBlockDevices("12:0:0:3"))
+	assert.Len(t, GetBlockDevices("9:0:3:11"), 2)
+	assert.Empty(t, GetBlockDevices("12:0:0:5"))
+}
+
+func TestGetInquiryData(t *testing.T) {
+	inquiry, err := GetInquiryData("12:0:0:3")
+	assert.Nil(t, err)
+	assert.Equal(t, InquiryData{Vendor: "LIO-ORG", Product: "block1", Revision: "4.0", DeviceType: 0,
+		Serial: "a1b2c3d4-e5f6-0718-293a-4b5c6a1b2c3d"}, inquiry)
+}
+
+func TestGetInquiryDataNonexistent(t *testing.T) {
+	_, err := GetInquiryData("99:0:0:1")
+	assert.Error(t, err)
+}
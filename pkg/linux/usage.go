@@ -0,0 +1,288 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
+)
+
+const (
+	// MountInfoPath lists the mounts with the device numbers
+	MountInfoPath = "/proc/self/mountinfo"
+	// SwapsPath lists the active swap devices
+	SwapsPath = "/proc/swaps"
+	// BlockClassPath contains all the block devices including the partitions
+	BlockClassPath = "/sys/class/block"
+)
+
+// multipathd keeps the paths open to check them, it is not a user of the devices
+var ignoredProcesses = []string{"multipathd"}
+
+// DeviceUsage tells how a block device is used on the host, the usage of
+// its partitions and the devices built on top of it is included.
+type DeviceUsage struct {
+	// Kernel name like sdb or dm-3
+	Device string
+	// Mount points of the device
+	Mounts []string
+	// Devices like dm-4 of LVM which are built on top of the device
+	Holders []string
+	// Processes like 2301(mysqld) which have the device open
+	Processes []string
+	Swap      bool
+}
+
+// InUse returns true if the device should not be removed
+func (u DeviceUsage) InUse() bool {
+	return len(u.Mounts) > 0 || len(u.Holders) > 0 || len(u.Processes) > 0 || u.Swap
+}
+
+func (u DeviceUsage) String() string {
+	var reasons []string
+	if len(u.Mounts) > 0 {
+		reasons = append(reasons, "mounted on "+strings.Join(u.Mounts, ", "))
+	}
+	if u.Swap {
+		reasons = append(reasons, "used as swap")
+	}
+	if len(u.Holders) > 0 {
+		reasons = append(reasons, "held by "+strings.Join(u.Holders, ", "))
+	}
+	if len(u.Processes) > 0 {
+		reasons = append(reasons, "opened by "+strings.Join(u.Processes, ", "))
+	}
+	if len(reasons) == 0 {
+		return u.Device + " is not in use"
+	}
+	return u.Device + " is " + strings.Join(reasons, ", ")
+}
+
+// DeviceBusyError is returned when the devices to remove are still in use
+type DeviceBusyError struct {
+	Usages []DeviceUsage
+}
+
+func (e *DeviceBusyError) Error() string {
+	var usages []string
+	for _, usage := range e.Usages {
+		usages = append(usages, usage.String())
+	}
+	return fmt.Sprintf("refuse to remove the devices in use: %s; force the removal if they are not needed",
+		strings.Join(usages, "; "))
+}
+
+// IsDeviceBusy returns true if err is a DeviceBusyError
+func IsDeviceBusy(err error) bool {
+	_, ok := err.(*DeviceBusyError)
+	return ok
+}
+
+// GetDeviceName returns the kernel name of device, like sdb for "/dev/sdb" or
+// dm-3 for "/dev/mapper/<wwn>"
+func GetDeviceName(device string) string {
+	if strings.Contains(device, "/") {
+		if real, err := sysfs.RealPath(device); err == nil {
+			device = real
+		}
+	}
+	return filepath.Base(device)
+}
+
+// GetDeviceUsages checks the mounts, swaps, holders and open handles of the
+// devices, the holders in ignoredHolders are skipped.
+func GetDeviceUsages(devices []string, ignoredHolders ...string) ([]DeviceUsage, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the mounts: %s", err)
+	}
+	swaps, err := readSwaps()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the swaps: %s", err)
+	}
+	processes := findOpenDevices()
+	var usages []DeviceUsage
+	for _, device := range devices {
+		usage := DeviceUsage{Device: GetDeviceName(device)}
+		var names []string
+		names, usage.Holders = stackDevices(usage.Device, ignoredHolders)
+		for _, name := range names {
+			number, _ := sysfs.ReadAttr(BlockClassPath + "/" + name + "/dev")
+			for _, mount := range mounts {
+				if (number != "" && mount.number == number) || mount.device == name {
+					usage.Mounts = append(usage.Mounts, mount.point)
+				}
+			}
+			if goockutil.Contains(name, swaps) {
+				usage.Swap = true
+			}
+			usage.Processes = append(usage.Processes, processes[name]...)
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// CheckDevicesUnused returns DeviceBusyError if any of the devices is in use,
+// the holders in ignoredHolders are not counted.
+func CheckDevicesUnused(devices []string, ignoredHolders ...string) error {
+	usages, err := GetDeviceUsages(devices, ignoredHolders...)
+	if err != nil {
+		return err
+	}
+	busy := &DeviceBusyError{}
+	for _, usage := range usages {
+		if usage.InUse() {
+			busy.Usages = append(busy.Usages, usage)
+		}
+	}
+	if len(busy.Usages) > 0 {
+		return busy
+	}
+	return nil
+}
+
+// CheckMultipathUnused checks the multipath map and its paths, the paths are
+// held by the map which is removed along with them.
+func CheckMultipathUnused(multipath model.Multipath) error {
+	device := multipath.DmDeviceName
+	if device == "" {
+		device = GetDeviceName("/dev/mapper/" + multipath.Wwn)
+	}
+	devices := []string{device}
+	for _, single := range multipath.Paths {
+		devices = append(devices, single.DevNode)
+	}
+	return CheckDevicesUnused(devices, device)
+}
+
+// stackDevices returns name, its partitions and all the devices built on top
+// of them, as well as the direct holders of name and its partitions.
+func stackDevices(name string, ignoredHolders []string) ([]string, []string) {
+	names := []string{name}
+	partitions, _ := sysfs.ListDir(BlockClassPath+"/"+name, "^"+regexp.QuoteMeta(name)+"p?[0-9]+$")
+	names = append(names, partitions...)
+	var holders, stacked []string
+	for _, n := range names {
+		entries, _ := sysfs.ListDir(BlockClassPath+"/"+n+"/holders", "")
+		for _, holder := range entries {
+			if goockutil.Contains(holder, ignoredHolders) {
+				continue
+			}
+			holders = append(holders, holder)
+			above, _ := stackDevices(holder, nil)
+			stacked = append(stacked, above...)
+		}
+	}
+	return append(names, stacked...), holders
+}
+
+type mountEntry struct {
+	// major:minor of the mounted device
+	number string
+	// Kernel name of the mount source, like sdb1
+	device string
+	point  string
+}
+
+// readMounts parses the lines of mountinfo like:
+// 36 35 8:17 / /var/lib/data rw,relatime shared:1 - ext4 /dev/sdb1 rw
+func readMounts() ([]mountEntry, error) {
+	data, err := ioutil.ReadFile(sysfs.HostPath(MountInfoPath))
+	if err != nil {
+		return nil, err
+	}
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The optional fields end with "-"
+		separator := -1
+		for i := 5; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || separator+2 >= len(fields) {
+			continue
+		}
+		mount := mountEntry{number: fields[2], point: fields[4]}
+		if source := fields[separator+2]; strings.HasPrefix(source, "/dev/") {
+			mount.device = GetDeviceName(source)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// readSwaps returns the kernel names of the swap devices
+func readSwaps() ([]string, error) {
+	data, err := ioutil.ReadFile(sysfs.HostPath(SwapsPath))
+	if err != nil {
+		return nil, err
+	}
+	var swaps []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[1] != "partition" {
+			continue
+		}
+		swaps = append(swaps, GetDeviceName(fields[0]))
+	}
+	return swaps, scanner.Err()
+}
+
+// findOpenDevices maps the devices under /dev to the processes which have
+// them open, the processes not accessible are skipped.
+func findOpenDevices() map[string][]string {
+	opened := map[string][]string{}
+	pids, _ := sysfs.ListDir("/proc", "^[0-9]+$")
+	for _, pid := range pids {
+		comm, _ := sysfs.ReadAttr("/proc/" + pid + "/comm")
+		if goockutil.Contains(comm, ignoredProcesses) {
+			continue
+		}
+		fds, err := sysfs.ListDir("/proc/"+pid+"/fd", "")
+		if err != nil {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, fd := range fds {
+			target, err := os.Readlink(sysfs.HostPath("/proc/" + pid + "/fd/" + fd))
+			if err != nil || !strings.HasPrefix(target, "/dev/") {
+				continue
+			}
+			name := filepath.Base(target)
+			if !seen[name] {
+				seen[name] = true
+				opened[name] = append(opened[name], fmt.Sprintf("%s(%s)", pid, comm))
+			}
+		}
+	}
+	return opened
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package linux
+
+import (
+	"testing"
+
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDeviceName(t *testing.T) {
+	assert.Equal(t, "sdb", GetDeviceName("sdb"))
+	assert.Equal(t, "sdj", GetDeviceName(
+		"/dev/disk/by-path/ip-192.168.3.49:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904558.a12-lun-11"))
+	assert.Equal(t, "36006016074e03a00ee762958673eaf1b", GetDeviceName("/dev/mapper/36006016074e03a00ee762958673eaf1b"))
+}
+
+func TestGetDeviceUsages(t *testing.T) {
+	usages, err := GetDeviceUsages([]string{"sdaa", "/dev/sdab", "sdac", "sdb", "sdz"})
+	assert.Nil(t, err)
+	assert.Len(t, usages, 5)
+	// The LVM volume on sdaa is mounted and opened
+	assert.Equal(t, DeviceUsage{Device: "sdaa", Mounts: []string{"/var/lib/mysql"}, Holders: []string{"dm-20"},
+		Processes: []string{"2301(mysqld)"}}, usages[0])
+	assert.True(t, usages[1].Swap)
+	assert.Equal(t, []string{"/data"}, usages[2].Mounts)
+	// multipathd is not counted
+	assert.Equal(t, DeviceUsage{Device: "sdb", Holders: []string{"dm-5"}}, usages[3])
+	assert.False(t, usages[4].InUse())
+}
+
+func TestCheckDevicesUnused(t *testing.T) {
+	assert.Nil(t, CheckDevicesUnused([]string{"sdb", "sdy"}, "dm-5"))
+	err := CheckDevicesUnused([]string{"sdb", "sdaa", "sdz"})
+	assert.True(t, IsDeviceBusy(err))
+	assert.Len(t, err.(*DeviceBusyError).Usages, 2)
+	assert.Contains(t, err.Error(),
+		"sdaa is mounted on /var/lib/mysql, held by dm-20, opened by 2301(mysqld)")
+}
+
+func TestCheckMultipathUnused(t *testing.T) {
+	multipath := model.Multipath{Wwn: "350060160b6e00e5a50060160b6e11317", DmDeviceName: "dm-5",
+		Paths: []model.SinglePath{{DevNode: "sdb"}, {DevNode: "sdy"}}}
+	assert.Nil(t, CheckMultipathUnused(multipath))
+
+	multipath = model.Multipath{Wwn: "36006016074e03a00ee762958673eaf1b", DmDeviceName: "dm-20",
+		Paths: []model.SinglePath{{DevNode: "sdaa"}}}
+	err := CheckMultipathUnused(multipath)
+	assert.True(t, IsDeviceBusy(err))
+	assert.Contains(t, err.Error(), "dm-20 is mounted on /var/lib/mysql, opened by 2301(mysqld)")
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lock provides the file based advisory locks which serialize the
+// connect, disconnect and rescan operations among goock processes.
+package lock
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HostRescanKey is the host-wide lock held during the bus rescans
+	HostRescanKey = "host-rescan"
+	// Interval to retry a busy lock
+	retryInterval = 100 * time.Millisecond
+)
+
+var log = logrus.New()
+
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+// Directory of the lock files
+var dir = "/run/goock/locks"
+
+// SetDir changes the directory of the lock files, the locks only work among
+// the processes using the same directory.
+func SetDir(d string) {
+	dir = d
+}
+
+func GetDir() string {
+	return dir
+}
+
+// Timeout is the maximum time to wait for a lock
+var Timeout = 5 * time.Minute
+
+// Holders of the locks are looked up from here
+var procLocks = "/proc/locks"
+
+// TargetKey returns the lock key of a target IQN, WWN or NQN
+func TargetKey(target string) string {
+	return fmt.Sprintf("target-%s", strings.ToLower(target))
+}
+
+// LunKey returns the lock key of a LUN or namespace on a target
+func LunKey(target string, lun interface{}) string {
+	return fmt.Sprintf("lun-%s-%v", strings.ToLower(target), lun)
+}
+
+// DeviceKey returns the lock key of a local device like sdb
+func DeviceKey(device string) string {
+	return fmt.Sprintf("device-%s", filepath.Base(device))
+}
+
+// TimeoutError is returned when a lock is not acquired within the timeout
+// or before the context is done
+type TimeoutError struct {
+	Key     string
+	Timeout time.Duration
+	// Processes holding the lock, like "pid 1234 (goock connect 192.168.1.2 25)"
+	Holders []string
+	// Error of the context if it is done before the timeout
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	holders := "unknown holder"
+	if len(e.Holders) > 0 {
+		holders = strings.Join(e.Holders, ", ")
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s while waiting for lock %s held by %s", e.Err, e.Key, holders)
+	}
+	return fmt.Sprintf("timed out after %s waiting for lock %s held by %s", e.Timeout, e.Key, holders)
+}
+
+// Set is a group of locks acquired and released together
+type Set struct {
+	files []*os.File
+}
+
+// Release unlocks all the locks of the set
+func (s *Set) Release() {
+	for i := len(s.files) - 1; i >= 0; i-- {
+		syscall.Flock(int(s.files[i].Fd()), syscall.LOCK_UN)
+		s.files[i].Close()
+	}
+	s.files = nil
+}
+
+// Exclusive acquires the exclusive locks of keys within Timeout
+func Exclusive(keys ...string) (*Set, error) {
+	return Acquire(nil, keys)
+}
+
+// Acquire acquires the shared locks and the exclusive locks within Timeout,
+// a key in both is locked exclusively. The locks are taken in the order of
+// their keys to avoid deadlocks, the acquired ones are released on failure.
+func Acquire(shared []string, exclusive []string) (*Set, error) {
+	return AcquireContext(context.Background(), shared, exclusive)
+}
+
+// AcquireContext is Acquire which gives up once ctx is done
+func AcquireContext(ctx context.Context, shared []string, exclusive []string) (*Set, error) {
+	modes := map[string]int{}
+	for _, key := range shared {
+		modes[key] = syscall.LOCK_SH
+	}
+	for _, key := range exclusive {
+		modes[key] = syscall.LOCK_EX
+	}
+	var keys []string
+	for key := range modes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create lock directory %s: %v", dir, err)
+	}
+	set := &Set{}
+	deadline := time.Now().Add(Timeout)
+	for _, key := range keys {
+		file, err := lockFile(ctx, key, modes[key], deadline)
+		if err != nil {
+			set.Release()
+			return nil, err
+		}
+		set.files = append(set.files, file)
+	}
+	return set, nil
+}
+
+// Lock the file of key, retry until the deadline if it is held by others
+func lockFile(ctx context.Context, key string, mode int, deadline time.Time) (*os.File, error) {
+	path := filepath.Join(dir, url.QueryEscape(key)+".lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file %s: %v", path, err)
+	}
+	waiting := false
+	for {
+		err = syscall.Flock(int(file.Fd()), mode|syscall.LOCK_NB)
+		if err == nil {
+			log.Debugf("Acquired lock %s.", key)
+			return file, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("unable to lock %s: %v", path, err)
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			holders := getHolders(file)
+			file.Close()
+			return nil, &TimeoutError{Key: key, Timeout: Timeout, Holders: holders, Err: ctx.Err()}
+		}
+		if !waiting {
+			log.WithField("holders", getHolders(file)).Infof("Waiting for lock %s.", key)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// getHolders finds the processes holding the lock of file in /proc/locks,
+// whose lines look like:
+//  1: FLOCK  ADVISORY  WRITE 1234 00:19:5678 0 EOF
+//  1: -> FLOCK  ADVISORY  WRITE 4321 00:19:5678 0 EOF
+func getHolders(file *os.File) []string {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &stat); err != nil {
+		return nil
+	}
+	dev := uint64(stat.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	id := fmt.Sprintf("%02x:%02x:%d", major, minor, stat.Ino)
+
+	data, err := ioutil.ReadFile(procLocks)
+	if err != nil {
+		return nil
+	}
+	var holders []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		// Skip the blocked waiters
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != id {
+			continue
+		}
+		holders = append(holders, describeProcess(fields[4]))
+	}
+	return holders
+}
+
+// describeProcess returns the pid along with its command line
+func describeProcess(pid string) string {
+	if _, err := strconv.Atoi(pid); err != nil {
+		return fmt.Sprintf("pid %s", pid)
+	}
+	cmdline, err := ioutil.ReadFile(filepath.Join("/proc", pid, "cmdline"))
+	command := strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1))
+	if err != nil || command == "" {
+		return fmt.Sprintf("pid %s", pid)
+	}
+	return fmt.Sprintf("pid %s (%s)", pid, command)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lock
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	tmp, _ := ioutil.TempDir("", "goock-lock")
+	SetDir(tmp)
+	Timeout = 300 * time.Millisecond
+	code := m.Run()
+	os.RemoveAll(tmp)
+	os.Exit(code)
+}
+
+func TestKeys(t *testing.T) {
+	assert.Equal(t, "target-iqn.1992-04.com.emc:cx.fnm00150600267.a0",
+		TargetKey("iqn.1992-04.com.emc:cx.fnm00150600267.a0"))
+	assert.Equal(t, "lun-5006016d09200925-25", LunKey("5006016D09200925", 25))
+	assert.Equal(t, "device-sdb", DeviceKey("/dev/sdb"))
+}
+
+func TestExclusiveTimeout(t *testing.T) {
+	held, err := Exclusive(LunKey("iqn.a", 1))
+	assert.Nil(t, err)
+	defer held.Release()
+
+	_, err = Exclusive(LunKey("iqn.a", 1))
+	assert.Error(t, err)
+	timeout, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+	assert.Equal(t, "lun-iqn.a-1", timeout.Key)
+	assert.Contains(t, err.Error(), fmt.Sprintf("pid %d", os.Getpid()))
+}
+
+func TestRelease(t *testing.T) {
+	held, err := Exclusive(LunKey("iqn.b", 1))
+	assert.Nil(t, err)
+	held.Release()
+
+	again, err := Exclusive(LunKey("iqn.b", 1))
+	assert.Nil(t, err)
+	again.Release()
+}
+
+func TestSharedLocks(t *testing.T) {
+	first, err := Acquire([]string{TargetKey("iqn.c")}, []string{LunKey("iqn.c", 1)})
+	assert.Nil(t, err)
+	defer first.Release()
+
+	// Another LUN of the same target
+	second, err := Acquire([]string{TargetKey("iqn.c")}, []string{LunKey("iqn.c", 2)})
+	assert.Nil(t, err)
+	defer second.Release()
+
+	_, err = Exclusive(TargetKey("iqn.c"))
+	assert.Error(t, err)
+}
+
+func TestAcquireReleaseOnFailure(t *testing.T) {
+	held, err := Exclusive(LunKey("iqn.d", 2))
+	assert.Nil(t, err)
+
+	_, err = Exclusive(LunKey("iqn.d", 1), LunKey("iqn.d", 2))
+	assert.Error(t, err)
+	held.Release()
+
+	// lun 1 is released along with the failure
+	again, err := Exclusive(LunKey("iqn.d", 1))
+	assert.Nil(t, err)
+	again.Release()
+}
+
+func TestAcquireWaits(t *testing.T) {
+	held, err := Exclusive(HostRescanKey)
+	assert.Nil(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held.Release()
+	}()
+	again, err := Exclusive(HostRescanKey)
+	assert.Nil(t, err)
+	again.Release()
+}
+
+func TestAcquireContextCancelled(t *testing.T) {
+	held, err := Exclusive(LunKey("iqn.e", 1))
+	assert.Nil(t, err)
+	defer held.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = AcquireContext(ctx, nil, []string{LunKey("iqn.e", 1)})
+	assert.Error(t, err)
+	assert.Equal(t, context.Canceled, err.(*TimeoutError).Err)
+	assert.Contains(t, err.Error(), "context canceled while waiting for lock lun-iqn.e-1")
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package manifest records the volumes attached by goock in a state file,
+// so that they are restored after reboot and checked for drift.
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
+)
+
+// Version of the manifest format, it is bumped when any field is renamed or removed
+const Version = "v1"
+
+// The manifest is updated under this lock among goock processes
+const lockKey = "manifest"
+
+// Path of the manifest
+var path = "/var/lib/goock/attachments.json"
+
+// SetPath changes the path of the manifest
+func SetPath(p string) {
+	path = p
+}
+
+func GetPath() string {
+	return path
+}
+
+// Attachment is a volume attached by goock. The CHAP credentials are not
+// recorded, they are supplied again on restore.
+type Attachment struct {
+	// Identifies the LUN or namespace on the targets, see Key
+	Key        string                       `json:"key"`
+	Property   connector.ConnectionProperty `json:"property"`
+	Wwn        string                       `json:"wwn"`
+	Multipath  string                       `json:"multipath,omitempty"`
+	Paths      []string                     `json:"paths"`
+	AttachedAt time.Time                    `json:"attachedAt"`
+}
+
+// Manifest is the content of the state file
+type Manifest struct {
+	Version     string       `json:"version"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// NewAttachment returns the attachment of the volume connected with property
+func NewAttachment(property connector.ConnectionProperty, info connector.VolumeInfo) Attachment {
+	property.SessionAuth = connector.CHAPCredential{}
+	property.DiscoveryAuth = connector.CHAPCredential{}
+	return Attachment{
+		Key:        Key(property),
+		Property:   property,
+		Wwn:        info.Wwn,
+		Multipath:  info.Multipath,
+		Paths:      info.Paths,
+		AttachedAt: time.Now().UTC(),
+	}
+}
+
+// Key returns the identity of the LUN or namespace of property, like
+// iscsi:iqn.a,iqn.b:25, fc:5006016d09200925:25 or nvme:nqn...:<nguid>. The
+// portals are not part of the key since the same targets are discovered
+// via any of them.
+func Key(property connector.ConnectionProperty) string {
+	switch property.StorageProtocol {
+	case connector.IscsiProtocol:
+		lun := 0
+		if len(property.TargetLuns) > 0 {
+			lun = property.TargetLuns[0]
+		}
+		return fmt.Sprintf("iscsi:%s:%d", joinSorted(property.TargetIqns, ""), lun)
+	case connector.FcProtocol:
+		return fmt.Sprintf("fc:%s:%d", joinSorted(property.TargetWwns, ":"), property.TargetLun)
+	case connector.NVMeTCPProtocol:
+		namespace := property.VolumeNguid
+		if namespace == "" {
+			namespace = property.VolumeUuid
+		}
+		return fmt.Sprintf("nvme:%s:%s", property.TargetNqn, strings.ToLower(namespace))
+	}
+	return ""
+}
+
+// Returns the unique lowercased items in order, cutset is removed from them
+func joinSorted(items []string, cutset string) string {
+	var unique []string
+	for _, item := range items {
+		if cutset != "" {
+			item = strings.Replace(item, cutset, "", -1)
+		}
+		item = strings.ToLower(item)
+		if !goockutil.Contains(item, unique) {
+			unique = append(unique, item)
+		}
+	}
+	sort.Strings(unique)
+	return strings.Join(unique, ",")
+}
+
+// Load returns the recorded attachments, nothing is recorded if the
+// manifest does not exist
+func Load() ([]Attachment, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse the manifest %s: %s", path, err)
+	}
+	return manifest.Attachments, nil
+}
+
+// Record adds the attachment, the one of the same key is replaced
+func Record(attachment Attachment) error {
+	return update(func(attachments []Attachment) []Attachment {
+		for i, a := range attachments {
+			if a.Key == attachment.Key {
+				attachments[i] = attachment
+				return attachments
+			}
+		}
+		return append(attachments, attachment)
+	})
+}
+
+// Remove removes the attachments of keys
+func Remove(keys ...string) error {
+	return update(func(attachments []Attachment) []Attachment {
+		var kept []Attachment
+		for _, a := range attachments {
+			if !goockutil.Contains(a.Key, keys) {
+				kept = append(kept, a)
+			}
+		}
+		return kept
+	})
+}
+
+// DeviceKeys returns the keys of the attachments whose multipath or single
+// paths are device, like /dev/sdb, sdb or /dev/mapper/<wwid>. The links are
+// resolved, so it is called before the devices are removed.
+func DeviceKeys(device string) ([]string, error) {
+	attachments, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	name := deviceName(connector.FormatDevicePath(device))
+	var keys []string
+	for _, a := range attachments {
+		if a.hasDevice(name) {
+			keys = append(keys, a.Key)
+		}
+	}
+	return keys, nil
+}
+
+// Tests if name is the multipath or a single path of the attachment
+func (a Attachment) hasDevice(name string) bool {
+	for _, device := range append([]string{a.Multipath}, a.Paths...) {
+		if device != "" && deviceName(device) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the kernel name of device, like dm-3 for /dev/mapper/<wwid>
+func deviceName(device string) string {
+	if real, err := sysfs.RealPath(device); err == nil {
+		return filepath.Base(real)
+	}
+	return filepath.Base(device)
+}
+
+// Updates the attachments under the lock, the manifest is replaced
+// atomically so that it is never left half written
+func update(change func([]Attachment) []Attachment) error {
+	locks, err := lock.Exclusive(lockKey)
+	if err != nil {
+		return err
+	}
+	defer locks.Release()
+	attachments, err := Load()
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(Manifest{Version: Version, Attachments: change(attachments)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Status of the recorded attachment on the host
+type Status string
+
+const (
+	// All the devices exist and are of the recorded wwn
+	StatusAttached Status = "attached"
+	// Some devices are missing, or the devices are of another wwn
+	StatusDrifted Status = "drifted"
+	// None of the devices exists
+	StatusMissing Status = "missing"
+)
+
+// Verify checks the recorded devices of the attachment, the reason is
+// given unless it is attached.
+func Verify(attachment Attachment) (Status, string) {
+	var existing, missing []string
+	for _, device := range append([]string{attachment.Multipath}, attachment.Paths...) {
+		if device == "" {
+			continue
+		}
+		if goockutil.IsPathExists(device) == nil {
+			existing = append(existing, device)
+		} else {
+			missing = append(missing, device)
+		}
+	}
+	if len(existing) == 0 {
+		return StatusMissing, fmt.Sprintf("none of %s exists", missing)
+	}
+	for _, device := range existing {
+		if wwn := linux.GetWWN(device); wwn != "" && !strings.EqualFold(wwn, attachment.Wwn) {
+			return StatusDrifted, fmt.Sprintf("%s is of wwn %s rather than %s", device, wwn, attachment.Wwn)
+		}
+	}
+	if len(missing) > 0 {
+		return StatusDrifted, fmt.Sprintf("%s are missing", missing)
+	}
+	return StatusAttached, ""
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/linux"
+	"github.com/peter-wangxu/goock/pkg/lock"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+)
+
+var root *test.FakeRoot
+
+// Run the tests with the fake sysfs and /dev tree
+func TestMain(m *testing.M) {
+	root = test.NewFakeRoot()
+	sysfs.SetRoot(root.Dir)
+	lock.SetDir(filepath.Join(root.Dir, "run/goock/locks"))
+	linux.SetExecutor(test.NewMockExecutor())
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
+// Uses an empty manifest in the test
+func useManifest(t *testing.T) func() {
+	SetPath(filepath.Join(root.Dir, "var/lib/goock", t.Name()+".json"))
+	return func() {
+		os.Remove(GetPath())
+	}
+}
+
+var iscsiProperty = connector.ConnectionProperty{
+	StorageProtocol: connector.IscsiProtocol,
+	TargetIqns:      []string{"iqn.1992-04.com.emc:cx.apm00152904447.b17", "iqn.1992-04.com.emc:cx.apm00152904447.a17"},
+	TargetPortals:   []string{"10.168.3.45:3260", "10.168.3.44:3260"},
+	TargetLuns:      []int{11, 11},
+	SessionAuth:     connector.CHAPCredential{Username: "user", Secret: "secret"},
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "iscsi:iqn.1992-04.com.emc:cx.apm00152904447.a17,iqn.1992-04.com.emc:cx.apm00152904447.b17:11",
+		Key(iscsiProperty))
+	assert.Equal(t, "fc:5006016036e00e5a,5006016d09200925:25", Key(connector.ConnectionProperty{
+		StorageProtocol: connector.FcProtocol,
+		TargetWwns:      []string{"50:06:01:6D:09:20:09:25", "5006016036e00e5a", "5006016d09200925"},
+		TargetLun:       25,
+	}))
+	assert.Equal(t, "nvme:nqn.2014-08.org.example:subsys1:6e3d1a8a9c3b4d5e8f0011223344aabb", Key(connector.ConnectionProperty{
+		StorageProtocol: connector.NVMeTCPProtocol,
+		TargetNqn:       "nqn.2014-08.org.example:subsys1",
+		VolumeNguid:     "6E3D1A8A9C3B4D5E8F0011223344AABB",
+	}))
+	assert.Equal(t, "", Key(connector.ConnectionProperty{}))
+}
+
+func TestNewAttachmentWithoutSecret(t *testing.T) {
+	attachment := NewAttachment(iscsiProperty, connector.VolumeInfo{Wwn: "wwn1", Paths: []string{"/dev/sdk"}})
+	assert.Equal(t, Key(iscsiProperty), attachment.Key)
+	assert.True(t, attachment.Property.SessionAuth.IsEmpty())
+	assert.Equal(t, "user", iscsiProperty.SessionAuth.Username)
+	assert.Equal(t, []string{"/dev/sdk"}, attachment.Paths)
+}
+
+func TestLoadMissing(t *testing.T) {
+	defer useManifest(t)()
+	attachments, err := Load()
+	assert.Nil(t, err)
+	assert.Empty(t, attachments)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	defer useManifest(t)()
+	os.MkdirAll(filepath.Dir(GetPath()), 0755)
+	ioutil.WriteFile(GetPath(), []byte("{"), 0600)
+	_, err := Load()
+	assert.Error(t, err)
+}
+
+func TestRecordAndRemove(t *testing.T) {
+	defer useManifest(t)()
+	assert.Nil(t, Record(Attachment{Key: "key1", Wwn: "wwn1"}))
+	assert.Nil(t, Record(Attachment{Key: "key2", Wwn: "wwn2"}))
+	assert.Nil(t, Record(Attachment{Key: "key1", Wwn: "wwn3"}))
+	attachments, err := Load()
+	assert.Nil(t, err)
+	assert.Len(t, attachments, 2)
+	assert.Equal(t, "wwn3", attachments[0].Wwn)
+
+	assert.Nil(t, Remove("key1", "key3"))
+	attachments, _ = Load()
+	assert.Len(t, attachments, 1)
+	assert.Equal(t, "key2", attachments[0].Key)
+
+	content, _ := ioutil.ReadFile(GetPath())
+	assert.Contains(t, string(content), `"version": "v1"`)
+	info, _ := os.Stat(GetPath())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestDeviceKeys(t *testing.T) {
+	defer useManifest(t)()
+	Record(Attachment{Key: "key1", Multipath: "/dev/disk/by-id/dm-uuid-mpath-350060160b6e00e5a50060160b6e00e5a",
+		Paths: []string{"/dev/sdk", "/dev/sdj"}})
+	Record(Attachment{Key: "key2", Paths: []string{"/dev/sdh"}})
+
+	keys, err := DeviceKeys("dm-8")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key1"}, keys)
+	keys, _ = DeviceKeys("/dev/disk/by-path/ip-10.168.7.14:3260-iscsi-iqn.1992-04.com.emc:cx.apm00141313414.a17-lun-19")
+	assert.Equal(t, []string{"key2"}, keys)
+	keys, _ = DeviceKeys("sdj")
+	assert.Equal(t, []string{"key1"}, keys)
+	keys, _ = DeviceKeys("sdz")
+	assert.Empty(t, keys)
+}
+
+func TestVerify(t *testing.T) {
+	status, reason := Verify(Attachment{Wwn: "351160160b6e00e5a50060160b6e00e5a",
+		Paths: []string{"/dev/disk/by-path/ip-10.168.3.44:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904447.a17-lun-11"}})
+	assert.Equal(t, StatusAttached, status)
+	assert.Empty(t, reason)
+}
+
+func TestVerifyMissing(t *testing.T) {
+	status, reason := Verify(Attachment{Wwn: "wwn1", Multipath: "/dev/dm-99", Paths: []string{"/dev/sdz"}})
+	assert.Equal(t, StatusMissing, status)
+	assert.Contains(t, reason, "/dev/sdz")
+}
+
+func TestVerifyPathMissing(t *testing.T) {
+	status, reason := Verify(Attachment{Wwn: "351160160b6e00e5a50060160b6e00e5a",
+		Paths: []string{"/dev/disk/by-path/ip-10.168.3.44:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904447.a17-lun-11", "/dev/sdz"}})
+	assert.Equal(t, StatusDrifted, status)
+	assert.Contains(t, reason, "/dev/sdz")
+}
+
+func TestVerifyWwnChanged(t *testing.T) {
+	status, reason := Verify(Attachment{Wwn: "36001405a1b2c3d4e5f60718293a4b5c6",
+		Paths: []string{"/dev/disk/by-path/ip-10.168.3.44:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904447.a17-lun-11"}})
+	assert.Equal(t, StatusDrifted, status)
+	assert.Contains(t, reason, "351160160b6e00e5a50060160b6e00e5a")
+}
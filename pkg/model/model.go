@@ -16,9 +16,14 @@ limitations under the License.
 package model
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/peter-wangxu/goock/pkg/exec"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
 	"github.com/sirupsen/logrus"
+	"net"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -37,6 +42,19 @@ func SetExecutor(e exec.Interface) {
 	executor = e
 }
 
+// getOutput returns the combined output of cmd, or empty if the command
+// fails, the command is killed once ctx is done.
+func getOutput(ctx context.Context, cmd []string) string {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out, err := executor.CommandContext(ctx, cmd[0], cmd[1:]...).CombinedOutput()
+	if nil != err {
+		return ""
+	}
+	return string(out[:])
+}
+
 type Parser interface {
 	Parse(output string, pat interface{}) []map[string]string
 	filter(item map[string]string) bool
@@ -159,11 +177,24 @@ type ISCSISession struct {
 	TargetPortal string
 	TargetIp     string
 	Tag          string
-	parser       Parser
-}
-
+	// Only for logged in sessions, like 1 of "tcp: [1] 10.64.76.253:3260,1 iqn..."
+	SessionId string
+	// Only for logged in sessions, like tcp, iser or bnx2i
+	Transport string
+	// The iface which the target is discovered or logged in via, empty if
+	// the target is not bound to any iface
+	Iface  string
+	parser Parser
+	// Context of the iscsiadm command
+	ctx context.Context
+}
+
+// The portal is like 10.64.76.253:3260 or [fe80::1]:3260, the tag is -1 if
+// the target portal group is unknown
 func (iscsi *ISCSISession) GetPattern() interface{} {
-	return "\\s*(?P<TargetPortal>\\S+:\\d*),(?P<Tag>\\d+)\\s+(?P<TargetIqn>\\S+)"
+	return "\\s*(?:(?P<Transport>[\\w-]+):\\s+)?(?:\\[(?P<SessionId>\\d+)\\]\\s+)?" +
+		"(?P<TargetPortal>\\[[^\\]\\s]+\\](?::\\d*)?|[^\\s\\[\\],]+:\\d*)," +
+		"(?P<Tag>-?\\d+)\\s+(?P<TargetIqn>\\S+)"
 }
 
 func (iscsi *ISCSISession) GetCommand() []string {
@@ -194,21 +225,23 @@ func (iscsi *ISCSISession) Parse() []ISCSISession {
 		for k, v := range each {
 			s.setValue(k, v)
 		}
+		s.TargetIp, _ = SplitPortal(s.TargetPortal, ISCSIDefaultPort)
 		list[i] = *s
 	}
 	return list
 }
 
 func (iscsi *ISCSISession) getOutput() string {
-	cmd := iscsi.GetCommand()
-	out, err := executor.Command(cmd[0], cmd[1:]...).CombinedOutput()
-	if nil != err {
-		return ""
-	}
-	return string(out[:])
+	return getOutput(iscsi.ctx, iscsi.GetCommand())
 }
 func NewISCSISession() []ISCSISession {
-	return (&ISCSISession{parser: &LineParser{Delimiter: "\\n+"}}).Parse()
+	return NewISCSISessionContext(context.Background())
+}
+
+// NewISCSISessionContext returns the logged in sessions, iscsiadm is killed
+// once ctx is done.
+func NewISCSISessionContext(ctx context.Context) []ISCSISession {
+	return (&ISCSISession{parser: &LineParser{Delimiter: "\\n+"}, ctx: ctx}).Parse()
 }
 
 // Discover all the targets provided by targetPortals
@@ -216,25 +249,82 @@ func NewISCSISession() []ISCSISession {
 // the "--op new" is important, or the existing node info will be overwritten
 // after the discovery.
 func DiscoverISCSISession(targetPortals []string) []ISCSISession {
+	return DiscoverISCSISessionContext(context.Background(), targetPortals)
+}
+
+// DiscoverISCSISessionContext is DiscoverISCSISession which kills the
+// discovery once ctx is done.
+func DiscoverISCSISessionContext(ctx context.Context, targetPortals []string) []ISCSISession {
+	return DiscoverISCSISessionIfaceContext(ctx, targetPortals, nil)
+}
+
+// DiscoverISCSISessionIfaceContext discovers the targets via each of ifaces,
+// the node records are bound to the iface which the target is discovered
+// via. The default iface is used if ifaces is empty, and the targets are not
+// bound to any iface.
+func DiscoverISCSISessionIfaceContext(ctx context.Context, targetPortals []string, ifaces []string) []ISCSISession {
+	return discoverISCSISession(ctx, targetPortals, ifaces, func(portal string, iface string) []string {
+		return []string{
+			"-m", "discovery", "-t", "sendtargets", "-I", iface, "-p", portal,
+			"--op", "new",
+		}
+	})
+}
+
+// DiscoverISCSISessionDB discovers the targets by the discovery records
+// (discoverydb) of targetPortals, the settings of the record such as CHAP
+// authentication take effect during the discovery.
+func DiscoverISCSISessionDB(targetPortals []string) []ISCSISession {
+	return DiscoverISCSISessionDBContext(context.Background(), targetPortals)
+}
+
+// DiscoverISCSISessionDBContext is DiscoverISCSISessionDB which kills the
+// discovery once ctx is done.
+func DiscoverISCSISessionDBContext(ctx context.Context, targetPortals []string) []ISCSISession {
+	return DiscoverISCSISessionDBIfaceContext(ctx, targetPortals, nil)
+}
+
+// DiscoverISCSISessionDBIfaceContext is DiscoverISCSISessionDBContext via
+// each of ifaces, see DiscoverISCSISessionIfaceContext
+func DiscoverISCSISessionDBIfaceContext(ctx context.Context, targetPortals []string, ifaces []string) []ISCSISession {
+	return discoverISCSISession(ctx, targetPortals, ifaces, func(portal string, iface string) []string {
+		return []string{
+			"-m", "discoverydb", "-t", "sendtargets", "-I", iface, "-p", portal,
+			"--discover", "--op", "new",
+		}
+	})
+}
+
+func discoverISCSISession(ctx context.Context, targetPortals []string, ifaces []string,
+	discoveryParams func(portal string, iface string) []string) []ISCSISession {
 	var results []ISCSISession
-	c := make(chan []ISCSISession, len(targetPortals))
+	bound := len(ifaces) > 0
+	if !bound {
+		ifaces = []string{DefaultIface}
+	}
+	c := make(chan []ISCSISession, len(targetPortals)*len(ifaces))
 	for _, portal := range targetPortals {
-		discovery := []string{
-			"-m", "discovery", "-t", "sendtargets", "-I", "default", "-p", portal,
-			"--op", "new",
+		for _, iface := range ifaces {
+			discovery := discoveryParams(portal, iface)
+			iface := iface
+			go func() {
+				session := ISCSISession{parser: &LineParser{Delimiter: "\\n+"}, ctx: ctx}
+				session.params = discovery
+				ret := session.Parse()
+				if bound {
+					for i := range ret {
+						ret[i].Iface = iface
+					}
+				}
+				// Aggregate the results
+				c <- ret
+			}()
 		}
-		go func() {
-			session := ISCSISession{parser: &LineParser{Delimiter: "\\n+"}}
-			session.params = discovery
-			ret := session.Parse()
-			// Aggregate the results
-			c <- ret
-		}()
 
 	}
 	// Wait for all discovery
 	var discoveredTargets []string
-	for i := 0; i < len(targetPortals); i++ {
+	for i := 0; i < cap(c); i++ {
 		each := <-c
 		results = append(results, each...)
 		for _, d := range each {
@@ -251,10 +341,15 @@ func DiscoverISCSISession(targetPortals []string) []ISCSISession {
 
 // end of implementation of ISCSISession
 
-// (HBA) Subclass of Interface
+// Sysfs directories of the FC and SCSI devices
+const (
+	FCHostClassPath       = "/sys/class/fc_host"
+	FCRemotePortClassPath = "/sys/class/fc_remote_ports"
+	BlockPath             = "/sys/block"
+)
+
+// (HBA) Represents the FC host bus adapter under /sys/class/fc_host
 type HBA struct {
-	dataMap         map[string]string
-	parser          Parser
 	Name            string
 	Path            string
 	FabricName      string
@@ -266,56 +361,6 @@ type HBA struct {
 	DevicePath      string
 }
 
-func (s *HBA) GetPattern() interface{} {
-
-	return []string{
-		"(?m)^\\s+Device\\s+=\\s+\"(?P<Name>.*)\"",
-		"(?m)^\\s+Device path\\s+=\\s+\"(?P<DevicePath>.*)\"",
-		"fabric_name\\s+=\\s+\"0x(?P<FabricName>.*)\"",
-		"node_name\\s+=\\s+\"0x(?P<NodeName>.*)\"",
-		"port_name\\s+=\\s+\"0x(?P<PortName>.*)\"",
-		"port_state\\s+=\\s+\"(?P<PortState>.*)\"",
-		"speed\\s+=\\s+\"(?P<Speed>.*)\"",
-		"supported_speeds\\s+=\\s+\"(?P<SupportedSpeeds>.*)\"",
-	}
-}
-
-func (s *HBA) GetCommand() []string {
-	return []string{"systool", "-c", "fc_host", "-v"}
-}
-
-func (s *HBA) GetValue(key string) interface{} {
-	return s.dataMap[key]
-}
-
-func (s *HBA) setValue(key string, value interface{}) {
-	ref := reflect.ValueOf(s).Elem()
-	SetValue(ref.FieldByName(key), value)
-}
-
-func (s *HBA) Parse() []HBA {
-	parser := s.parser
-	dataList := parser.Parse(s.getOutput(), s.GetPattern())
-	list := make([]HBA, len(dataList))
-	for i, each := range dataList {
-		s := &HBA{}
-		for k, v := range each {
-			s.setValue(k, v)
-		}
-		list[i] = *s
-	}
-	return list
-}
-
-func (s *HBA) getOutput() string {
-	cmd := s.GetCommand()
-	out, err := executor.Command(cmd[0], cmd[1:]...).CombinedOutput()
-	if nil != err {
-		return ""
-	}
-	return string(out[:])
-}
-
 // Return the id of HBA, host7 -> 7
 func (s *HBA) GetHostId() (int, error) {
 	if s.Name != "" {
@@ -325,15 +370,42 @@ func (s *HBA) GetHostId() (int, error) {
 	return 0, fmt.Errorf("Name of HBA is empty.")
 }
 
+// NewHBA reads the HBAs from sysfs, layout:
+// /sys/class/fc_host/host7 -> ../../devices/pci0000:00/0000:00:03.0/0000:05:00.0/host7/fc_host/host7
 func NewHBA() []HBA {
-	return (&HBA{parser: &PairParser{Matcher: "Class Device ="}}).Parse()
-}
-
-// (FibreChannelTarget) Subclass of Interface
-// Represents the FC targets connected with HBA
+	hosts, err := sysfs.ListDir(FCHostClassPath, `^host\d+$`)
+	if err != nil {
+		log.WithError(err).Debug("Unable to list the FC hosts.")
+		return []HBA{}
+	}
+	hbas := make([]HBA, len(hosts))
+	for i, host := range hosts {
+		classPath := filepath.Join(FCHostClassPath, host)
+		hbas[i].Name = host
+		hbas[i].Path, _ = sysfs.RealPath(classPath)
+		hbas[i].DevicePath, _ = sysfs.RealPath(filepath.Join(classPath, "device"))
+		hbas[i].FabricName = readWwnAttr(classPath, "fabric_name")
+		hbas[i].NodeName = readWwnAttr(classPath, "node_name")
+		hbas[i].PortName = readWwnAttr(classPath, "port_name")
+		hbas[i].PortState, _ = sysfs.ReadAttr(filepath.Join(classPath, "port_state"))
+		hbas[i].Speed, _ = sysfs.ReadAttr(filepath.Join(classPath, "speed"))
+		hbas[i].SupportedSpeeds, _ = sysfs.ReadAttr(filepath.Join(classPath, "supported_speeds"))
+	}
+	return hbas
+}
+
+// Returns the wwn attribute without "0x", 0x10000090fa534cd0 -> 10000090fa534cd0
+func readWwnAttr(classPath string, name string) string {
+	value, err := sysfs.ReadAttr(filepath.Join(classPath, name))
+	if err != nil {
+		log.WithError(err).Debugf("Unable to read %s of %s.", name, classPath)
+	}
+	return strings.TrimPrefix(value, "0x")
+}
+
+// (FibreChannelTarget) Represents the FC targets connected with HBA,
+// each SCSI target under the remote port is a FibreChannelTarget
 type FibreChannelTarget struct {
-	dataMap         map[string]string
-	parser          Parser
 	ClassDevice     string
 	ClassDevicePath string
 	NodeName        string
@@ -343,55 +415,6 @@ type FibreChannelTarget struct {
 	DevicePath      string
 }
 
-func (s *FibreChannelTarget) GetPattern() interface{} {
-
-	return []string{
-		"Class Device\\s+=\\s+\"(?P<ClassDevice>.*)\"",
-		"Class Device path\\s+=\\s+\"(?P<ClassDevicePath>.*)\"",
-		"node_name\\s+=\\s+\"0x(?P<NodeName>.*)\"",
-		"port_id\\s+=\\s+\"(?P<PortId>.*)\"",
-		"port_name\\s+=\\s+\"0x(?P<PortName>.*)\"",
-		"(?m)^\\s+Device\\s+=\\s+\"(?P<Device>.*)\"",
-		"(?m)^\\s+Device path\\s+=\\s+\"(?P<DevicePath>.*)\"",
-	}
-}
-
-func (s *FibreChannelTarget) GetCommand() []string {
-	return []string{"systool", "-c", "fc_transport", "-v"}
-}
-
-func (s *FibreChannelTarget) GetValue(key string) interface{} {
-	return s.dataMap[key]
-}
-
-func (s *FibreChannelTarget) setValue(key string, value interface{}) {
-	ref := reflect.ValueOf(s).Elem()
-	SetValue(ref.FieldByName(key), value)
-}
-
-func (s *FibreChannelTarget) Parse() []FibreChannelTarget {
-	parser := s.parser
-	dataList := parser.Parse(s.getOutput(), s.GetPattern())
-	list := make([]FibreChannelTarget, len(dataList))
-	for i, each := range dataList {
-		s := &FibreChannelTarget{}
-		for k, v := range each {
-			s.setValue(k, v)
-		}
-		list[i] = *s
-	}
-	return list
-}
-
-func (s *FibreChannelTarget) getOutput() string {
-	cmd := s.GetCommand()
-	out, err := executor.Command(cmd[0], cmd[1:]...).CombinedOutput()
-	if nil != err {
-		return ""
-	}
-	return string(out[:])
-}
-
 // Parse Device  "target9:0:0" to []int{9, 0, 0}
 func (s *FibreChannelTarget) GetHostChannelTarget() ([]int, error) {
 	err := fmt.Errorf("Unable to get Host:Channel:Target, Device is empty.")
@@ -407,8 +430,39 @@ func (s *FibreChannelTarget) GetHostChannelTarget() ([]int, error) {
 
 }
 
+// NewFibreChannelTarget reads the FC targets from sysfs, layout:
+// /sys/class/fc_remote_ports/rport-9:0-2 -> ../../devices/.../host9/rport-9:0-2/fc_remote_ports/rport-9:0-2
+// /sys/devices/.../host9/rport-9:0-2/target9:0:0
+// Remote ports without the target role have no SCSI target and are skipped.
 func NewFibreChannelTarget() []FibreChannelTarget {
-	return (&FibreChannelTarget{parser: &PairParser{Matcher: "Class Device ="}}).Parse()
+	rports, err := sysfs.ListDir(FCRemotePortClassPath, `^rport-\d+:\d+-\d+$`)
+	if err != nil {
+		log.WithError(err).Debug("Unable to list the FC remote ports.")
+		return []FibreChannelTarget{}
+	}
+	targets := []FibreChannelTarget{}
+	for _, rport := range rports {
+		classPath := filepath.Join(FCRemotePortClassPath, rport)
+		devicePath, err := sysfs.RealPath(filepath.Join(classPath, "device"))
+		if err != nil {
+			log.WithError(err).Debugf("Unable to find the device of %s.", rport)
+			continue
+		}
+		devices, _ := sysfs.ListDir(devicePath, `^target\d+:\d+:\d+$`)
+		for _, device := range devices {
+			target := FibreChannelTarget{
+				ClassDevice: rport,
+				NodeName:    readWwnAttr(classPath, "node_name"),
+				PortName:    readWwnAttr(classPath, "port_name"),
+				Device:      device,
+				DevicePath:  filepath.Join(devicePath, device),
+			}
+			target.ClassDevicePath, _ = sysfs.RealPath(classPath)
+			target.PortId, _ = sysfs.ReadAttr(filepath.Join(classPath, "port_id"))
+			targets = append(targets, target)
+		}
+	}
+	return targets
 }
 
 // (Multipath) Subclass of Interface
@@ -471,12 +525,7 @@ func (s *Multipath) Parse() []Multipath {
 }
 
 func (s *Multipath) getOutput() string {
-	cmd := s.GetCommand()
-	out, err := executor.Command(cmd[0], cmd[1:]...).CombinedOutput()
-	if nil != err {
-		return ""
-	}
-	return string(out[:])
+	return getOutput(context.Background(), s.GetCommand())
 }
 
 func (s *Multipath) SetParams(params []string) {
@@ -565,12 +614,9 @@ func NewSinglePath(output string) []SinglePath {
 	return rS.Parse()
 }
 
-// DeviceInfo: subclass of Interface
+// DeviceInfo: the SCSI address of a block device
 
 type DeviceInfo struct {
-	dataMap map[string]string
-	parser  Parser
-	params  []string
 	Device  string
 	Host    string
 	Channel int
@@ -578,67 +624,285 @@ type DeviceInfo struct {
 	Lun     int
 }
 
-func (d *DeviceInfo) GetPattern() interface{} {
-	return `(?P<Device>.*):\s+(?P<Host>\w+)\s+channel=(?P<Channel>\d+)\s+id=(?P<Target>\d+)\s+lun=(?P<Lun>\d+)`
+func (d *DeviceInfo) GetHostId() int {
+	i, _ := strconv.Atoi(strings.Replace(d.Host, "scsi", "", -1))
+	return i
 }
 
-func (d *DeviceInfo) GetCommand() []string {
-	if len(d.params) <= 0 {
-		return []string{"sg_scan"}
-	} else {
-		return append([]string{"sg_scan"}, d.params...)
-	}
+// Returns a string with format: <host>:<channel>:<Target>:<Lun>
+func (d *DeviceInfo) GetDeviceIdentifier() string {
+	return fmt.Sprintf("%d:%d:%d:%d", d.GetHostId(), d.Channel, d.Target, d.Lun)
 }
 
-func (d *DeviceInfo) getOutput() string {
-	cmd := d.GetCommand()
-	out, err := executor.Command(cmd[0], cmd[1:]...).CombinedOutput()
-	if nil != err {
-		log.Debug("Failed to get device info: ", out)
+// NewDeviceInfo reads the SCSI address of the device from sysfs,
+// path is like "/dev/sdb" or "/dev/disk/by-path/ip-10.244.213.177:3260-iscsi-iqn.1992-04.com.emc:cx.fnm00150600267.a0-lun-10"
+// /sys/block/sdb/device -> ../../../0:1:0:0
+func NewDeviceInfo(path string) []DeviceInfo {
+	device, err := sysfs.RealPath(path)
+	if err != nil {
+		// the device node may be absent from the root, use the name of it
+		log.WithError(err).Debugf("Unable to resolve device %s.", path)
+		device = path
+	}
+	scsiPath, err := sysfs.RealPath(filepath.Join(BlockPath, filepath.Base(device), "device"))
+	if err != nil {
+		log.WithError(err).Debugf("Device %s is not a SCSI device.", path)
+		return []DeviceInfo{}
+	}
+	var host, channel, target, lun int
+	if _, err := fmt.Sscanf(filepath.Base(scsiPath), "%d:%d:%d:%d", &host, &channel, &target, &lun); err != nil {
+		log.WithError(err).Debugf("Unable to parse the SCSI address of %s.", scsiPath)
+		return []DeviceInfo{}
+	}
+	return []DeviceInfo{{
+		Device:  path,
+		Host:    fmt.Sprintf("scsi%d", host),
+		Channel: channel,
+		Target:  target,
+		Lun:     lun,
+	}}
+}
+
+// (NVMeDiscoveryEntry) Subclass of Interface
+// Represents a log entry from `nvme discover`
+type NVMeDiscoveryEntry struct {
+	dataMap   map[string]string
+	parser    Parser
+	params    []string
+	ctx       context.Context
+	Transport string
+	SubType   string
+	Port      string
+	Nqn       string
+	Address   string
+}
+
+func (d *NVMeDiscoveryEntry) GetPattern() interface{} {
+	return []string{
+		"trtype:\\s+(?P<Transport>\\S+)",
+		"subtype:\\s+(?P<SubType>.*\\S)",
+		"trsvcid:\\s+(?P<Port>\\S+)",
+		"subnqn:\\s+(?P<Nqn>\\S+)",
+		"traddr:\\s+(?P<Address>\\S+)",
 	}
-	return string(out[:])
 }
 
-func (d *DeviceInfo) GetValue(key string) interface{} {
+func (d *NVMeDiscoveryEntry) GetCommand() []string {
+	return append([]string{"nvme", "discover"}, d.params...)
+}
+
+func (d *NVMeDiscoveryEntry) getOutput() string {
+	return getOutput(d.ctx, d.GetCommand())
+}
+
+func (d *NVMeDiscoveryEntry) GetValue(key string) interface{} {
 	return d.dataMap[key]
 }
 
-func (d *DeviceInfo) setValue(key string, value interface{}) {
+func (d *NVMeDiscoveryEntry) setValue(key string, value interface{}) {
 	ref := reflect.ValueOf(d).Elem()
 	SetValue(ref.FieldByName(key), value)
 }
 
-func (d *DeviceInfo) setParser(parser Parser) {
-	d.parser = parser
+func (d *NVMeDiscoveryEntry) Parse() []NVMeDiscoveryEntry {
+	var list []NVMeDiscoveryEntry
+	for _, s := range d.parseLog() {
+		// Referrals to other discovery controllers are not subsystems to connect.
+		if s.IsSubsystem() {
+			list = append(list, s)
+		}
+	}
+	return list
 }
 
-func (d *DeviceInfo) Parse() []DeviceInfo {
+// Returns all the entries of the discovery log
+func (d *NVMeDiscoveryEntry) parseLog() []NVMeDiscoveryEntry {
 	parser := d.parser
 	dataList := parser.Parse(d.getOutput(), d.GetPattern())
-	list := make([]DeviceInfo, len(dataList))
-	for i, each := range dataList {
-		s := &DeviceInfo{}
+	var list []NVMeDiscoveryEntry
+	for _, each := range dataList {
+		s := &NVMeDiscoveryEntry{}
 		for k, v := range each {
 			s.setValue(k, v)
 		}
-		list[i] = *s
+		list = append(list, *s)
 	}
 	return list
 }
 
-func (d *DeviceInfo) GetHostId() int {
-	i, _ := strconv.Atoi(strings.Replace(d.Host, "scsi", "", -1))
-	return i
+// IsSubsystem returns true if the entry is an NVM subsystem to connect
+func (d NVMeDiscoveryEntry) IsSubsystem() bool {
+	return d.SubType == "nvme subsystem"
 }
 
-// Returns a string with format: <host>:<channel>:<Target>:<Lun>
-func (d *DeviceInfo) GetDeviceIdentifier() string {
-	return fmt.Sprintf("%d:%d:%d:%d", d.GetHostId(), d.Channel, d.Target, d.Lun)
+// IsReferral returns true if the entry refers to another discovery
+// controller, it is "discovery subsystem referral" since nvme-cli 2.0. The
+// discovery controller queried itself is "current discovery subsystem".
+func (d NVMeDiscoveryEntry) IsReferral() bool {
+	return d.SubType == "discovery subsystem" || d.SubType == "discovery subsystem referral"
 }
 
-func NewDeviceInfo(path string) []DeviceInfo {
-	rS := &DeviceInfo{parser: &LineParser{Delimiter: "\\n+"}, params: []string{path}}
-	return rS.Parse()
+// DiscoverNVMeSubsystem discovers all the NVMe subsystems of targetPortals
+// via the discovery controller, targetPortals are in format of <address>:<port>
+func DiscoverNVMeSubsystem(transport string, targetPortals []string) []NVMeDiscoveryEntry {
+	return DiscoverNVMeSubsystemContext(context.Background(), transport, targetPortals)
+}
+
+// DiscoverNVMeSubsystemContext is DiscoverNVMeSubsystem which kills the
+// discovery once ctx is done.
+func DiscoverNVMeSubsystemContext(ctx context.Context, transport string,
+	targetPortals []string) []NVMeDiscoveryEntry {
+	var results []NVMeDiscoveryEntry
+	for _, portal := range targetPortals {
+		results = append(results, newNVMeDiscoveryEntry(ctx, transport, portal).Parse()...)
+	}
+	return results
+}
+
+// DiscoverNVMeLogContext returns all the entries of the discovery log of the
+// discovery controller at portal, including the referrals. Empty list is
+// returned if the discovery controller is unreachable.
+func DiscoverNVMeLogContext(ctx context.Context, transport string, portal string) []NVMeDiscoveryEntry {
+	return newNVMeDiscoveryEntry(ctx, transport, portal).parseLog()
+}
+
+func newNVMeDiscoveryEntry(ctx context.Context, transport string, portal string) *NVMeDiscoveryEntry {
+	address, port := SplitPortal(portal, NVMeDiscoveryPort)
+	return &NVMeDiscoveryEntry{
+		parser: &PairParser{Matcher: "Discovery Log Entry"},
+		params: []string{"-t", transport, "-a", address, "-s", port},
+		ctx:    ctx,
+	}
+}
+
+// NVMeDiscoveryPort is the port of the NVMe discovery controller if absent
+const NVMeDiscoveryPort = "8009"
+
+// ISCSIDefaultPort is the port of iSCSI target portal if absent
+const ISCSIDefaultPort = "3260"
+
+// DefaultIface is the iscsiadm iface of the software iSCSI over tcp
+const DefaultIface = "default"
+
+// SplitPortal splits the portal into address and port, defaultPort is
+// returned if the port is absent. The IPv6 address is with or without the
+// brackets, the port is only recognized for the bracketed one, like
+// [fe80::1]:3260.
+func SplitPortal(portal string, defaultPort string) (string, string) {
+	if address, port, err := net.SplitHostPort(portal); err == nil {
+		if port == "" {
+			port = defaultPort
+		}
+		return address, port
+	}
+	return strings.Trim(portal, "[]"), defaultPort
+}
+
+// NormalizePortal returns the portal as address:port for comparison, the IPv6
+// address is compressed and bracketed like [fe80::1]:3260, the DNS name is
+// lowercased. defaultPort is used if the port is absent.
+func NormalizePortal(portal string, defaultPort string) string {
+	address, port := SplitPortal(portal, defaultPort)
+	return net.JoinHostPort(NormalizeAddress(address), port)
+}
+
+// NormalizeAddress compresses the IP address, or lowercases the DNS name
+func NormalizeAddress(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(address)
+}
+
+// NVMePath represents a controller of NVMe subsystem
+type NVMePath struct {
+	Name      string
+	Transport string
+	// Address likes "traddr=10.0.0.1,trsvcid=4420"
+	Address string
+	State   string
+}
+
+// GetTargetAddress returns the traddr from the Address
+func (p NVMePath) GetTargetAddress() string {
+	return p.getAddressValue("traddr")
+}
+
+// GetTargetPort returns the trsvcid from the Address
+func (p NVMePath) GetTargetPort() string {
+	return p.getAddressValue("trsvcid")
+}
+
+func (p NVMePath) getAddressValue(key string) string {
+	pattern := regexp.MustCompile(key + "=([^,\\s]+)")
+	matches := pattern.FindStringSubmatch(p.Address)
+	if len(matches) < 2 {
+		return ""
+	}
+	return matches[1]
+}
+
+// NVMeSubsystem represents a NVMe subsystem from `nvme list-subsys -o json`
+type NVMeSubsystem struct {
+	params []string
+	Name   string
+	Nqn    string
+	Paths  []NVMePath
+}
+
+type nvmeSubsystemJSON struct {
+	Name  string `json:"Name"`
+	NQN   string `json:"NQN"`
+	Paths []NVMePath
+}
+
+type nvmeHostJSON struct {
+	Subsystems []nvmeSubsystemJSON `json:"Subsystems"`
+}
+
+func (s *NVMeSubsystem) GetCommand() []string {
+	return append([]string{"nvme", "list-subsys", "-o", "json"}, s.params...)
+}
+
+func (s *NVMeSubsystem) getOutput() string {
+	return getOutput(context.Background(), s.GetCommand())
+}
+
+// Parse supports both output formats of nvme-cli:
+// 1.x: {"Subsystems": [{"Name": .., "NQN": ..}, {"Paths": [..]}]}
+// 2.x: [{"HostNQN": .., "Subsystems": [{"Name": .., "NQN": .., "Paths": [..]}]}]
+func (s *NVMeSubsystem) Parse() []NVMeSubsystem {
+	output := strings.TrimSpace(s.getOutput())
+	var hosts []nvmeHostJSON
+	var err error
+	if strings.HasPrefix(output, "[") {
+		err = json.Unmarshal([]byte(output), &hosts)
+	} else if output != "" {
+		var host nvmeHostJSON
+		err = json.Unmarshal([]byte(output), &host)
+		hosts = append(hosts, host)
+	}
+	if err != nil {
+		log.WithError(err).Debug("Unable to parse the NVMe subsystems.")
+		return []NVMeSubsystem{}
+	}
+	var list []NVMeSubsystem
+	for _, host := range hosts {
+		for _, each := range host.Subsystems {
+			if each.Name == "" && len(list) > 0 {
+				// The paths of previous subsystem in 1.x format
+				last := &list[len(list)-1]
+				last.Paths = append(last.Paths, each.Paths...)
+				continue
+			}
+			list = append(list, NVMeSubsystem{Name: each.Name, Nqn: each.NQN, Paths: each.Paths})
+		}
+	}
+	return list
+}
+
+func NewNVMeSubsystem() []NVMeSubsystem {
+	return (&NVMeSubsystem{}).Parse()
 }
 
 // RegSplit splits by regexp specified by delimiter
@@ -16,11 +16,23 @@ limitations under the License.
 package model
 
 import (
+	"context"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
 	"github.com/peter-wangxu/goock/test"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 )
 
+// Run the tests with the fake sysfs and /dev tree
+func TestMain(m *testing.M) {
+	root := test.NewFakeRoot()
+	sysfs.SetRoot(root.Dir)
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
 func TestNewHBA(t *testing.T) {
 	old := executor
 	executor = test.NewMockExecutor()
@@ -34,7 +46,7 @@ func TestNewHBA(t *testing.T) {
 	hostId, err := hbas[0].GetHostId()
 	assert.Nil(t, err)
 	assert.Equal(t, 7, hostId)
-	assert.Equal(t, "", hbas[0].Path)
+	assert.Equal(t, "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.0/host7/fc_host/host7", hbas[0].Path)
 	assert.Equal(t, "100050eb1a033f59", hbas[0].FabricName)
 	assert.Equal(t, "20000090fa534cd0", hbas[0].NodeName)
 	assert.Equal(t, "10000090fa534cd0", hbas[0].PortName)
@@ -53,8 +65,8 @@ func TestNewFibreChannelTarget(t *testing.T) {
 
 	targets := NewFibreChannelTarget()
 	assert.Len(t, targets, 4)
-	assert.Equal(t, "0:0", targets[0].ClassDevice)
-	assert.Equal(t, "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.1/host9/rport-9:0-2/target9:0:0/fc_transport/target9:0:0", targets[0].ClassDevicePath)
+	assert.Equal(t, "rport-9:0-2", targets[0].ClassDevice)
+	assert.Equal(t, "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.1/host9/rport-9:0-2/fc_remote_ports/rport-9:0-2", targets[0].ClassDevicePath)
 	assert.Equal(t, "0x020500", targets[0].PortId)
 	assert.Equal(t, "5006016089200925", targets[0].NodeName)
 	assert.Equal(t, "5006016d09200925", targets[0].PortName)
@@ -74,6 +86,9 @@ func TestNewISCSISession(t *testing.T) {
 	sessions := NewISCSISession()
 	assert.Equal(t, 2, len(sessions))
 	assert.Contains(t, sessions[1].TargetIqn, "iqn.1992-04.com.emc:cx.fcnch097ae6ef3")
+	assert.Equal(t, "11.64.76.253:3260", sessions[1].TargetPortal)
+	assert.Equal(t, "2", sessions[1].SessionId)
+	assert.Equal(t, "tcp", sessions[1].Transport)
 }
 
 func TestNewMultipath(t *testing.T) {
@@ -131,6 +146,43 @@ func TestDiscoverISCSISession(t *testing.T) {
 	assert.Equal(t, "10.244.213.177:3260", discovered[0].TargetPortal)
 	assert.Equal(t, "2", discovered[0].Tag)
 }
+
+func TestDiscoverISCSISessionIface(t *testing.T) {
+	old := executor
+	executor = test.NewMockExecutor()
+	defer func() {
+		executor = old
+	}()
+	discovered := DiscoverISCSISessionIfaceContext(context.Background(), []string{"10.244.213.177"},
+		[]string{"eth1", "eth2"})
+	assert.Len(t, discovered, 4)
+	ifaces := map[string]int{}
+	for _, d := range discovered {
+		ifaces[d.Iface]++
+	}
+	assert.Equal(t, map[string]int{"eth1": 2, "eth2": 2}, ifaces)
+
+	// Not bound to any iface if discovered via the default one
+	discovered = DiscoverISCSISession([]string{"10.244.213.177"})
+	assert.Len(t, discovered, 2)
+	assert.Equal(t, "", discovered[0].Iface)
+}
+
+func TestDiscoverISCSISessionIPv6(t *testing.T) {
+	old := executor
+	executor = test.NewMockExecutor()
+	defer func() {
+		executor = old
+	}()
+	discovered := DiscoverISCSISession([]string{"[fd00:10::20]:3260"})
+	assert.Len(t, discovered, 3)
+	assert.Equal(t, "[fd00:10::20]:3260", discovered[0].TargetPortal)
+	assert.Equal(t, "fd00:10::20", discovered[0].TargetIp)
+	assert.Equal(t, "iqn.2003-01.org.linux-iscsi.target6:sn.a1", discovered[1].TargetIqn)
+	assert.Equal(t, "-1", discovered[2].Tag)
+	assert.Equal(t, "[fd00:10::22]:3260", NormalizePortal(discovered[2].TargetPortal, "3260"))
+}
+
 func TestNewDeviceInfo(t *testing.T) {
 	old := executor
 	executor = test.NewMockExecutor()
@@ -147,6 +199,111 @@ func TestNewDeviceInfo(t *testing.T) {
 	assert.Equal(t, 0, devices[0].GetHostId())
 	assert.Equal(t, "0:1:0:0", devices[0].GetDeviceIdentifier())
 }
+
+func TestNewDeviceInfoByPath(t *testing.T) {
+	devices := NewDeviceInfo("/dev/disk/by-path/pci-0000:05:00.0-fc-0x5006016d09200925-lun-11")
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "7:0:0:11", devices[0].GetDeviceIdentifier())
+}
+
+func TestNewDeviceInfoNotSCSI(t *testing.T) {
+	devices := NewDeviceInfo("/dev/nvme0n1")
+	assert.Len(t, devices, 0)
+}
+
+func TestDiscoverNVMeSubsystem(t *testing.T) {
+	old := executor
+	executor = test.NewMockExecutor()
+	defer func() {
+		executor = old
+	}()
+	discovered := DiscoverNVMeSubsystem("tcp", []string{"10.0.0.1"})
+	assert.Len(t, discovered, 2)
+	assert.Equal(t, "nqn.2014-08.org.example:subsys1", discovered[0].Nqn)
+	assert.Equal(t, "10.0.0.1", discovered[0].Address)
+	assert.Equal(t, "4420", discovered[0].Port)
+	assert.Equal(t, "tcp", discovered[0].Transport)
+	assert.Equal(t, "nqn.2014-08.org.example:subsys2", discovered[1].Nqn)
+	assert.Equal(t, "10.0.0.3", discovered[1].Address)
+}
+
+func TestDiscoverNVMeLog(t *testing.T) {
+	old := executor
+	executor = test.NewMockExecutor()
+	defer func() {
+		executor = old
+	}()
+	entries := DiscoverNVMeLogContext(context.Background(), "tcp", "10.0.0.6:8009")
+	assert.Len(t, entries, 3)
+	assert.False(t, entries[0].IsReferral())
+	assert.False(t, entries[0].IsSubsystem())
+	assert.True(t, entries[1].IsReferral())
+	assert.Equal(t, "10.0.0.5", entries[1].Address)
+	assert.True(t, entries[2].IsSubsystem())
+	assert.Empty(t, DiscoverNVMeLogContext(context.Background(), "tcp", "10.0.0.9"))
+}
+
+func TestSplitPortal(t *testing.T) {
+	address, port := SplitPortal("10.0.0.1:4420", "8009")
+	assert.Equal(t, "10.0.0.1", address)
+	assert.Equal(t, "4420", port)
+	address, port = SplitPortal("10.0.0.1", "8009")
+	assert.Equal(t, "10.0.0.1", address)
+	assert.Equal(t, "8009", port)
+	address, port = SplitPortal("[fe80::1]:4420", "8009")
+	assert.Equal(t, "fe80::1", address)
+	assert.Equal(t, "4420", port)
+	address, port = SplitPortal("[fe80::1]", "8009")
+	assert.Equal(t, "fe80::1", address)
+	assert.Equal(t, "8009", port)
+	address, port = SplitPortal("fe80::1", "8009")
+	assert.Equal(t, "fe80::1", address)
+	assert.Equal(t, "8009", port)
+	address, port = SplitPortal("storage.example.com:3261", "3260")
+	assert.Equal(t, "storage.example.com", address)
+	assert.Equal(t, "3261", port)
+}
+
+func TestNormalizePortal(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:3260", NormalizePortal("10.0.0.1", "3260"))
+	assert.Equal(t, "10.0.0.1:3261", NormalizePortal("10.0.0.1:3261", "3260"))
+	assert.Equal(t, "[fe80::1]:3260", NormalizePortal("FE80:0:0::1", "3260"))
+	assert.Equal(t, "[fe80::1]:3260", NormalizePortal("[fe80:0000::1]:3260", "3260"))
+	assert.Equal(t, "storage.example.com:3260", NormalizePortal("Storage.Example.com", "3260"))
+}
+
+func TestNewNVMeSubsystem(t *testing.T) {
+	old := executor
+	executor = test.NewMockExecutor()
+	defer func() {
+		executor = old
+	}()
+	subsystems := NewNVMeSubsystem()
+	assert.Len(t, subsystems, 2)
+	assert.Equal(t, "nvme-subsys0", subsystems[0].Name)
+	assert.Equal(t, "nqn.2014-08.org.example:subsys1", subsystems[0].Nqn)
+	assert.Len(t, subsystems[0].Paths, 1)
+	assert.Equal(t, "nvme0", subsystems[0].Paths[0].Name)
+	assert.Equal(t, "10.0.0.1", subsystems[0].Paths[0].GetTargetAddress())
+	assert.Equal(t, "4420", subsystems[0].Paths[0].GetTargetPort())
+	assert.Len(t, subsystems[1].Paths, 2)
+	assert.Equal(t, "connecting", subsystems[1].Paths[1].State)
+}
+
+func TestNewNVMeSubsystemLegacy(t *testing.T) {
+	old := executor
+	executor = test.NewMockExecutor()
+	defer func() {
+		executor = old
+	}()
+	subsystems := (&NVMeSubsystem{params: []string{"/dev/nvme3"}}).Parse()
+	assert.Len(t, subsystems, 1)
+	assert.Equal(t, "nvme-subsys3", subsystems[0].Name)
+	assert.Equal(t, "nqn.2014-08.org.example:subsys3", subsystems[0].Nqn)
+	assert.Len(t, subsystems[0].Paths, 1)
+	assert.Equal(t, "10.0.0.5", subsystems[0].Paths[0].GetTargetAddress())
+	assert.Equal(t, "4420", subsystems[0].Paths[0].GetTargetPort())
+}
 func TestRegSplit(t *testing.T) {
 	var s = `aaa|bbb|ccc`
 	ret := RegSplit(s, "\\|")
@@ -0,0 +1,247 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/model"
+)
+
+// Client calls the goock daemon over the unix socket, it implements
+// connector.Interface for the storage protocol.
+type Client struct {
+	protocol   connector.StringEnum
+	httpClient *http.Client
+}
+
+// NewClient creates the client of protocol for the daemon listening on socket
+func NewClient(socket string, protocol connector.StringEnum) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{protocol: protocol, httpClient: &http.Client{Transport: transport}}
+}
+
+func (c *Client) GetHostInfo() (connector.HostInfo, error) {
+	var info connector.HostInfo
+	err := c.call(context.Background(), http.MethodGet, "/host-info", nil, &info)
+	return info, err
+}
+
+func (c *Client) ConnectVolume(connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	return c.ConnectVolumeContext(context.Background(), connectionProperty)
+}
+
+// ConnectVolumeContext cancels the request once ctx is done, the daemon
+// cancels the operation along with the request.
+func (c *Client) ConnectVolumeContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	var info connector.VolumeInfo
+	connectionProperty.StorageProtocol = c.protocol
+	err := c.call(ctx, http.MethodPost, "/volumes/connect", connectionProperty, &info)
+	return info, err
+}
+
+func (c *Client) ConnectTarget(connectionProperty connector.ConnectionProperty) ([]connector.VolumeInfo, error) {
+	return c.ConnectTargetContext(context.Background(), connectionProperty)
+}
+
+// ConnectTargetContext attaches all the LUNs of the targets via the daemon,
+// see connector.ISCSIInterface
+func (c *Client) ConnectTargetContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) ([]connector.VolumeInfo, error) {
+	var volumes []connector.VolumeInfo
+	connectionProperty.StorageProtocol = c.protocol
+	err := c.call(ctx, http.MethodPost, "/volumes/connect-target", connectionProperty, &volumes)
+	return volumes, err
+}
+
+func (c *Client) DisconnectVolume(connectionProperty connector.ConnectionProperty) error {
+	return c.DisconnectVolumeContext(context.Background(), connectionProperty)
+}
+
+func (c *Client) DisconnectVolumeContext(ctx context.Context, connectionProperty connector.ConnectionProperty) error {
+	connectionProperty.StorageProtocol = c.protocol
+	return c.call(ctx, http.MethodPost, "/volumes/disconnect", connectionProperty, nil)
+}
+
+func (c *Client) ExtendVolume(connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return c.ExtendVolumeContext(context.Background(), connectionProperty)
+}
+
+func (c *Client) ExtendVolumeContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	var info connector.ExtendInfo
+	connectionProperty.StorageProtocol = c.protocol
+	err := c.call(ctx, http.MethodPost, "/volumes/extend", connectionProperty, &info)
+	return info, err
+}
+
+// DisconnectDevice removes the local device via the daemon, see connector.DisconnectDevice
+func (c *Client) DisconnectDevice(device string) error {
+	return c.DisconnectDeviceContext(context.Background(), device, false)
+}
+
+func (c *Client) DisconnectDeviceContext(ctx context.Context, device string, force bool) error {
+	return c.call(ctx, http.MethodPost, "/devices/disconnect", DeviceRequest{Device: device, Force: force}, nil)
+}
+
+// ExtendDevice extends the local device via the daemon, see connector.ExtendDevice
+func (c *Client) ExtendDevice(device string) (connector.ExtendInfo, error) {
+	return c.ExtendDeviceContext(context.Background(), device)
+}
+
+func (c *Client) ExtendDeviceContext(ctx context.Context, device string) (connector.ExtendInfo, error) {
+	var info connector.ExtendInfo
+	err := c.call(ctx, http.MethodPost, "/devices/extend", DeviceRequest{Device: device}, &info)
+	return info, err
+}
+
+// Sends the request and decodes the data of response into data
+func (c *Client) call(ctx context.Context, method string, path string, body interface{}, data interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+	// The host is ignored by the unix socket transport
+	request, err := http.NewRequest(method, "http://goock"+APIVersion+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(request.WithContext(ctx))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to reach the goock daemon: %s", err)
+	}
+	defer resp.Body.Close()
+	var response struct {
+		RequestId string          `json:"requestId"`
+		Data      json.RawMessage `json:"data"`
+		Error     string          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("unable to decode the response of goock daemon: %s", err)
+	}
+	log.WithField("requestId", response.RequestId).Debugf("Goock daemon responded %s to %s.", resp.Status, path)
+	if data != nil && len(response.Data) > 0 {
+		if err := json.Unmarshal(response.Data, data); err != nil {
+			return fmt.Errorf("unable to decode the response of goock daemon: %s", err)
+		}
+	}
+	if response.Error != "" {
+		return fmt.Errorf("%s (request %s)", response.Error, response.RequestId)
+	}
+	return nil
+}
+
+// ISCSIClient implements connector.ISCSIInterface, the targets are logged in
+// by the daemon within ConnectVolume, so the login and logout are not supported.
+type ISCSIClient struct {
+	*Client
+}
+
+func NewISCSIClient(socket string) *ISCSIClient {
+	return &ISCSIClient{NewClient(socket, connector.IscsiProtocol)}
+}
+
+func (c *ISCSIClient) DiscoverPortal(targetPortal ...string) []model.ISCSISession {
+	return c.DiscoverPortalWithAuth(connector.CHAPCredential{}, targetPortal...)
+}
+
+func (c *ISCSIClient) DiscoverPortalWithAuth(auth connector.CHAPCredential, targetPortal ...string) []model.ISCSISession {
+	return c.DiscoverPortalWithAuthContext(context.Background(), auth, targetPortal...)
+}
+
+func (c *ISCSIClient) DiscoverPortalWithAuthContext(ctx context.Context, auth connector.CHAPCredential,
+	targetPortal ...string) []model.ISCSISession {
+	return c.DiscoverPortalWithIfacesContext(ctx, auth, nil, "", targetPortal...)
+}
+
+func (c *ISCSIClient) DiscoverPortalWithIfacesContext(ctx context.Context, auth connector.CHAPCredential,
+	ifaces []string, transport connector.StringEnum, targetPortal ...string) []model.ISCSISession {
+	var sessions []model.ISCSISession
+	request := DiscoverRequest{TargetPortals: targetPortal, DiscoveryAuth: auth, Ifaces: ifaces, Transport: transport}
+	if err := c.call(ctx, http.MethodPost, "/iscsi/discover", request, &sessions); err != nil {
+		log.WithError(err).Errorf("Unable to discover %s.", targetPortal)
+	}
+	return sessions
+}
+
+func (c *ISCSIClient) LoginPortal(targetPortal string, targetIqn string) error {
+	return errNotSupported("login")
+}
+
+func (c *ISCSIClient) LoginPortalWithAuth(auth connector.CHAPCredential, targetPortal string, targetIqn string) error {
+	return errNotSupported("login")
+}
+
+func (c *ISCSIClient) LoginTargets(targets []model.ISCSISession, connectionProperty connector.ConnectionProperty) []connector.LoginResult {
+	results := make([]connector.LoginResult, len(targets))
+	for i, target := range targets {
+		results[i] = connector.LoginResult{TargetPortal: target.TargetPortal, TargetIqn: target.TargetIqn,
+			Status: connector.LoginFailed, Err: errNotSupported("login")}
+	}
+	return results
+}
+
+func (c *ISCSIClient) LogoutPortal(targetPortal string, targetIqn string) error {
+	return errNotSupported("logout")
+}
+
+func (c *ISCSIClient) SetNode2Auto(targetPortal string, targetIqn string) error {
+	return errNotSupported("node update")
+}
+
+// NVMeTCPClient implements connector.NVMeTCPInterface, the subsystems are
+// connected by the daemon within ConnectVolume.
+type NVMeTCPClient struct {
+	*Client
+}
+
+func NewNVMeTCPClient(socket string) *NVMeTCPClient {
+	return &NVMeTCPClient{NewClient(socket, connector.NVMeTCPProtocol)}
+}
+
+func (c *NVMeTCPClient) ConnectPortal(targetPortal string, targetNqn string) error {
+	return errNotSupported("subsystem connect")
+}
+
+func (c *NVMeTCPClient) DiscoverPortal(targetPortal ...string) []model.NVMeDiscoveryEntry {
+	log.WithError(errNotSupported("discovery")).Warnf("Unable to discover %s.", targetPortal)
+	return nil
+}
+
+func errNotSupported(operation string) error {
+	return fmt.Errorf("%s is not supported via the goock daemon", operation)
+}
@@ -0,0 +1,465 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/model"
+	goockutil "github.com/peter-wangxu/goock/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultSocket is the unix socket which the goock daemon listens on
+	DefaultSocket = "/run/goock/goock.sock"
+	// RequestIdHeader carries the request id, it is generated by the daemon
+	// if the caller does not supply one.
+	RequestIdHeader = "X-Request-Id"
+	// APIVersion is the path prefix of all the API
+	APIVersion = "/v1"
+)
+
+var log *logrus.Logger = logrus.New()
+
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+// ShutdownTimeout is the time to wait for the in-flight requests on shutdown
+var ShutdownTimeout = 5 * time.Minute
+
+// DiscoverRequest is the body of the iSCSI discovery request
+type DiscoverRequest struct {
+	TargetPortals []string                 `json:"targetPortals"`
+	DiscoveryAuth connector.CHAPCredential `json:"discoveryAuth"`
+	// Ifaces and Transport: the targets are discovered via each of the
+	// ifaces, see connector.ConnectionProperty
+	Ifaces    []string             `json:"ifaces,omitempty"`
+	Transport connector.StringEnum `json:"transport,omitempty"`
+}
+
+// DeviceRequest is the body of the local device request
+type DeviceRequest struct {
+	Device string `json:"device"`
+	// Disconnect the device even if it is in use
+	Force bool `json:"force,omitempty"`
+}
+
+// Response is the body of all the API responses, Data is set even though
+// Error is not empty, like the login results of a failed ConnectVolume.
+type Response struct {
+	RequestId string      `json:"requestId"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// Server exposes the connectors over HTTP/JSON, operations on the same
+// target are serialised.
+type Server struct {
+	connectors  map[connector.StringEnum]connector.Interface
+	iscsi       connector.ISCSIInterface
+	hostInfo    func() (connector.HostInfo, error)
+	locks       *keyLock
+	httpServer  *http.Server
+	requestSeed string
+	requestSeq  uint64
+}
+
+// NewServer creates the server with the iSCSI, FC and NVMe/TCP connectors
+func NewServer() *Server {
+	s := &Server{
+		connectors:  map[connector.StringEnum]connector.Interface{},
+		hostInfo:    connector.GetHostInfo,
+		locks:       newKeyLock(),
+		requestSeed: fmt.Sprintf("%x", time.Now().Unix()),
+	}
+	s.httpServer = &http.Server{Handler: s.Handler()}
+	s.SetISCSIConnector(connector.NewISCSIConnector())
+	s.SetConnector(connector.FcProtocol, connector.NewFibreChannelConnector())
+	s.SetConnector(connector.NVMeTCPProtocol, connector.NewNVMeTCPConnector())
+	return s
+}
+
+// SetConnector sets the connector of protocol
+func (s *Server) SetConnector(protocol connector.StringEnum, c connector.Interface) {
+	s.connectors[protocol] = c
+}
+
+// SetISCSIConnector sets the iSCSI connector, which discovers the targets as well
+func (s *Server) SetISCSIConnector(iscsi connector.ISCSIInterface) {
+	s.iscsi = iscsi
+	s.SetConnector(connector.IscsiProtocol, iscsi)
+}
+
+// Handler returns the http handler of the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(APIVersion+"/host-info", s.wrap(http.MethodGet, s.handleHostInfo))
+	mux.HandleFunc(APIVersion+"/volumes/connect", s.wrap(http.MethodPost, s.handleConnect))
+	mux.HandleFunc(APIVersion+"/volumes/connect-target", s.wrap(http.MethodPost, s.handleConnectTarget))
+	mux.HandleFunc(APIVersion+"/volumes/disconnect", s.wrap(http.MethodPost, s.handleDisconnect))
+	mux.HandleFunc(APIVersion+"/volumes/extend", s.wrap(http.MethodPost, s.handleExtend))
+	mux.HandleFunc(APIVersion+"/devices/disconnect", s.wrap(http.MethodPost, s.handleDeviceDisconnect))
+	mux.HandleFunc(APIVersion+"/devices/extend", s.wrap(http.MethodPost, s.handleDeviceExtend))
+	mux.HandleFunc(APIVersion+"/iscsi/discover", s.wrap(http.MethodPost, s.handleDiscover))
+	return mux
+}
+
+// Serve listens on the unix socket and serves the API until Shutdown is called
+func (s *Server) Serve(socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	// Remove the socket left by the previous daemon
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	// Only root is allowed to manage the devices
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	log.Infof("Goock daemon is listening on %s.", socket)
+	err = s.httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting new requests and waits for the in-flight ones
+func (s *Server) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return s.httpServer.Shutdown(ctx)
+}
+
+type handlerFunc func(r *http.Request, logger *logrus.Entry) (interface{}, int, error)
+
+// Wraps the handler with the method check, request id and the json response
+func (s *Server) wrap(method string, handler handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if requestId == "" {
+			requestId = fmt.Sprintf("%s-%d", s.requestSeed, atomic.AddUint64(&s.requestSeq, 1))
+		}
+		logger := log.WithFields(logrus.Fields{"requestId": requestId, "path": r.URL.Path})
+		var data interface{}
+		var status int
+		var err error
+		if r.Method != method {
+			status, err = http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method)
+		} else {
+			logger.Info("Handling request.")
+			data, status, err = handler(r, logger)
+		}
+		response := Response{RequestId: requestId, Data: data}
+		if err != nil {
+			logger.WithError(err).Error("Request failed.")
+			response.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(RequestIdHeader, requestId)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func (s *Server) handleHostInfo(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	info, err := s.hostInfo()
+	if err != nil {
+		return info, http.StatusInternalServerError, err
+	}
+	return info, http.StatusOK, nil
+}
+
+func (s *Server) handleConnect(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	property, c, err := s.decodeProperty(r, connector.ConnectionProperty.IsEmpty)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	unlock, err := s.lock(r, targetKeys(property)...)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer unlock()
+	info, err := c.ConnectVolumeContext(r.Context(), property)
+	if err != nil {
+		return info, http.StatusInternalServerError, err
+	}
+	return info, http.StatusOK, nil
+}
+
+// targetConnector attaches all the LUNs of the targets, which is implemented
+// by the iSCSI and FC connectors
+type targetConnector interface {
+	ConnectTargetContext(ctx context.Context, connectionProperty connector.ConnectionProperty) ([]connector.VolumeInfo, error)
+}
+
+func (s *Server) handleConnectTarget(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	property, c, err := s.decodeProperty(r, checkTargets)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	tc, ok := c.(targetConnector)
+	if !ok {
+		return nil, http.StatusBadRequest, fmt.Errorf("connecting all the LUNs is not supported by %s", property.StorageProtocol)
+	}
+	unlock, err := s.lock(r, targetKeys(property)...)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer unlock()
+	volumes, err := tc.ConnectTargetContext(r.Context(), property)
+	if err != nil {
+		return volumes, http.StatusInternalServerError, err
+	}
+	return volumes, http.StatusOK, nil
+}
+
+func (s *Server) handleDisconnect(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	property, c, err := s.decodeProperty(r, connector.ConnectionProperty.IsEmpty)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	unlock, err := s.lock(r, targetKeys(property)...)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer unlock()
+	if err := c.DisconnectVolumeContext(r.Context(), property); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return nil, http.StatusOK, nil
+}
+
+func (s *Server) handleExtend(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	property, c, err := s.decodeProperty(r, connector.ConnectionProperty.IsEmpty)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	unlock, err := s.lock(r, targetKeys(property)...)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer unlock()
+	info, err := c.ExtendVolumeContext(r.Context(), property)
+	if err != nil {
+		return info, http.StatusInternalServerError, err
+	}
+	return info, http.StatusOK, nil
+}
+
+func (s *Server) handleDeviceDisconnect(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	var request DeviceRequest
+	if err := decodeBody(r, &request); err != nil || request.Device == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("device is required")
+	}
+	unlock, err := s.lock(r, "device:"+request.Device)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer unlock()
+	if err := connector.DisconnectDeviceContext(r.Context(), request.Device, request.Force); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return nil, http.StatusOK, nil
+}
+
+func (s *Server) handleDeviceExtend(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	var request DeviceRequest
+	if err := decodeBody(r, &request); err != nil || request.Device == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("device is required")
+	}
+	unlock, err := s.lock(r, "device:"+request.Device)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer unlock()
+	info, err := connector.ExtendDeviceContext(r.Context(), request.Device)
+	if err != nil {
+		return info, http.StatusInternalServerError, err
+	}
+	return info, http.StatusOK, nil
+}
+
+func (s *Server) handleDiscover(r *http.Request, logger *logrus.Entry) (interface{}, int, error) {
+	var request DiscoverRequest
+	if err := decodeBody(r, &request); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(request.TargetPortals) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("target portals are required")
+	}
+	if err := connector.ValidateCHAPCredentials(connector.CHAPCredential{}, request.DiscoveryAuth); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return s.iscsi.DiscoverPortalWithIfacesContext(r.Context(), request.DiscoveryAuth, request.Ifaces,
+		request.Transport, request.TargetPortals...), http.StatusOK, nil
+}
+
+// Decodes the ConnectionProperty, validates it with check and finds the
+// connector of its protocol
+func (s *Server) decodeProperty(r *http.Request,
+	check func(connector.ConnectionProperty) error) (connector.ConnectionProperty, connector.Interface, error) {
+	var property connector.ConnectionProperty
+	if err := decodeBody(r, &property); err != nil {
+		return property, nil, err
+	}
+	if err := check(property); err != nil {
+		return property, nil, err
+	}
+	if err := connector.ValidateCHAPCredentials(property.SessionAuth, property.DiscoveryAuth); err != nil {
+		return property, nil, err
+	}
+	c, ok := s.connectors[property.StorageProtocol]
+	if !ok {
+		return property, nil, fmt.Errorf("storage protocol %s is not supported", property.StorageProtocol)
+	}
+	return property, c, nil
+}
+
+// Validates the property of connect-target, the LUNs of an iSCSI target are
+// scanned rather than given
+func checkTargets(property connector.ConnectionProperty) error {
+	if property.StorageProtocol != connector.IscsiProtocol {
+		return property.IsEmpty()
+	}
+	if len(property.TargetPortals) == 0 || len(property.TargetIqns) == 0 {
+		return fmt.Errorf("target portals and IQNs are required")
+	}
+	return nil
+}
+
+// Locks the keys until the request is done, a request cancelled or timed out
+// while waiting for the other operations on the keys fails
+func (s *Server) lock(r *http.Request, keys ...string) (func(), error) {
+	unlock, err := s.locks.Lock(r.Context(), keys...)
+	if err != nil {
+		return nil, fmt.Errorf("gave up waiting for the operation on %s: %s", strings.Join(keys, ", "), err)
+	}
+	return unlock, nil
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %s", err)
+	}
+	return nil
+}
+
+// Returns the keys of the targets which the operation is serialised on,
+// the same target is locked no matter the port is specified or not.
+func targetKeys(property connector.ConnectionProperty) []string {
+	var keys []string
+	switch property.StorageProtocol {
+	case connector.IscsiProtocol:
+		for _, portal := range property.TargetPortals {
+			keys = append(keys, "iscsi:"+model.NormalizePortal(portal, model.ISCSIDefaultPort))
+		}
+	case connector.FcProtocol:
+		for _, wwn := range property.TargetWwns {
+			keys = append(keys, "fc:"+strings.ToLower(wwn))
+		}
+	case connector.NVMeTCPProtocol:
+		keys = append(keys, "nvme:"+property.TargetNqn)
+	}
+	return keys
+}
+
+// keyLock serialises the operations on the same keys
+type keyLock struct {
+	mutex sync.Mutex
+	locks map[string]*keyEntry
+}
+
+// keyEntry is locked by sending to the channel, which can be selected with
+// the context of the request
+type keyEntry struct {
+	held chan struct{}
+	refs int
+}
+
+func newKeyLock() *keyLock {
+	return &keyLock{locks: map[string]*keyEntry{}}
+}
+
+// Lock locks all the keys in order to avoid dead lock, the returned
+// function unlocks them. It gives up and returns the error of ctx once ctx
+// is done before all the keys are locked.
+func (l *keyLock) Lock(ctx context.Context, keys ...string) (func(), error) {
+	sorted := []string{}
+	for _, key := range keys {
+		if !goockutil.Contains(key, sorted) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	entries := make([]*keyEntry, len(sorted))
+	l.mutex.Lock()
+	for i, key := range sorted {
+		entry, ok := l.locks[key]
+		if !ok {
+			entry = &keyEntry{held: make(chan struct{}, 1)}
+			l.locks[key] = entry
+		}
+		entry.refs++
+		entries[i] = entry
+	}
+	l.mutex.Unlock()
+	// Releases the first held entries and drops the references of all
+	release := func(held int) {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for i, entry := range entries {
+			if i < held {
+				<-entry.held
+			}
+			entry.refs--
+			if entry.refs == 0 {
+				delete(l.locks, sorted[i])
+			}
+		}
+	}
+	for i, entry := range entries {
+		select {
+		case entry.held <- struct{}{}:
+		case <-ctx.Done():
+			release(i)
+			return nil, ctx.Err()
+		}
+	}
+	return func() { release(len(entries)) }, nil
+}
@@ -0,0 +1,431 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peter-wangxu/goock/pkg/connector"
+	"github.com/peter-wangxu/goock/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeConnector struct {
+	// ConnectVolume blocks until release is closed if it is not nil
+	release chan struct{}
+	started chan struct{}
+	// Receives the error of the context if ConnectVolume is cancelled
+	cancelled chan error
+}
+
+func (fake *FakeConnector) GetHostInfo() (connector.HostInfo, error) {
+	return connector.HostInfo{}, nil
+}
+
+func (fake *FakeConnector) ConnectVolume(connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	return fake.ConnectVolumeContext(context.Background(), connectionProperty)
+}
+
+func (fake *FakeConnector) ConnectVolumeContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) (connector.VolumeInfo, error) {
+	if fake.started != nil {
+		fake.started <- struct{}{}
+	}
+	if fake.release != nil {
+		select {
+		case <-fake.release:
+		case <-ctx.Done():
+			fake.cancelled <- ctx.Err()
+			return connector.VolumeInfo{}, ctx.Err()
+		}
+	}
+	if connectionProperty.TargetLun == 99 {
+		return connector.VolumeInfo{Wwn: "partial"}, fmt.Errorf("failed to connect volume")
+	}
+	return connector.VolumeInfo{Wwn: "wwn1", Paths: []string{"/dev/sdb"}}, nil
+}
+
+func (fake *FakeConnector) ConnectTarget(connectionProperty connector.ConnectionProperty) ([]connector.VolumeInfo, error) {
+	return fake.ConnectTargetContext(context.Background(), connectionProperty)
+}
+
+func (fake *FakeConnector) ConnectTargetContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) ([]connector.VolumeInfo, error) {
+	volumes := []connector.VolumeInfo{{Wwn: "wwn1", Paths: []string{"/dev/sdb"}}}
+	if connectionProperty.TargetLun == 99 {
+		return volumes, fmt.Errorf("unable to attach LUN(s) [99]")
+	}
+	return append(volumes, connector.VolumeInfo{Wwn: "wwn2", Paths: []string{"/dev/sdc"}}), nil
+}
+
+func (fake *FakeConnector) DisconnectVolume(connectionProperty connector.ConnectionProperty) error {
+	return fake.DisconnectVolumeContext(context.Background(), connectionProperty)
+}
+
+func (fake *FakeConnector) DisconnectVolumeContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) error {
+	return nil
+}
+
+func (fake *FakeConnector) ExtendVolume(connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return fake.ExtendVolumeContext(context.Background(), connectionProperty)
+}
+
+func (fake *FakeConnector) ExtendVolumeContext(ctx context.Context,
+	connectionProperty connector.ConnectionProperty) (connector.ExtendInfo, error) {
+	return connector.ExtendInfo{Wwn: "wwn1", OriginalSize: 1024, NewSize: 2048}, nil
+}
+
+type FakeISCSIConnector struct {
+	FakeConnector
+}
+
+func (fake *FakeISCSIConnector) LoginPortal(targetPortal string, targetIqn string) error {
+	return nil
+}
+
+func (fake *FakeISCSIConnector) LoginPortalWithAuth(auth connector.CHAPCredential, targetPortal string, targetIqn string) error {
+	return nil
+}
+
+func (fake *FakeISCSIConnector) LoginTargets(targets []model.ISCSISession, connectionProperty connector.ConnectionProperty) []connector.LoginResult {
+	return nil
+}
+
+func (fake *FakeISCSIConnector) LogoutPortal(targetPortal string, targetIqn string) error {
+	return nil
+}
+
+func (fake *FakeISCSIConnector) SetNode2Auto(targetPortal string, targetIqn string) error {
+	return nil
+}
+
+func (fake *FakeISCSIConnector) DiscoverPortal(targetPortal ...string) []model.ISCSISession {
+	return fake.DiscoverPortalWithAuth(connector.CHAPCredential{}, targetPortal...)
+}
+
+func (fake *FakeISCSIConnector) DiscoverPortalWithAuth(auth connector.CHAPCredential, targetPortal ...string) []model.ISCSISession {
+	return fake.DiscoverPortalWithAuthContext(context.Background(), auth, targetPortal...)
+}
+
+func (fake *FakeISCSIConnector) DiscoverPortalWithAuthContext(ctx context.Context, auth connector.CHAPCredential,
+	targetPortal ...string) []model.ISCSISession {
+	return fake.DiscoverPortalWithIfacesContext(ctx, auth, nil, "", targetPortal...)
+}
+
+func (fake *FakeISCSIConnector) DiscoverPortalWithIfacesContext(ctx context.Context, auth connector.CHAPCredential,
+	ifaces []string, transport connector.StringEnum, targetPortal ...string) []model.ISCSISession {
+	session := model.ISCSISession{TargetPortal: targetPortal[0] + ":3260", TargetIqn: "iqn.2017-01.com.example:" + auth.Username}
+	if len(ifaces) == 0 {
+		return []model.ISCSISession{session}
+	}
+	var sessions []model.ISCSISession
+	for _, iface := range ifaces {
+		session.Iface = iface
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func newFakeServer(fc *FakeConnector) *Server {
+	s := NewServer()
+	s.SetISCSIConnector(&FakeISCSIConnector{})
+	s.SetConnector(connector.FcProtocol, fc)
+	s.hostInfo = func() (connector.HostInfo, error) {
+		return connector.HostInfo{Hostname: "host1"}, nil
+	}
+	return s
+}
+
+// Serves the fake server on a temporary unix socket
+func serveFake(t *testing.T, fc *FakeConnector) (*Server, string, func()) {
+	dir, err := ioutil.TempDir("", "goock-server")
+	assert.Nil(t, err)
+	socket := filepath.Join(dir, "goock.sock")
+	s := newFakeServer(fc)
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(socket)
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, socket, func() {
+		s.Shutdown()
+		assert.Nil(t, <-done)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClientConnectVolume(t *testing.T) {
+	_, socket, stop := serveFake(t, &FakeConnector{})
+	defer stop()
+	fc := NewClient(socket, connector.FcProtocol)
+	info, err := fc.ConnectVolume(connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}, TargetLun: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, "wwn1", info.Wwn)
+	assert.Equal(t, []string{"/dev/sdb"}, info.Paths)
+
+	extendInfo, err := fc.ExtendVolume(connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2048, extendInfo.NewSize)
+	assert.Nil(t, fc.DisconnectVolume(connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}}))
+
+	hostInfo, err := fc.GetHostInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, "host1", hostInfo.Hostname)
+}
+
+func TestClientConnectVolumeFailed(t *testing.T) {
+	_, socket, stop := serveFake(t, &FakeConnector{})
+	defer stop()
+	fc := NewClient(socket, connector.FcProtocol)
+	info, err := fc.ConnectVolume(connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}, TargetLun: 99})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to connect volume (request ")
+	assert.Equal(t, "partial", info.Wwn)
+}
+
+func TestClientConnectTarget(t *testing.T) {
+	_, socket, stop := serveFake(t, &FakeConnector{})
+	defer stop()
+	fc := NewClient(socket, connector.FcProtocol)
+	volumes, err := fc.ConnectTarget(connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}})
+	assert.Nil(t, err)
+	assert.Len(t, volumes, 2)
+	assert.Equal(t, "wwn2", volumes[1].Wwn)
+
+	volumes, err = fc.ConnectTarget(connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}, TargetLun: 99})
+	assert.Error(t, err)
+	assert.Len(t, volumes, 1)
+
+	nvme := NewClient(socket, connector.NVMeTCPProtocol)
+	_, err = nvme.ConnectTarget(connector.ConnectionProperty{TargetPortals: []string{"192.168.1.10"},
+		TargetNqn: "nqn.2014-08.org.example:subsys1", VolumeNguid: "5f5e4d3c2b1a09f8"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not supported")
+}
+
+func TestClientNotSupportedProtocol(t *testing.T) {
+	_, socket, stop := serveFake(t, &FakeConnector{})
+	defer stop()
+	s := NewClient(socket, "unknown")
+	_, err := s.ConnectVolume(connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}})
+	assert.Error(t, err)
+}
+
+func TestISCSIClientDiscover(t *testing.T) {
+	_, socket, stop := serveFake(t, &FakeConnector{})
+	defer stop()
+	iscsi := NewISCSIClient(socket)
+	sessions := iscsi.DiscoverPortalWithAuth(connector.CHAPCredential{Username: "user", Secret: "secret"}, "192.168.1.10")
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "192.168.1.10:3260", sessions[0].TargetPortal)
+	assert.Equal(t, "iqn.2017-01.com.example:user", sessions[0].TargetIqn)
+	sessions = iscsi.DiscoverPortalWithIfacesContext(context.Background(), connector.CHAPCredential{},
+		[]string{"eth1", "eth2"}, connector.TransportTCP, "192.168.1.10")
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "eth2", sessions[1].Iface)
+	assert.Error(t, iscsi.LoginPortal("192.168.1.10:3260", "iqn"))
+}
+
+func TestClientDaemonNotRunning(t *testing.T) {
+	fc := NewClient("/tmp/goock-not-existed.sock", connector.FcProtocol)
+	_, err := fc.GetHostInfo()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to reach the goock daemon")
+}
+
+func TestRequestId(t *testing.T) {
+	handler := newFakeServer(&FakeConnector{}).Handler()
+	request := httptest.NewRequest(http.MethodGet, "/v1/host-info", nil)
+	request.Header.Set(RequestIdHeader, "req-1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "req-1", recorder.Header().Get(RequestIdHeader))
+	assert.Contains(t, recorder.Body.String(), `"requestId":"req-1"`)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/host-info", nil))
+	assert.NotEmpty(t, recorder.Header().Get(RequestIdHeader))
+}
+
+func TestBadRequest(t *testing.T) {
+	handler := newFakeServer(&FakeConnector{}).Handler()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/volumes/connect",
+		strings.NewReader(`{"storageProtocol": "fibre_channel"}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/volumes/connect", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	// Half-filled CHAP credentials
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/volumes/connect",
+		strings.NewReader(`{"storageProtocol": "iscsi", "targetPortals": ["192.168.1.10"], "targetIqns": ["iqn.a"],
+			"targetLuns": [1], "sessionAuth": {"username": "user"}}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "invalid session credential")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/iscsi/discover",
+		strings.NewReader(`{"targetPortals": ["192.168.1.10"], "discoveryAuth": {"secret": "secret"}}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "invalid discovery credential")
+}
+
+func TestConnectTargetWithoutLuns(t *testing.T) {
+	handler := newFakeServer(&FakeConnector{}).Handler()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/volumes/connect-target",
+		strings.NewReader(`{"storageProtocol": "iscsi", "targetPortals": ["192.168.1.10"],
+			"targetIqns": ["iqn.1992-04.com.emc:cx.fnm00124500890.a5"]}`)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/volumes/connect-target",
+		strings.NewReader(`{"storageProtocol": "iscsi", "targetPortals": ["192.168.1.10"]}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "target portals and IQNs are required")
+}
+
+func TestTargetKeys(t *testing.T) {
+	keys := targetKeys(connector.ConnectionProperty{StorageProtocol: connector.IscsiProtocol,
+		TargetPortals: []string{"192.168.1.10", "192.168.1.11:3260"}})
+	assert.Equal(t, []string{"iscsi:192.168.1.10:3260", "iscsi:192.168.1.11:3260"}, keys)
+	keys = targetKeys(connector.ConnectionProperty{StorageProtocol: connector.FcProtocol,
+		TargetWwns: []string{"5006016D09200925"}})
+	assert.Equal(t, []string{"fc:5006016d09200925"}, keys)
+}
+
+func TestKeyLock(t *testing.T) {
+	locks := newKeyLock()
+	unlock, err := locks.Lock(context.Background(), "a", "b")
+	assert.Nil(t, err)
+	// A different key is not blocked
+	unlockC, err := locks.Lock(context.Background(), "c")
+	assert.Nil(t, err)
+	unlockC()
+
+	var wg sync.WaitGroup
+	acquired := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		unlockB, err := locks.Lock(context.Background(), "b", "b")
+		assert.Nil(t, err)
+		unlockB()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("key b is locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	wg.Wait()
+	assert.Len(t, locks.locks, 0)
+}
+
+func TestKeyLockContextDone(t *testing.T) {
+	locks := newKeyLock()
+	unlock, err := locks.Lock(context.Background(), "b")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = locks.Lock(ctx, "a", "b")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// Key a held by the failed Lock is released
+	unlockA, err := locks.Lock(context.Background(), "a")
+	assert.Nil(t, err)
+	unlockA()
+	unlock()
+	assert.Len(t, locks.locks, 0)
+}
+
+func TestLockedRequestCancelled(t *testing.T) {
+	s := newFakeServer(&FakeConnector{})
+	unlock, err := s.locks.Lock(context.Background(), "device:/dev/sdb")
+	assert.Nil(t, err)
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request := httptest.NewRequest(http.MethodPost, "/v1/devices/disconnect",
+		strings.NewReader(`{"device": "/dev/sdb"}`)).WithContext(ctx)
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "gave up waiting for the operation on device:/dev/sdb")
+}
+
+func TestShutdownWaitsForRequest(t *testing.T) {
+	fc := &FakeConnector{release: make(chan struct{}), started: make(chan struct{}, 1)}
+	s, socket, stop := serveFake(t, fc)
+	done := make(chan error)
+	go func() {
+		_, err := NewClient(socket, connector.FcProtocol).ConnectVolume(
+			connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}})
+		done <- err
+	}()
+	<-fc.started
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(fc.release)
+	assert.Nil(t, <-done)
+	assert.Nil(t, <-shutdown)
+	stop()
+	_, err := os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestClientContextCancelsOperation(t *testing.T) {
+	fc := &FakeConnector{release: make(chan struct{}), started: make(chan struct{}, 1),
+		cancelled: make(chan error, 1)}
+	_, socket, stop := serveFake(t, fc)
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := NewClient(socket, connector.FcProtocol).ConnectVolumeContext(ctx,
+		connector.ConnectionProperty{TargetWwns: []string{"5006016d09200925"}})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// The operation in the daemon is cancelled along with the request
+	select {
+	case err = <-fc.cancelled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Error("the operation is not cancelled")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sysfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Root directory of the host filesystem where /sys and /dev are located,
+// it is changed when goock runs in a container with the host mounted or
+// when a fake sysfs tree is used for testing.
+var root = "/"
+
+func SetRoot(r string) {
+	root = r
+}
+
+func GetRoot() string {
+	return root
+}
+
+// HostPath returns the path under the root directory
+func HostPath(path string) string {
+	return filepath.Join(root, path)
+}
+
+// Exists returns nil if the path exists under the root directory
+func Exists(path string) error {
+	_, err := os.Stat(HostPath(path))
+	return err
+}
+
+// ReadAttr returns the trimmed content of the sysfs attribute,
+// like /sys/class/fc_host/host7/port_name
+func ReadAttr(path string) (string, error) {
+	data, err := ioutil.ReadFile(HostPath(path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// RealPath resolves all symbolic links of path, the result is relative to
+// the root directory, like /sys/devices/platform/host3/session1/target3:0:0
+func RealPath(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(HostPath(path))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is resolved to %s which is out of %s", path, real, root)
+	}
+	return filepath.Join("/", rel), nil
+}
+
+// ListDir returns the entries of dir whose names match the pattern
+func ListDir(dir string, pattern string) ([]string, error) {
+	entries, err := ioutil.ReadDir(HostPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	matcher := regexp.MustCompile(pattern)
+	var names []string
+	for _, entry := range entries {
+		if matcher.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
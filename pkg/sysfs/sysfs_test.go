@@ -0,0 +1,61 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sysfs
+
+import (
+	"github.com/peter-wangxu/goock/test"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	root := test.NewFakeRoot()
+	SetRoot(root.Dir)
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
+func TestExists(t *testing.T) {
+	assert.Nil(t, Exists("/sys/class/fc_host/host7"))
+	assert.Error(t, Exists("/sys/class/fc_host/host8"))
+}
+
+func TestReadAttr(t *testing.T) {
+	value, err := ReadAttr("/sys/class/fc_host/host7/port_state")
+	assert.Nil(t, err)
+	assert.Equal(t, "Online", value)
+	_, err = ReadAttr("/sys/class/fc_host/host7/not_existed")
+	assert.Error(t, err)
+}
+
+func TestRealPath(t *testing.T) {
+	path, err := RealPath("/sys/block/sdb/device")
+	assert.Nil(t, err)
+	assert.Equal(t, "/sys/devices/platform/host0/rport-0:1-0/target0:1:0/0:1:0:0", path)
+	path, err = RealPath("/dev/disk/by-id/dm-uuid-mpath-350060160b6e00e5a50060160b6e00e5a")
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/dm-8", path)
+}
+
+func TestListDir(t *testing.T) {
+	names, err := ListDir("/sys/class/fc_remote_ports", `^rport-9:0-[23]$`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"rport-9:0-2", "rport-9:0-3"}, names)
+	_, err = ListDir("/sys/class/not_existed", ".*")
+	assert.Error(t, err)
+}
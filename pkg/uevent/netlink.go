@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package uevent
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Multicast groups of the kernel and udev events
+	kernelGroup = 1
+	udevGroup   = 2
+	// The pending Receive checks whether the source is closed in this interval
+	receiveTimeout = 100 * time.Millisecond
+	// Size of the receive buffer of the socket
+	socketBuffer = 1024 * 1024
+)
+
+// netlinkSource receives the events from the NETLINK_KOBJECT_UEVENT socket,
+// both the kernel events and the events processed by udev are received, the
+// latter come after the links under /dev/disk are created.
+type netlinkSource struct {
+	mutex     sync.Mutex
+	fd        int
+	receiving bool
+	closed    bool
+}
+
+// OpenNetlink opens the uevent netlink socket
+func OpenNetlink() (Source, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the uevent socket: %s", err)
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: kernelGroup | udevGroup}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("unable to bind the uevent socket: %s", err)
+	}
+	// A burst of events should not overflow the socket
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, socketBuffer)
+	timeout := syscall.NsecToTimeval(receiveTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("unable to set the timeout of uevent socket: %s", err)
+	}
+	return &netlinkSource{fd: fd}, nil
+}
+
+func (s *netlinkSource) Receive() (Event, error) {
+	buf := make([]byte, 64*1024)
+	for {
+		s.mutex.Lock()
+		if s.closed {
+			s.closeSocket()
+			s.mutex.Unlock()
+			return Event{}, errClosed
+		}
+		s.receiving = true
+		fd := s.fd
+		s.mutex.Unlock()
+
+		// Only root is allowed to send to the groups, no need to check the sender
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+
+		s.mutex.Lock()
+		s.receiving = false
+		s.mutex.Unlock()
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			// Some events are lost, the waiters check the devices anyway
+			log.Debug("The uevent socket overflowed.")
+			continue
+		}
+		if err != nil {
+			return Event{}, err
+		}
+		event, err := Parse(buf[:n])
+		if err != nil {
+			log.WithError(err).Debug("Ignore the invalid uevent.")
+			continue
+		}
+		return event, nil
+	}
+}
+
+// Close closes the socket, or lets the pending Receive close it in
+// receiveTimeout so that the descriptor is not reused under its feet.
+func (s *netlinkSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if !s.receiving {
+		s.closeSocket()
+	}
+	return nil
+}
+
+func (s *netlinkSource) closeSocket() {
+	if s.fd >= 0 {
+		syscall.Close(s.fd)
+		s.fd = -1
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package uevent listens to the kernel and udev uevents, so that the waiters
+// return as soon as the devices appear or disappear instead of polling.
+package uevent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+	ActionChange = "change"
+
+	SubsystemBlock = "block"
+
+	// Prefix and magic of the messages sent by udev
+	udevPrefix = "libudev\x00"
+	udevMagic  = 0xfeedcafe
+	// Size of the prefix, magic, header_size, properties_off and properties_len
+	udevHeaderMin = 24
+	// Number of the events buffered by a monitor
+	bufferSize = 64
+)
+
+var log = logrus.New()
+
+var errClosed = errors.New("uevent source is closed")
+
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+// Event is a uevent of a device, the properties are like:
+//  ACTION=add
+//  DEVPATH=/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb
+//  SUBSYSTEM=block
+//  DEVNAME=/dev/sdb
+//  DEVLINKS=/dev/disk/by-id/wwn-0x... /dev/disk/by-path/ip-...
+type Event struct {
+	Action     string
+	DevPath    string
+	Subsystem  string
+	Properties map[string]string
+}
+
+// DevName returns the device node like /dev/sdb, the kernel events only
+// carry the name under /dev
+func (e Event) DevName() string {
+	name := e.Properties["DEVNAME"]
+	if name != "" && !strings.HasPrefix(name, "/") {
+		name = "/dev/" + name
+	}
+	return name
+}
+
+// DevLinks returns the links to the device created by udev
+func (e Event) DevLinks() []string {
+	return strings.Fields(e.Properties["DEVLINKS"])
+}
+
+// IsBlock returns true for the events of block devices, including the
+// change events of the device mapper
+func IsBlock(e Event) bool {
+	return e.Subsystem == SubsystemBlock
+}
+
+// Source delivers the uevents
+type Source interface {
+	// Receive blocks until the next event arrives, it returns an error once
+	// the source is closed or exhausted.
+	Receive() (Event, error)
+	Close() error
+}
+
+var openSource = OpenNetlink
+
+// SetSource changes how the source of events is opened, nil restores the
+// netlink socket.
+func SetSource(open func() (Source, error)) {
+	if open == nil {
+		open = OpenNetlink
+	}
+	openSource = open
+}
+
+// Monitor delivers the events of a source in the background
+type Monitor struct {
+	source Source
+	events chan Event
+}
+
+// Watch delivers the events accepted by filter, nil accepts all the events.
+// The monitor delivers nothing if the source is not available, the callers
+// should poll in that case.
+func Watch(filter func(Event) bool) *Monitor {
+	m := &Monitor{}
+	source, err := openSource()
+	if err != nil {
+		log.WithError(err).Debug("Unable to listen to uevents, fall back to polling.")
+		return m
+	}
+	m.source = source
+	m.events = make(chan Event, bufferSize)
+	go m.run(filter)
+	return m
+}
+
+// Events returns the channel of the events, it is nil if the source is not
+// available and closed once the source fails. The events are dropped when
+// the buffer is full, so the receivers should check the devices rather than
+// count the events.
+func (m *Monitor) Events() <-chan Event {
+	return m.events
+}
+
+func (m *Monitor) Close() error {
+	if m.source == nil {
+		return nil
+	}
+	return m.source.Close()
+}
+
+func (m *Monitor) run(filter func(Event) bool) {
+	defer close(m.events)
+	for {
+		event, err := m.source.Receive()
+		if err != nil {
+			if err != io.EOF && err != errClosed {
+				log.WithError(err).Debug("Stop listening to uevents.")
+			}
+			return
+		}
+		if filter != nil && !filter(event) {
+			continue
+		}
+		select {
+		case m.events <- event:
+		default:
+		}
+	}
+}
+
+// Parse parses a message of the kernel like "add@/devices/...\0ACTION=add\0..."
+// or the message of udev which starts with the libudev header
+func Parse(data []byte) (Event, error) {
+	var properties []byte
+	if bytes.HasPrefix(data, []byte(udevPrefix)) {
+		if len(data) < udevHeaderMin || binary.BigEndian.Uint32(data[8:12]) != udevMagic {
+			return Event{}, errors.New("invalid udev message header")
+		}
+		// The offset and length are in the host byte order
+		offset, length := binary.LittleEndian.Uint32(data[16:20]), binary.LittleEndian.Uint32(data[20:24])
+		if uint64(offset)+uint64(length) > uint64(len(data)) {
+			offset, length = binary.BigEndian.Uint32(data[16:20]), binary.BigEndian.Uint32(data[20:24])
+		}
+		if uint64(offset)+uint64(length) > uint64(len(data)) {
+			return Event{}, errors.New("invalid udev message properties")
+		}
+		properties = data[offset : offset+length]
+	} else {
+		i := bytes.IndexByte(data, 0)
+		if i < 0 || !bytes.Contains(data[:i], []byte("@")) {
+			return Event{}, errors.New("invalid kernel uevent message")
+		}
+		properties = data[i+1:]
+	}
+	values := map[string]string{}
+	for _, field := range bytes.Split(properties, []byte{0}) {
+		if kv := strings.SplitN(string(field), "=", 2); len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	return newEvent(values)
+}
+
+func newEvent(properties map[string]string) (Event, error) {
+	if properties["ACTION"] == "" {
+		return Event{}, errors.New("uevent without ACTION")
+	}
+	return Event{Action: properties["ACTION"], DevPath: properties["DEVPATH"],
+		Subsystem: properties["SUBSYSTEM"], Properties: properties}, nil
+}
+
+// ReplaySource replays the events recorded by "udevadm monitor --property"
+type ReplaySource struct {
+	events []Event
+	closed bool
+}
+
+// NewReplaySource reads the recorded events, every event is a block of
+// KEY=VALUE lines separated by an empty line, the other lines like
+// "UDEV  [1234.5678] add /devices/... (block)" are ignored.
+func NewReplaySource(r io.Reader) (*ReplaySource, error) {
+	source := &ReplaySource{}
+	properties := map[string]string{}
+	flush := func() error {
+		if len(properties) == 0 {
+			return nil
+		}
+		event, err := newEvent(properties)
+		if err != nil {
+			return err
+		}
+		source.events = append(source.events, event)
+		properties = map[string]string{}
+		return nil
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 && !strings.ContainsAny(kv[0], " [") {
+			properties[kv[0]] = kv[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// Receive returns the recorded events in order, then io.EOF
+func (s *ReplaySource) Receive() (Event, error) {
+	if s.closed {
+		return Event{}, errClosed
+	}
+	if len(s.events) == 0 {
+		return Event{}, io.EOF
+	}
+	event := s.events[0]
+	s.events = s.events[1:]
+	return event, nil
+}
+
+func (s *ReplaySource) Close() error {
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package uevent
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The test package replays the same recordings, but it imports this package
+func openRecording(t *testing.T, name string) *ReplaySource {
+	file, err := os.Open("../../test/mock_data/uevent_" + name + ".txt")
+	assert.Nil(t, err)
+	defer file.Close()
+	source, err := NewReplaySource(file)
+	assert.Nil(t, err)
+	return source
+}
+
+func TestParseKernelEvent(t *testing.T) {
+	data := "add@/devices/virtual/block/dm-3\x00ACTION=add\x00DEVPATH=/devices/virtual/block/dm-3\x00" +
+		"SUBSYSTEM=block\x00DEVNAME=dm-3\x00SEQNUM=4314\x00"
+	event, err := Parse([]byte(data))
+	assert.Nil(t, err)
+	assert.Equal(t, ActionAdd, event.Action)
+	assert.Equal(t, "/devices/virtual/block/dm-3", event.DevPath)
+	assert.True(t, IsBlock(event))
+	assert.Equal(t, "/dev/dm-3", event.DevName())
+	assert.Empty(t, event.DevLinks())
+}
+
+func TestParseUdevEvent(t *testing.T) {
+	properties := "ACTION=change\x00DEVPATH=/devices/virtual/block/dm-3\x00SUBSYSTEM=block\x00" +
+		"DEVNAME=/dev/dm-3\x00DEVLINKS=/dev/mapper/3600 /dev/disk/by-id/dm-uuid-mpath-3600\x00"
+	header := make([]byte, 40)
+	copy(header, udevPrefix)
+	binary.BigEndian.PutUint32(header[8:12], udevMagic)
+	binary.LittleEndian.PutUint32(header[12:16], 40)
+	binary.LittleEndian.PutUint32(header[16:20], 40)
+	binary.LittleEndian.PutUint32(header[20:24], uint32(len(properties)))
+	event, err := Parse(append(header, properties...))
+	assert.Nil(t, err)
+	assert.Equal(t, ActionChange, event.Action)
+	assert.Equal(t, "/dev/dm-3", event.DevName())
+	assert.Equal(t, []string{"/dev/mapper/3600", "/dev/disk/by-id/dm-uuid-mpath-3600"}, event.DevLinks())
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse([]byte("libudev\x00\x00\x00"))
+	assert.Error(t, err)
+	_, err = Parse([]byte("ACTION=add\x00"))
+	assert.Error(t, err)
+	_, err = Parse([]byte("add@/devices/virtual/block/dm-3\x00SUBSYSTEM=block\x00"))
+	assert.Error(t, err)
+}
+
+func TestReplaySource(t *testing.T) {
+	source := openRecording(t, "multipath_add")
+	var events []Event
+	for {
+		event, err := source.Receive()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		events = append(events, event)
+	}
+	assert.Len(t, events, 3)
+	assert.Equal(t, "scsi", events[0].Subsystem)
+	assert.Equal(t, "/dev/sdc", events[1].DevName())
+	assert.Len(t, events[1].DevLinks(), 3)
+	assert.Equal(t, "mpath-36006016015301d00a8b3d55e1e3ee611", events[2].Properties["DM_UUID"])
+
+	source.Close()
+	_, err := source.Receive()
+	assert.Equal(t, errClosed, err)
+}
+
+func TestReplaySourceInvalid(t *testing.T) {
+	_, err := NewReplaySource(strings.NewReader("DEVNAME=/dev/sdc\nSUBSYSTEM=block\n"))
+	assert.Error(t, err)
+}
+
+func TestWatch(t *testing.T) {
+	SetSource(func() (Source, error) {
+		return openRecording(t, "multipath_add"), nil
+	})
+	defer SetSource(nil)
+	monitor := Watch(IsBlock)
+	defer monitor.Close()
+	var devices []string
+	for event := range monitor.Events() {
+		devices = append(devices, event.DevName())
+	}
+	assert.Equal(t, []string{"/dev/sdc", "/dev/dm-3"}, devices)
+}
+
+func TestWatchUnavailable(t *testing.T) {
+	SetSource(func() (Source, error) {
+		return nil, errors.New("netlink is not available")
+	})
+	defer SetSource(nil)
+	monitor := Watch(nil)
+	assert.Nil(t, monitor.Events())
+	assert.Nil(t, monitor.Close())
+}
+
+func TestOpenNetlink(t *testing.T) {
+	source, err := OpenNetlink()
+	if err != nil {
+		t.Skipf("Netlink is not available: %s", err)
+	}
+	monitor := &Monitor{source: source, events: make(chan Event, bufferSize)}
+	go monitor.run(nil)
+	assert.Nil(t, monitor.Close())
+	// The pending Receive stops in the receive timeout
+	for range monitor.Events() {
+	}
+}
@@ -16,8 +16,11 @@ limitations under the License.
 package util
 
 import (
+	"context"
 	"errors"
 	"github.com/peter-wangxu/goock/pkg/exec"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	"github.com/peter-wangxu/goock/pkg/uevent"
 	"github.com/sirupsen/logrus"
 	"time"
 )
@@ -40,44 +43,160 @@ func SetExecutor(e exec.Interface) {
 }
 
 func WaitForPath(path string, maxWait int) bool {
-	for x := 0; x < maxWait; x++ {
-		time.Sleep(time.Second * time.Duration(WaitInterval))
-		err := IsPathExists(path)
-		if err == nil {
-			return true
-		}
+	return WaitForPathContext(context.Background(), path, maxWait)
+}
+
+// WaitForPathContext waits for the path to appear, it gives up after maxWait
+// intervals or once ctx is done.
+func WaitForPathContext(ctx context.Context, path string, maxWait int) bool {
+	_, err := WaitForFirstPathContext(ctx, []string{path}, maxWait)
+	return err == nil
+}
+
+// WaitForFirstPath waits for any of the paths to appear, the paths are
+// checked in order, so the preferred one is returned if several exist.
+func WaitForFirstPath(paths []string, maxWait int) (string, error) {
+	return WaitForFirstPathContext(context.Background(), paths, maxWait)
+}
+
+// WaitForFirstPathContext is WaitForFirstPath which returns the error of ctx
+// once ctx is done.
+func WaitForFirstPathContext(ctx context.Context, paths []string, maxWait int) (string, error) {
+	path, err := waitForDevice(ctx, existingPath(paths), maxWait, nil)
+	if err != nil && ctx.Err() == nil {
+		log.Debugf("Paths %s do not appear in %v seconds", paths, maxWait*WaitInterval)
 	}
-	log.Debugf("Path %s does not appear in %v seconds", path, maxWait*WaitInterval)
-	return false
+	return path, err
 }
 
 // Return immediately once any path found of hook is nil
 // else run the hook and wait
 func WaitForAnyPath(paths []string, hook func()) (string, error) {
+	return WaitForAnyPathContext(context.Background(), paths, hook)
+}
 
-	err := errors.New("No path found")
+// WaitForAnyPathContext is WaitForAnyPath which returns the error of ctx
+// once ctx is done.
+func WaitForAnyPathContext(ctx context.Context, paths []string, hook func()) (string, error) {
+	return WaitForDeviceContext(ctx, existingPath(paths), hook)
+}
+
+// WaitForDeviceContext waits until find returns any device, it is for the
+// devices which are looked up rather than known by path. find runs right away
+// and on every uevent of the block devices, the hook runs once an interval.
+// Like WaitForAnyPathContext, it only waits for an interval if hook is nil.
+func WaitForDeviceContext(ctx context.Context, find func() []string, hook func()) (string, error) {
 	maxWait := MaxWait
 	if hook == nil {
 		// Only run once for the paths.
 		maxWait = 1
 	}
+	return waitForDevice(ctx, find, maxWait, hook)
+}
 
-	for x := 0; x < maxWait; x++ {
-		time.Sleep(time.Second * time.Duration(WaitInterval))
-		for _, path := range paths {
-			err = IsPathExists(path)
-			if err == nil {
-				return path, err
-			}
+// WaitForContext waits until check passes, it is for the conditions which
+// are not a device, such as, the LUNs of a target. Like WaitForDeviceContext,
+// check runs right away and on every uevent of the block devices, the hook
+// runs once an interval and it only waits for an interval if hook is nil.
+func WaitForContext(ctx context.Context, check func() bool, hook func()) error {
+	maxWait := MaxWait
+	if hook == nil {
+		maxWait = 1
+	}
+	return waitFor(ctx, check, maxWait, hook)
+}
+
+// waitForDevice checks the devices right away and on every uevent of the
+// block devices, the hook runs once an interval.
+func waitForDevice(ctx context.Context, find func() []string, maxWait int, hook func()) (string, error) {
+	var found string
+	err := waitFor(ctx, func() bool {
+		if devices := find(); len(devices) > 0 {
+			found = devices[0]
+			return true
 		}
+		return false
+	}, maxWait, hook)
+	if err != nil {
+		return "", err
+	}
+	return found, nil
+}
+
+// waitFor runs check right away and on every uevent of the block devices,
+// the hook runs once an interval.
+func waitFor(ctx context.Context, check func() bool, maxWait int, hook func()) error {
+	monitor := uevent.Watch(uevent.IsBlock)
+	defer monitor.Close()
+
+	if check() {
+		return nil
+	}
+	for x := 0; x < maxWait; x++ {
 		// Run the hook, such as, Rescan hosts
 		if nil != hook {
 			hook()
 		}
+		ok, ctxErr := waitForEvents(ctx, monitor, check)
+		if ctxErr != nil {
+			return ctxErr
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errors.New("No path found")
+}
+
+// Returns the finder of the first existing path
+func existingPath(paths []string) func() []string {
+	return func() []string {
+		if path, err := findAnyPath(paths); err == nil {
+			return []string{path}
+		}
+		return nil
+	}
+}
+
+// Returns the first existing path
+func findAnyPath(paths []string) (string, error) {
+	err := errors.New("No path found")
+	for _, path := range paths {
+		if err = IsPathExists(path); err == nil {
+			return path, nil
+		}
 	}
 	return "", err
 }
 
+// waitForEvents waits for an interval, check runs on every event of monitor
+// and at the end of the interval, it returns true as soon as check passes.
+// Without the events it is a plain sleep, it returns the error of ctx if ctx
+// is done in the meantime.
+func waitForEvents(ctx context.Context, monitor *uevent.Monitor, check func() bool) (bool, error) {
+	events := monitor.Events()
+	timer := time.NewTimer(time.Second * time.Duration(WaitInterval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				// Fall back to polling if the source fails
+				events = nil
+				continue
+			}
+			log.Debugf("Received uevent %s of %s.", event.Action, event.DevPath)
+			if check() {
+				return true, nil
+			}
+		case <-timer.C:
+			return check(), nil
+		}
+	}
+}
+
 // FilterPath Filters out paths which are not existed.
 func FilterPath(paths []string) ([]string, error) {
 	var newPaths []string
@@ -94,20 +213,33 @@ func FilterPath(paths []string) ([]string, error) {
 
 // WaitForPathRemoval Returns the paths which are still existing
 func WaitForPathRemoval(paths []string, maxWait int) []string {
-	var left []string
-	for x := 0; x < maxWait; x++ {
-		time.Sleep(time.Second * time.Duration(WaitInterval))
+	return WaitForPathRemovalContext(context.Background(), paths, maxWait)
+}
+
+// WaitForPathRemovalContext returns the paths which are still existing after
+// maxWait intervals or once ctx is done, it returns as soon as the uevents show
+// the paths are gone.
+func WaitForPathRemovalContext(ctx context.Context, paths []string, maxWait int) []string {
+	monitor := uevent.Watch(uevent.IsBlock)
+	defer monitor.Close()
+
+	left, _ := FilterPath(paths)
+	check := func() bool {
 		left, _ = FilterPath(paths)
-		if len(left) == 0 {
+		return len(left) == 0
+	}
+	for x := 0; x < maxWait && len(left) > 0; x++ {
+		ok, ctxErr := waitForEvents(ctx, monitor, check)
+		if ok || ctxErr != nil {
 			break
 		}
 	}
 	return left
 }
 
+// IsPathExists returns nil if the path exists under the sysfs root
 func IsPathExists(path string) error {
-	_, err := executor.Command("ls", path).CombinedOutput()
-	return err
+	return sysfs.Exists(path)
 }
 
 func Contains(key string, all []string) bool {
@@ -118,3 +250,12 @@ func Contains(key string, all []string) bool {
 	}
 	return false
 }
+
+func ContainsInt(key int, all []int) bool {
+	for _, item := range all {
+		if key == item {
+			return true
+		}
+	}
+	return false
+}
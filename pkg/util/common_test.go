@@ -1,12 +1,29 @@
 package util
 
 import (
+	"context"
 	"fmt"
+	"github.com/peter-wangxu/goock/pkg/sysfs"
+	"github.com/peter-wangxu/goock/pkg/uevent"
 	"github.com/peter-wangxu/goock/test"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
+// Run the tests with the fake sysfs and /dev tree
+func TestMain(m *testing.M) {
+	root := test.NewFakeRoot()
+	sysfs.SetRoot(root.Dir)
+	test.DisableUevents()
+	code := m.Run()
+	root.Remove()
+	os.Exit(code)
+}
+
 func hook() {
 	fmt.Println("Called!")
 }
@@ -32,3 +49,118 @@ func TestWaitForAnyPath(t *testing.T) {
 	assert.Error(t, err)
 	assert.Empty(t, r)
 }
+
+func TestWaitForAnyPathContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r, err := WaitForAnyPathContext(ctx, []string{"/real/not_created_yet"}, hook)
+	assert.Empty(t, r)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second*time.Duration(WaitInterval))
+}
+
+func TestWaitForPathContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, WaitForPathContext(ctx, "/real/not_created_yet", MaxWait))
+}
+
+func TestWaitForPathRemovalContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	left := WaitForPathRemovalContext(ctx, []string{"/real/path", "/fake/path"}, MaxWait)
+	assert.Equal(t, []string{"/real/path"}, left)
+}
+
+// Replays the recorded uevents, the device of each event is created or
+// removed right before the event is delivered, like what udev does.
+type deviceSource struct {
+	uevent.Source
+	device string
+}
+
+func (s *deviceSource) Receive() (uevent.Event, error) {
+	// The waiter should not find the device before the event
+	time.Sleep(200 * time.Millisecond)
+	event, err := s.Source.Receive()
+	if err != nil {
+		return event, err
+	}
+	path := sysfs.HostPath(s.device)
+	if event.Action == uevent.ActionRemove {
+		os.Remove(path)
+	} else if Contains(s.device, event.DevLinks()) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, nil, 0644)
+	}
+	return event, nil
+}
+
+func setUeventSource(t *testing.T, name string, device string) {
+	uevent.SetSource(func() (uevent.Source, error) {
+		source, err := test.NewUeventSource(name)
+		assert.Nil(t, err)
+		return &deviceSource{Source: source, device: device}, nil
+	})
+}
+
+func TestWaitForFirstPathUevent(t *testing.T) {
+	device := "/dev/disk/by-id/dm-uuid-mpath-36006016015301d00a8b3d55e1e3ee611"
+	setUeventSource(t, "multipath_add", device)
+	defer test.DisableUevents()
+	defer os.Remove(sysfs.HostPath(device))
+	start := time.Now()
+	r, err := WaitForFirstPath([]string{device, "/dev/mapper/36006016015301d00a8b3d55e1e3ee611"}, MaxWait)
+	assert.Nil(t, err)
+	assert.Equal(t, device, r)
+	assert.True(t, time.Since(start) < time.Second*time.Duration(WaitInterval))
+}
+
+func TestWaitForPathRemovalUevent(t *testing.T) {
+	device := "/dev/disk/by-id/dm-uuid-mpath-36006016015301d00a8b3d55e1e3ee611"
+	os.MkdirAll(filepath.Dir(sysfs.HostPath(device)), 0755)
+	ioutil.WriteFile(sysfs.HostPath(device), nil, 0644)
+	setUeventSource(t, "multipath_remove", device)
+	defer test.DisableUevents()
+	start := time.Now()
+	left := WaitForPathRemoval([]string{device}, MaxWait)
+	assert.Empty(t, left)
+	assert.True(t, time.Since(start) < time.Second*time.Duration(WaitInterval))
+}
+
+func TestWaitForFirstPathPolling(t *testing.T) {
+	uevent.SetSource(func() (uevent.Source, error) {
+		return nil, fmt.Errorf("netlink is not available")
+	})
+	defer test.DisableUevents()
+	r, err := WaitForFirstPath([]string{"/fake/path", "/real/path"}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "/real/path", r)
+	r, err = WaitForFirstPath([]string{"/fake/path"}, 1)
+	assert.Error(t, err)
+	assert.Empty(t, r)
+}
+
+func TestWaitForContext(t *testing.T) {
+	calls := 0
+	err := WaitForContext(context.Background(), func() bool {
+		calls++
+		return calls > 1
+	}, func() {})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestWaitForContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := WaitForContext(ctx, func() bool { return false }, func() {})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestContainsInt(t *testing.T) {
+	assert.True(t, ContainsInt(11, []int{0, 11}))
+	assert.False(t, ContainsInt(1, []int{0, 11}))
+	assert.False(t, ContainsInt(1, nil))
+}
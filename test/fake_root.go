@@ -0,0 +1,358 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// FakeRoot is a temporary host root directory with a fake sysfs and /dev tree,
+// it is used with sysfs.SetRoot.
+type FakeRoot struct {
+	Dir string
+}
+
+type fakeFCHost struct {
+	pci        string
+	host       string
+	fabricName string
+	nodeName   string
+	portName   string
+	speed      string
+}
+
+type fakeRemotePort struct {
+	rport    string
+	target   string
+	nodeName string
+	portId   string
+	portName string
+}
+
+var fakeFCHosts = []fakeFCHost{
+	{"0000:05:00.0", "host7", "0x100050eb1a033f59", "0x20000090fa534cd0", "0x10000090fa534cd0", "8 Gbit"},
+	{"0000:05:00.1", "host9", "0x10000027f8c7928a", "0x20000090fa534cd1", "0x10000090fa534cd1", "16 Gbit"},
+}
+
+// Remote ports of host9
+var fakeRemotePorts = []fakeRemotePort{
+	{"rport-9:0-2", "target9:0:0", "0x5006016089200925", "0x020500", "0x5006016d09200925"},
+	{"rport-9:0-3", "target9:0:1", "0x50060160b6e00e5a", "0x020400", "0x5006016036e00e5a"},
+	{"rport-9:0-4", "target9:0:2", "0x5006016089200925", "0x020200", "0x5006016509200925"},
+	{"rport-9:0-5", "target9:0:3", "0x50060160b6e00e5a", "0x020000", "0x5006016136e00e5a"},
+}
+
+// SCSI address(H:C:T:L) of the block devices
+var fakeBlockDevices = map[string]string{
+	"sdap": "9:0:2:10",
+	"sdcd": "13:0:0:10",
+	"sdg":  "9:2:1:9",
+	"sdh":  "9:0:0:11",
+	"sdi":  "7:0:0:11",
+	"sdm":  "9:0:0:10",
+	"sdv":  "9:0:3:11",
+	"sdw":  "9:0:1:12",
+	"sdy":  "9:0:3:11",
+}
+
+// The SCSI devices whose remote port or session is not registered under
+// /sys/class, only their sysfs paths tell the transport
+var fakeDevicePaths = map[string]string{
+	"sdaa": "/sys/devices/platform/host10/session3/target10:0:0/10:0:0:3",
+	"sdb":  "/sys/devices/platform/host0/rport-0:1-0/target0:1:0/0:1:0:0",
+	"sdx":  "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.1/host9/rport-9:0-6/target9:0:3/9:0:3:11",
+}
+
+type fakeISCSISession struct {
+	session string
+	host    string
+	iqn     string
+	address string
+	port    string
+	iface   string
+	// SCSI address(H:C:T:L) and block device of the LUNs, the block device
+	// is not created yet if empty
+	devices map[string]string
+}
+
+// The sessions only exist in sysfs, their links under /dev/disk are absent.
+// session2 has no LUN attached, the iface of session1 and session2 is unknown.
+// session8 and session9 log in to the same portal via eth1 and eth2.
+var fakeISCSISessions = []fakeISCSISession{
+	{"session1", "host3", "iqn.1992-04.com.emc:cx.fcnch097ae5ef3.h1", "10.64.76.253", "3260", "",
+		map[string]string{"3:0:0:0": "", "3:0:0:11": ""}},
+	{"session2", "host4", "iqn.1992-04.com.emc:cx.fcnch097ae6ef3.h2", "11.64.76.253", "3260", "", nil},
+	{"session5", "host12", "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59", "10.64.77.10", "3260", "default",
+		map[string]string{"12:0:0:3": "sdq", "12:0:0:4": "sdr"}},
+	{"session6", "host13", "iqn.2003-01.org.linux-iscsi.target1:sn.0f1d2c3b4a59", "10.64.78.10", "3260", "default",
+		map[string]string{"13:0:0:3": "sds"}},
+	{"session7", "host14", "iqn.2003-01.org.linux-iscsi.target6:sn.a1", "fd00:10::20", "3260", "eth1",
+		map[string]string{"14:0:0:5": "sdt"}},
+	{"session8", "host15", "iqn.2003-01.org.linux-iscsi.target7:sn.b2", "10.64.79.10", "3260", "eth1",
+		map[string]string{"15:0:0:2": "sdae"}},
+	{"session9", "host16", "iqn.2003-01.org.linux-iscsi.target7:sn.b2", "10.64.79.10", "3260", "eth2",
+		map[string]string{"16:0:0:2": "sdaf"}},
+}
+
+// Attributes of the SCSI devices of the iSCSI sessions, path 13:0:0:3 of
+// 36001405a1b2c3d4e5f60718293a4b5c6 is offline
+var fakeSCSIAttrs = map[string]map[string]string{
+	"12:0:0:3": {"vendor": "LIO-ORG", "model": "block1", "rev": "4.0", "type": "0", "state": "running",
+		"vpd_pg80": "\x00\x80\x00\x24a1b2c3d4-e5f6-0718-293a-4b5c6a1b2c3d"},
+	"12:0:0:4": {"vendor": "LIO-ORG", "model": "block2", "state": "running"},
+	"13:0:0:3": {"vendor": "LIO-ORG", "model": "block1", "state": "offline"},
+	"14:0:0:5": {"vendor": "LIO-ORG", "model": "block6", "state": "running"},
+}
+
+// Size in 512-byte sectors and read only attribute of the block devices
+var fakeBlockAttrs = map[string]map[string]string{
+	"sdq": {"size": "2097152", "ro": "0"},
+	"sdt": {"size": "4194304", "ro": "1"},
+}
+
+// MAC addresses of the network interfaces under /sys/class/net
+var fakeNetInterfaces = map[string]string{
+	"eth1": "00:0c:29:3e:1a:01",
+	"eth2": "00:0c:29:3e:1a:02",
+}
+
+// Entries of the NVMe subsystems under /sys/class/nvme-subsystem
+var fakeNVMeSubsystems = map[string][]string{
+	"nvme-subsys0": {"nvme0", "nvme0n1"},
+	"nvme-subsys1": {"nvme1", "nvme1n1", "nvme1n2", "nvme2"},
+}
+
+// Configuration files of open-iscsi and nvme-cli
+var fakeConfigFiles = map[string]string{
+	"/etc/iscsi/initiatorname.iscsi": `## DO NOT EDIT OR REMOVE THIS FILE!
+## If you remove this file, the iSCSI daemon will not start.
+InitiatorName=iqn.1993-08.org.debian:01:b974ee37fea`,
+	"/etc/nvme/hostnqn":                          "nqn.2014-08.org.nvmexpress:uuid:2d1a3c3e-5c4b-4f6e-9a6d-3b2f1e0d9c8b",
+	"/sys/module/nvme_core/parameters/multipath": "Y",
+}
+
+// Links under /dev/disk
+var fakeDiskLinks = map[string]string{
+	"by-id/dm-uuid-mpath-350060160b6e00e5a50060160b6e00e5a":                               "dm-8",
+	"by-id/dm-uuid-mpath-350060160b6e00e5a50060160b6e11317":                               "dm-9",
+	"by-id/nvme-eui.6e3d1a8a9c3b4d5e8f0011223344aabb":                                     "nvme0n1",
+	"by-id/nvme-uuid.0b2f3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d":                                "nvme1n1",
+	"by-path/ip-10.168.3.44:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904447.a17-lun-11":  "sdk",
+	"by-path/ip-10.168.7.14:3260-iscsi-iqn.1992-04.com.emc:cx.apm00141313414.a17-lun-19":  "sdh",
+	"by-path/ip-192.168.3.49:3260-iscsi-iqn.1992-04.com.emc:cx.apm00152904558.a12-lun-11": "sdj",
+	"by-path/ip-10.64.79.10:3260-iscsi-iqn.2003-01.org.linux-iscsi.target7:sn.b2-lun-2":   "sdae",
+	"by-path/pci-0000:05:00.0-fc-0x5006016d09200925-lun-11":                               "sdi",
+	"by-path/pci-0000:05:00.1-fc-0x5006016136e00e5a-lun-11":                               "sdv",
+}
+
+// Device numbers of the block devices under /sys/class/block
+var fakeDeviceNumbers = map[string]string{
+	"dm-20": "253:20",
+	"dm-5":  "253:5",
+	"sdaa":  "65:160",
+	"sdab":  "65:176",
+	"sdac":  "65:192",
+	"sdac1": "65:193",
+	"sdb":   "8:16",
+	"sdy":   "65:128",
+}
+
+// The paths of multipath 350060160b6e00e5a50060160b6e11317 are held by dm-5,
+// sdaa is the PV of the LVM volume dm-20
+var fakeHolders = map[string]string{
+	"sdaa": "dm-20",
+	"sdb":  "dm-5",
+	"sdy":  "dm-5",
+}
+
+// dm-20 is mounted, so is the partition sdac1
+const fakeMountInfo = `22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/rhel-root rw,attr2,inode64
+25 22 0:22 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+61 22 253:20 / /var/lib/mysql rw,relatime shared:30 - xfs /dev/mapper/vg_db-lv_mysql rw,attr2,inode64
+62 22 65:193 / /data rw,relatime shared:31 - ext4 /dev/sdac1 rw`
+
+const fakeSwaps = `Filename				Type		Size	Used	Priority
+/dev/sdab                               partition	2097148	0	-2`
+
+type fakeProcess struct {
+	pid   string
+	comm  string
+	files []string
+}
+
+// multipathd opens the paths to check them
+var fakeProcesses = []fakeProcess{
+	{"812", "multipathd", []string{"/dev/sdb", "/dev/sdy"}},
+	{"2301", "mysqld", []string{"/dev/dm-20", "/var/lib/mysql/ibdata1"}},
+}
+
+// NewFakeRoot creates the fake host root which matches the mock data
+func NewFakeRoot() *FakeRoot {
+	dir, err := ioutil.TempDir("", "goock-root")
+	if err != nil {
+		log.Fatal(err)
+	}
+	root := &FakeRoot{Dir: dir}
+	for _, h := range fakeFCHosts {
+		hostPath := fmt.Sprintf("/sys/devices/pci0000:00/0000:00:03.0/%s/%s", h.pci, h.host)
+		classPath := fmt.Sprintf("%s/fc_host/%s", hostPath, h.host)
+		root.WriteFile(classPath+"/fabric_name", h.fabricName)
+		root.WriteFile(classPath+"/node_name", h.nodeName)
+		root.WriteFile(classPath+"/port_name", h.portName)
+		root.WriteFile(classPath+"/port_state", "Online")
+		root.WriteFile(classPath+"/speed", h.speed)
+		root.WriteFile(classPath+"/supported_speeds", "4 Gbit, 8 Gbit, 16 Gbit")
+		root.Symlink("../../../"+h.host, classPath+"/device")
+		root.Symlink("../.."+classPath[len("/sys"):], "/sys/class/fc_host/"+h.host)
+	}
+	for _, r := range fakeRemotePorts {
+		rportPath := "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.1/host9/" + r.rport
+		classPath := fmt.Sprintf("%s/fc_remote_ports/%s", rportPath, r.rport)
+		root.WriteFile(classPath+"/node_name", r.nodeName)
+		root.WriteFile(classPath+"/port_id", r.portId)
+		root.WriteFile(classPath+"/port_name", r.portName)
+		root.Symlink("../../../"+r.rport, classPath+"/device")
+		root.Symlink("../.."+classPath[len("/sys"):], "/sys/class/fc_remote_ports/"+r.rport)
+		root.Mkdir(rportPath + "/" + r.target)
+	}
+	for name, hctl := range fakeBlockDevices {
+		var host, channel, target, lun int
+		fmt.Sscanf(hctl, "%d:%d:%d:%d", &host, &channel, &target, &lun)
+		targetPath := fmt.Sprintf("/sys/devices/platform/host%d/target%d:%d:%d", host, host, channel, target)
+		for _, r := range fakeRemotePorts {
+			// The FC devices are under the remote ports
+			if r.target == fmt.Sprintf("target%d:%d:%d", host, channel, target) {
+				targetPath = "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.1/host9/" + r.rport + "/" + r.target
+			}
+		}
+		root.addBlockDevice(targetPath+"/"+hctl, name)
+	}
+	for name, devicePath := range fakeDevicePaths {
+		root.addBlockDevice(devicePath, name)
+	}
+	for _, s := range fakeISCSISessions {
+		sessionPath := fmt.Sprintf("/sys/devices/platform/%s/%s", s.host, s.session)
+		classPath := fmt.Sprintf("%s/iscsi_session/%s", sessionPath, s.session)
+		root.WriteFile(classPath+"/targetname", s.iqn)
+		root.WriteFile(classPath+"/ifacename", s.iface)
+		root.Symlink("../../../"+s.session, classPath+"/device")
+		root.Symlink("../.."+classPath[len("/sys"):], "/sys/class/iscsi_session/"+s.session)
+		connection := fmt.Sprintf("connection%s:0", s.session[len("session"):])
+		connectionPath := fmt.Sprintf("%s/%s/iscsi_connection/%s", sessionPath, connection, connection)
+		root.WriteFile(connectionPath+"/persistent_address", s.address)
+		root.WriteFile(connectionPath+"/persistent_port", s.port)
+		for hctl, name := range s.devices {
+			var host, channel, target, lun int
+			fmt.Sscanf(hctl, "%d:%d:%d:%d", &host, &channel, &target, &lun)
+			devicePath := fmt.Sprintf("%s/target%d:%d:%d/%s", sessionPath, host, channel, target, hctl)
+			if name == "" {
+				root.Mkdir(devicePath)
+				continue
+			}
+			root.addBlockDevice(devicePath, name)
+			root.WriteFile("/dev/"+name, "")
+		}
+	}
+	for hctl, attrs := range fakeSCSIAttrs {
+		for name, value := range attrs {
+			root.WriteFile("/sys/bus/scsi/devices/"+hctl+"/"+name, value)
+		}
+	}
+	for device, attrs := range fakeBlockAttrs {
+		for name, value := range attrs {
+			root.WriteFile("/sys/block/"+device+"/"+name, value)
+		}
+	}
+	for name, address := range fakeNetInterfaces {
+		root.WriteFile("/sys/class/net/"+name+"/address", address)
+	}
+	for subsystem, entries := range fakeNVMeSubsystems {
+		for _, entry := range entries {
+			root.Mkdir("/sys/class/nvme-subsystem/" + subsystem + "/" + entry)
+		}
+	}
+	for path, content := range fakeConfigFiles {
+		root.WriteFile(path, content)
+	}
+	// The FC device without any link under /dev/disk
+	root.WriteFile("/dev/sdw", "")
+	for link, device := range fakeDiskLinks {
+		root.WriteFile("/dev/"+device, "")
+		root.Symlink("../../"+device, "/dev/disk/"+link)
+	}
+	root.WriteFile("/real/path", "")
+	for name, number := range fakeDeviceNumbers {
+		root.WriteFile("/sys/class/block/"+name+"/dev", number)
+		root.Mkdir("/sys/class/block/" + name + "/holders")
+	}
+	root.Mkdir("/sys/class/block/sdac/sdac1")
+	for name, holder := range fakeHolders {
+		root.Symlink("../../"+holder, "/sys/class/block/"+name+"/holders/"+holder)
+	}
+	root.WriteFile("/proc/self/mountinfo", fakeMountInfo)
+	root.WriteFile("/proc/swaps", fakeSwaps)
+	for _, p := range fakeProcesses {
+		root.WriteFile("/proc/"+p.pid+"/comm", p.comm)
+		for i, file := range p.files {
+			root.Symlink(file, fmt.Sprintf("/proc/%s/fd/%d", p.pid, i+3))
+		}
+	}
+	return root
+}
+
+// Creates the block device under the SCSI device at devicePath, layout:
+// /sys/devices/.../target3:0:0/3:0:0:1/block/sdb
+// /sys/block/sdb -> ../devices/.../target3:0:0/3:0:0:1/block/sdb
+// /sys/bus/scsi/devices/3:0:0:1 -> ../../../devices/.../target3:0:0/3:0:0:1
+func (root *FakeRoot) addBlockDevice(devicePath string, name string) {
+	hctl := filepath.Base(devicePath)
+	root.Symlink("../../../"+hctl, devicePath+"/block/"+name+"/device")
+	root.Symlink("../devices"+devicePath[len("/sys/devices"):]+"/block/"+name, "/sys/block/"+name)
+	link := "/sys/bus/scsi/devices/" + hctl
+	if _, err := os.Lstat(filepath.Join(root.Dir, link)); os.IsNotExist(err) {
+		root.Symlink("../../../devices"+devicePath[len("/sys/devices"):], link)
+	}
+}
+
+// WriteFile writes content to the path under the fake root
+func (root *FakeRoot) WriteFile(path string, content string) {
+	root.Mkdir(filepath.Dir(path))
+	if err := ioutil.WriteFile(filepath.Join(root.Dir, path), []byte(content+"\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Symlink creates link under the fake root which points to target
+func (root *FakeRoot) Symlink(target string, link string) {
+	root.Mkdir(filepath.Dir(link))
+	if err := os.Symlink(target, filepath.Join(root.Dir, link)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (root *FakeRoot) Mkdir(path string) {
+	if err := os.MkdirAll(filepath.Join(root.Dir, path), 0755); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (root *FakeRoot) Remove() {
+	os.RemoveAll(root.Dir)
+}
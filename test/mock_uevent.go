@@ -0,0 +1,45 @@
+/*
+Copyright 2017 The Goock Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/peter-wangxu/goock/pkg/uevent"
+)
+
+// NewUeventSource replays the uevents in mock_data/uevent_<name>.txt, which
+// are recorded by "udevadm monitor --udev --property".
+func NewUeventSource(name string) (uevent.Source, error) {
+	file, err := os.Open(path.Join(getMockDir(), fmt.Sprintf("uevent_%s.txt", name)))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return uevent.NewReplaySource(file)
+}
+
+// DisableUevents makes the waits poll the devices rather than listen to the
+// uevents of the host, so the tests never open a netlink socket. It is set
+// in TestMain of the packages which wait for the devices.
+func DisableUevents() {
+	uevent.SetSource(func() (uevent.Source, error) {
+		return nil, errors.New("uevents are disabled in the tests")
+	})
+}
@@ -18,9 +18,10 @@ package test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/peter-wangxu/goock/exec"
+	"github.com/peter-wangxu/goock/pkg/exec"
 	"github.com/stretchr/testify/mock"
 	"io"
 	"io/ioutil"
@@ -28,6 +29,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
@@ -39,6 +41,10 @@ func (m *MockExecutor) Command(cmd string, args ...string) exec.Cmd {
 	return &MockCmd{Path: cmd, Args: args}
 }
 
+func (m *MockExecutor) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	return &MockCmd{Path: cmd, Args: args, ctx: ctx}
+}
+
 func (m *MockExecutor) LookPath(file string) (string, error) {
 	return "", nil
 }
@@ -54,6 +60,7 @@ type MockCmd struct {
 	Env  []string
 	// Add more properties if mock needed
 	Stdin []string
+	ctx   context.Context
 }
 
 func (m *MockCmd) SetDir(dir string) {
@@ -83,6 +90,10 @@ func (m *MockCmd) Output() ([]byte, error) {
 // This function returns the mocked output according
 // to the joined commands and it's parameters.
 func (m *MockCmd) mockOutput() ([]byte, error) {
+	if m.ctx != nil && m.ctx.Err() != nil {
+		// The command is killed once the context is done
+		return []byte(""), m.ctx.Err()
+	}
 	var cmds []string
 	cmds = append(cmds, m.Path)
 	cmds = append(cmds, m.Args...)
@@ -131,7 +142,8 @@ func (m *MockCmd) mockOutput() ([]byte, error) {
 		if cmdStatus == "0" {
 			return []byte(buffer.String()), nil
 		} else {
-			cmdError := errors.New("Status code is " + cmdStatus)
+			code, _ := strconv.Atoi(cmdStatus)
+			cmdError := exec.CodeExitError{Err: errors.New("Status code is " + cmdStatus), Code: code}
 			return []byte(buffer.String()), cmdError
 		}
 